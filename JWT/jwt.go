@@ -4,23 +4,77 @@ import (
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 )
 
-func GenerateJWT(userID int) (string, error) {
+// MinSecretKeyLength is the shortest key SetSecretKey accepts, as long as the HMAC-SHA256 output
+const MinSecretKeyLength = 32
+
+// ErrNoSecretKey is returned until SetSecretKey has been called, there is no default key to fall back on
+var ErrNoSecretKey = errors.New("no JWT secret key set")
+
+var secretKey []byte
+
+// SetSecretKey sets the key every token is signed and checked with, it has to be called once at startup
+func SetSecretKey(key string) error {
+	if len(key) < MinSecretKeyLength {
+		return fmt.Errorf("JWT secret key must be at least %d bytes long", MinSecretKeyLength)
+	}
+	secretKey = []byte(key)
+	return nil
+}
+
+// Claims is the payload we sign into every auth token
+type Claims struct {
+	// Subject is the user's public id, the integer key never leaves the server
+	Subject string `json:"sub"`
+	Exp     int64  `json:"exp"`
+	// Org is the slug of the organization picked at sign in and OrgRole the user's role in it
+	Org         string   `json:"org,omitempty"`
+	OrgRole     string   `json:"org_role,omitempty"`
+	Roles       []string `json:"roles,omitempty"`
+	Permissions []string `json:"permissions,omitempty"`
+	// AppMetadata holds the app_metadata keys the server is configured to copy into tokens
+	AppMetadata map[string]json.RawMessage `json:"app_metadata,omitempty"`
+}
+
+// HasPermission reports whether the claims carry permission. Tokens are issued with the permissions the user had at
+// sign in, so callers should refresh them from the user store before trusting them.
+func (c *Claims) HasPermission(permission string) bool {
+	for _, p := range c.Permissions {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+func GenerateJWT(subject string) (string, error) {
+	return GenerateJWTWithClaims(Claims{Subject: subject})
+}
+
+// GenerateJWTWithClaims signs claims as given apart from Exp, which is always 24 hours from now
+func GenerateJWTWithClaims(claims Claims) (string, error) {
+	if len(secretKey) == 0 {
+		return "", ErrNoSecretKey
+	}
 	// Prepare the JWT payload
-	payload := fmt.Sprintf(`{"user_id":%d,"exp":%d}`, userID, time.Now().Add(time.Hour*24).Unix())
+	claims.Exp = time.Now().Add(time.Hour * 24).Unix()
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
 
 	// Create a signature using HMAC-SHA256
-	secretKey := []byte("your-secret-key")
-	hmac256 := hmac.New(sha256.New, secretKey)
-	hmac256.Write([]byte(payload))
-	signature := hmac256.Sum(nil)
+	signature := sign(payload)
 
 	// Encode the payload and signature as base64
-	encodedPayload := base64.StdEncoding.EncodeToString([]byte(payload))
+	encodedPayload := base64.StdEncoding.EncodeToString(payload)
 	encodedSignature := base64.StdEncoding.EncodeToString(signature)
 
 	// Combine the encoded payload and signature with a dot separator
@@ -28,6 +82,48 @@ func GenerateJWT(userID int) (string, error) {
 	return token, nil
 }
 
+// ParseJWT checks the signature and expiry of a token created by GenerateJWT and returns its claims
+func ParseJWT(token string) (*Claims, error) {
+	if len(secretKey) == 0 {
+		return nil, ErrNoSecretKey
+	}
+	encodedPayload, encodedSignature, found := strings.Cut(token, ".")
+	if !found {
+		return nil, errors.New("malformed token")
+	}
+
+	payload, err := base64.StdEncoding.DecodeString(encodedPayload)
+	if err != nil {
+		return nil, fmt.Errorf("decode payload: %w", err)
+	}
+	signature, err := base64.StdEncoding.DecodeString(encodedSignature)
+	if err != nil {
+		return nil, fmt.Errorf("decode signature: %w", err)
+	}
+
+	// hmac.Equal compares in constant time so the signature can't be guessed byte by byte
+	if !hmac.Equal(signature, sign(payload)) {
+		return nil, errors.New("invalid signature")
+	}
+
+	var claims Claims
+	err = json.Unmarshal(payload, &claims)
+	if err != nil {
+		return nil, fmt.Errorf("decode claims: %w", err)
+	}
+	if time.Now().Unix() > claims.Exp {
+		return nil, errors.New("token has expired")
+	}
+
+	return &claims, nil
+}
+
+func sign(payload []byte) []byte {
+	hmac256 := hmac.New(sha256.New, secretKey)
+	hmac256.Write(payload)
+	return hmac256.Sum(nil)
+}
+
 func SetAuthCookie(w http.ResponseWriter, token string) {
 	cookie := &http.Cookie{
 		Name:     "auth_token",
@@ -1,16 +1,42 @@
 package JWT
 
 import (
+	"encoding/base64"
+	"errors"
 	"net/http/httptest"
+	"os"
+	"strings"
 	"testing"
 	"time"
 )
 
+func TestMain(m *testing.M) {
+	if err := SetSecretKey(strings.Repeat("k", MinSecretKeyLength)); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+func TestSetSecretKey(t *testing.T) {
+	defer func(key []byte) { secretKey = key }(secretKey)
+
+	if err := SetSecretKey("your-secret-key"); err == nil {
+		t.Errorf("Expected a short key to be refused")
+	}
+	secretKey = nil
+	if _, err := GenerateJWT("someone"); !errors.Is(err, ErrNoSecretKey) {
+		t.Errorf("Expected ErrNoSecretKey signing without a key, got %v", err)
+	}
+	if _, err := ParseJWT("e30.e30"); !errors.Is(err, ErrNoSecretKey) {
+		t.Errorf("Expected ErrNoSecretKey parsing without a key, got %v", err)
+	}
+}
+
 func TestGenerateAndValidateJWT(t *testing.T) {
-	userID := 123
+	subject := "0190a6e2-5c3b-7c1e-9f3a-2b4c6d8e0f12"
 
 	// Generate JWT
-	token, err := GenerateJWT(userID)
+	token, err := GenerateJWT(subject)
 	if err != nil {
 		t.Fatalf("generateJWT failed: %v", err)
 	}
@@ -18,6 +44,47 @@ func TestGenerateAndValidateJWT(t *testing.T) {
 	if token == "" {
 		t.Error("generateJWT produced an empty token")
 	}
+
+	claims, err := ParseJWT(token)
+	if err != nil {
+		t.Fatalf("parseJWT failed: %v", err)
+	}
+	if claims.Subject != subject {
+		t.Errorf("Expected subject %s, got %s", subject, claims.Subject)
+	}
+}
+
+func TestParseJWT_SadPaths(t *testing.T) {
+	validToken, err := GenerateJWT("0190a6e2-5c3b-7c1e-9f3a-2b4c6d8e0f12")
+	if err != nil {
+		t.Fatalf("generateJWT failed: %v", err)
+	}
+	payload, _, _ := strings.Cut(validToken, ".")
+	expiredPayload := base64.StdEncoding.EncodeToString([]byte(`{"sub":"someone","exp":1}`))
+	expiredSignature := base64.StdEncoding.EncodeToString(sign([]byte(`{"sub":"someone","exp":1}`)))
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{name: "Empty token", token: ""},
+		{name: "No signature", token: payload},
+		{name: "Tampered signature", token: payload + "." + base64.StdEncoding.EncodeToString([]byte("nope"))},
+		{name: "Bad base64", token: "!!!.???"},
+		{name: "Expired token", token: expiredPayload + "." + expiredSignature},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			claims, err := ParseJWT(test.token)
+			if err == nil {
+				t.Errorf("Expected error, got nil")
+			}
+			if claims != nil {
+				t.Errorf("Expected nil claims, got %v", claims)
+			}
+		})
+	}
 }
 func TestSetAuthCookie(t *testing.T) {
 	w := httptest.NewRecorder()
@@ -60,3 +127,26 @@ func TestDeleteAuthCookie(t *testing.T) {
 		t.Error("deleteAuthCookie did not set the cookie expiration time to the past")
 	}
 }
+
+func TestClaims_HasPermission(t *testing.T) {
+	token, err := GenerateJWTWithClaims(Claims{Subject: "someone", Roles: []string{"admin"}, Permissions: []string{"users:admin"}})
+	if err != nil {
+		t.Fatalf("generateJWT failed: %v", err)
+	}
+	claims, err := ParseJWT(token)
+	if err != nil {
+		t.Fatalf("parseJWT failed: %v", err)
+	}
+	if claims.Exp <= time.Now().Unix() {
+		t.Errorf("Expected expiry to be set, got %d", claims.Exp)
+	}
+	if len(claims.Roles) != 1 || claims.Roles[0] != "admin" {
+		t.Errorf("Expected admin role, got %v", claims.Roles)
+	}
+	if !claims.HasPermission("users:admin") {
+		t.Errorf("Expected users:admin permission, got %v", claims.Permissions)
+	}
+	if claims.HasPermission("users:read") {
+		t.Errorf("Expected no users:read permission, got %v", claims.Permissions)
+	}
+}
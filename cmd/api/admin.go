@@ -0,0 +1,183 @@
+package main
+
+import (
+	"github.com/go-chi/chi/v5"
+	"net/http"
+	"the_lonely_road/errors"
+	"the_lonely_road/models"
+	"the_lonely_road/validator"
+)
+
+// listUsers pages through every user for support staff, see models.UserFilters for the supported query params
+func (app *App) listUsers(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	qs := r.URL.Query()
+
+	filters := models.UserFilters{
+		Filters: models.Filters{
+			Page:         app.readInt(qs, "page", 1, v),
+			PageSize:     app.readInt(qs, "page_size", 20, v),
+			Sort:         app.readString(qs, "sort", "id"),
+			SortSafelist: models.UserSortSafelist,
+		},
+		Email:         app.readString(qs, "email", ""),
+		CreatedAfter:  app.readTime(qs, "created_after", v),
+		CreatedBefore: app.readTime(qs, "created_before", v),
+		Verified:      app.readBool(qs, "verified", v),
+		Locked:        app.readBool(qs, "locked", v),
+		Role:          app.readString(qs, "role", ""),
+	}
+
+	if models.ValidateUserFilters(v, filters); !v.Valid() {
+		v.AddError("message", errors.InvalidFilters)
+		http.Error(w, v.Errors["message"], http.StatusBadRequest)
+		return
+	}
+
+	users, metadata, err := app.userModel.ListUsers(filters)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, map[string]any{"metadata": metadata, "users": users})
+	if err != nil {
+		http.Error(w, errors.JsonWriteError, http.StatusInternalServerError)
+		return
+	}
+}
+
+// searchUsers finds users from part of their email or name, best match first
+func (app *App) searchUsers(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	qs := r.URL.Query()
+
+	filters := models.SearchFilters{
+		Filters: models.Filters{
+			Page:         app.readInt(qs, "page", 1, v),
+			PageSize:     app.readInt(qs, "page_size", 20, v),
+			Sort:         "rank",
+			SortSafelist: models.SearchSortSafelist,
+		},
+		Query: app.readString(qs, "q", ""),
+	}
+
+	if models.ValidateSearchFilters(v, filters); !v.Valid() {
+		v.AddError("message", errors.InvalidFilters)
+		http.Error(w, v.Errors["message"], http.StatusBadRequest)
+		return
+	}
+
+	results, metadata, err := app.userModel.SearchUsers(filters)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, map[string]any{"metadata": metadata, "results": results})
+	if err != nil {
+		http.Error(w, errors.JsonWriteError, http.StatusInternalServerError)
+		return
+	}
+}
+
+// assignUserRole grants the role named in the body to the user in the URL
+func (app *App) assignUserRole(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		http.Error(w, errors.InvalidUserID, http.StatusBadRequest)
+		return
+	}
+
+	var payload struct {
+		Role string `json:"role"`
+	}
+	err = app.readJSON(w, r, &payload)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, ok := models.DefaultRolePermissions[payload.Role]; !ok {
+		http.Error(w, errors.UnknownRole, http.StatusBadRequest)
+		return
+	}
+
+	user, err := app.userModel.GetByPublicID(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	err = app.userModel.AssignRole(int(user.ID), payload.Role)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	app.writeUserByID(w, int(user.ID))
+}
+
+// revokeUserRole takes the role in the URL away from the user
+func (app *App) revokeUserRole(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		http.Error(w, errors.InvalidUserID, http.StatusBadRequest)
+		return
+	}
+
+	user, err := app.userModel.GetByPublicID(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	err = app.userModel.RevokeRole(int(user.ID), chi.URLParam(r, "role"))
+	if err != nil {
+		http.Error(w, errors.RoleNotAssigned, http.StatusNotFound)
+		return
+	}
+
+	app.writeUserByID(w, int(user.ID))
+}
+
+// writeUserByID reloads the user so the response shows the roles and permissions now in effect
+func (app *App) writeUserByID(w http.ResponseWriter, id int) {
+	user, err := app.userModel.GetByID(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, user)
+	if err != nil {
+		http.Error(w, errors.JsonWriteError, http.StatusInternalServerError)
+		return
+	}
+}
+
+// unlockUser lifts a lockout early and resets the failed login counter
+func (app *App) unlockUser(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		http.Error(w, errors.InvalidUserID, http.StatusBadRequest)
+		return
+	}
+
+	user, err := app.userModel.GetByPublicID(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	err = app.userModel.UnlockUser(int(user.ID))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, errors.AccountUnlocked)
+	if err != nil {
+		http.Error(w, errors.JsonWriteError, http.StatusInternalServerError)
+		return
+	}
+}
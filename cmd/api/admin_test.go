@@ -0,0 +1,291 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/go-chi/chi/v5"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"the_lonely_road/errors"
+	"the_lonely_road/models"
+	"time"
+)
+
+// public ids for the users in the admin tests
+const (
+	alice = "0190a6e2-5c3b-7c1e-9f3a-000000000001"
+	bob   = "0190a6e2-5c3b-7c1e-9f3a-000000000002"
+	carol = "0190a6e2-5c3b-7c1e-9f3a-000000000003"
+)
+
+func TestApp_listUsers(t *testing.T) {
+	lockedUntil := time.Now().Add(time.Hour)
+	app := App{userModel: &models.UserModelMock{DB: []*models.User{
+		{ID: 1, PublicID: alice, Email: "alice@example.com", CreatedAt: time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC), Verified: true},
+		{ID: 2, PublicID: bob, Email: "bob@example.com", CreatedAt: time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC), LockedUntil: &lockedUntil},
+		{ID: 3, PublicID: carol, Email: "carol@test.com", CreatedAt: time.Date(2023, 9, 1, 0, 0, 0, 0, time.UTC), Verified: true},
+	}}}
+
+	tests := []struct {
+		name          string
+		query         string
+		expectedCode  int
+		expectedIDs   []string
+		expectedTotal int
+		expectedError string
+	}{
+		{name: "Defaults", query: "", expectedCode: http.StatusOK, expectedIDs: []string{alice, bob, carol}, expectedTotal: 3},
+		{name: "Email substring", query: "?email=EXAMPLE", expectedCode: http.StatusOK, expectedIDs: []string{alice, bob}, expectedTotal: 2},
+		{name: "Created range", query: "?created_after=2023-02-01&created_before=2023-12-31", expectedCode: http.StatusOK, expectedIDs: []string{bob, carol}, expectedTotal: 2},
+		{name: "Verified", query: "?verified=false", expectedCode: http.StatusOK, expectedIDs: []string{bob}, expectedTotal: 1},
+		{name: "Locked", query: "?locked=true", expectedCode: http.StatusOK, expectedIDs: []string{bob}, expectedTotal: 1},
+		{name: "Sort descending", query: "?sort=-created_at", expectedCode: http.StatusOK, expectedIDs: []string{carol, bob, alice}, expectedTotal: 3},
+		{name: "Second page", query: "?page=2&page_size=2&sort=email", expectedCode: http.StatusOK, expectedIDs: []string{carol}, expectedTotal: 3},
+		{name: "Unknown sort", query: "?sort=password_hash", expectedCode: http.StatusBadRequest, expectedError: errors.InvalidFilters},
+		{name: "Page size too large", query: "?page_size=1000", expectedCode: http.StatusBadRequest, expectedError: errors.InvalidFilters},
+		{name: "Bad date", query: "?created_after=yesterday", expectedCode: http.StatusBadRequest, expectedError: errors.InvalidFilters},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req, err := http.NewRequest("GET", "/admin/users"+test.query, nil)
+			if err != nil {
+				t.Errorf("Unexpected error in GET request to /admin/users")
+			}
+			rr := httptest.NewRecorder()
+
+			app.listUsers(rr, req)
+			if rr.Code != test.expectedCode {
+				t.Errorf("Expected status code %d, got %d", test.expectedCode, rr.Code)
+			}
+			if test.expectedError != "" {
+				if !strings.Contains(rr.Body.String(), test.expectedError) {
+					t.Errorf("Expected body to contain '%s', got '%s'", test.expectedError, rr.Body.String())
+				}
+				return
+			}
+
+			var response struct {
+				Metadata models.Metadata `json:"metadata"`
+				Users    []models.User   `json:"users"`
+			}
+			err = json.Unmarshal(rr.Body.Bytes(), &response)
+			if err != nil {
+				t.Errorf("Error unmarshaling JSON: %v", err)
+			}
+			if response.Metadata.TotalRecords != test.expectedTotal {
+				t.Errorf("Expected %d total records, got %d", test.expectedTotal, response.Metadata.TotalRecords)
+			}
+			if len(response.Users) != len(test.expectedIDs) {
+				t.Fatalf("Expected %d users, got %d", len(test.expectedIDs), len(response.Users))
+			}
+			for i, id := range test.expectedIDs {
+				if response.Users[i].PublicID != id {
+					t.Errorf("Expected user %s at position %d, got %s", id, i, response.Users[i].PublicID)
+				}
+			}
+			if strings.Contains(rr.Body.String(), "password") {
+				t.Errorf("Expected password hashes to be left out of the listing")
+			}
+		})
+	}
+}
+
+func TestApp_searchUsers(t *testing.T) {
+	app := App{userModel: &models.UserModelMock{DB: []*models.User{
+		{ID: 1, PublicID: alice, Email: "alice@example.com", GivenName: "Alice", FamilyName: "Jonathan"},
+		{ID: 2, PublicID: bob, Email: "bob@example.com", DisplayName: "Bob Example"},
+		{ID: 3, PublicID: carol, Email: "carol@test.com"},
+	}}}
+
+	tests := []struct {
+		name          string
+		query         string
+		expectedCode  int
+		expectedIDs   []string
+		expectedTotal int
+		expectedError string
+	}{
+		{name: "Email prefix", query: "?q=ALI", expectedCode: http.StatusOK, expectedIDs: []string{alice}, expectedTotal: 1},
+		{name: "Typo in a name", query: "?q=jonathon", expectedCode: http.StatusOK, expectedIDs: []string{alice}, expectedTotal: 1},
+		{name: "Name word prefix first", query: "?q=example", expectedCode: http.StatusOK, expectedIDs: []string{bob, alice}, expectedTotal: 2},
+		{name: "Second page", query: "?q=example&page=2&page_size=1", expectedCode: http.StatusOK, expectedIDs: []string{alice}, expectedTotal: 2},
+		{name: "No match", query: "?q=dave", expectedCode: http.StatusOK, expectedIDs: []string{}, expectedTotal: 0},
+		{name: "Missing query", query: "", expectedCode: http.StatusBadRequest, expectedError: errors.InvalidFilters},
+		{name: "Query too short", query: "?q=al", expectedCode: http.StatusBadRequest, expectedError: errors.InvalidFilters},
+		{name: "Page size too large", query: "?q=alice&page_size=1000", expectedCode: http.StatusBadRequest, expectedError: errors.InvalidFilters},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req, err := http.NewRequest("GET", "/admin/users/search"+test.query, nil)
+			if err != nil {
+				t.Errorf("Unexpected error in GET request to /admin/users/search")
+			}
+			rr := httptest.NewRecorder()
+
+			app.searchUsers(rr, req)
+			if rr.Code != test.expectedCode {
+				t.Errorf("Expected status code %d, got %d", test.expectedCode, rr.Code)
+			}
+			if test.expectedError != "" {
+				if !strings.Contains(rr.Body.String(), test.expectedError) {
+					t.Errorf("Expected body to contain '%s', got '%s'", test.expectedError, rr.Body.String())
+				}
+				return
+			}
+
+			var response struct {
+				Metadata models.Metadata `json:"metadata"`
+				Results  []struct {
+					User       models.User       `json:"user"`
+					Rank       float64           `json:"rank"`
+					Highlights map[string]string `json:"highlights"`
+				} `json:"results"`
+			}
+			err = json.Unmarshal(rr.Body.Bytes(), &response)
+			if err != nil {
+				t.Errorf("Error unmarshaling JSON: %v", err)
+			}
+			if response.Metadata.TotalRecords != test.expectedTotal {
+				t.Errorf("Expected %d total records, got %d", test.expectedTotal, response.Metadata.TotalRecords)
+			}
+			if len(response.Results) != len(test.expectedIDs) {
+				t.Fatalf("Expected %d results, got %d", len(test.expectedIDs), len(response.Results))
+			}
+			for i, id := range test.expectedIDs {
+				if response.Results[i].User.PublicID != id {
+					t.Errorf("Expected user %s at position %d, got %s", id, i, response.Results[i].User.PublicID)
+				}
+				if len(response.Results[i].Highlights) == 0 {
+					t.Errorf("Expected the matched fields of %s to be highlighted", id)
+				}
+			}
+			if strings.Contains(rr.Body.String(), "password") {
+				t.Errorf("Expected password hashes to be left out of the results")
+			}
+		})
+	}
+}
+
+func TestApp_assignUserRole(t *testing.T) {
+	app := App{userModel: &models.UserModelMock{DB: []*models.User{
+		{ID: 1, PublicID: alice, Email: "alice@example.com", Roles: []string{}, Permissions: []string{}},
+	}}}
+	r := chi.NewRouter()
+	r.Post("/admin/users/{id}/roles", app.assignUserRole)
+
+	tests := []struct {
+		name          string
+		path          string
+		payload       string
+		expectedCode  int
+		expectedError string
+	}{
+		{name: "Assign support", path: "/admin/users/" + alice + "/roles", payload: `{"role":"support"}`, expectedCode: http.StatusOK},
+		{name: "Assign again", path: "/admin/users/" + alice + "/roles", payload: `{"role":"support"}`, expectedCode: http.StatusOK},
+		{name: "Unknown role", path: "/admin/users/" + alice + "/roles", payload: `{"role":"owner"}`, expectedCode: http.StatusBadRequest, expectedError: errors.UnknownRole},
+		{name: "Bad id", path: "/admin/users/abc/roles", payload: `{"role":"support"}`, expectedCode: http.StatusBadRequest, expectedError: errors.InvalidUserID},
+		{name: "Missing user", path: "/admin/users/" + bob + "/roles", payload: `{"role":"support"}`, expectedCode: http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", test.path, strings.NewReader(test.payload))
+			rr := httptest.NewRecorder()
+
+			r.ServeHTTP(rr, req)
+			if rr.Code != test.expectedCode {
+				t.Errorf("Expected status code %d, got %d", test.expectedCode, rr.Code)
+			}
+			if test.expectedError != "" && !strings.Contains(rr.Body.String(), test.expectedError) {
+				t.Errorf("Expected body to contain '%s', got '%s'", test.expectedError, rr.Body.String())
+			}
+		})
+	}
+
+	user, _ := app.userModel.GetByID(1)
+	if len(user.Roles) != 1 || user.Roles[0] != models.RoleSupport {
+		t.Errorf("Expected only the support role, got %v", user.Roles)
+	}
+	if len(user.Permissions) != 1 || user.Permissions[0] != models.PermissionUsersRead {
+		t.Errorf("Expected users:read permission, got %v", user.Permissions)
+	}
+}
+
+func TestApp_revokeUserRole(t *testing.T) {
+	app := App{userModel: &models.UserModelMock{DB: []*models.User{
+		{ID: 1, PublicID: alice, Email: "alice@example.com", Roles: []string{models.RoleAdmin}, Permissions: models.DefaultRolePermissions[models.RoleAdmin]},
+	}}}
+	r := chi.NewRouter()
+	r.Delete("/admin/users/{id}/roles/{role}", app.revokeUserRole)
+
+	tests := []struct {
+		name          string
+		path          string
+		expectedCode  int
+		expectedError string
+	}{
+		{name: "Revoke admin", path: "/admin/users/" + alice + "/roles/admin", expectedCode: http.StatusOK},
+		{name: "Not assigned", path: "/admin/users/" + alice + "/roles/admin", expectedCode: http.StatusNotFound, expectedError: errors.RoleNotAssigned},
+		{name: "Bad id", path: "/admin/users/0/roles/admin", expectedCode: http.StatusBadRequest, expectedError: errors.InvalidUserID},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest("DELETE", test.path, nil)
+			rr := httptest.NewRecorder()
+
+			r.ServeHTTP(rr, req)
+			if rr.Code != test.expectedCode {
+				t.Errorf("Expected status code %d, got %d", test.expectedCode, rr.Code)
+			}
+			if test.expectedError != "" && !strings.Contains(rr.Body.String(), test.expectedError) {
+				t.Errorf("Expected body to contain '%s', got '%s'", test.expectedError, rr.Body.String())
+			}
+		})
+	}
+
+	user, _ := app.userModel.GetByID(1)
+	if len(user.Roles) != 0 || len(user.Permissions) != 0 {
+		t.Errorf("Expected no roles or permissions, got %v %v", user.Roles, user.Permissions)
+	}
+}
+
+func TestApp_unlockUser(t *testing.T) {
+	lockedUntil := time.Now().Add(time.Hour)
+	app := App{userModel: &models.UserModelMock{DB: []*models.User{
+		{ID: 1, PublicID: alice, Email: "alice@example.com", LockedUntil: &lockedUntil, FailedLogins: 3},
+	}}}
+	r := chi.NewRouter()
+	r.Post("/admin/users/{id}/unlock", app.unlockUser)
+
+	tests := []struct {
+		name         string
+		path         string
+		expectedCode int
+	}{
+		{name: "Unlock", path: "/admin/users/" + alice + "/unlock", expectedCode: http.StatusOK},
+		{name: "Already unlocked", path: "/admin/users/" + alice + "/unlock", expectedCode: http.StatusOK},
+		{name: "Missing user", path: "/admin/users/" + bob + "/unlock", expectedCode: http.StatusNotFound},
+		{name: "Bad id", path: "/admin/users/x/unlock", expectedCode: http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", test.path, nil)
+			rr := httptest.NewRecorder()
+
+			r.ServeHTTP(rr, req)
+			if rr.Code != test.expectedCode {
+				t.Errorf("Expected status code %d, got %d", test.expectedCode, rr.Code)
+			}
+		})
+	}
+
+	user, _ := app.userModel.GetByID(1)
+	if user.LockedUntil != nil || user.FailedLogins != 0 {
+		t.Errorf("Expected lock to be cleared, got %v and %d", user.LockedUntil, user.FailedLogins)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"the_lonely_road/errors"
+	"the_lonely_road/models"
+	"the_lonely_road/validator"
+	"time"
+)
+
+// audit appends event to the security log with the request's IP, user agent and request id. A failed write is
+// only printed, the request it describes has already happened and shouldn't fail because of the log.
+func (app *App) audit(r *http.Request, event models.AuditEvent) {
+	event.IP = clientIP(r)
+	event.UserAgent = r.UserAgent()
+	event.RequestID = app.contextGetRequestID(r)
+	event.CreatedAt = time.Now()
+	err := app.userModel.RecordAuditEvent(&event)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+// auditEmail records event about whichever account event.Email belongs to, the subject is left empty when none does
+func (app *App) auditEmail(r *http.Request, event models.AuditEvent) {
+	if user, err := app.userModel.GetByEmail(event.Email); err == nil {
+		event.SubjectID = user.PublicID
+	}
+	app.audit(r, event)
+}
+
+// auditLogin records event about the account a sign in named. For an email the event keeps what was typed, for a
+// username it gets the account's address, if there is one, so the log can still be searched by email.
+func (app *App) auditLogin(r *http.Request, event models.AuditEvent, login string) {
+	if models.IsEmailLogin(login) {
+		event.Email = login
+		app.auditEmail(r, event)
+		return
+	}
+	if user, err := app.userModel.GetByUsername(login); err == nil {
+		event.SubjectID, event.Email = user.PublicID, user.Email
+	}
+	app.audit(r, event)
+}
+
+// clientIP is the address of the peer that connected to us. Forwarded headers are ignored because anyone can set them.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// listAuditEvents pages through the security log, newest first unless sort=created_at.
+// It can be narrowed with type, user (a public id, matched as actor or subject), after and before.
+func (app *App) listAuditEvents(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	qs := r.URL.Query()
+
+	filters := models.AuditFilters{
+		Filters: models.Filters{
+			Page:         app.readInt(qs, "page", 1, v),
+			PageSize:     app.readInt(qs, "page_size", 20, v),
+			Sort:         app.readString(qs, "sort", "-created_at"),
+			SortSafelist: models.AuditSortSafelist,
+		},
+		Type:   app.readString(qs, "type", ""),
+		User:   app.readString(qs, "user", ""),
+		After:  app.readTime(qs, "after", v),
+		Before: app.readTime(qs, "before", v),
+	}
+
+	if models.ValidateAuditFilters(v, filters); !v.Valid() {
+		v.AddError("message", errors.InvalidAuditFilters)
+		http.Error(w, v.Errors["message"], http.StatusBadRequest)
+		return
+	}
+
+	events, metadata, err := app.userModel.ListAuditEvents(filters)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, map[string]any{"metadata": metadata, "events": events})
+	if err != nil {
+		http.Error(w, errors.JsonWriteError, http.StatusInternalServerError)
+		return
+	}
+}
+
+// getLoginHistory lists the caller's recent sign ins, successful or not, so they can spot any that weren't them
+func (app *App) getLoginHistory(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	qs := r.URL.Query()
+
+	filters := models.Filters{
+		Page:         app.readInt(qs, "page", 1, v),
+		PageSize:     app.readInt(qs, "page_size", 20, v),
+		Sort:         "-created_at",
+		SortSafelist: models.AuditSortSafelist,
+	}
+	if models.ValidateFilters(v, filters); !v.Valid() {
+		v.AddError("message", errors.InvalidPage)
+		http.Error(w, v.Errors["message"], http.StatusBadRequest)
+		return
+	}
+
+	history, metadata, err := app.userModel.ListLoginHistory(app.contextGetSubject(r), time.Now().Add(-app.loginHistoryWindow()), filters)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, map[string]any{"metadata": metadata, "login_history": history})
+	if err != nil {
+		http.Error(w, errors.JsonWriteError, http.StatusInternalServerError)
+		return
+	}
+}
+
+func (app *App) loginHistoryWindow() time.Duration {
+	if app.Config.loginHistoryWindow <= 0 {
+		return models.DefaultLoginHistoryWindow
+	}
+	return app.Config.loginHistoryWindow
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"the_lonely_road/JWT"
+	"the_lonely_road/errors"
+	"the_lonely_road/models"
+	"time"
+)
+
+func TestApp_audit_Events(t *testing.T) {
+	app, mock := orgTestApp(t)
+	handler := app.SetRoutes()
+	send := func(method, target, body string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("User-Agent", "audit-test")
+		req.Header.Set("X-Request-Id", "req"+strings.ReplaceAll(target, "/", "-"))
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	send("POST", "/users/login", `{"email": "alice@example.com", "password": "wrongpassword"}`)
+	send("POST", "/users/login", `{"email": "nobody@example.com", "password": "wrongpassword"}`)
+	rr := send("POST", "/users/login", `{"email": "alice@example.com", "password": "securepassword"}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected sign in to succeed, got %d: %s", rr.Code, rr.Body.String())
+	}
+	send("POST", "/users/logout", "", rr.Result().Cookies()...)
+	send("POST", "/users", `{"email": "dave@example.com", "password": "securepassword"}`)
+	app.wg.Wait()
+
+	expected := []models.AuditEvent{
+		{Type: models.AuditLoginFailed, SubjectID: alice, Email: "alice@example.com", RequestID: "req-users-login"},
+		{Type: models.AuditLoginFailed, Email: "nobody@example.com", RequestID: "req-users-login"},
+		{Type: models.AuditLoginSucceeded, ActorID: alice, SubjectID: alice, Email: "alice@example.com", RequestID: "req-users-login"},
+		{Type: models.AuditSignedOut, ActorID: alice, SubjectID: alice, RequestID: "req-users-logout"},
+		{Type: models.AuditUserCreated, Email: "dave@example.com", RequestID: "req-users"},
+	}
+	if len(mock.AuditEvents) != len(expected) {
+		t.Fatalf("Expected %d events, got %d: %+v", len(expected), len(mock.AuditEvents), mock.AuditEvents)
+	}
+	for i, want := range expected {
+		got := mock.AuditEvents[i]
+		if want.Type == models.AuditUserCreated {
+			// the new account's id isn't known up front, it just has to be the actor and subject
+			want.ActorID, want.SubjectID = got.SubjectID, got.SubjectID
+		}
+		if got.Type != want.Type || got.ActorID != want.ActorID || got.SubjectID != want.SubjectID || got.Email != want.Email ||
+			got.RequestID != want.RequestID {
+			t.Errorf("Event %d: expected %+v, got %+v", i, want, got)
+		}
+		if got.IP != "192.0.2.1" || got.UserAgent != "audit-test" || got.CreatedAt.IsZero() {
+			t.Errorf("Event %d: expected the request's IP, user agent and a time, got %+v", i, got)
+		}
+	}
+}
+
+func TestApp_audit_PasswordReset(t *testing.T) {
+	app, mock := orgTestApp(t)
+	mock.DB[0].PasswordResetExpiry = time.Now().Add(time.Hour)
+
+	req := httptest.NewRequest("POST", "/users/password/reset?token=wrong", strings.NewReader(`{"email": "alice@example.com", "password": "newpassword"}`))
+	rr := httptest.NewRecorder()
+	app.ProcessPasswordReset(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("Expected a bad token to be refused, got %d", rr.Code)
+	}
+	if len(mock.AuditEvents) != 1 || mock.AuditEvents[0].Type != models.AuditPasswordResetFailed || mock.AuditEvents[0].SubjectID != alice {
+		t.Errorf("Expected a failed reset for alice, got %+v", mock.AuditEvents)
+	}
+}
+
+func TestApp_listAuditEvents(t *testing.T) {
+	app, mock := orgTestApp(t)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, event := range []*models.AuditEvent{
+		{Type: models.AuditLoginFailed, SubjectID: alice},
+		{Type: models.AuditLoginSucceeded, ActorID: alice, SubjectID: alice},
+		{Type: models.AuditLoginSucceeded, ActorID: bob, SubjectID: bob},
+	} {
+		event.CreatedAt = start.Add(time.Duration(i) * time.Hour)
+		_ = mock.RecordAuditEvent(event)
+	}
+
+	tests := []struct {
+		name          string
+		query         string
+		expectedCode  int
+		expectedIDs   []int64
+		expectedTotal int
+	}{
+		{name: "Defaults", query: "", expectedCode: http.StatusOK, expectedIDs: []int64{3, 2, 1}, expectedTotal: 3},
+		{name: "Oldest first", query: "?sort=created_at&page_size=2", expectedCode: http.StatusOK, expectedIDs: []int64{1, 2}, expectedTotal: 3},
+		{name: "By type and user", query: "?type=login.succeeded&user=" + alice, expectedCode: http.StatusOK, expectedIDs: []int64{2}, expectedTotal: 1},
+		{name: "Time range", query: "?after=2024-01-01T00:30:00Z&before=2024-01-01T01:30:00Z", expectedCode: http.StatusOK, expectedIDs: []int64{2}, expectedTotal: 1},
+		{name: "Unknown type", query: "?type=login.maybe", expectedCode: http.StatusBadRequest},
+		{name: "Sort by email", query: "?sort=email", expectedCode: http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/admin/audit-events"+test.query, nil)
+			rr := httptest.NewRecorder()
+
+			app.listAuditEvents(rr, req)
+			if rr.Code != test.expectedCode {
+				t.Fatalf("Expected status code %d, got %d: %s", test.expectedCode, rr.Code, rr.Body.String())
+			}
+			if test.expectedCode != http.StatusOK {
+				if !strings.Contains(rr.Body.String(), errors.InvalidAuditFilters) {
+					t.Errorf("Expected body to contain '%s', got '%s'", errors.InvalidAuditFilters, rr.Body.String())
+				}
+				return
+			}
+
+			var response struct {
+				Metadata models.Metadata     `json:"metadata"`
+				Events   []models.AuditEvent `json:"events"`
+			}
+			err := json.Unmarshal(rr.Body.Bytes(), &response)
+			if err != nil {
+				t.Fatalf("Error unmarshaling JSON: %v", err)
+			}
+			if response.Metadata.TotalRecords != test.expectedTotal || len(response.Events) != len(test.expectedIDs) {
+				t.Fatalf("Expected ids %v of %d, got %+v", test.expectedIDs, test.expectedTotal, response)
+			}
+			for i, event := range response.Events {
+				if event.ID != test.expectedIDs[i] {
+					t.Errorf("Expected ids %v, got %+v", test.expectedIDs, response.Events)
+				}
+			}
+		})
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	app := &App{}
+	var seen string
+	handler := app.requestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = app.contextGetRequestID(r)
+	}))
+
+	tests := []struct {
+		name     string
+		incoming string
+		kept     bool
+	}{
+		{name: "Generated", incoming: "", kept: false},
+		{name: "From a proxy", incoming: "edge-1234.abc", kept: true},
+		{name: "Malformed", incoming: "has spaces\tand tabs", kept: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			if test.incoming != "" {
+				req.Header.Set("X-Request-Id", test.incoming)
+			}
+			rr := httptest.NewRecorder()
+
+			handler.ServeHTTP(rr, req)
+			if seen == "" || rr.Header().Get("X-Request-Id") != seen {
+				t.Fatalf("Expected the request id %q to be echoed, got %q", seen, rr.Header().Get("X-Request-Id"))
+			}
+			if (seen == test.incoming) != test.kept {
+				t.Errorf("Expected keeping %q to be %v, got %q", test.incoming, test.kept, seen)
+			}
+		})
+	}
+}
+
+func TestAuditRoutePermission(t *testing.T) {
+	app, mock := orgTestApp(t)
+	handler := app.SetRoutes()
+	_ = mock.AssignRole(1, models.RoleAdmin)
+	_ = mock.AssignRole(2, models.RoleSupport)
+
+	support, err := JWT.GenerateJWT(bob)
+	if err != nil {
+		t.Fatalf("Unexpected error generating token: %v", err)
+	}
+	admin, err := JWT.GenerateJWT(alice)
+	if err != nil {
+		t.Fatalf("Unexpected error generating token: %v", err)
+	}
+	// carol's token claims a permission none of her roles grant
+	claimed, err := JWT.GenerateJWTWithClaims(JWT.Claims{Subject: carol, Permissions: []string{models.PermissionAuditRead}})
+	if err != nil {
+		t.Fatalf("Unexpected error generating token: %v", err)
+	}
+
+	for token, expectedCode := range map[string]int{support: http.StatusForbidden, admin: http.StatusOK, claimed: http.StatusForbidden} {
+		req := httptest.NewRequest("GET", "/admin/audit-events", nil)
+		req.AddCookie(&http.Cookie{Name: "auth_token", Value: token})
+		rr := httptest.NewRecorder()
+
+		handler.ServeHTTP(rr, req)
+		if rr.Code != expectedCode {
+			t.Errorf("Expected status %d, got %d", expectedCode, rr.Code)
+		}
+	}
+}
+
+func TestApp_getLoginHistory(t *testing.T) {
+	app, mock := orgTestApp(t)
+	app.Config.loginHistoryWindow = 24 * time.Hour
+	for _, event := range []*models.AuditEvent{
+		{Type: models.AuditLoginSucceeded, SubjectID: alice, Method: models.LoginMethodPassword, CreatedAt: time.Now().Add(-48 * time.Hour)},
+		{Type: models.AuditLoginFailed, SubjectID: alice, Method: models.LoginMethodPassword, IP: "192.0.2.1", CreatedAt: time.Now().Add(-time.Hour),
+			UserAgent: "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36"},
+		{Type: models.AuditLoginSucceeded, SubjectID: bob, Method: models.LoginMethodPassword, CreatedAt: time.Now()},
+	} {
+		_ = mock.RecordAuditEvent(event)
+	}
+
+	tests := []struct {
+		name         string
+		query        string
+		expectedCode int
+		expectedLen  int
+	}{
+		{name: "Within the window", query: "", expectedCode: http.StatusOK, expectedLen: 1},
+		{name: "Past the last page", query: "?page=2", expectedCode: http.StatusOK, expectedLen: 0},
+		{name: "Page size too large", query: "?page_size=1000", expectedCode: http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/users/me/login-history"+test.query, nil)
+			req = app.contextSetSubject(req, alice)
+			rr := httptest.NewRecorder()
+
+			app.getLoginHistory(rr, req)
+			if rr.Code != test.expectedCode {
+				t.Fatalf("Expected status code %d, got %d: %s", test.expectedCode, rr.Code, rr.Body.String())
+			}
+			if test.expectedCode != http.StatusOK {
+				if !strings.Contains(rr.Body.String(), errors.InvalidPage) {
+					t.Errorf("Expected body to contain '%s', got '%s'", errors.InvalidPage, rr.Body.String())
+				}
+				return
+			}
+
+			var response struct {
+				LoginHistory []models.LoginHistoryEntry `json:"login_history"`
+			}
+			err := json.Unmarshal(rr.Body.Bytes(), &response)
+			if err != nil {
+				t.Fatalf("Error unmarshaling JSON: %v", err)
+			}
+			if len(response.LoginHistory) != test.expectedLen {
+				t.Fatalf("Expected %d entries, got %+v", test.expectedLen, response.LoginHistory)
+			}
+			if test.expectedLen == 0 {
+				return
+			}
+			entry := response.LoginHistory[0]
+			if entry.Succeeded || entry.IP != "192.0.2.1" || entry.Browser != "Chrome" || entry.OS != "Windows" || entry.Method != models.LoginMethodPassword {
+				t.Errorf("Expected alice's failed Chrome on Windows sign in, got %+v", entry)
+			}
+		})
+	}
+}
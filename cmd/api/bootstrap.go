@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"the_lonely_road/models"
+	"the_lonely_road/validator"
+	"time"
+)
+
+// bootstrapAdmin makes sure there is someone who can hand out roles. It does nothing once any user
+// has the admin role, so removing the config after the first start is safe. An account that already has the address
+// is only promoted if the configured password signs in to it, otherwise whoever signed up with the address first
+// would become the admin.
+func (app *App) bootstrapAdmin() error {
+	email := app.Config.bootstrapAdmin.email
+	if email == "" {
+		return nil
+	}
+
+	_, metadata, err := app.userModel.ListUsers(models.UserFilters{
+		Filters: models.Filters{Page: 1, PageSize: 1, Sort: "id", SortSafelist: models.UserSortSafelist},
+		Role:    models.RoleAdmin,
+	})
+	if err != nil {
+		return fmt.Errorf("bootstrap admin: %w", err)
+	}
+	if metadata.TotalRecords > 0 {
+		return nil
+	}
+
+	user, err := app.userModel.GetByEmail(email)
+	if err != nil {
+		user = &models.User{
+			Email:     email,
+			Password:  app.Config.bootstrapAdmin.password,
+			CreatedAt: time.Now(),
+		}
+		v := validator.New()
+		if models.ValidateUser(v, user, app.Config.hasher); !v.Valid() {
+			return fmt.Errorf("bootstrap admin: invalid email or password: %v", v.Errors)
+		}
+		err = app.userModel.Insert(user)
+		if err != nil {
+			return fmt.Errorf("bootstrap admin: %w", err)
+		}
+	} else {
+		_, err = app.userModel.Authenticate(email, app.Config.bootstrapAdmin.password)
+		if err != nil {
+			return fmt.Errorf("bootstrap admin: %s already has an account that BOOTSTRAP_ADMIN_PASSWORD doesn't sign in to", email)
+		}
+	}
+
+	err = app.userModel.AssignRole(int(user.ID), models.RoleAdmin)
+	if err != nil {
+		return fmt.Errorf("bootstrap admin: %w", err)
+	}
+	fmt.Println("Granted admin role to", email)
+	return nil
+}
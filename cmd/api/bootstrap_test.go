@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+	"the_lonely_road/models"
+)
+
+func TestApp_bootstrapAdmin(t *testing.T) {
+	t.Run("Not configured", func(t *testing.T) {
+		mock := &models.UserModelMock{DB: []*models.User{}}
+		app := App{userModel: mock}
+		if err := app.bootstrapAdmin(); err != nil {
+			t.Errorf("Expected no error, got %s", err)
+		}
+		if len(mock.DB) != 0 {
+			t.Errorf("Expected no users to be created, got %d", len(mock.DB))
+		}
+	})
+	t.Run("Creates the admin", func(t *testing.T) {
+		mock := &models.UserModelMock{DB: []*models.User{}}
+		app := App{userModel: mock}
+		app.Config.bootstrapAdmin.email = "root@example.com"
+		app.Config.bootstrapAdmin.password = "veryinsecurepassword"
+		if err := app.bootstrapAdmin(); err != nil {
+			t.Fatalf("Expected no error, got %s", err)
+		}
+		user, err := mock.GetByEmail("root@example.com")
+		if err != nil {
+			t.Fatalf("Expected admin to be created, got %s", err)
+		}
+		if len(user.Roles) != 1 || user.Roles[0] != models.RoleAdmin {
+			t.Errorf("Expected admin role, got %v", user.Roles)
+		}
+	})
+	t.Run("Promotes an existing user", func(t *testing.T) {
+		mock := &models.UserModelMock{DB: []*models.User{}}
+		if err := mock.Insert(&models.User{Email: "root@example.com", Password: "veryinsecurepassword"}); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		app := App{userModel: mock}
+		app.Config.bootstrapAdmin.email = "root@example.com"
+		app.Config.bootstrapAdmin.password = "veryinsecurepassword"
+		if err := app.bootstrapAdmin(); err != nil {
+			t.Fatalf("Expected no error, got %s", err)
+		}
+		if roles := mock.DB[0].Roles; len(roles) != 1 || roles[0] != models.RoleAdmin {
+			t.Errorf("Expected admin role, got %v", roles)
+		}
+	})
+	t.Run("Existing user with another password", func(t *testing.T) {
+		mock := &models.UserModelMock{DB: []*models.User{}}
+		if err := mock.Insert(&models.User{Email: "root@example.com", Password: "squatterspassword"}); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		app := App{userModel: mock}
+		app.Config.bootstrapAdmin.email = "root@example.com"
+		app.Config.bootstrapAdmin.password = "veryinsecurepassword"
+		if err := app.bootstrapAdmin(); err == nil {
+			t.Errorf("Expected an account the password doesn't sign in to to be refused")
+		}
+		if roles := mock.DB[0].Roles; len(roles) != 0 {
+			t.Errorf("Expected the account not to be promoted, got %v", roles)
+		}
+	})
+	t.Run("Admin already exists", func(t *testing.T) {
+		mock := &models.UserModelMock{DB: []*models.User{
+			{ID: 1, Email: "first@example.com", Roles: []string{models.RoleAdmin}},
+			{ID: 2, Email: "root@example.com"},
+		}}
+		app := App{userModel: mock}
+		app.Config.bootstrapAdmin.email = "root@example.com"
+		if err := app.bootstrapAdmin(); err != nil {
+			t.Fatalf("Expected no error, got %s", err)
+		}
+		if len(mock.DB[1].Roles) != 0 {
+			t.Errorf("Expected no roles for the second user, got %v", mock.DB[1].Roles)
+		}
+	})
+	t.Run("Invalid password", func(t *testing.T) {
+		app := App{userModel: &models.UserModelMock{DB: []*models.User{}}}
+		app.Config.bootstrapAdmin.email = "root@example.com"
+		if err := app.bootstrapAdmin(); err == nil {
+			t.Errorf("Expected error for missing password, got nil")
+		}
+	})
+}
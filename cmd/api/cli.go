@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"the_lonely_road/models"
+)
+
+// runCommand runs one of the commands below against the user store instead of starting the server, with
+// USER_STORE=memory that is the snapshot in MEMORY_SNAPSHOT_PATH
+//
+//	api import [-format csv|ndjson] [-dry-run] [-batch-size 500] FILE
+//	api export [-format csv|ndjson] [-o FILE]
+//	api reencrypt [-batch-size 500]
+func (app *App) runCommand(args []string) error {
+	if args[0] != "import" && args[0] != "export" && args[0] != "reencrypt" {
+		return fmt.Errorf("unknown command %q, use import, export or reencrypt", args[0])
+	}
+
+	userModel, closeUserModel, err := app.openUserModel()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := closeUserModel(); err != nil {
+			fmt.Println("Error closing user store:", err)
+		}
+	}()
+	app.userModel = userModel
+
+	switch args[0] {
+	case "import":
+		return app.importCommand(args[1:], os.Stdin, os.Stdout)
+	case "reencrypt":
+		return app.reencryptCommand(args[1:], os.Stdout)
+	}
+	return app.exportCommand(args[1:], os.Stdout)
+}
+
+// importCommand imports FILE, or stdin when FILE is -, and prints the report. It fails when any row did, so
+// scripts can tell a clean import from a partial one.
+func (app *App) importCommand(args []string, stdin io.Reader, stdout io.Writer) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	format := flags.String("format", "", "csv or ndjson, taken from the file extension when left out")
+	dryRun := flags.Bool("dry-run", false, "check every row without storing anything")
+	batchSize := flags.Int("batch-size", models.DefaultImportBatchSize, "users per transaction")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: import [-format csv|ndjson] [-dry-run] [-batch-size n] FILE, where - reads stdin")
+	}
+	if *batchSize < 1 || *batchSize > models.MaxImportBatchSize {
+		return fmt.Errorf("batch-size must be between 1 and %d", models.MaxImportBatchSize)
+	}
+
+	path := flags.Arg(0)
+	input := stdin
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		input = file
+		if *format == "" {
+			*format = strings.TrimPrefix(filepath.Ext(path), ".")
+		}
+	}
+	parsedFormat, err := models.ParseUserFileFormat(*format)
+	if err != nil {
+		return err
+	}
+
+	reader, err := models.NewUserReader(input, parsedFormat)
+	if err != nil {
+		return err
+	}
+	importer := models.Importer{Users: app.userModel, Hasher: app.Config.hasher, BatchSize: *batchSize, DryRun: *dryRun}
+	report, importErr := importer.Import(reader)
+
+	out, err := json.MarshalIndent(report, "", "\t")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(stdout, string(out))
+	if importErr != nil {
+		return importErr
+	}
+	if report.Failed > 0 {
+		return fmt.Errorf("%d of %d rows failed", report.Failed, report.Rows)
+	}
+	return nil
+}
+
+// exportCommand writes every user that hasn't been deleted to -o, or to stdout when it is left out
+func (app *App) exportCommand(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	format := flags.String("format", "", "csv or ndjson, taken from the -o extension or ndjson when left out")
+	path := flags.String("o", "", "file to write, stdout when left out")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 0 {
+		return fmt.Errorf("usage: export [-format csv|ndjson] [-o FILE]")
+	}
+
+	output := stdout
+	if *path != "" {
+		file, err := os.Create(*path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		output = file
+		if *format == "" {
+			*format = strings.TrimPrefix(filepath.Ext(*path), ".")
+		}
+	}
+	if *format == "" {
+		*format = models.FormatNDJSON
+	}
+	parsedFormat, err := models.ParseUserFileFormat(*format)
+	if err != nil {
+		return err
+	}
+
+	writer, err := models.NewUserWriter(output, parsedFormat)
+	if err != nil {
+		return err
+	}
+	exported := 0
+	err = app.userModel.ExportUsers(func(user *models.User) error {
+		exported++
+		return writer.Write(user)
+	})
+	if err != nil {
+		return err
+	}
+	err = writer.Flush()
+	if err != nil {
+		return err
+	}
+	if *path != "" {
+		fmt.Fprintln(stdout, "Exported", exported, "users to", *path)
+	}
+	return nil
+}
+
+// reencryptCommand seals every user's and invitation's emails with the first ENCRYPTION_KEYS key and recomputes their
+// index. Run it after turning encryption on for a store that already has users, the server refuses to start until it
+// has, and after putting a new master key in front, before the old one is removed.
+func (app *App) reencryptCommand(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("reencrypt", flag.ContinueOnError)
+	batchSize := flags.Int("batch-size", models.DefaultReencryptBatchSize, "rows per transaction")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 0 {
+		return fmt.Errorf("usage: reencrypt [-batch-size n]")
+	}
+	if *batchSize < 1 {
+		return fmt.Errorf("batch-size must be at least 1")
+	}
+
+	rewritten, err := app.userModel.ReencryptUsers(*batchSize)
+	if errors.Is(err, models.ErrEncryptionDisabled) {
+		return fmt.Errorf("%w, set ENCRYPTION_KEYS and ENCRYPTION_INDEX_KEY", err)
+	}
+	// batches that committed before a failure stay done, the next run skips them
+	fmt.Fprintln(stdout, "Re-encrypted", rewritten, "users and invitations")
+	return err
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"the_lonely_road/JWT"
+)
+
+type contextKey string
+
+const (
+	claimsContextKey    = contextKey("claims")
+	requestIDContextKey = contextKey("request_id")
+)
+
+// contextSetClaims returns a copy of the request carrying the authenticated user's token claims
+func (app *App) contextSetClaims(r *http.Request, claims *JWT.Claims) *http.Request {
+	ctx := context.WithValue(r.Context(), claimsContextKey, claims)
+	return r.WithContext(ctx)
+}
+
+// contextGetClaims should only be called behind requireAuthenticatedUser, missing claims are a programming error
+func (app *App) contextGetClaims(r *http.Request) *JWT.Claims {
+	claims, ok := r.Context().Value(claimsContextKey).(*JWT.Claims)
+	if !ok {
+		panic("missing claims in request context")
+	}
+	return claims
+}
+
+// contextSetSubject is shorthand for a request authenticated as the user with publicID and no permissions
+func (app *App) contextSetSubject(r *http.Request, publicID string) *http.Request {
+	return app.contextSetClaims(r, &JWT.Claims{Subject: publicID})
+}
+
+// contextGetSubject returns the public id of the signed-in user
+func (app *App) contextGetSubject(r *http.Request) string {
+	return app.contextGetClaims(r).Subject
+}
+
+// contextSetRequestID returns a copy of the request carrying the id the requestID middleware gave it
+func (app *App) contextSetRequestID(r *http.Request, id string) *http.Request {
+	ctx := context.WithValue(r.Context(), requestIDContextKey, id)
+	return r.WithContext(ctx)
+}
+
+// contextGetRequestID is empty for requests that didn't go through the requestID middleware
+func (app *App) contextGetRequestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDContextKey).(string)
+	return id
+}
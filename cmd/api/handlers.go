@@ -1,6 +1,7 @@
 package main
 
 import (
+	stdErrors "errors"
 	"fmt"
 	"net/http"
 	"the_lonely_road/JWT"
@@ -35,6 +36,8 @@ func (app *App) CreateUser(w http.ResponseWriter, r *http.Request) {
 	var payload struct {
 		Email    string
 		Password string
+		// Username is optional, it can also be set later through the profile
+		Username string
 	}
 
 	err := app.readJSON(w, r, &payload)
@@ -47,10 +50,11 @@ func (app *App) CreateUser(w http.ResponseWriter, r *http.Request) {
 	user := models.User{
 		Email:     payload.Email,
 		Password:  payload.Password,
+		Username:  payload.Username,
 		CreatedAt: time.Now(),
 	}
 
-	if models.ValidateUser(v, &user); !v.Valid() {
+	if models.ValidateUser(v, &user, app.Config.hasher); !v.Valid() {
 		v.AddError("message", errors.InvalidUser)
 		http.Error(w, v.Errors["message"], http.StatusBadRequest)
 		return
@@ -58,11 +62,23 @@ func (app *App) CreateUser(w http.ResponseWriter, r *http.Request) {
 
 	err = app.userModel.Insert(&user)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		switch {
+		case stdErrors.Is(err, models.ErrDuplicateUsername):
+			http.Error(w, errors.UsernameTaken, http.StatusConflict)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	app.audit(r, models.AuditEvent{Type: models.AuditUserCreated, ActorID: user.PublicID, SubjectID: user.PublicID, Email: user.Email})
+
+	membership, err := app.orgMembership(&user, "")
+	if err != nil {
+		http.Error(w, errors.InternalServerError, http.StatusInternalServerError)
 		return
 	}
 
-	jwt, err := JWT.GenerateJWT(int(user.ID))
+	jwt, err := JWT.GenerateJWTWithClaims(app.userClaims(&user, membership))
 	if err != nil {
 		http.Error(w, errors.InternalServerError, http.StatusInternalServerError)
 		return
@@ -112,6 +128,8 @@ func (app *App) updateUserPassword(w http.ResponseWriter, r *http.Request) {
 
 	var payload struct {
 		Email string
+		// Channel is email, the default, or sms to text a code to the verified phone instead
+		Channel string
 	}
 	v := validator.New()
 
@@ -125,22 +143,44 @@ func (app *App) updateUserPassword(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, v.Errors["message"], http.StatusBadRequest)
 		return
 	}
+	if !validator.PermittedValue(payload.Channel, "", "email", "sms") {
+		http.Error(w, errors.InvalidResetChannel, http.StatusBadRequest)
+		return
+	}
 	user, err := app.userModel.GetByEmail(payload.Email)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if !app.ifMatch(r, app.userETag(user)) {
+		http.Error(w, errors.PreconditionFailed, http.StatusPreconditionFailed)
+		return
+	}
+	if payload.Channel == "sms" {
+		// a texted code is kept apart from the user, so the row and its tag stay as they are
+		w.Header().Set("ETag", app.userETag(user))
+		app.requestSMSPasswordReset(w, r, user)
+		return
+	}
 	passwordToken, salt, err := token.GenerateTokenAndSalt(32, 16)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	hashedToken := token.HashToken(passwordToken, salt)
-	err = app.userModel.EnterPasswordHash(user.Email, hashedToken, salt)
+	version := user.Version
+	err = app.userModel.EnterPasswordHash(user.Email, hashedToken, salt, version)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		switch {
+		case stdErrors.Is(err, models.ErrEditConflict):
+			app.editConflict(w, r)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
 		return
 	}
+	w.Header().Set("ETag", app.writtenETag(version))
+	app.audit(r, models.AuditEvent{Type: models.AuditPasswordResetRequested, SubjectID: user.PublicID, Email: user.Email})
 	// send email with token
 	app.background(func() {
 		err = app.emailer.ForgotPassword(user.Email, fmt.Sprintf("localhost:8080/users/password/reset?token=%s", passwordToken))
@@ -156,45 +196,88 @@ func (app *App) updateUserPassword(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// ProcessPasswordReset sets a new password with the token from the reset email, or with the code texted instead
 func (app *App) ProcessPasswordReset(w http.ResponseWriter, r *http.Request) {
 	var payload struct {
 		Email    string
 		Password string
+		// Code is the texted code when the reset was asked for over SMS, the token is ignored then
+		Code string
 	}
 	passwordToken := r.URL.Query().Get("token")
+	v := validator.New()
 	err := app.readJSON(w, r, &payload)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if models.ValidatePasswordPlaintext(v, payload.Password, app.Config.hasher); !v.Valid() {
+		v.AddError("message", errors.InvalidPassword)
+		http.Error(w, v.Errors["message"], http.StatusBadRequest)
+		return
+	}
 
 	user, err := app.userModel.GetByEmail(payload.Email)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-
-	if user.PasswordResetExpiry.Before(time.Now()) {
-		http.Error(w, errors.PasswordResetExpired, http.StatusBadRequest)
+	if !app.ifMatch(r, app.userETag(user)) {
+		http.Error(w, errors.PreconditionFailed, http.StatusPreconditionFailed)
 		return
 	}
 
-	ok := token.IsValidToken(passwordToken, user.PasswordResetHashToken, user.PasswordResetSalt)
-	if !ok {
-		http.Error(w, errors.InvalidToken, http.StatusBadRequest)
-		return
+	var smsCode *models.SMSCode
+	if payload.Code != "" {
+		smsCode, err = app.checkSMSCode(user.ID, models.SMSCodePasswordReset, payload.Code)
+		if err != nil {
+			app.audit(r, models.AuditEvent{Type: models.AuditPasswordResetFailed, SubjectID: user.PublicID, Email: user.Email,
+				Method: models.ResetMethodSMS})
+			app.smsCodeRefused(w, err)
+			return
+		}
+	} else {
+		if user.PasswordResetExpiry.Before(time.Now()) {
+			app.audit(r, models.AuditEvent{Type: models.AuditPasswordResetFailed, SubjectID: user.PublicID, Email: user.Email})
+			http.Error(w, errors.PasswordResetExpired, http.StatusBadRequest)
+			return
+		}
+
+		ok := token.IsValidToken(passwordToken, user.PasswordResetHashToken, user.PasswordResetSalt)
+		if !ok {
+			app.audit(r, models.AuditEvent{Type: models.AuditPasswordResetFailed, SubjectID: user.PublicID, Email: user.Email})
+			http.Error(w, errors.InvalidToken, http.StatusBadRequest)
+			return
+		}
 	}
 
-	err = app.userModel.UpdatePassword(int(user.ID), payload.Password)
+	version := user.Version
+	err = app.userModel.ResetPassword(int(user.ID), payload.Password, version)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		switch {
+		case stdErrors.Is(err, models.ErrPasswordReused):
+			v.AddError("message", errors.PasswordReused)
+			http.Error(w, v.Errors["message"], http.StatusBadRequest)
+		case stdErrors.Is(err, models.ErrEditConflict):
+			app.editConflict(w, r)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
 		return
 	}
-	err = app.userModel.ConsumePasswordReset(user.Email)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	if smsCode != nil {
+		// the version check in ResetPassword already stopped the code being used twice at once
+		err = app.userModel.DeleteSMSCode(int(smsCode.ID))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		app.audit(r, models.AuditEvent{Type: models.AuditPasswordReset, SubjectID: user.PublicID, Email: user.Email,
+			Method: models.ResetMethodSMS})
+	} else {
+		app.audit(r, models.AuditEvent{Type: models.AuditPasswordReset, SubjectID: user.PublicID, Email: user.Email})
 	}
+	w.Header().Set("ETag", app.writtenETag(version))
 	err = app.writeJSON(w, 200, "Password updated successfully")
 	if err != nil {
 		http.Error(w, errors.JsonWriteError, http.StatusInternalServerError)
@@ -203,10 +286,56 @@ func (app *App) ProcessPasswordReset(w http.ResponseWriter, r *http.Request) {
 
 }
 
+// authenticate checks a password through the model and emails the owner when the attempt locks their account.
+// login is an email address or a username.
+func (app *App) authenticate(login, password string) (*models.User, error) {
+	user, err := app.userModel.Authenticate(login, password)
+	if stdErrors.Is(err, models.ErrTooManyAttempts) {
+		lockedUntil := time.Now().Add(app.Config.lockout.LockDuration)
+		app.background(func() {
+			// mail the address as the owner wrote it rather than what they typed at the login form
+			owner, err := app.userByLogin(login)
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+			err = app.emailer.AccountLocked(owner.Email, lockedUntil)
+			if err != nil {
+				fmt.Println(err)
+			}
+		})
+	}
+	return user, err
+}
+
+// userByLogin finds the account a sign in names, usernames can't contain @ so anything with one is an email
+func (app *App) userByLogin(login string) (*models.User, error) {
+	if models.IsEmailLogin(login) {
+		return app.userModel.GetByEmail(login)
+	}
+	return app.userModel.GetByUsername(login)
+}
+
+// authenticationFailed tells throttled and locked accounts apart from a wrong password
+func (app *App) authenticationFailed(w http.ResponseWriter, err error) {
+	switch {
+	case stdErrors.Is(err, models.ErrLoginThrottled):
+		http.Error(w, errors.LoginThrottled, http.StatusTooManyRequests)
+	case stdErrors.Is(err, models.ErrAccountLocked), stdErrors.Is(err, models.ErrTooManyAttempts):
+		http.Error(w, errors.AccountLocked, http.StatusLocked)
+	default:
+		http.Error(w, errors.InvalidCredentials, http.StatusBadRequest)
+	}
+}
+
 func (app *App) Authenticate(w http.ResponseWriter, r *http.Request) {
 	var payload struct {
+		// Email or Username names the account, Email wins when both are given
 		Email    string
+		Username string
 		Password string
+		// Org is the slug of the organization to sign in to, the default organization when empty
+		Org string
 	}
 	v := validator.New()
 
@@ -215,23 +344,44 @@ func (app *App) Authenticate(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	if models.ValidateEmail(v, payload.Email); !v.Valid() {
+	login := payload.Email
+	if login == "" && payload.Username != "" {
+		login = payload.Username
+		if !validator.Matches(login, validator.UsernameRX) {
+			http.Error(w, errors.InvalidLogin, http.StatusBadRequest)
+			return
+		}
+	} else if models.ValidateEmail(v, login); !v.Valid() {
 		v.AddError("message", errors.InvalidUser)
 		http.Error(w, v.Errors["message"], http.StatusBadRequest)
 		return
 	}
 
-	user, err := app.userModel.Authenticate(payload.Email, payload.Password)
+	user, err := app.authenticate(login, payload.Password)
 	if err != nil {
-		http.Error(w, errors.InvalidCredentials, http.StatusBadRequest)
+		app.auditLogin(r, models.AuditEvent{Type: models.AuditLoginFailed, Method: models.LoginMethodPassword}, login)
+		app.authenticationFailed(w, err)
 		return
 	}
 
-	jwt, err := JWT.GenerateJWT(int(user.ID))
+	membership, err := app.orgMembership(user, payload.Org)
+	if err != nil {
+		switch {
+		case stdErrors.Is(err, models.ErrNotMember):
+			http.Error(w, errors.NotOrgMember, http.StatusForbidden)
+		default:
+			http.Error(w, errors.InternalServerError, http.StatusInternalServerError)
+		}
+		return
+	}
+
+	jwt, err := JWT.GenerateJWTWithClaims(app.userClaims(user, membership))
 	if err != nil {
 		http.Error(w, errors.InternalServerError, http.StatusInternalServerError)
 		return
 	}
+	app.audit(r, models.AuditEvent{Type: models.AuditLoginSucceeded, ActorID: user.PublicID, SubjectID: user.PublicID, Email: user.Email,
+		Method: models.LoginMethodPassword})
 
 	// Set the token in a cookie
 	JWT.SetAuthCookie(w, jwt)
@@ -249,6 +399,12 @@ func (app *App) SignOut(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, errors.Unauthorized, http.StatusUnauthorized)
 		return
 	}
+	// an expired token still signs out, the event just can't say who it was
+	event := models.AuditEvent{Type: models.AuditSignedOut}
+	if claims, err := JWT.ParseJWT(cookie.Value); err == nil {
+		event.ActorID, event.SubjectID = claims.Subject, claims.Subject
+	}
+	app.audit(r, event)
 	JWT.DeleteAuthCookie(w, cookie)
 	err = app.writeJSON(w, 200, "Successfully signed out")
 	if err != nil {
@@ -256,3 +412,374 @@ func (app *App) SignOut(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 }
+
+// getCurrentUser returns the profile of the signed-in user
+func (app *App) getCurrentUser(w http.ResponseWriter, r *http.Request) {
+	user, err := app.userModel.GetByPublicID(app.contextGetSubject(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("ETag", app.userETag(user))
+	err = app.writeJSON(w, http.StatusOK, &user)
+	if err != nil {
+		http.Error(w, errors.JsonWriteError, http.StatusInternalServerError)
+		return
+	}
+}
+
+// updateCurrentUserProfile applies a partial update, fields left out of the body keep their current values
+func (app *App) updateCurrentUserProfile(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		DisplayName *string `json:"display_name"`
+		GivenName   *string `json:"given_name"`
+		FamilyName  *string `json:"family_name"`
+		Locale      *string `json:"locale"`
+		TimeZone    *string `json:"time_zone"`
+		Username    *string `json:"username"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	user, err := app.userModel.GetByPublicID(app.contextGetSubject(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if !app.ifMatch(r, app.userETag(user)) {
+		http.Error(w, errors.PreconditionFailed, http.StatusPreconditionFailed)
+		return
+	}
+
+	if payload.DisplayName != nil {
+		user.DisplayName = *payload.DisplayName
+	}
+	if payload.GivenName != nil {
+		user.GivenName = *payload.GivenName
+	}
+	if payload.FamilyName != nil {
+		user.FamilyName = *payload.FamilyName
+	}
+	if payload.Locale != nil {
+		user.Locale = *payload.Locale
+	}
+	if payload.TimeZone != nil {
+		user.TimeZone = *payload.TimeZone
+	}
+	if payload.Username != nil {
+		user.Username = *payload.Username
+	}
+
+	v := validator.New()
+	if models.ValidateProfile(v, user); !v.Valid() {
+		v.AddError("message", errors.InvalidProfile)
+		http.Error(w, v.Errors["message"], http.StatusBadRequest)
+		return
+	}
+
+	err = app.userModel.UpdateProfile(user)
+	if err != nil {
+		switch {
+		case stdErrors.Is(err, models.ErrEditConflict):
+			app.editConflict(w, r)
+		case stdErrors.Is(err, models.ErrDuplicateUsername):
+			http.Error(w, errors.UsernameTaken, http.StatusConflict)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("ETag", app.userETag(user))
+	err = app.writeJSON(w, http.StatusOK, &user)
+	if err != nil {
+		http.Error(w, errors.JsonWriteError, http.StatusInternalServerError)
+		return
+	}
+}
+
+// editConflict answers a write that lost a race with another one. A client that sent If-Match asked for the
+// precondition, so it gets 412; anyone else gets 409.
+func (app *App) editConflict(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("If-Match") != "" {
+		http.Error(w, errors.PreconditionFailed, http.StatusPreconditionFailed)
+		return
+	}
+	http.Error(w, errors.EditConflict, http.StatusConflict)
+}
+
+// requestEmailChange re-checks the password, then mails a confirmation link to the new address and a cancel link to the old one
+func (app *App) requestEmailChange(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Email    string
+		Password string
+	}
+	v := validator.New()
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if models.ValidateEmail(v, payload.Email); !v.Valid() {
+		v.AddError("message", errors.InvalidUser)
+		http.Error(w, v.Errors["message"], http.StatusBadRequest)
+		return
+	}
+
+	user, err := app.userModel.GetByPublicID(app.contextGetSubject(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if !app.ifMatch(r, app.userETag(user)) {
+		http.Error(w, errors.PreconditionFailed, http.StatusPreconditionFailed)
+		return
+	}
+	if models.CanonicalEmail(payload.Email) == models.CanonicalEmail(user.Email) {
+		http.Error(w, errors.SameEmail, http.StatusBadRequest)
+		return
+	}
+
+	_, err = app.authenticate(user.Email, payload.Password)
+	if err != nil {
+		app.authenticationFailed(w, err)
+		return
+	}
+
+	// catch the obvious conflict now, ConfirmEmailChange still guards against someone signing up in the meantime
+	_, err = app.userModel.GetByEmail(payload.Email)
+	if err == nil {
+		http.Error(w, models.ErrDuplicateEmail.Error(), http.StatusConflict)
+		return
+	}
+
+	changeToken, salt, err := token.GenerateTokenAndSalt(32, 16)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// the old address gets a token of its own, one that can only cancel
+	cancelToken, cancelSalt, err := token.GenerateTokenAndSalt(32, 16)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	version := user.Version
+	err = app.userModel.RequestEmailChange(int(user.ID), payload.Email, token.HashToken(changeToken, salt), salt,
+		token.HashToken(cancelToken, cancelSalt), cancelSalt)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("ETag", app.writtenETag(version))
+
+	oldEmail := user.Email
+	app.background(func() {
+		err := app.emailer.ConfirmEmailChange(payload.Email, fmt.Sprintf("localhost:8080/users/me/email/confirm?token=%s", changeToken))
+		if err != nil {
+			fmt.Println(err)
+		}
+		err = app.emailer.EmailChangeNotice(oldEmail, payload.Email, fmt.Sprintf("localhost:8080/users/email/cancel?token=%s", cancelToken))
+		if err != nil {
+			fmt.Println(err)
+		}
+	})
+
+	err = app.writeJSON(w, http.StatusAccepted, errors.EmailChangeEmail)
+	if err != nil {
+		http.Error(w, errors.JsonWriteError, http.StatusInternalServerError)
+		return
+	}
+}
+
+// confirmEmailChange consumes the token from the confirmation email and switches the users email over. The token comes
+// in the body so it stays out of access logs.
+func (app *App) confirmEmailChange(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Token string
+	}
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	user, err := app.userModel.GetByPublicID(app.contextGetSubject(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if user.PendingEmail == "" {
+		http.Error(w, errors.NoPendingEmail, http.StatusBadRequest)
+		return
+	}
+	if user.EmailChangeExpiry.Before(time.Now()) {
+		http.Error(w, errors.EmailChangeExpired, http.StatusBadRequest)
+		return
+	}
+	ok := token.IsValidToken(payload.Token, user.EmailChangeHashToken, user.EmailChangeSalt)
+	if !ok {
+		http.Error(w, errors.InvalidToken, http.StatusBadRequest)
+		return
+	}
+
+	err = app.userModel.ConfirmEmailChange(int(user.ID))
+	if err != nil {
+		switch {
+		case stdErrors.Is(err, models.ErrDuplicateEmail):
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	user, err = app.userModel.GetByID(int(user.ID))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, &user)
+	if err != nil {
+		http.Error(w, errors.JsonWriteError, http.StatusInternalServerError)
+		return
+	}
+}
+
+// cancelEmailChange is linked from the notice sent to the old address, so it works without signing in
+func (app *App) cancelEmailChange(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Email string
+	}
+	cancelToken := r.URL.Query().Get("token")
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	user, err := app.userModel.GetByEmail(payload.Email)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if user.PendingEmail == "" {
+		http.Error(w, errors.NoPendingEmail, http.StatusBadRequest)
+		return
+	}
+	ok := token.IsValidToken(cancelToken, user.EmailChangeCancelHashToken, user.EmailChangeCancelSalt)
+	if !ok {
+		http.Error(w, errors.InvalidToken, http.StatusBadRequest)
+		return
+	}
+
+	err = app.userModel.CancelEmailChange(int(user.ID))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, errors.EmailChangeCancelled)
+	if err != nil {
+		http.Error(w, errors.JsonWriteError, http.StatusInternalServerError)
+		return
+	}
+}
+
+// deleteCurrentUser soft deletes the signed-in account after re-checking the password and mails a restore link
+func (app *App) deleteCurrentUser(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Password string
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	user, err := app.userModel.GetByPublicID(app.contextGetSubject(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	_, err = app.authenticate(user.Email, payload.Password)
+	if err != nil {
+		app.authenticationFailed(w, err)
+		return
+	}
+
+	restoreToken, salt, err := token.GenerateTokenAndSalt(32, 16)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	restoreDays := app.Config.accountDeletion.restoreDays
+	restoreExpiry := time.Now().AddDate(0, 0, restoreDays)
+	err = app.userModel.SoftDeleteUser(int(user.ID), token.HashToken(restoreToken, salt), salt, restoreExpiry)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// the account is gone as far as the client is concerned, so drop the session too
+	JWT.DeleteAuthCookie(w, nil)
+
+	app.background(func() {
+		err := app.emailer.AccountDeleted(user.Email, fmt.Sprintf("localhost:8080/users/restore?token=%s", restoreToken), restoreDays)
+		if err != nil {
+			fmt.Println(err)
+		}
+	})
+
+	err = app.writeJSON(w, http.StatusOK, errors.AccountDeleted)
+	if err != nil {
+		http.Error(w, errors.JsonWriteError, http.StatusInternalServerError)
+		return
+	}
+}
+
+// restoreUser brings back a soft deleted account as long as the restore link hasn't expired
+func (app *App) restoreUser(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Email string
+	}
+	restoreToken := r.URL.Query().Get("token")
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	user, err := app.userModel.GetDeletedByEmail(payload.Email)
+	if err != nil {
+		http.Error(w, errors.AccountNotDeleted, http.StatusBadRequest)
+		return
+	}
+	if user.RestoreExpiry.Before(time.Now()) {
+		http.Error(w, errors.RestoreExpired, http.StatusBadRequest)
+		return
+	}
+	ok := token.IsValidToken(restoreToken, user.RestoreHashToken, user.RestoreSalt)
+	if !ok {
+		http.Error(w, errors.InvalidToken, http.StatusBadRequest)
+		return
+	}
+
+	err = app.userModel.RestoreUser(int(user.ID))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, errors.AccountRestored)
+	if err != nil {
+		http.Error(w, errors.JsonWriteError, http.StatusInternalServerError)
+		return
+	}
+}
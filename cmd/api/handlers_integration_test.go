@@ -428,7 +428,11 @@ func TestApp_ProcessPasswordResetIntegration(t *testing.T) {
 			t.Errorf("Expected no error, got %s", err)
 		}
 		hashedToken := token.HashToken(hash, salt)
-		err = app.userModel.EnterPasswordHash("admin@localhost", hashedToken, salt)
+		admin, err := app.userModel.GetByEmail("admin@localhost")
+		if err != nil {
+			t.Fatalf("Expected no error, got %s", err)
+		}
+		err = app.userModel.EnterPasswordHash("admin@localhost", hashedToken, salt, admin.Version)
 		if err != nil {
 			t.Errorf("Expected no error, got %s", err)
 		}
@@ -472,7 +476,11 @@ func TestApp_ProcessPasswordResetIntegration(t *testing.T) {
 			t.Errorf("Expected no error, got %s", err)
 		}
 		hashedToken := token.HashToken(hash, salt)
-		err = app.userModel.EnterPasswordHash("admin@localhost", hashedToken, salt)
+		admin, err := app.userModel.GetByEmail("admin@localhost")
+		if err != nil {
+			t.Fatalf("Expected no error, got %s", err)
+		}
+		err = app.userModel.EnterPasswordHash("admin@localhost", hashedToken, salt, admin.Version)
 		if err != nil {
 			t.Errorf("Expected no error, got %s", err)
 		}
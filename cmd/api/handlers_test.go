@@ -82,9 +82,9 @@ func TestApp_CreateUser(t *testing.T) {
 		if err != nil {
 			t.Errorf("Error unmarshaling JSON: %v", err)
 		}
-		// we aren't setting the id in the handler it's scanned by postgres so the id will always be 0
-		if response.ID != 0 {
-			t.Errorf("Expected ID to be 0, got %d", response.ID)
+		// the integer key stays internal, only the public id is sent back
+		if !validator.Matches(response.PublicID, validator.UUIDRX) {
+			t.Errorf("Expected a public id, got %q", response.PublicID)
 		}
 
 		if response.Email != "test@example.com" {
@@ -127,6 +127,12 @@ func TestApp_CreateUser_SadPaths(t *testing.T) {
 			expectedCode:  http.StatusBadRequest,
 			expectedError: "User password must be 4 characters long and email must be 5 characters long\n",
 		},
+		{
+			name:          "Bad email that looks encrypted",
+			payload:       []byte(`{"email": "enc:v1:a:b:c", "password": "securepassword"}`),
+			expectedCode:  http.StatusBadRequest,
+			expectedError: "User password must be 4 characters long and email must be 5 characters long\n",
+		},
 	}
 	app := App{userModel: &models.UserModelMock{DB: []*models.User{}}}
 	for _, test := range tests {
@@ -154,7 +160,7 @@ func TestApp_CreateUser_SadPaths(t *testing.T) {
 				t.Errorf("Expected status code %d, got %d", test.expectedCode, rr.Code)
 			}
 
-			if test.name == "Bad json" || test.name == "Bad email" {
+			if test.name == "Bad json" || strings.HasPrefix(test.name, "Bad email") {
 				var response models.User
 				err = json.Unmarshal(rr.Body.Bytes(), &response)
 				if err == nil {
@@ -181,6 +187,24 @@ func TestApp_CreateUser_SadPaths(t *testing.T) {
 	}
 }
 
+func TestApp_CreateUser_DuplicateUsername(t *testing.T) {
+	app := App{userModel: &models.UserModelMock{DB: []*models.User{{ID: 1, Email: "alice@example.com", Username: "Alice_W"}}}}
+	req, err := http.NewRequest("POST", "/users", bytes.NewBuffer([]byte(`{"email": "test@example.com", "password": "securepassword", "username": "alice_w"}`)))
+	if err != nil {
+		t.Errorf("Unexpected error in creating HTTP request: %v", err)
+	}
+	rr := httptest.NewRecorder()
+
+	app.CreateUser(rr, req)
+	if rr.Code != http.StatusConflict {
+		t.Errorf("Expected status code %d, got %d", http.StatusConflict, rr.Code)
+	}
+	if rr.Body.String() != errors.UsernameTaken+"\n" {
+		t.Errorf("Expected '%s', but got '%s'", errors.UsernameTaken, rr.Body.String())
+	}
+	app.checkMockDBSize(t, 1)
+}
+
 func TestApp_getUserByEmail(t *testing.T) {
 	app := App{userModel: &models.UserModelMock{DB: []*models.User{}}}
 	user := models.User{
@@ -413,7 +437,7 @@ func TestApp_ProcessPasswordReset(t *testing.T) {
 			t.Errorf("Unexpected error in get request to /users")
 		}
 		hashedToken := token.HashToken(passwordToken, salt)
-		err = mockModel.EnterPasswordHash(testUser.Email, hashedToken, salt)
+		err = mockModel.EnterPasswordHash(testUser.Email, hashedToken, salt, testUser.Version)
 		if err != nil {
 			t.Errorf("Unexpected error in get request to /users")
 		}
@@ -440,6 +464,68 @@ func TestApp_ProcessPasswordReset(t *testing.T) {
 	})
 }
 
+func TestApp_ProcessPasswordReset_IfMatch(t *testing.T) {
+	tests := []struct {
+		name         string
+		ifMatch      func(current string) string
+		expectedCode int
+	}{
+		{name: "Current tag", ifMatch: func(current string) string { return current }, expectedCode: http.StatusOK},
+		{name: "Stale tag", ifMatch: func(string) string { return `"0"` }, expectedCode: http.StatusPreconditionFailed},
+		{name: "One of several tags", ifMatch: func(current string) string { return `"0", ` + current }, expectedCode: http.StatusOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mockModel := &models.UserModelMock{DB: []*models.User{}}
+			app := App{userModel: mockModel}
+			err := mockModel.Insert(&models.User{Email: "test@example.com", Password: "secret", CreatedAt: time.Now()})
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			user, _ := mockModel.GetByEmail("test@example.com")
+			passwordToken, salt, err := token.GenerateTokenAndSalt(32, 16)
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			err = mockModel.EnterPasswordHash(user.Email, token.HashToken(passwordToken, salt), salt, user.Version)
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			current := app.userETag(user)
+
+			payload := []byte(`{"email": "test@example.com", "password": "securepassword"}`)
+			req := httptest.NewRequest("POST", "/users/password/reset?token="+passwordToken, bytes.NewBuffer(payload))
+			req.Header.Set("If-Match", test.ifMatch(current))
+			rr := httptest.NewRecorder()
+			app.ProcessPasswordReset(rr, req)
+
+			if rr.Code != test.expectedCode {
+				t.Fatalf("Expected status code %d, got %d: %s", test.expectedCode, rr.Code, rr.Body.String())
+			}
+			if test.expectedCode == http.StatusPreconditionFailed {
+				if !strings.Contains(rr.Body.String(), errors.PreconditionFailed) {
+					t.Errorf("Expected body to contain '%s', got '%s'", errors.PreconditionFailed, rr.Body.String())
+				}
+				if _, err := mockModel.Authenticate("test@example.com", "secret"); err != nil {
+					t.Errorf("Expected the old password to still work, got %s", err)
+				}
+				if rr.Header().Get("ETag") != "" {
+					t.Errorf("Expected no ETag on a refused write, got %s", rr.Header().Get("ETag"))
+				}
+				return
+			}
+			if _, err := mockModel.Authenticate("test@example.com", "securepassword"); err != nil {
+				t.Errorf("Expected the new password to work, got %s", err)
+			}
+			stored, _ := mockModel.GetByEmail("test@example.com")
+			if got := rr.Header().Get("ETag"); got != app.userETag(stored) || got == current {
+				t.Errorf("Expected the ETag of the written user %s, got %s", app.userETag(stored), got)
+			}
+		})
+	}
+}
+
 func TestProcessPasswordReset_SadPaths(t *testing.T) {
 	tests := []struct {
 		name          string
@@ -462,6 +548,13 @@ func TestProcessPasswordReset_SadPaths(t *testing.T) {
 			expectedCode:  http.StatusBadRequest,
 			expectedError: "record not found",
 		},
+		{
+			name:          "Deleted user",
+			token:         "valid_token",
+			payload:       []byte(`{"email": "deleted@example.com", "password": "securepassword"}`),
+			expectedCode:  http.StatusBadRequest,
+			expectedError: "record not found",
+		},
 		{
 			name:          "Expired token",
 			token:         "expired_token",
@@ -476,6 +569,13 @@ func TestProcessPasswordReset_SadPaths(t *testing.T) {
 			expectedCode:  http.StatusBadRequest,
 			expectedError: "Invalid Token",
 		},
+		{
+			name:          "Password too short",
+			token:         "valid_token",
+			payload:       []byte(`{"email": "test@example.com", "password": "abc"}`),
+			expectedCode:  http.StatusBadRequest,
+			expectedError: errors.InvalidPassword,
+		},
 	}
 
 	app := App{userModel: &models.UserModelMock{DB: []*models.User{}}}
@@ -490,7 +590,8 @@ func TestProcessPasswordReset_SadPaths(t *testing.T) {
 	if !ok {
 		t.Errorf("Expected app.userModel to be of type UserModelMock")
 	}
-	mockModel.DB = append(mockModel.DB, &user)
+	deletedAt := time.Now()
+	mockModel.DB = append(mockModel.DB, &user, &models.User{ID: 2, Email: "deleted@example.com", CreatedAt: time.Now(), DeletedAt: &deletedAt})
 
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
@@ -500,7 +601,7 @@ func TestProcessPasswordReset_SadPaths(t *testing.T) {
 				t.Errorf("Unexpected error in hashing token")
 			}
 			hashedToken := token.HashToken(passwordToken, salt)
-			err = mockModel.EnterPasswordHash(user.Email, hashedToken, salt)
+			err = mockModel.EnterPasswordHash(user.Email, hashedToken, salt, user.Version)
 			if err != nil {
 				t.Errorf("Unexpected error in entering password hash")
 			}
@@ -536,12 +637,66 @@ func TestProcessPasswordReset_SadPaths(t *testing.T) {
 	}
 }
 
+func TestApp_ProcessPasswordReset_Reuse(t *testing.T) {
+	app := App{userModel: &models.UserModelMock{DB: []*models.User{}, PasswordHistory: 1}}
+	err := app.userModel.Insert(&models.User{ID: 1, Password: "first-password", Email: "test@example.com", CreatedAt: time.Now()})
+	if err != nil {
+		t.Fatalf("Unexpected error in inserting user")
+	}
+
+	tests := []struct {
+		name          string
+		password      string
+		expectedCode  int
+		expectedError string
+	}{
+		{name: "Current password", password: "first-password", expectedCode: http.StatusBadRequest, expectedError: errors.PasswordReused},
+		{name: "New password", password: "second-password", expectedCode: http.StatusOK},
+		{name: "Previous password", password: "first-password", expectedCode: http.StatusBadRequest, expectedError: errors.PasswordReused},
+		{name: "Another new password", password: "third-password", expectedCode: http.StatusOK},
+		{name: "Forgotten password", password: "first-password", expectedCode: http.StatusOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			passwordToken, salt, err := token.GenerateTokenAndSalt(32, 16)
+			if err != nil {
+				t.Errorf("Unexpected error in hashing token")
+			}
+			user, err := app.userModel.GetByEmail("test@example.com")
+			if err != nil {
+				t.Fatalf("Unexpected error in getting user: %s", err)
+			}
+			err = app.userModel.EnterPasswordHash(user.Email, token.HashToken(passwordToken, salt), salt, user.Version)
+			if err != nil {
+				t.Errorf("Unexpected error in entering password hash")
+			}
+
+			payload := []byte(`{"email": "test@example.com", "password": "` + test.password + `"}`)
+			req, err := http.NewRequest("POST", "/users/password/reset?token="+passwordToken, bytes.NewBuffer(payload))
+			if err != nil {
+				t.Errorf("Unexpected error in creating HTTP request: %v", err)
+			}
+			rr := httptest.NewRecorder()
+
+			app.ProcessPasswordReset(rr, req)
+			if rr.Code != test.expectedCode {
+				t.Errorf("Expected status code %d, got %d", test.expectedCode, rr.Code)
+			}
+			if !strings.Contains(rr.Body.String(), test.expectedError) {
+				t.Errorf("Expected body to contain '%s', but got '%s'", test.expectedError, rr.Body.String())
+			}
+		})
+	}
+}
+
 func TestApp_Authenticate(t *testing.T) {
 	app := App{userModel: &models.UserModelMock{DB: []*models.User{}}}
 	user := models.User{
 		ID:        1,
 		Password:  "admin",
 		Email:     "admin@admin.com",
+		Username:  "Admin_1",
 		CreatedAt: time.Now(),
 	}
 
@@ -579,6 +734,67 @@ func TestApp_Authenticate(t *testing.T) {
 		}
 
 	})
+	t.Run("Username", func(t *testing.T) {
+		testPayload := []byte(`{"username": "admin_1", "password": "admin"}`)
+		req, err := http.NewRequest("POST", "/users/login", bytes.NewBuffer(testPayload))
+		if err != nil {
+			t.Errorf("Unexpected error in POST request to /users/login")
+		}
+		rr := httptest.NewRecorder()
+
+		app.Authenticate(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Errorf("Expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+		var responseUser models.User
+		err = json.Unmarshal(rr.Body.Bytes(), &responseUser)
+		if err != nil {
+			t.Errorf("Error unmarshaling JSON: %v", err)
+		}
+		if responseUser.Email != user.Email || responseUser.Username != "Admin_1" {
+			t.Errorf("Expected %s signed in as Admin_1, got %+v", user.Email, responseUser)
+		}
+	})
+}
+
+func TestApp_Authenticate_Lockout(t *testing.T) {
+	app := App{userModel: &models.UserModelMock{DB: []*models.User{}, Lockout: models.LockoutPolicy{Threshold: 2, LockDuration: time.Hour}}}
+	app.Config.lockout = models.LockoutPolicy{Threshold: 2, LockDuration: time.Hour}
+	err := app.userModel.Insert(&models.User{ID: 1, Password: "admin", Email: "admin@admin.com", CreatedAt: time.Now()})
+	if err != nil {
+		t.Errorf("Unexpected error in inserting user")
+	}
+
+	tests := []struct {
+		name          string
+		password      string
+		expectedCode  int
+		expectedError string
+	}{
+		{name: "First failure", password: "wrong", expectedCode: http.StatusBadRequest, expectedError: errors.InvalidCredentials},
+		{name: "Failure that locks", password: "wrong", expectedCode: http.StatusLocked, expectedError: errors.AccountLocked},
+		{name: "Right password while locked", password: "admin", expectedCode: http.StatusLocked, expectedError: errors.AccountLocked},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			payload := []byte(`{"email": "admin@admin.com", "password": "` + test.password + `"}`)
+			req, err := http.NewRequest("POST", "/users/login", bytes.NewBuffer(payload))
+			if err != nil {
+				t.Errorf("Unexpected error in POST request to /users/login")
+			}
+			rr := httptest.NewRecorder()
+
+			app.Authenticate(rr, req)
+			if rr.Code != test.expectedCode {
+				t.Errorf("Expected status code %d, got %d", test.expectedCode, rr.Code)
+			}
+			if !strings.Contains(rr.Body.String(), test.expectedError) {
+				t.Errorf("Expected body to contain '%s', got '%s'", test.expectedError, rr.Body.String())
+			}
+		})
+	}
+	app.wg.Wait()
 }
 
 func TestApp_Authenticate_SadPaths(t *testing.T) {
@@ -619,7 +835,7 @@ func TestApp_Authenticate_SadPaths(t *testing.T) {
 		},
 		{
 			name:             "User not found",
-			payload:          []byte(`{"email": "notfound", "password": "admin"}`),
+			payload:          []byte(`{"email": "notfound@admin.com", "password": "admin"}`),
 			expectedCode:     http.StatusBadRequest,
 			expectedResponse: "Invalid Credentials\n",
 		},
@@ -629,6 +845,18 @@ func TestApp_Authenticate_SadPaths(t *testing.T) {
 			expectedCode:     http.StatusBadRequest,
 			expectedResponse: "Invalid Credentials\n",
 		},
+		{
+			name:             "Malformed username",
+			payload:          []byte(`{"username": "a b", "password": "admin"}`),
+			expectedCode:     http.StatusBadRequest,
+			expectedResponse: errors.InvalidLogin + "\n",
+		},
+		{
+			name:             "Unknown username",
+			payload:          []byte(`{"username": "nobody", "password": "admin"}`),
+			expectedCode:     http.StatusBadRequest,
+			expectedResponse: "Invalid Credentials\n",
+		},
 	}
 
 	for _, testCase := range testCases {
@@ -734,3 +962,624 @@ func (app *App) checkMockDBSize(t *testing.T, expected int) {
 		t.Errorf("Not enough users in database, expected %d, got %d", expected, len(mockModel.DB))
 	}
 }
+
+func TestApp_getCurrentUser(t *testing.T) {
+	app := App{userModel: &models.UserModelMock{DB: []*models.User{}}}
+	user := models.User{
+		ID:          1,
+		PublicID:    "0190a6e2-5c3b-7c1e-9f3a-2b4c6d8e0f12",
+		Password:    "secret",
+		Email:       "test@example.com",
+		DisplayName: "Test User",
+		CreatedAt:   time.Now(),
+		Version:     2,
+	}
+	mockModel, ok := app.userModel.(*models.UserModelMock)
+	if !ok {
+		t.Errorf("Expected app.userModel to be of type UserModelMock")
+	}
+	mockModel.DB = append(mockModel.DB, &user)
+
+	tests := []struct {
+		name         string
+		subject      string
+		expectedCode int
+	}{
+		{name: "Happy Path", subject: "0190a6e2-5c3b-7c1e-9f3a-2b4c6d8e0f12", expectedCode: http.StatusOK},
+		{name: "User not found", subject: "0190a6e2-5c3b-7c1e-9f3a-2b4c6d8e0f13", expectedCode: http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req, err := http.NewRequest("GET", "/users/me", nil)
+			if err != nil {
+				t.Errorf("Unexpected error in GET request to /users/me")
+			}
+			req = app.contextSetSubject(req, test.subject)
+			rr := httptest.NewRecorder()
+
+			app.getCurrentUser(rr, req)
+			if rr.Code != test.expectedCode {
+				t.Errorf("Expected status code %d, got %d", test.expectedCode, rr.Code)
+			}
+			if test.expectedCode != http.StatusOK {
+				return
+			}
+
+			var responseUser models.User
+			err = json.Unmarshal(rr.Body.Bytes(), &responseUser)
+			if err != nil {
+				t.Errorf("Error unmarshaling JSON: %v", err)
+			}
+			if responseUser.DisplayName != user.DisplayName {
+				t.Errorf("Expected display name %s, got %s", user.DisplayName, responseUser.DisplayName)
+			}
+			if etag := rr.Header().Get("ETag"); etag != `"2"` {
+				t.Errorf("Expected ETag %q, got %q", `"2"`, etag)
+			}
+		})
+	}
+}
+
+func TestApp_updateCurrentUserProfile(t *testing.T) {
+	tests := []struct {
+		name             string
+		payload          []byte
+		ifMatch          string
+		expectedCode     int
+		expectedResponse string
+	}{
+		{
+			name:             "Partial update",
+			payload:          []byte(`{"display_name": "Robbie", "time_zone": "America/New_York"}`),
+			expectedCode:     http.StatusOK,
+			expectedResponse: `"display_name":"Robbie"`,
+		},
+		{
+			name:             "Matching If-Match",
+			payload:          []byte(`{"display_name": "Robbie", "time_zone": "America/New_York"}`),
+			ifMatch:          `"1", "3"`,
+			expectedCode:     http.StatusOK,
+			expectedResponse: `"display_name":"Robbie"`,
+		},
+		{
+			name:             "Any version",
+			payload:          []byte(`{"display_name": "Robbie", "time_zone": "America/New_York"}`),
+			ifMatch:          "*",
+			expectedCode:     http.StatusOK,
+			expectedResponse: `"display_name":"Robbie"`,
+		},
+		{
+			name:             "Stale If-Match",
+			payload:          []byte(`{"display_name": "Robbie", "time_zone": "America/New_York"}`),
+			ifMatch:          `"2"`,
+			expectedCode:     http.StatusPreconditionFailed,
+			expectedResponse: errors.PreconditionFailed,
+		},
+		{
+			name:             "Bad time zone",
+			payload:          []byte(`{"time_zone": "Mars/Olympus_Mons"}`),
+			expectedCode:     http.StatusBadRequest,
+			expectedResponse: errors.InvalidProfile,
+		},
+		{
+			name:             "Bad locale",
+			payload:          []byte(`{"locale": "english please"}`),
+			expectedCode:     http.StatusBadRequest,
+			expectedResponse: errors.InvalidProfile,
+		},
+		{
+			name:             "Unknown field",
+			payload:          []byte(`{"email": "new@example.com"}`),
+			expectedCode:     http.StatusBadRequest,
+			expectedResponse: `body contains unknown key "email"`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			user := models.User{
+				ID:         1,
+				PublicID:   "0190a6e2-5c3b-7c1e-9f3a-2b4c6d8e0f12",
+				Password:   "secret",
+				Email:      "test@example.com",
+				GivenName:  "Rob",
+				FamilyName: "Bridges",
+				Locale:     "en-US",
+				CreatedAt:  time.Now(),
+				Version:    3,
+			}
+			app := App{userModel: &models.UserModelMock{DB: []*models.User{&user}}}
+
+			req, err := http.NewRequest("PATCH", "/users/me", bytes.NewBuffer(test.payload))
+			if err != nil {
+				t.Errorf("Unexpected error in PATCH request to /users/me")
+			}
+			if test.ifMatch != "" {
+				req.Header.Set("If-Match", test.ifMatch)
+			}
+			req = app.contextSetSubject(req, user.PublicID)
+			rr := httptest.NewRecorder()
+
+			app.updateCurrentUserProfile(rr, req)
+			if rr.Code != test.expectedCode {
+				t.Errorf("Expected status code %d, got %d", test.expectedCode, rr.Code)
+			}
+			if !strings.Contains(rr.Body.String(), test.expectedResponse) {
+				t.Errorf("Expected body to contain '%s', got '%s'", test.expectedResponse, rr.Body.String())
+			}
+			if test.expectedCode != http.StatusOK {
+				if user.Version != 3 || user.DisplayName != "" {
+					t.Errorf("Expected a refused update to leave the user alone, got %+v", user)
+				}
+				return
+			}
+			if etag := rr.Header().Get("ETag"); etag != `"4"` {
+				t.Errorf("Expected ETag %q, got %q", `"4"`, etag)
+			}
+
+			// fields that weren't sent should be left alone
+			if user.GivenName != "Rob" || user.FamilyName != "Bridges" || user.Locale != "en-US" {
+				t.Errorf("Expected untouched fields to keep their values, got %+v", user)
+			}
+			if user.TimeZone != "America/New_York" {
+				t.Errorf("Expected time zone to be updated, got %s", user.TimeZone)
+			}
+			if user.UpdatedAt.IsZero() {
+				t.Errorf("Expected updated_at to be set")
+			}
+		})
+	}
+}
+
+func TestApp_editConflict(t *testing.T) {
+	tests := []struct {
+		name          string
+		ifMatch       string
+		expectedCode  int
+		expectedError string
+	}{
+		{name: "Without If-Match", expectedCode: http.StatusConflict, expectedError: errors.EditConflict},
+		{name: "With If-Match", ifMatch: `"3"`, expectedCode: http.StatusPreconditionFailed, expectedError: errors.PreconditionFailed},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			app := App{}
+			req := httptest.NewRequest("PATCH", "/users/me", nil)
+			if test.ifMatch != "" {
+				req.Header.Set("If-Match", test.ifMatch)
+			}
+			rr := httptest.NewRecorder()
+
+			app.editConflict(rr, req)
+			if rr.Code != test.expectedCode {
+				t.Errorf("Expected status code %d, got %d", test.expectedCode, rr.Code)
+			}
+			if !strings.Contains(rr.Body.String(), test.expectedError) {
+				t.Errorf("Expected body to contain '%s', got '%s'", test.expectedError, rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestApp_requestEmailChange(t *testing.T) {
+	tests := []struct {
+		name             string
+		payload          []byte
+		expectedCode     int
+		expectedResponse string
+	}{
+		{
+			name:             "Happy Path",
+			payload:          []byte(`{"email": "new@example.com", "password": "securepassword"}`),
+			expectedCode:     http.StatusAccepted,
+			expectedResponse: errors.EmailChangeEmail,
+		},
+		{
+			name:             "Wrong password",
+			payload:          []byte(`{"email": "new@example.com", "password": "wrongpassword"}`),
+			expectedCode:     http.StatusBadRequest,
+			expectedResponse: errors.InvalidCredentials,
+		},
+		{
+			name:             "Same email",
+			payload:          []byte(`{"email": "test@example.com", "password": "securepassword"}`),
+			expectedCode:     http.StatusBadRequest,
+			expectedResponse: errors.SameEmail,
+		},
+		{
+			name:             "Email taken",
+			payload:          []byte(`{"email": "taken@example.com", "password": "securepassword"}`),
+			expectedCode:     http.StatusConflict,
+			expectedResponse: "duplicate email",
+		},
+		{
+			name:             "Bad email",
+			payload:          emailOnlyBadPayload,
+			expectedCode:     http.StatusBadRequest,
+			expectedResponse: errors.InvalidUser,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			app := App{userModel: &models.UserModelMock{DB: []*models.User{}}}
+			user := models.User{ID: 1, Email: "test@example.com", Password: "securepassword", CreatedAt: time.Now()}
+			takenUser := models.User{ID: 2, Email: "taken@example.com", Password: "securepassword", CreatedAt: time.Now()}
+			for _, u := range []*models.User{&user, &takenUser} {
+				err := app.userModel.Insert(u)
+				if err != nil {
+					t.Errorf("Unexpected error in inserting user")
+				}
+			}
+
+			req, err := http.NewRequest("POST", "/users/me/email", bytes.NewBuffer(test.payload))
+			if err != nil {
+				t.Errorf("Unexpected error in POST request to /users/me/email")
+			}
+			req = app.contextSetSubject(req, user.PublicID)
+			rr := httptest.NewRecorder()
+
+			app.requestEmailChange(rr, req)
+			if rr.Code != test.expectedCode {
+				t.Errorf("Expected status code %d, got %d", test.expectedCode, rr.Code)
+			}
+			if !strings.Contains(rr.Body.String(), test.expectedResponse) {
+				t.Errorf("Expected body to contain '%s', got '%s'", test.expectedResponse, rr.Body.String())
+			}
+
+			if test.expectedCode == http.StatusAccepted {
+				if user.PendingEmail != "new@example.com" || user.EmailChangeHashToken == "" {
+					t.Errorf("Expected pending email change to be stored, got %+v", user)
+				}
+				if user.EmailChangeCancelHashToken == "" || user.EmailChangeCancelHashToken == user.EmailChangeHashToken {
+					t.Errorf("Expected a separate cancel token to be stored, got %+v", user)
+				}
+				if user.Email != "test@example.com" {
+					t.Errorf("Expected email to stay the same until confirmed, got %s", user.Email)
+				}
+			} else if user.PendingEmail != "" {
+				t.Errorf("Expected no pending email change, got %s", user.PendingEmail)
+			}
+		})
+	}
+}
+
+func TestApp_confirmEmailChange(t *testing.T) {
+	tests := []struct {
+		name             string
+		pendingEmail     string
+		badToken         bool
+		cancelToken      bool
+		expired          bool
+		expectedCode     int
+		expectedResponse string
+	}{
+		{
+			name:             "Happy Path",
+			pendingEmail:     "new@example.com",
+			expectedCode:     http.StatusOK,
+			expectedResponse: `"email":"new@example.com"`,
+		},
+		{
+			name:             "Bad token",
+			pendingEmail:     "new@example.com",
+			badToken:         true,
+			expectedCode:     http.StatusBadRequest,
+			expectedResponse: errors.InvalidToken,
+		},
+		{
+			name:             "Cancel token",
+			pendingEmail:     "new@example.com",
+			cancelToken:      true,
+			expectedCode:     http.StatusBadRequest,
+			expectedResponse: errors.InvalidToken,
+		},
+		{
+			name:             "Expired token",
+			pendingEmail:     "new@example.com",
+			expired:          true,
+			expectedCode:     http.StatusBadRequest,
+			expectedResponse: errors.EmailChangeExpired,
+		},
+		{
+			name:             "Email taken since request",
+			pendingEmail:     "taken@example.com",
+			expectedCode:     http.StatusConflict,
+			expectedResponse: "duplicate email",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			user := models.User{ID: 1, PublicID: "0190a6e2-5c3b-7c1e-9f3a-2b4c6d8e0f12", Email: "test@example.com", CreatedAt: time.Now()}
+			takenUser := models.User{ID: 2, PublicID: "0190a6e2-5c3b-7c1e-9f3a-2b4c6d8e0f13", Email: "taken@example.com", CreatedAt: time.Now()}
+			app := App{userModel: &models.UserModelMock{DB: []*models.User{&user, &takenUser}}}
+
+			changeToken, salt, err := token.GenerateTokenAndSalt(32, 16)
+			if err != nil {
+				t.Errorf("Unexpected error in generating token")
+			}
+			cancelToken, cancelSalt, err := token.GenerateTokenAndSalt(32, 16)
+			if err != nil {
+				t.Errorf("Unexpected error in generating token")
+			}
+			err = app.userModel.RequestEmailChange(1, test.pendingEmail, token.HashToken(changeToken, salt), salt,
+				token.HashToken(cancelToken, cancelSalt), cancelSalt)
+			if err != nil {
+				t.Errorf("Unexpected error in requesting email change")
+			}
+			if test.badToken {
+				changeToken += "bad"
+			}
+			if test.cancelToken {
+				changeToken = cancelToken
+			}
+			if test.expired {
+				user.EmailChangeExpiry = time.Now().Add(-time.Hour)
+			}
+
+			payload := []byte(`{"token": "` + changeToken + `"}`)
+			req, err := http.NewRequest("POST", "/users/me/email/confirm", bytes.NewBuffer(payload))
+			if err != nil {
+				t.Errorf("Unexpected error in POST request to /users/me/email/confirm")
+			}
+			req = app.contextSetSubject(req, user.PublicID)
+			rr := httptest.NewRecorder()
+
+			app.confirmEmailChange(rr, req)
+			if rr.Code != test.expectedCode {
+				t.Errorf("Expected status code %d, got %d", test.expectedCode, rr.Code)
+			}
+			if !strings.Contains(rr.Body.String(), test.expectedResponse) {
+				t.Errorf("Expected body to contain '%s', got '%s'", test.expectedResponse, rr.Body.String())
+			}
+			if test.expectedCode != http.StatusOK && user.Email != "test@example.com" {
+				t.Errorf("Expected email to be unchanged, got %s", user.Email)
+			}
+		})
+	}
+}
+
+func TestApp_cancelEmailChange(t *testing.T) {
+	tests := []struct {
+		name             string
+		payload          []byte
+		badToken         bool
+		confirmToken     bool
+		expectedCode     int
+		expectedResponse string
+	}{
+		{
+			name:             "Happy Path",
+			payload:          []byte(`{"email": "test@example.com"}`),
+			expectedCode:     http.StatusOK,
+			expectedResponse: errors.EmailChangeCancelled,
+		},
+		{
+			name:             "Confirmation token",
+			payload:          []byte(`{"email": "test@example.com"}`),
+			confirmToken:     true,
+			expectedCode:     http.StatusBadRequest,
+			expectedResponse: errors.InvalidToken,
+		},
+		{
+			name:             "Bad token",
+			payload:          []byte(`{"email": "test@example.com"}`),
+			badToken:         true,
+			expectedCode:     http.StatusBadRequest,
+			expectedResponse: errors.InvalidToken,
+		},
+		{
+			name:             "User not found",
+			payload:          []byte(`{"email": "notfound@example.com"}`),
+			expectedCode:     http.StatusBadRequest,
+			expectedResponse: "record not found",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			user := models.User{ID: 1, Email: "test@example.com", CreatedAt: time.Now()}
+			app := App{userModel: &models.UserModelMock{DB: []*models.User{&user}}}
+
+			changeToken, salt, err := token.GenerateTokenAndSalt(32, 16)
+			if err != nil {
+				t.Errorf("Unexpected error in generating token")
+			}
+			cancelToken, cancelSalt, err := token.GenerateTokenAndSalt(32, 16)
+			if err != nil {
+				t.Errorf("Unexpected error in generating token")
+			}
+			err = app.userModel.RequestEmailChange(1, "new@example.com", token.HashToken(changeToken, salt), salt,
+				token.HashToken(cancelToken, cancelSalt), cancelSalt)
+			if err != nil {
+				t.Errorf("Unexpected error in requesting email change")
+			}
+			if test.badToken {
+				cancelToken += "bad"
+			}
+			if test.confirmToken {
+				cancelToken = changeToken
+			}
+
+			req, err := http.NewRequest("POST", "/users/email/cancel?token="+cancelToken, bytes.NewBuffer(test.payload))
+			if err != nil {
+				t.Errorf("Unexpected error in POST request to /users/email/cancel")
+			}
+			rr := httptest.NewRecorder()
+
+			app.cancelEmailChange(rr, req)
+			if rr.Code != test.expectedCode {
+				t.Errorf("Expected status code %d, got %d", test.expectedCode, rr.Code)
+			}
+			if !strings.Contains(rr.Body.String(), test.expectedResponse) {
+				t.Errorf("Expected body to contain '%s', got '%s'", test.expectedResponse, rr.Body.String())
+			}
+
+			wantPending := "new@example.com"
+			if test.expectedCode == http.StatusOK {
+				wantPending = ""
+			}
+			if user.PendingEmail != wantPending {
+				t.Errorf("Expected pending email '%s', got '%s'", wantPending, user.PendingEmail)
+			}
+		})
+	}
+}
+
+func TestApp_deleteCurrentUser(t *testing.T) {
+	tests := []struct {
+		name             string
+		payload          []byte
+		expectedCode     int
+		expectedResponse string
+	}{
+		{
+			name:             "Happy Path",
+			payload:          []byte(`{"password": "securepassword"}`),
+			expectedCode:     http.StatusOK,
+			expectedResponse: errors.AccountDeleted,
+		},
+		{
+			name:             "Wrong password",
+			payload:          []byte(`{"password": "wrongpassword"}`),
+			expectedCode:     http.StatusBadRequest,
+			expectedResponse: errors.InvalidCredentials,
+		},
+		{
+			name:             "Bad JSON",
+			payload:          []byte(`{"password": }`),
+			expectedCode:     http.StatusBadRequest,
+			expectedResponse: "body contains badly-form JSON",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			app := App{userModel: &models.UserModelMock{DB: []*models.User{}}}
+			app.Config.accountDeletion.restoreDays = 30
+			user := models.User{ID: 1, Email: "test@example.com", Password: "securepassword", CreatedAt: time.Now()}
+			err := app.userModel.Insert(&user)
+			if err != nil {
+				t.Errorf("Unexpected error in inserting user")
+			}
+
+			req, err := http.NewRequest("DELETE", "/users/me", bytes.NewBuffer(test.payload))
+			if err != nil {
+				t.Errorf("Unexpected error in DELETE request to /users/me")
+			}
+			req = app.contextSetSubject(req, user.PublicID)
+			rr := httptest.NewRecorder()
+
+			app.deleteCurrentUser(rr, req)
+			if rr.Code != test.expectedCode {
+				t.Errorf("Expected status code %d, got %d", test.expectedCode, rr.Code)
+			}
+			if !strings.Contains(rr.Body.String(), test.expectedResponse) {
+				t.Errorf("Expected body to contain '%s', got '%s'", test.expectedResponse, rr.Body.String())
+			}
+			if test.expectedCode != http.StatusOK {
+				if user.DeletedAt != nil {
+					t.Errorf("Expected user not to be deleted")
+				}
+				return
+			}
+
+			if user.DeletedAt == nil || user.RestoreHashToken == "" {
+				t.Errorf("Expected user to be soft deleted with a restore token, got %+v", user)
+			}
+			if user.RestoreExpiry.Before(time.Now().AddDate(0, 0, 29)) {
+				t.Errorf("Expected restore window of 30 days, got %s", user.RestoreExpiry)
+			}
+			// a deleted account must not be able to sign in
+			_, err = app.userModel.Authenticate(user.Email, "securepassword")
+			if err == nil {
+				t.Errorf("Expected deleted user to be blocked from signing in")
+			}
+			if rr.Result().Cookies()[0].MaxAge >= 0 {
+				t.Errorf("Expected auth cookie to be cleared")
+			}
+		})
+	}
+}
+
+func TestApp_restoreUser(t *testing.T) {
+	tests := []struct {
+		name             string
+		payload          []byte
+		badToken         bool
+		expired          bool
+		expectedCode     int
+		expectedResponse string
+	}{
+		{
+			name:             "Happy Path",
+			payload:          []byte(`{"email": "test@example.com"}`),
+			expectedCode:     http.StatusOK,
+			expectedResponse: errors.AccountRestored,
+		},
+		{
+			name:             "Bad token",
+			payload:          []byte(`{"email": "test@example.com"}`),
+			badToken:         true,
+			expectedCode:     http.StatusBadRequest,
+			expectedResponse: errors.InvalidToken,
+		},
+		{
+			name:             "Expired token",
+			payload:          []byte(`{"email": "test@example.com"}`),
+			expired:          true,
+			expectedCode:     http.StatusBadRequest,
+			expectedResponse: errors.RestoreExpired,
+		},
+		{
+			name:             "Account not deleted",
+			payload:          []byte(`{"email": "active@example.com"}`),
+			expectedCode:     http.StatusBadRequest,
+			expectedResponse: errors.AccountNotDeleted,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			user := models.User{ID: 1, Email: "test@example.com", CreatedAt: time.Now()}
+			activeUser := models.User{ID: 2, Email: "active@example.com", CreatedAt: time.Now()}
+			app := App{userModel: &models.UserModelMock{DB: []*models.User{&user, &activeUser}}}
+
+			restoreToken, salt, err := token.GenerateTokenAndSalt(32, 16)
+			if err != nil {
+				t.Errorf("Unexpected error in generating token")
+			}
+			restoreExpiry := time.Now().AddDate(0, 0, 30)
+			if test.expired {
+				restoreExpiry = time.Now().Add(-time.Hour)
+			}
+			err = app.userModel.SoftDeleteUser(1, token.HashToken(restoreToken, salt), salt, restoreExpiry)
+			if err != nil {
+				t.Errorf("Unexpected error in deleting user")
+			}
+			if test.badToken {
+				restoreToken += "bad"
+			}
+
+			req, err := http.NewRequest("POST", "/users/restore?token="+restoreToken, bytes.NewBuffer(test.payload))
+			if err != nil {
+				t.Errorf("Unexpected error in POST request to /users/restore")
+			}
+			rr := httptest.NewRecorder()
+
+			app.restoreUser(rr, req)
+			if rr.Code != test.expectedCode {
+				t.Errorf("Expected status code %d, got %d", test.expectedCode, rr.Code)
+			}
+			if !strings.Contains(rr.Body.String(), test.expectedResponse) {
+				t.Errorf("Expected body to contain '%s', got '%s'", test.expectedResponse, rr.Body.String())
+			}
+			if test.expectedCode == http.StatusOK && user.DeletedAt != nil {
+				t.Errorf("Expected user to be restored")
+			}
+		})
+	}
+}
@@ -4,11 +4,34 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/go-chi/chi/v5"
 	"io"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"the_lonely_road/JWT"
+	"the_lonely_road/models"
+	"the_lonely_road/validator"
+	"time"
 )
 
+// userClaims builds the claims a freshly issued token for user should carry, membership is nil for a token
+// that isn't scoped to an organization
+func (app *App) userClaims(user *models.User, membership *models.Membership) JWT.Claims {
+	claims := JWT.Claims{
+		Subject:     user.PublicID,
+		Roles:       user.Roles,
+		Permissions: user.Permissions,
+		AppMetadata: models.ProjectMetadata(user.AppMetadata, app.Config.metadataClaims),
+	}
+	if membership != nil {
+		claims.Org = membership.OrgSlug
+		claims.OrgRole = membership.Role
+	}
+	return claims
+}
+
 // simple write json function
 func (app *App) writeJSON(w http.ResponseWriter, status int, data interface{}, headers ...http.Header) error {
 	out, err := json.Marshal(data)
@@ -98,3 +121,93 @@ func (app *App) background(fn func()) {
 		fn()
 	}()
 }
+
+func (app *App) readString(qs url.Values, key string, defaultValue string) string {
+	s := qs.Get(key)
+	if s == "" {
+		return defaultValue
+	}
+	return s
+}
+
+func (app *App) readInt(qs url.Values, key string, defaultValue int, v *validator.Validator) int {
+	s := qs.Get(key)
+	if s == "" {
+		return defaultValue
+	}
+
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		v.AddError(key, "must be an integer value")
+		return defaultValue
+	}
+	return i
+}
+
+// readBool returns nil when key is missing so callers can tell "not asked" apart from false
+func (app *App) readBool(qs url.Values, key string, v *validator.Validator) *bool {
+	s := qs.Get(key)
+	if s == "" {
+		return nil
+	}
+
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		v.AddError(key, "must be true or false")
+		return nil
+	}
+	return &b
+}
+
+// readTime accepts RFC 3339 timestamps or plain dates, a missing key returns nil
+func (app *App) readTime(qs url.Values, key string, v *validator.Validator) *time.Time {
+	s := qs.Get(key)
+	if s == "" {
+		return nil
+	}
+
+	for _, layout := range []string{time.RFC3339, time.DateOnly} {
+		t, err := time.Parse(layout, s)
+		if err == nil {
+			return &t
+		}
+	}
+	v.AddError(key, "must be a date (2006-01-02) or RFC 3339 timestamp")
+	return nil
+}
+
+// readIDParam reads the {id} URL parameter, which is always a public id
+func (app *App) readIDParam(r *http.Request) (string, error) {
+	id := chi.URLParam(r, "id")
+	if !validator.Matches(id, validator.UUIDRX) {
+		return "", errors.New("invalid id parameter")
+	}
+	return id, nil
+}
+
+// userETag is a strong entity tag for the user's representation, it changes with every write to the row
+func (app *App) userETag(user *models.User) string {
+	return `"` + strconv.Itoa(user.Version) + `"`
+}
+
+// writtenETag is the tag a user read at version carries once a write to it went through, every write bumps the
+// version by one and the checked ones fail rather than skip ahead
+func (app *App) writtenETag(version int) string {
+	return `"` + strconv.Itoa(version+1) + `"`
+}
+
+// ifMatch reports whether the request's If-Match header lets a write go ahead against a resource tagged etag.
+// Without the header there is nothing to check.
+func (app *App) ifMatch(r *http.Request, etag string) bool {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		return true
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
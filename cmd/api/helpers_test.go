@@ -4,8 +4,11 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"strings"
 	"testing"
+	"the_lonely_road/models"
+	"the_lonely_road/validator"
 )
 
 type TestStruct struct {
@@ -174,3 +177,82 @@ func TestReadJSON(t *testing.T) {
 		}
 	})
 }
+
+func TestReadQueryParams(t *testing.T) {
+	app := &App{}
+	qs := url.Values{
+		"page":     {"3"},
+		"bad_page": {"three"},
+		"verified": {"true"},
+		"bad_bool": {"maybe"},
+		"since":    {"2023-09-10"},
+		"until":    {"2023-09-10T12:30:00Z"},
+		"bad_time": {"last tuesday"},
+	}
+
+	t.Run("Valid values", func(t *testing.T) {
+		v := validator.New()
+		if got := app.readString(qs, "missing", "fallback"); got != "fallback" {
+			t.Errorf("Expected default string, got %s", got)
+		}
+		if got := app.readInt(qs, "page", 1, v); got != 3 {
+			t.Errorf("Expected 3, got %d", got)
+		}
+		if got := app.readBool(qs, "verified", v); got == nil || !*got {
+			t.Errorf("Expected true, got %v", got)
+		}
+		if got := app.readBool(qs, "missing", v); got != nil {
+			t.Errorf("Expected nil for a missing flag, got %v", *got)
+		}
+		if got := app.readTime(qs, "since", v); got == nil || got.Day() != 10 {
+			t.Errorf("Expected date to parse, got %v", got)
+		}
+		if got := app.readTime(qs, "until", v); got == nil || got.Hour() != 12 {
+			t.Errorf("Expected timestamp to parse, got %v", got)
+		}
+		if !v.Valid() {
+			t.Errorf("Expected validator to be valid, got %v", v.Errors)
+		}
+	})
+
+	t.Run("Invalid values", func(t *testing.T) {
+		v := validator.New()
+		if got := app.readInt(qs, "bad_page", 1, v); got != 1 {
+			t.Errorf("Expected default int, got %d", got)
+		}
+		app.readBool(qs, "bad_bool", v)
+		app.readTime(qs, "bad_time", v)
+		for _, key := range []string{"bad_page", "bad_bool", "bad_time"} {
+			if _, ok := v.Errors[key]; !ok {
+				t.Errorf("Expected validation error for %s", key)
+			}
+		}
+	})
+}
+
+func TestUserClaims(t *testing.T) {
+	app := App{}
+	app.Config.metadataClaims = []string{"plan", "cohorts"}
+	claims := app.userClaims(&models.User{
+		ID:          7,
+		PublicID:    "0190a6e2-5c3b-7c1e-9f3a-2b4c6d8e0f12",
+		Roles:       []string{models.RoleSupport},
+		Permissions: []string{models.PermissionUsersRead},
+		AppMetadata: json.RawMessage(`{"plan":"pro","internal_note":"vip"}`),
+	}, &models.Membership{OrgSlug: "acme", Role: models.OrgRoleAdmin})
+	if claims.Subject != "0190a6e2-5c3b-7c1e-9f3a-2b4c6d8e0f12" {
+		t.Errorf("Expected the public id as subject, got %q", claims.Subject)
+	}
+	if !claims.HasPermission(models.PermissionUsersRead) || claims.HasPermission(models.PermissionUsersAdmin) {
+		t.Errorf("Expected only users:read, got %v", claims.Permissions)
+	}
+	if claims.Org != "acme" || claims.OrgRole != models.OrgRoleAdmin {
+		t.Errorf("Expected admin of acme, got %q %q", claims.OrgRole, claims.Org)
+	}
+	if len(claims.AppMetadata) != 1 || string(claims.AppMetadata["plan"]) != `"pro"` {
+		t.Errorf("Expected only the plan from app_metadata, got %v", claims.AppMetadata)
+	}
+	if claims := app.userClaims(&models.User{}, nil); len(claims.Permissions) != 0 || claims.Org != "" || claims.AppMetadata != nil {
+		t.Errorf("Expected no permissions, organization or metadata, got %v %q %v", claims.Permissions, claims.Org, claims.AppMetadata)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	stdErrors "errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"the_lonely_road/errors"
+	"the_lonely_road/models"
+	"the_lonely_road/validator"
+)
+
+// maxImportBytes is the largest file the import endpoint takes, bigger migrations go through the import command
+const maxImportBytes = 100 << 20
+
+// importUsers adds the users in a CSV or NDJSON body and answers with a report of every row that failed. The format
+// comes from ?format= or the Content-Type, ?dry_run=true checks the file without storing anything and ?batch_size=
+// sets how many users go into each transaction.
+func (app *App) importUsers(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	qs := r.URL.Query()
+
+	format, err := userFileFormat(r)
+	if err != nil {
+		v.AddError("format", err.Error())
+	}
+	dryRun := app.readBool(qs, "dry_run", v)
+	batchSize := app.readInt(qs, "batch_size", models.DefaultImportBatchSize, v)
+	v.Check(batchSize > 0 && batchSize <= models.MaxImportBatchSize, "batch_size", "must be between 1 and 5000")
+	if !v.Valid() {
+		v.AddError("message", errors.InvalidImportOptions)
+		http.Error(w, v.Errors["message"], http.StatusBadRequest)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportBytes)
+	reader, err := models.NewUserReader(r.Body, format)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	importer := models.Importer{Users: app.userModel, Hasher: app.Config.hasher, BatchSize: batchSize, DryRun: dryRun != nil && *dryRun}
+	report, err := importer.Import(reader)
+	if report != nil && report.Imported > 0 && !report.DryRun {
+		app.audit(r, models.AuditEvent{Type: models.AuditUsersImported, ActorID: app.contextGetSubject(r)})
+	}
+	if err != nil {
+		var maxBytesError *http.MaxBytesError
+		switch {
+		case stdErrors.As(err, &maxBytesError):
+			http.Error(w, errors.ImportTooLarge, http.StatusRequestEntityTooLarge)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, map[string]any{"report": report})
+	if err != nil {
+		http.Error(w, errors.JsonWriteError, http.StatusInternalServerError)
+		return
+	}
+}
+
+// exportUsers streams every user that hasn't been deleted, with their password hashes, as ?format=csv or ndjson.
+// The file can be imported as it is into another instance that has the same pepper.
+func (app *App) exportUsers(w http.ResponseWriter, r *http.Request) {
+	format, err := models.ParseUserFileFormat(app.readString(r.URL.Query(), "format", models.FormatNDJSON))
+	if err != nil {
+		http.Error(w, errors.InvalidImportOptions, http.StatusBadRequest)
+		return
+	}
+
+	contentType := "application/x-ndjson"
+	if format == models.FormatCSV {
+		contentType = "text/csv"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="users.%s"`, format))
+
+	writer, err := models.NewUserWriter(w, format)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	app.audit(r, models.AuditEvent{Type: models.AuditUsersExported, ActorID: app.contextGetSubject(r)})
+
+	exported := 0
+	err = app.userModel.ExportUsers(func(user *models.User) error {
+		exported++
+		return writer.Write(user)
+	})
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err != nil {
+		// once rows have gone out the status is sent, all that's left is to cut the file short
+		if exported == 0 {
+			w.Header().Del("Content-Disposition")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Println("export users:", err)
+	}
+}
+
+// userFileFormat is ?format= if given, otherwise what the Content-Type names
+func userFileFormat(r *http.Request) (string, error) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		switch mediaType {
+		case "text/csv":
+			format = models.FormatCSV
+		case "application/x-ndjson", "application/jsonl":
+			format = models.FormatNDJSON
+		}
+	}
+	return models.ParseUserFileFormat(format)
+}
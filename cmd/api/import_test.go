@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	stdErrors "errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"the_lonely_road/errors"
+	"the_lonely_road/models"
+	"time"
+)
+
+// importTestApp has alice as the only user and hashes with cheap bcrypt so imports stay fast
+func importTestApp(t *testing.T) (*App, *models.UserModelMock) {
+	hasher := models.Hasher{Current: models.BcryptHasher{Cost: 4}}
+	mock := &models.UserModelMock{DB: []*models.User{}, Hasher: hasher}
+	err := mock.Insert(&models.User{ID: 1, PublicID: alice, Email: "alice@example.com", Password: "securepassword", CreatedAt: time.Now()})
+	if err != nil {
+		t.Fatalf("Unexpected error in inserting user: %s", err)
+	}
+	app := &App{userModel: mock}
+	app.Config.hasher = hasher
+	return app, mock
+}
+
+func TestApp_importUsers(t *testing.T) {
+	csvBody := "email,password,display_name\nbob@example.com,securepassword,Bob\nalice@example.com,securepassword,Alice\n"
+	ndjsonBody := `{"email": "bob@example.com", "password": "securepassword"}` + "\n" + `{"email": "carol@example.com"}` + "\n"
+
+	tests := []struct {
+		name             string
+		query            string
+		contentType      string
+		body             string
+		expectedCode     int
+		expectedError    string
+		expectedImported int
+		expectedFailed   int
+		expectedUsers    int
+	}{
+		{name: "CSV from Content-Type", contentType: "text/csv; charset=utf-8", body: csvBody,
+			expectedCode: http.StatusOK, expectedImported: 1, expectedFailed: 1, expectedUsers: 2},
+		{name: "NDJSON from query", query: "?format=ndjson", body: ndjsonBody,
+			expectedCode: http.StatusOK, expectedImported: 1, expectedFailed: 1, expectedUsers: 2},
+		{name: "Dry run", query: "?dry_run=true&batch_size=1", contentType: "text/csv", body: csvBody,
+			expectedCode: http.StatusOK, expectedImported: 1, expectedFailed: 1, expectedUsers: 1},
+		{name: "No format", body: csvBody, expectedCode: http.StatusBadRequest, expectedError: errors.InvalidImportOptions, expectedUsers: 1},
+		{name: "Batch too large", query: "?format=csv&batch_size=10000", body: csvBody,
+			expectedCode: http.StatusBadRequest, expectedError: errors.InvalidImportOptions, expectedUsers: 1},
+		{name: "Unknown column", query: "?format=csv", body: "email,fax\nbob@example.com,555\n",
+			expectedCode: http.StatusBadRequest, expectedError: `unknown column "fax"`, expectedUsers: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			app, mock := importTestApp(t)
+			req := httptest.NewRequest("POST", "/admin/users/import"+test.query, strings.NewReader(test.body))
+			if test.contentType != "" {
+				req.Header.Set("Content-Type", test.contentType)
+			}
+			req = app.contextSetSubject(req, alice)
+			rr := httptest.NewRecorder()
+
+			app.importUsers(rr, req)
+			if rr.Code != test.expectedCode {
+				t.Fatalf("Expected status code %d, got %d: %s", test.expectedCode, rr.Code, rr.Body.String())
+			}
+			if len(mock.DB) != test.expectedUsers {
+				t.Errorf("Expected %d users afterwards, got %d", test.expectedUsers, len(mock.DB))
+			}
+			if test.expectedCode != http.StatusOK {
+				if !strings.Contains(rr.Body.String(), test.expectedError) {
+					t.Errorf("Expected body to contain '%s', got '%s'", test.expectedError, rr.Body.String())
+				}
+				return
+			}
+
+			var response struct {
+				Report models.ImportReport `json:"report"`
+			}
+			err := json.Unmarshal(rr.Body.Bytes(), &response)
+			if err != nil {
+				t.Fatalf("Error unmarshaling JSON: %v", err)
+			}
+			if response.Report.Imported != test.expectedImported || response.Report.Failed != test.expectedFailed ||
+				len(response.Report.Errors) != test.expectedFailed {
+				t.Errorf("Expected %d imported and %d failed, got %+v", test.expectedImported, test.expectedFailed, response.Report)
+			}
+			imported := len(mock.AuditEvents) == 1 && mock.AuditEvents[0].Type == models.AuditUsersImported && mock.AuditEvents[0].ActorID == alice
+			if imported == response.Report.DryRun {
+				t.Errorf("Expected the import to be audited unless it was a dry run, got %+v", mock.AuditEvents)
+			}
+		})
+	}
+}
+
+func TestApp_exportUsers(t *testing.T) {
+	tests := []struct {
+		name                string
+		query               string
+		expectedCode        int
+		expectedContentType string
+		expectedFirstLine   string
+	}{
+		{name: "Default", expectedCode: http.StatusOK, expectedContentType: "application/x-ndjson", expectedFirstLine: `{"id":"` + alice + `"`},
+		{name: "CSV", query: "?format=csv", expectedCode: http.StatusOK, expectedContentType: "text/csv", expectedFirstLine: "id,email,password_hash,"},
+		{name: "Unknown format", query: "?format=xml", expectedCode: http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			app, mock := importTestApp(t)
+			req := httptest.NewRequest("GET", "/admin/users/export"+test.query, nil)
+			req = app.contextSetSubject(req, alice)
+			rr := httptest.NewRecorder()
+
+			app.exportUsers(rr, req)
+			if rr.Code != test.expectedCode {
+				t.Fatalf("Expected status code %d, got %d: %s", test.expectedCode, rr.Code, rr.Body.String())
+			}
+			if test.expectedCode != http.StatusOK {
+				return
+			}
+			if contentType := rr.Header().Get("Content-Type"); contentType != test.expectedContentType {
+				t.Errorf("Expected Content-Type %s, got %s", test.expectedContentType, contentType)
+			}
+			if !strings.HasPrefix(rr.Body.String(), test.expectedFirstLine) {
+				t.Errorf("Expected the export to start with %s, got %s", test.expectedFirstLine, rr.Body.String())
+			}
+			if !strings.Contains(rr.Body.String(), mock.DB[0].Password) {
+				t.Errorf("Expected the password hash to be exported")
+			}
+			if len(mock.AuditEvents) != 1 || mock.AuditEvents[0].Type != models.AuditUsersExported {
+				t.Errorf("Expected the export to be audited, got %+v", mock.AuditEvents)
+			}
+		})
+	}
+}
+
+func TestApp_importCommand(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "users.csv")
+	err := os.WriteFile(path, []byte("email,password\nbob@example.com,securepassword\ncarol@example.com,\n"), 0o600)
+	if err != nil {
+		t.Fatalf("Unexpected error writing file: %s", err)
+	}
+
+	tests := []struct {
+		name          string
+		args          []string
+		stdin         string
+		expectedError string
+		expectedUsers int
+	}{
+		{name: "Dry run", args: []string{"-dry-run", path}, expectedError: "1 of 2 rows failed", expectedUsers: 1},
+		{name: "Format from extension", args: []string{path}, expectedError: "1 of 2 rows failed", expectedUsers: 2},
+		{name: "Stdin", args: []string{"-format", "ndjson", "-"}, stdin: `{"email": "bob@example.com", "password": "securepassword"}`, expectedUsers: 2},
+		{name: "Stdin without format", args: []string{"-"}, expectedError: "unknown format", expectedUsers: 1},
+		{name: "No file", args: []string{}, expectedError: "usage", expectedUsers: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			app, mock := importTestApp(t)
+			var stdout bytes.Buffer
+
+			err := app.importCommand(test.args, strings.NewReader(test.stdin), &stdout)
+			if test.expectedError == "" && err != nil {
+				t.Errorf("Expected no error, got %s", err)
+			}
+			if test.expectedError != "" && (err == nil || !strings.Contains(err.Error(), test.expectedError)) {
+				t.Errorf("Expected an error containing %q, got %v", test.expectedError, err)
+			}
+			if len(mock.DB) != test.expectedUsers {
+				t.Errorf("Expected %d users afterwards, got %d", test.expectedUsers, len(mock.DB))
+			}
+		})
+	}
+}
+
+func TestApp_exportCommand(t *testing.T) {
+	app, _ := importTestApp(t)
+	path := filepath.Join(t.TempDir(), "users.csv")
+	var stdout bytes.Buffer
+
+	err := app.exportCommand([]string{"-o", path}, &stdout)
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	exported, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Unexpected error reading export: %s", err)
+	}
+	if !strings.HasPrefix(string(exported), "id,email,") || !strings.Contains(string(exported), "alice@example.com") {
+		t.Errorf("Expected a CSV export with alice in it, got %s", exported)
+	}
+	if !strings.Contains(stdout.String(), "Exported 1 users") {
+		t.Errorf("Expected a summary on stdout, got %s", stdout.String())
+	}
+
+	stdout.Reset()
+	err = app.exportCommand(nil, &stdout)
+	if err != nil || !strings.HasPrefix(stdout.String(), `{"id":"`+alice) {
+		t.Errorf("Expected NDJSON on stdout, got %s, %v", stdout.String(), err)
+	}
+}
+
+func TestApp_reencryptCommand(t *testing.T) {
+	app, _ := importTestApp(t)
+	var stdout bytes.Buffer
+
+	err := app.reencryptCommand(nil, &stdout)
+	if !stdErrors.Is(err, models.ErrEncryptionDisabled) || !strings.Contains(err.Error(), "ENCRYPTION_KEYS") {
+		t.Errorf("Expected a hint to set the keys, got %v", err)
+	}
+	for _, args := range [][]string{{"-batch-size", "0"}, {"extra"}} {
+		if err := app.reencryptCommand(args, &stdout); err == nil {
+			t.Errorf("Expected %v to be rejected", args)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	stdErrors "errors"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"net/http"
+	"the_lonely_road/JWT"
+	"the_lonely_road/errors"
+	"the_lonely_road/models"
+	"the_lonely_road/token"
+	"the_lonely_road/validator"
+	"time"
+)
+
+// createInvitation emails an invitation to join the organization in the URL. Inviting an address again replaces
+// its open invitation, and only owners can invite new owners.
+func (app *App) createInvitation(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Email string `json:"email"`
+		Role  string `json:"role"`
+	}
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if payload.Role == "" {
+		payload.Role = models.OrgRoleMember
+	}
+
+	now := time.Now()
+	ttl := app.Config.invitationTTL
+	if ttl <= 0 {
+		ttl = models.DefaultInvitationTTL
+	}
+	inv := models.Invitation{Email: payload.Email, Role: payload.Role, CreatedAt: now, ExpiresAt: now.Add(ttl)}
+	v := validator.New()
+	if models.ValidateInvitation(v, &inv); !v.Valid() {
+		v.AddError("message", errors.InvalidInvitation)
+		http.Error(w, v.Errors["message"], http.StatusBadRequest)
+		return
+	}
+	if inv.Role == models.OrgRoleOwner && app.contextGetClaims(r).OrgRole != models.OrgRoleOwner {
+		http.Error(w, errors.OrgRoleRequired, http.StatusForbidden)
+		return
+	}
+
+	org, err := app.userModel.GetOrganization(chi.URLParam(r, "org"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if invitee, err := app.userModel.GetByEmail(inv.Email); err == nil {
+		if _, err := app.userModel.GetMembership(org.Slug, int(invitee.ID)); err == nil {
+			http.Error(w, errors.AlreadyMember, http.StatusConflict)
+			return
+		}
+	}
+	inviter, err := app.userModel.GetByPublicID(app.contextGetSubject(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	inviteToken, salt, err := token.GenerateTokenAndSalt(32, 16)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	inv.OrgID = org.ID
+	inv.InvitedBy = inviter.ID
+	inv.TokenHash = token.HashToken(inviteToken, salt)
+	inv.TokenSalt = salt
+	err = app.userModel.CreateInvitation(&inv)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	app.background(func() {
+		acceptURL := fmt.Sprintf("localhost:8080/invitations/%s/accept?token=%s", inv.PublicID, inviteToken)
+		err := app.emailer.OrgInvitation(inv.Email, org.Name, acceptURL, inv.ExpiresAt)
+		if err != nil {
+			fmt.Println(err)
+		}
+	})
+
+	err = app.writeJSON(w, http.StatusAccepted, &inv)
+	if err != nil {
+		http.Error(w, errors.JsonWriteError, http.StatusInternalServerError)
+		return
+	}
+}
+
+// listInvitations shows the organization's invitations that haven't been accepted, revoked or expired
+func (app *App) listInvitations(w http.ResponseWriter, r *http.Request) {
+	org, err := app.userModel.GetOrganization(chi.URLParam(r, "org"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	invitations, err := app.userModel.ListPendingInvitations(int(org.ID))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, map[string]any{"invitations": invitations})
+	if err != nil {
+		http.Error(w, errors.JsonWriteError, http.StatusInternalServerError)
+		return
+	}
+}
+
+// revokeInvitation stops an open invitation's link from working
+func (app *App) revokeInvitation(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		http.Error(w, errors.InvalidInvitationID, http.StatusBadRequest)
+		return
+	}
+
+	org, err := app.userModel.GetOrganization(chi.URLParam(r, "org"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	err = app.userModel.RevokeInvitation(int(org.ID), id)
+	if err != nil {
+		switch {
+		case stdErrors.Is(err, models.ErrInvitationClosed):
+			http.Error(w, errors.InvitationNotFound, http.StatusNotFound)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, errors.InvitationRevoked)
+	if err != nil {
+		http.Error(w, errors.JsonWriteError, http.StatusInternalServerError)
+		return
+	}
+}
+
+// acceptInvitation consumes the emailed token. An invitee who already has an account is added to the organization
+// as they are and sends an empty body. Anyone else sends a password and gets a verified account, since opening the
+// link proves they own the address, and is signed in to the organization straight away.
+func (app *App) acceptInvitation(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Password string
+	}
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	id, err := app.readIDParam(r)
+	if err != nil {
+		http.Error(w, errors.InvalidInvitationID, http.StatusBadRequest)
+		return
+	}
+
+	inv, err := app.userModel.GetInvitation(id)
+	if err != nil {
+		http.Error(w, errors.InvitationNotFound, http.StatusNotFound)
+		return
+	}
+	if !token.IsValidToken(r.URL.Query().Get("token"), inv.TokenHash, inv.TokenSalt) {
+		http.Error(w, errors.InvalidToken, http.StatusBadRequest)
+		return
+	}
+	if !inv.Pending(time.Now()) {
+		http.Error(w, errors.InvitationClosed, http.StatusBadRequest)
+		return
+	}
+
+	user, err := app.userModel.GetByEmail(inv.Email)
+	newAccount := stdErrors.Is(err, models.ErrRecordNotFound)
+	switch {
+	case newAccount:
+		user = &models.User{Email: inv.Email, Password: payload.Password, CreatedAt: time.Now(), Verified: true}
+		v := validator.New()
+		if models.ValidateUser(v, user, app.Config.hasher); !v.Valid() {
+			v.AddError("message", errors.InvalidUser)
+			http.Error(w, v.Errors["message"], http.StatusBadRequest)
+			return
+		}
+		err = app.userModel.Insert(user)
+		switch {
+		// the address belongs to a deleted account, which is restored rather than joined
+		case stdErrors.Is(err, models.ErrDuplicateEmail):
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = app.userModel.AcceptInvitation(int(inv.ID), int(user.ID))
+	if err != nil {
+		switch {
+		case stdErrors.Is(err, models.ErrInvitationClosed):
+			http.Error(w, errors.InvitationClosed, http.StatusBadRequest)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	membership, err := app.userModel.GetMembership(inv.OrgSlug, int(user.ID))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if newAccount {
+		jwt, err := JWT.GenerateJWTWithClaims(app.userClaims(user, membership))
+		if err != nil {
+			http.Error(w, errors.InternalServerError, http.StatusInternalServerError)
+			return
+		}
+		JWT.SetAuthCookie(w, jwt)
+	}
+
+	err = app.writeJSON(w, http.StatusOK, membership)
+	if err != nil {
+		http.Error(w, errors.JsonWriteError, http.StatusInternalServerError)
+		return
+	}
+}
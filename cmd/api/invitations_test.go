@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/go-chi/chi/v5"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"the_lonely_road/JWT"
+	"the_lonely_road/errors"
+	"the_lonely_road/models"
+	"the_lonely_road/token"
+	"time"
+)
+
+// inviteTo stores an open invitation to acme and returns it with its plaintext token
+func inviteTo(t *testing.T, mock *models.UserModelMock, email, role string) (*models.Invitation, string) {
+	inviteToken, salt, err := token.GenerateTokenAndSalt(32, 16)
+	if err != nil {
+		t.Fatalf("Unexpected error in generating token: %s", err)
+	}
+	org, err := mock.GetOrganization("acme")
+	if err != nil {
+		t.Fatalf("Unexpected error in getting organization: %s", err)
+	}
+	inv := &models.Invitation{OrgID: org.ID, Email: email, Role: role, TokenHash: token.HashToken(inviteToken, salt), TokenSalt: salt,
+		CreatedAt: time.Now(), ExpiresAt: time.Now().Add(time.Hour)}
+	err = mock.CreateInvitation(inv)
+	if err != nil {
+		t.Fatalf("Unexpected error in creating invitation: %s", err)
+	}
+	return inv, inviteToken
+}
+
+func TestApp_createInvitation(t *testing.T) {
+	tests := []struct {
+		name          string
+		callerRole    string
+		payload       string
+		expectedCode  int
+		expectedError string
+	}{
+		{name: "Invite member", callerRole: models.OrgRoleAdmin, payload: `{"email": "dave@example.com"}`, expectedCode: http.StatusAccepted},
+		{name: "Admin invites owner", callerRole: models.OrgRoleAdmin, payload: `{"email": "dave@example.com", "role": "owner"}`,
+			expectedCode: http.StatusForbidden, expectedError: errors.OrgRoleRequired},
+		{name: "Owner invites owner", callerRole: models.OrgRoleOwner, payload: `{"email": "dave@example.com", "role": "owner"}`, expectedCode: http.StatusAccepted},
+		{name: "Unknown role", callerRole: models.OrgRoleOwner, payload: `{"email": "dave@example.com", "role": "boss"}`,
+			expectedCode: http.StatusBadRequest, expectedError: errors.InvalidInvitation},
+		{name: "Already a member", callerRole: models.OrgRoleOwner, payload: `{"email": "Carol@Example.com"}`,
+			expectedCode: http.StatusConflict, expectedError: errors.AlreadyMember},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			app, mock := orgTestApp(t)
+			r := chi.NewRouter()
+			r.Post("/orgs/{org}/invitations", app.createInvitation)
+
+			req := httptest.NewRequest("POST", "/orgs/acme/invitations", strings.NewReader(test.payload))
+			req = app.contextSetClaims(req, &JWT.Claims{Subject: bob, Org: "acme", OrgRole: test.callerRole})
+			rr := httptest.NewRecorder()
+
+			r.ServeHTTP(rr, req)
+			app.wg.Wait()
+			if rr.Code != test.expectedCode {
+				t.Fatalf("Expected status code %d, got %d: %s", test.expectedCode, rr.Code, rr.Body.String())
+			}
+			if test.expectedError != "" && !strings.Contains(rr.Body.String(), test.expectedError) {
+				t.Errorf("Expected body to contain '%s', got '%s'", test.expectedError, rr.Body.String())
+			}
+			if test.expectedCode == http.StatusAccepted {
+				if len(mock.Invitations) != 1 || mock.Invitations[0].TokenHash == "" || mock.Invitations[0].InvitedBy != 2 {
+					t.Errorf("Expected one hashed invitation from bob, got %+v", mock.Invitations)
+				}
+				if strings.Contains(rr.Body.String(), mock.Invitations[0].TokenHash) {
+					t.Errorf("Expected the token hash to be left out of the response")
+				}
+			}
+		})
+	}
+}
+
+func TestApp_listInvitations(t *testing.T) {
+	app, mock := orgTestApp(t)
+	inviteTo(t, mock, "dave@example.com", models.OrgRoleMember)
+	revoked, _ := inviteTo(t, mock, "erin@example.com", models.OrgRoleMember)
+	err := mock.RevokeInvitation(int(revoked.OrgID), revoked.PublicID)
+	if err != nil {
+		t.Fatalf("Unexpected error in revoking invitation: %s", err)
+	}
+	r := chi.NewRouter()
+	r.Get("/orgs/{org}/invitations", app.listInvitations)
+
+	req := httptest.NewRequest("GET", "/orgs/acme/invitations", nil)
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, rr.Code)
+	}
+
+	var response struct {
+		Invitations []models.Invitation `json:"invitations"`
+	}
+	err = json.Unmarshal(rr.Body.Bytes(), &response)
+	if err != nil {
+		t.Fatalf("Error unmarshaling JSON: %v", err)
+	}
+	if len(response.Invitations) != 1 || response.Invitations[0].Email != "dave@example.com" {
+		t.Errorf("Expected only dave's invitation, got %+v", response.Invitations)
+	}
+}
+
+func TestApp_revokeInvitation(t *testing.T) {
+	app, mock := orgTestApp(t)
+	inv, _ := inviteTo(t, mock, "dave@example.com", models.OrgRoleMember)
+	r := chi.NewRouter()
+	r.Delete("/orgs/{org}/invitations/{id}", app.revokeInvitation)
+
+	tests := []struct {
+		name         string
+		id           string
+		expectedCode int
+	}{
+		{name: "Revoke", id: inv.PublicID, expectedCode: http.StatusOK},
+		{name: "Already revoked", id: inv.PublicID, expectedCode: http.StatusNotFound},
+		{name: "Bad id", id: "1", expectedCode: http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest("DELETE", "/orgs/acme/invitations/"+test.id, nil)
+			rr := httptest.NewRecorder()
+
+			r.ServeHTTP(rr, req)
+			if rr.Code != test.expectedCode {
+				t.Errorf("Expected status code %d, got %d", test.expectedCode, rr.Code)
+			}
+		})
+	}
+}
+
+func TestApp_acceptInvitation(t *testing.T) {
+	tests := []struct {
+		name          string
+		email         string
+		payload       string
+		badToken      bool
+		expectedCode  int
+		expectedError string
+		signedIn      bool
+	}{
+		{name: "New account", email: "dave@example.com", payload: `{"password": "securepassword"}`, expectedCode: http.StatusOK, signedIn: true},
+		{name: "New account without password", email: "dave@example.com", payload: `{}`,
+			expectedCode: http.StatusBadRequest, expectedError: errors.InvalidUser},
+		{name: "Existing account", email: "outsider@example.com", payload: `{}`, expectedCode: http.StatusOK},
+		{name: "Deleted account", email: "deleted@example.com", payload: `{"password": "securepassword"}`,
+			expectedCode: http.StatusConflict, expectedError: models.ErrDuplicateEmail.Error()},
+		{name: "Bad token", email: "dave@example.com", payload: `{"password": "securepassword"}`, badToken: true,
+			expectedCode: http.StatusBadRequest, expectedError: errors.InvalidToken},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			app, mock := orgTestApp(t)
+			err := mock.Insert(&models.User{ID: 4, Email: "outsider@example.com", Password: "securepassword", CreatedAt: time.Now()})
+			if err != nil {
+				t.Fatalf("Unexpected error in inserting user: %s", err)
+			}
+			err = mock.Insert(&models.User{ID: 5, Email: "deleted@example.com", Password: "securepassword", CreatedAt: time.Now()})
+			if err == nil {
+				err = mock.SoftDeleteUser(5, "hash", "salt", time.Now().Add(time.Hour))
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error in deleting user: %s", err)
+			}
+			inv, inviteToken := inviteTo(t, mock, test.email, models.OrgRoleMember)
+			if test.badToken {
+				inviteToken += "bad"
+			}
+			r := chi.NewRouter()
+			r.Post("/invitations/{id}/accept", app.acceptInvitation)
+
+			req := httptest.NewRequest("POST", "/invitations/"+inv.PublicID+"/accept?token="+inviteToken, strings.NewReader(test.payload))
+			rr := httptest.NewRecorder()
+
+			r.ServeHTTP(rr, req)
+			if rr.Code != test.expectedCode {
+				t.Fatalf("Expected status code %d, got %d: %s", test.expectedCode, rr.Code, rr.Body.String())
+			}
+			if test.expectedError != "" && !strings.Contains(rr.Body.String(), test.expectedError) {
+				t.Errorf("Expected body to contain '%s', got '%s'", test.expectedError, rr.Body.String())
+			}
+			if test.signedIn != (len(rr.Result().Cookies()) > 0) {
+				t.Errorf("Expected signed in to be %v, got cookies %v", test.signedIn, rr.Result().Cookies())
+			}
+			if test.expectedCode != http.StatusOK {
+				return
+			}
+
+			user, err := mock.GetByEmail(test.email)
+			if err != nil {
+				t.Fatalf("Expected the invitee to have an account, got %s", err)
+			}
+			if test.signedIn && !user.Verified {
+				t.Errorf("Expected an account made from an invitation to be verified")
+			}
+			if _, err := mock.GetMembership("acme", int(user.ID)); err != nil {
+				t.Errorf("Expected the invitee to join acme, got %s", err)
+			}
+
+			// the link only works once
+			req = httptest.NewRequest("POST", "/invitations/"+inv.PublicID+"/accept?token="+inviteToken, strings.NewReader(`{}`))
+			rr = httptest.NewRecorder()
+			r.ServeHTTP(rr, req)
+			if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), errors.InvitationClosed) {
+				t.Errorf("Expected a used invitation to be refused, got %d: %s", rr.Code, rr.Body.String())
+			}
+		})
+	}
+}
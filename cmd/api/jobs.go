@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"the_lonely_road/models"
+	"time"
+)
+
+const (
+	purgeInterval = time.Hour
+)
+
+// startPurgeJob hard deletes accounts whose restore window has passed and personal data exports whose link has expired,
+// it keeps running until stop is closed
+func (app *App) startPurgeJob(interval time.Duration, stop <-chan struct{}) {
+	app.background(func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				purged, err := app.userModel.PurgeDeletedUsers(time.Now())
+				if err != nil {
+					fmt.Println(err)
+				} else if purged > 0 {
+					fmt.Println("Purged deleted users", map[string]int64{
+						"count": purged,
+					})
+				}
+
+				purged, err = app.userModel.PurgeDataExports(time.Now())
+				if err != nil {
+					fmt.Println(err)
+				} else if purged > 0 {
+					fmt.Println("Purged data exports", map[string]int64{
+						"count": purged,
+					})
+				}
+			case <-stop:
+				return
+			}
+		}
+	})
+}
+
+// startSnapshotJob saves the in-memory store every interval until stop is closed, Serve saves it once more after
+func (app *App) startSnapshotJob(store *models.MemoryUserModel, interval time.Duration, stop <-chan struct{}) {
+	app.background(func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				err := store.SaveSnapshot()
+				if err != nil {
+					fmt.Println(err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	})
+}
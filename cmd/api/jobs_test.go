@@ -0,0 +1,77 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"the_lonely_road/models"
+	"time"
+)
+
+func TestApp_startPurgeJob(t *testing.T) {
+	expired := time.Now().Add(-48 * time.Hour)
+	deletedAt := expired.AddDate(0, 0, -30)
+	mockModel := &models.UserModelMock{DB: []*models.User{
+		{ID: 1, Email: "active@example.com"},
+		{ID: 2, Email: "restorable@example.com", DeletedAt: &deletedAt, RestoreExpiry: time.Now().Add(time.Hour)},
+		{ID: 3, Email: "expired@example.com", DeletedAt: &deletedAt, RestoreExpiry: expired},
+	}}
+	app := App{userModel: mockModel}
+
+	stop := make(chan struct{})
+	app.startPurgeJob(10*time.Millisecond, stop)
+	time.Sleep(50 * time.Millisecond)
+	close(stop)
+	// the job has to exit on stop, otherwise graceful shutdown would hang here
+	app.wg.Wait()
+
+	if len(mockModel.DB) != 2 {
+		t.Fatalf("Expected 2 users left after purge, got %d", len(mockModel.DB))
+	}
+	for _, user := range mockModel.DB {
+		if user.Email == "expired@example.com" {
+			t.Errorf("Expected expired account to be purged")
+		}
+	}
+}
+
+func TestApp_startPurgeJob_DataExports(t *testing.T) {
+	mockModel := &models.UserModelMock{DB: []*models.User{{ID: 1, Email: "alice@example.com"}}}
+	_ = mockModel.CreateDataExport(&models.DataExport{UserID: 1, ExpiresAt: time.Now().Add(-time.Minute)})
+	_ = mockModel.CreateDataExport(&models.DataExport{UserID: 1, ExpiresAt: time.Now().Add(time.Hour)})
+	app := App{userModel: mockModel}
+
+	stop := make(chan struct{})
+	app.startPurgeJob(10*time.Millisecond, stop)
+	time.Sleep(50 * time.Millisecond)
+	close(stop)
+	app.wg.Wait()
+
+	if len(mockModel.DataExports) != 1 || !mockModel.DataExports[0].ExpiresAt.After(time.Now()) {
+		t.Errorf("Expected only the expired export to be purged, got %+v", mockModel.DataExports)
+	}
+}
+
+func TestApp_startSnapshotJob(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	store := models.NewMemoryUserModel(models.LockoutPolicy{}, 0, models.Hasher{Current: models.BcryptHasher{Cost: 4}}, nil)
+	err := store.LoadSnapshot(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	err = store.Insert(&models.User{Email: "alice@example.com", Password: "securepassword"})
+	if err != nil {
+		t.Fatalf("Unexpected error inserting user: %s", err)
+	}
+	app := App{userModel: store}
+
+	stop := make(chan struct{})
+	app.startSnapshotJob(store, 10*time.Millisecond, stop)
+	time.Sleep(50 * time.Millisecond)
+	close(stop)
+	app.wg.Wait()
+
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("Expected the job to save a snapshot, got %s", err)
+	}
+}
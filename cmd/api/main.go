@@ -3,9 +3,13 @@ package main
 import (
 	"fmt"
 	"github.com/spf13/viper"
+	"os"
+	"strings"
 	"sync"
+	"the_lonely_road/JWT"
 	"the_lonely_road/mailer"
 	"the_lonely_road/models"
+	"time"
 )
 
 // I did my best to get away with no env variables in a mock service, but I can't expose my SMTP credentials. You win this round, env variables.
@@ -13,6 +17,25 @@ func setViper() {
 	viper.SetConfigFile("email.env")
 	viper.AddConfigPath("./")
 	viper.AutomaticEnv()
+	viper.SetDefault("ACCOUNT_RESTORE_DAYS", 30)
+	viper.SetDefault("PASSWORD_HISTORY", models.DefaultPasswordHistory)
+	viper.SetDefault("PASSWORD_HASH_ALGORITHM", "argon2id")
+	viper.SetDefault("LOGIN_LOCKOUT_THRESHOLD", models.DefaultLockoutPolicy.Threshold)
+	viper.SetDefault("LOGIN_LOCKOUT_DURATION", models.DefaultLockoutPolicy.LockDuration)
+	viper.SetDefault("LOGIN_BACKOFF_BASE", models.DefaultLockoutPolicy.BaseDelay)
+	viper.SetDefault("LOGIN_BACKOFF_MAX", models.DefaultLockoutPolicy.MaxDelay)
+	viper.SetDefault("INVITATION_TTL", models.DefaultInvitationTTL)
+	viper.SetDefault("LOGIN_HISTORY_WINDOW", models.DefaultLoginHistoryWindow)
+	viper.SetDefault("DATA_EXPORT_MAX_INLINE_EVENTS", 1000)
+	viper.SetDefault("DATA_EXPORT_LINK_TTL", models.DefaultDataExportTTL)
+	viper.SetDefault("USER_STORE", userStorePostgres)
+	viper.SetDefault("MEMORY_SNAPSHOT_INTERVAL", time.Minute)
+	viper.SetDefault("USERNAME_CHECK_RATE", 30)
+	viper.SetDefault("USERNAME_CHECK_BURST", 10)
+	viper.SetDefault("SMS_PROVIDER", smsProviderFile)
+	viper.SetDefault("SMS_CODE_TTL", models.DefaultSMSCodeTTL)
+	viper.SetDefault("SMS_CODE_RATE", 5)
+	viper.SetDefault("SMS_CODE_BURST", 3)
 
 	if err := viper.ReadInConfig(); err != nil {
 		panic(fmt.Errorf("init: %w", err))
@@ -23,13 +46,67 @@ type Config struct {
 	cors struct {
 		trustedOrigins []string
 	}
+	// deleted accounts can be restored for this many days before the purge job removes them
+	accountDeletion struct {
+		restoreDays int
+	}
+	// new passwords are hashed with this, older hashes are upgraded on login
+	hasher models.PasswordHasher
+	// user emails are encrypted with this before they are stored, nil keeps them in plaintext
+	cipher *models.FieldCipher
+	// how many previous passwords can't be reused, the current one never can
+	passwordHistory int
+	// failed logins back off and then lock the account, see models.LockoutPolicy
+	lockout models.LockoutPolicy
+	// app_metadata keys copied into every token, user_metadata never is since users can write it
+	metadataClaims []string
+	// organization invitations stop working after this long
+	invitationTTL time.Duration
+	// how far back /users/me/login-history and personal data exports go, nothing is deleted, the audit log keeps
+	// every sign in
+	loginHistoryWindow time.Duration
+	// personal data exports with more audit events than maxInlineEvents are built in the background and emailed
+	// as a link that works for linkTTL
+	dataExport struct {
+		maxInlineEvents int
+		linkTTL         time.Duration
+	}
+	// users are kept in Postgres unless kind is memory, which needs no database. With a snapshot path the
+	// in-memory store is loaded from that file at startup and saved to it every snapshotInterval and on shutdown.
+	userStore struct {
+		kind             string
+		snapshotPath     string
+		snapshotInterval time.Duration
+	}
+	// GET /users/username-available is public, each client IP can make burst checks and then rate a minute
+	usernameCheck struct {
+		rate  int
+		burst int
+	}
+	// texts go through provider, the file provider writes them to logPath or stdout. Codes work for codeTTL, and
+	// each client IP can ask for burst codes for its own phone and then rate a minute.
+	sms struct {
+		provider string
+		logPath  string
+		codeTTL  time.Duration
+		rate     int
+		burst    int
+	}
+	// the first admin is created from these at startup when no user has the admin role yet
+	bootstrapAdmin struct {
+		email    string
+		password string
+	}
 }
 
 type App struct {
 	userModel models.IUserModel
 	emailer   mailer.EmailService
+	sms       mailer.SMSSender
 	Config    Config
 	wg        sync.WaitGroup
+	// smsLimiter is shared by every route that texts a code, SetRoutes makes it
+	smsLimiter *rateLimiter
 }
 
 const (
@@ -40,7 +117,60 @@ func main() {
 	// we use viper to read in our env variables
 	setViper()
 	app := App{}
-	err := app.Serve()
+	app.Config.accountDeletion.restoreDays = viper.GetInt("ACCOUNT_RESTORE_DAYS")
+	hasher, err := models.NewHasher(viper.GetString("PASSWORD_HASH_ALGORITHM"), viper.GetString("PASSWORD_PEPPER"))
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	app.Config.hasher = hasher
+	cipher, err := models.NewFieldCipher(viper.GetString("ENCRYPTION_KEYS"), viper.GetString("ENCRYPTION_INDEX_KEY"))
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	app.Config.cipher = cipher
+	app.Config.passwordHistory = viper.GetInt("PASSWORD_HISTORY")
+	app.Config.lockout = models.LockoutPolicy{
+		Threshold:    viper.GetInt("LOGIN_LOCKOUT_THRESHOLD"),
+		LockDuration: viper.GetDuration("LOGIN_LOCKOUT_DURATION"),
+		BaseDelay:    viper.GetDuration("LOGIN_BACKOFF_BASE"),
+		MaxDelay:     viper.GetDuration("LOGIN_BACKOFF_MAX"),
+	}
+	app.Config.invitationTTL = viper.GetDuration("INVITATION_TTL")
+	app.Config.loginHistoryWindow = viper.GetDuration("LOGIN_HISTORY_WINDOW")
+	app.Config.dataExport.maxInlineEvents = viper.GetInt("DATA_EXPORT_MAX_INLINE_EVENTS")
+	app.Config.dataExport.linkTTL = viper.GetDuration("DATA_EXPORT_LINK_TTL")
+	app.Config.userStore.kind = viper.GetString("USER_STORE")
+	app.Config.userStore.snapshotPath = viper.GetString("MEMORY_SNAPSHOT_PATH")
+	app.Config.userStore.snapshotInterval = viper.GetDuration("MEMORY_SNAPSHOT_INTERVAL")
+	// a comma separated list, viper would only split an env var on spaces
+	app.Config.metadataClaims = strings.FieldsFunc(viper.GetString("METADATA_CLAIMS"), func(r rune) bool { return r == ',' || r == ' ' })
+	app.Config.usernameCheck.rate = viper.GetInt("USERNAME_CHECK_RATE")
+	app.Config.usernameCheck.burst = viper.GetInt("USERNAME_CHECK_BURST")
+	app.Config.sms.provider = viper.GetString("SMS_PROVIDER")
+	app.Config.sms.logPath = viper.GetString("SMS_LOG_PATH")
+	app.Config.sms.codeTTL = viper.GetDuration("SMS_CODE_TTL")
+	app.Config.sms.rate = viper.GetInt("SMS_CODE_RATE")
+	app.Config.sms.burst = viper.GetInt("SMS_CODE_BURST")
+	app.Config.bootstrapAdmin.email = viper.GetString("BOOTSTRAP_ADMIN_EMAIL")
+	app.Config.bootstrapAdmin.password = viper.GetString("BOOTSTRAP_ADMIN_PASSWORD")
+	// `api import`, `api export` and `api reencrypt` work on the database and exit rather than starting the server
+	if len(os.Args) > 1 {
+		err = app.runCommand(os.Args[1:])
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+	// tokens are signed with this, without it anyone could sign their own
+	err = JWT.SetSecretKey(viper.GetString("JWT_SECRET"))
+	if err != nil {
+		fmt.Println(fmt.Errorf("set JWT_SECRET: %w", err))
+		return
+	}
+	err = app.Serve()
 	if err != nil {
 		fmt.Println(err)
 	}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	stdErrors "errors"
+	"net/http"
+	"the_lonely_road/errors"
+	"the_lonely_road/models"
+)
+
+// updateCurrentUserMetadata merge-patches the caller's user_metadata, a null value removes the key
+func (app *App) updateCurrentUserMetadata(w http.ResponseWriter, r *http.Request) {
+	var patch json.RawMessage
+	err := app.readJSON(w, r, &patch)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	user, err := app.userModel.GetByPublicID(app.contextGetSubject(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if !app.ifMatch(r, app.userETag(user)) {
+		http.Error(w, errors.PreconditionFailed, http.StatusPreconditionFailed)
+		return
+	}
+
+	app.writeMetadataPatch(w, user, app.userModel.UpdateUserMetadata(user, patch))
+}
+
+// updateAppMetadata merge-patches the app_metadata of the user in the URL. Keys listed in METADATA_CLAIMS show up
+// in that user's tokens from their next sign in.
+func (app *App) updateAppMetadata(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		http.Error(w, errors.InvalidUserID, http.StatusBadRequest)
+		return
+	}
+
+	var patch json.RawMessage
+	err = app.readJSON(w, r, &patch)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	user, err := app.userModel.GetByPublicID(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if !app.ifMatch(r, app.userETag(user)) {
+		http.Error(w, errors.PreconditionFailed, http.StatusPreconditionFailed)
+		return
+	}
+
+	app.writeMetadataPatch(w, user, app.userModel.UpdateAppMetadata(user, patch))
+}
+
+// writeMetadataPatch answers a metadata update with the patched user and its new tag, or the reason the patch was
+// refused
+func (app *App) writeMetadataPatch(w http.ResponseWriter, user *models.User, err error) {
+	if err != nil {
+		switch {
+		case stdErrors.Is(err, models.ErrMetadataTooLarge):
+			http.Error(w, errors.MetadataTooLarge, http.StatusRequestEntityTooLarge)
+		case stdErrors.Is(err, models.ErrMetadataNotObject):
+			http.Error(w, errors.InvalidMetadata, http.StatusBadRequest)
+		case stdErrors.Is(err, models.ErrRecordNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("ETag", app.userETag(user))
+	err = app.writeJSON(w, http.StatusOK, user)
+	if err != nil {
+		http.Error(w, errors.JsonWriteError, http.StatusInternalServerError)
+		return
+	}
+}
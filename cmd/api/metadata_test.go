@@ -0,0 +1,100 @@
+package main
+
+import (
+	"github.com/go-chi/chi/v5"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"the_lonely_road/errors"
+)
+
+func TestApp_updateCurrentUserMetadata(t *testing.T) {
+	tests := []struct {
+		name          string
+		payload       string
+		ifMatch       string
+		expectedCode  int
+		expectedError string
+		expected      string
+	}{
+		{name: "Set keys", payload: `{"theme": "dark", "lang": "en"}`, expectedCode: http.StatusOK, expected: `{"lang":"en","theme":"dark"}`},
+		{name: "Not an object", payload: `"dark"`, expectedCode: http.StatusBadRequest, expectedError: errors.InvalidMetadata},
+		{name: "Too large", payload: `{"blob": "` + strings.Repeat("x", 17*1024) + `"}`, expectedCode: http.StatusRequestEntityTooLarge,
+			expectedError: errors.MetadataTooLarge},
+		{name: "Bad JSON", payload: `{"theme":`, expectedCode: http.StatusBadRequest},
+		{name: "Stale If-Match", payload: `{"theme": "dark"}`, ifMatch: `"0"`, expectedCode: http.StatusPreconditionFailed,
+			expectedError: errors.PreconditionFailed, expected: `{}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			app, mock := orgTestApp(t)
+			req := httptest.NewRequest("PATCH", "/users/me/metadata", strings.NewReader(test.payload))
+			req = app.contextSetSubject(req, carol)
+			if test.ifMatch != "" {
+				req.Header.Set("If-Match", test.ifMatch)
+			}
+			rr := httptest.NewRecorder()
+
+			app.updateCurrentUserMetadata(rr, req)
+			if rr.Code != test.expectedCode {
+				t.Fatalf("Expected status code %d, got %d: %s", test.expectedCode, rr.Code, rr.Body.String())
+			}
+			if test.expectedError != "" && !strings.Contains(rr.Body.String(), test.expectedError) {
+				t.Errorf("Expected body to contain '%s', got '%s'", test.expectedError, rr.Body.String())
+			}
+			user, _ := mock.GetByID(3)
+			if test.expected != "" && string(user.UserMetadata) != test.expected {
+				t.Errorf("Expected user_metadata %s, got %s", test.expected, user.UserMetadata)
+			}
+			if rr.Code == http.StatusOK && rr.Header().Get("ETag") != app.userETag(user) {
+				t.Errorf("Expected the ETag of the patched user %s, got %s", app.userETag(user), rr.Header().Get("ETag"))
+			}
+			if string(user.AppMetadata) != `{}` {
+				t.Errorf("Expected app_metadata to be left alone, got %s", user.AppMetadata)
+			}
+		})
+	}
+}
+
+func TestApp_updateAppMetadata(t *testing.T) {
+	app, mock := orgTestApp(t)
+	r := chi.NewRouter()
+	r.Patch("/admin/users/{id}/metadata", app.updateAppMetadata)
+
+	tests := []struct {
+		name         string
+		id           string
+		payload      string
+		expectedCode int
+		expected     string
+	}{
+		{name: "Set plan", id: bob, payload: `{"plan": "pro", "seats": 5}`, expectedCode: http.StatusOK, expected: `{"plan":"pro","seats":5}`},
+		{name: "Remove seats", id: bob, payload: `{"seats": null}`, expectedCode: http.StatusOK, expected: `{"plan":"pro"}`},
+		{name: "Unknown user", id: "0190a6e2-5c3b-7c1e-9f3a-000000000009", payload: `{}`, expectedCode: http.StatusNotFound},
+		{name: "Bad id", id: "2", payload: `{}`, expectedCode: http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest("PATCH", "/admin/users/"+test.id+"/metadata", strings.NewReader(test.payload))
+			rr := httptest.NewRecorder()
+
+			r.ServeHTTP(rr, req)
+			if rr.Code != test.expectedCode {
+				t.Fatalf("Expected status code %d, got %d: %s", test.expectedCode, rr.Code, rr.Body.String())
+			}
+			if test.expected == "" {
+				return
+			}
+			user, _ := mock.GetByID(2)
+			if string(user.AppMetadata) != test.expected {
+				t.Errorf("Expected app_metadata %s, got %s", test.expected, user.AppMetadata)
+			}
+			if !strings.Contains(rr.Body.String(), `"app_metadata"`) {
+				t.Errorf("Expected the patched user in the response, got %s", rr.Body.String())
+			}
+		})
+	}
+}
@@ -1,8 +1,14 @@
 package main
 
 import (
+	stdErrors "errors"
 	"fmt"
+	"github.com/go-chi/chi/v5"
 	"net/http"
+	"the_lonely_road/JWT"
+	"the_lonely_road/errors"
+	"the_lonely_road/models"
+	"the_lonely_road/validator"
 )
 
 func (app *App) recoverPanic(next http.Handler) http.Handler {
@@ -20,6 +26,25 @@ func (app *App) recoverPanic(next http.Handler) http.Handler {
 	})
 }
 
+// requestID tags every request with an id, echoed back in X-Request-Id and written to the audit log. A well-formed
+// id from an upstream proxy is kept so its logs line up with ours.
+func (app *App) requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-Id")
+		if !validator.Matches(id, validator.RequestIDRX) {
+			var err error
+			id, err = models.NewPublicID()
+			if err != nil {
+				http.Error(w, errors.InternalServerError, http.StatusInternalServerError)
+				return
+			}
+		}
+		w.Header().Set("X-Request-Id", id)
+
+		next.ServeHTTP(w, app.contextSetRequestID(r, id))
+	})
+}
+
 func (app *App) enableCORS(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// We can't guarantee the Access control header will be in every request, so add it as vary
@@ -72,3 +97,87 @@ func (app *App) RequireCookieMiddleware(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+// requireAuthenticatedUser validates the auth token and stores its claims in the request context. The token only
+// proves who signed in, its subject has to still be an account that isn't deleted.
+func (app *App) requireAuthenticatedUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cookie, err := r.Cookie("auth_token")
+		if err != nil || cookie.Value == "" {
+			http.Error(w, "Please sign in to use this resource", http.StatusUnauthorized)
+			return
+		}
+
+		claims, err := JWT.ParseJWT(cookie.Value)
+		if err != nil {
+			http.Error(w, errors.Unauthorized, http.StatusUnauthorized)
+			return
+		}
+		user, err := app.userModel.GetByPublicID(claims.Subject)
+		if err != nil {
+			switch {
+			case stdErrors.Is(err, models.ErrRecordNotFound):
+				http.Error(w, errors.Unauthorized, http.StatusUnauthorized)
+			default:
+				http.Error(w, errors.InternalServerError, http.StatusInternalServerError)
+			}
+			return
+		}
+		if user.DeletedAt != nil {
+			http.Error(w, errors.Unauthorized, http.StatusUnauthorized)
+			return
+		}
+
+		// roles and memberships change while tokens live for a day, so the claims the checks below read are the
+		// ones the store has now rather than the ones the token was issued with
+		claims.Roles, claims.Permissions = user.Roles, user.Permissions
+		if claims.Org != "" {
+			membership, err := app.userModel.GetMembership(claims.Org, int(user.ID))
+			switch {
+			case stdErrors.Is(err, models.ErrNotMember):
+				claims.Org, claims.OrgRole = "", ""
+			case err != nil:
+				http.Error(w, errors.InternalServerError, http.StatusInternalServerError)
+				return
+			default:
+				claims.OrgRole = membership.Role
+			}
+		}
+
+		next.ServeHTTP(w, app.contextSetClaims(r, claims))
+	})
+}
+
+// requireOrgRole has to sit behind requireAuthenticatedUser inside a route with an {org} parameter. The token must
+// have been issued for that organization, the user must still be a member and, when roles are given, hold one of them.
+func (app *App) requireOrgRole(roles ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims := app.contextGetClaims(r)
+			if claims.Org == "" || claims.Org != chi.URLParam(r, "org") {
+				http.Error(w, errors.NotOrgMember, http.StatusForbidden)
+				return
+			}
+			if len(roles) > 0 && !validator.PermittedValue(claims.OrgRole, roles...) {
+				http.Error(w, errors.OrgRoleRequired, http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// requirePermission has to sit behind requireAuthenticatedUser, it rejects users whose roles don't grant permission
+func (app *App) requirePermission(permission string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !app.contextGetClaims(r).HasPermission(permission) {
+				http.Error(w, errors.Forbidden, http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
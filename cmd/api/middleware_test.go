@@ -4,10 +4,22 @@ import (
 	"github.com/go-chi/chi/v5"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"strings"
 	"testing"
+	"the_lonely_road/JWT"
 	"the_lonely_road/models"
+	"time"
 )
 
+// TestMain gives the tests a signing key, main refuses to start without one
+func TestMain(m *testing.M) {
+	if err := JWT.SetSecretKey(strings.Repeat("k", JWT.MinSecretKeyLength)); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
 func TestRecoverPanicMiddleware(t *testing.T) {
 	app := App{userModel: &models.UserModelMock{DB: []*models.User{}}}
 	// Create a new Chi router and apply the recoverPanic middleware
@@ -176,3 +188,211 @@ func TestRequireCookieMiddleware_SadPath(t *testing.T) {
 	}
 
 }
+
+func TestRequireAuthenticatedUser(t *testing.T) {
+	deletedAt := time.Now()
+	app := &App{userModel: &models.UserModelMock{DB: []*models.User{
+		{ID: 1, PublicID: "0190a6e2-5c3b-7c1e-9f3a-2b4c6d8e0f12", Email: "alice@example.com"},
+		{ID: 2, PublicID: "0190a6e2-5c3b-7c1e-9f3a-2b4c6d8e0f13", Email: "bob@example.com", DeletedAt: &deletedAt},
+	}}}
+
+	r := chi.NewRouter()
+	r.Use(app.requireAuthenticatedUser)
+	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(app.contextGetSubject(r)))
+	})
+
+	token := func(subject string) string {
+		token, err := JWT.GenerateJWT(subject)
+		if err != nil {
+			t.Fatalf("Unexpected error generating token: %v", err)
+		}
+		return token
+	}
+
+	tests := []struct {
+		name         string
+		cookie       *http.Cookie
+		expectedCode int
+		expectedBody string
+	}{
+		{
+			name:         "Valid token",
+			cookie:       &http.Cookie{Name: "auth_token", Value: token("0190a6e2-5c3b-7c1e-9f3a-2b4c6d8e0f12")},
+			expectedCode: http.StatusOK,
+			expectedBody: "0190a6e2-5c3b-7c1e-9f3a-2b4c6d8e0f12",
+		},
+		{
+			name:         "No cookie",
+			expectedCode: http.StatusUnauthorized,
+			expectedBody: "Please sign in to use this resource\n",
+		},
+		{
+			name:         "Forged token",
+			cookie:       &http.Cookie{Name: "auth_token", Value: "example_token"},
+			expectedCode: http.StatusUnauthorized,
+			expectedBody: "Unauthorized\n",
+		},
+		{
+			name:         "Unknown subject",
+			cookie:       &http.Cookie{Name: "auth_token", Value: token("0190a6e2-5c3b-7c1e-9f3a-2b4c6d8e0f99")},
+			expectedCode: http.StatusUnauthorized,
+			expectedBody: "Unauthorized\n",
+		},
+		{
+			name:         "Deleted account",
+			cookie:       &http.Cookie{Name: "auth_token", Value: token("0190a6e2-5c3b-7c1e-9f3a-2b4c6d8e0f13")},
+			expectedCode: http.StatusUnauthorized,
+			expectedBody: "Unauthorized\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			if test.cookie != nil {
+				req.AddCookie(test.cookie)
+			}
+			rr := httptest.NewRecorder()
+
+			r.ServeHTTP(rr, req)
+
+			if rr.Code != test.expectedCode {
+				t.Errorf("Expected status %d, got %d", test.expectedCode, rr.Code)
+			}
+			if rr.Body.String() != test.expectedBody {
+				t.Errorf("Expected body '%s', got '%s'", test.expectedBody, rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestRequirePermission(t *testing.T) {
+	app := &App{userModel: &models.UserModelMock{DB: []*models.User{
+		{ID: 1, PublicID: "0190a6e2-5c3b-7c1e-9f3a-2b4c6d8e0f12", Roles: []string{models.RoleAdmin}, Permissions: models.DefaultRolePermissions[models.RoleAdmin]},
+		{ID: 2, PublicID: "0190a6e2-5c3b-7c1e-9f3a-2b4c6d8e0f13", Roles: []string{models.RoleSupport}, Permissions: models.DefaultRolePermissions[models.RoleSupport]},
+		{ID: 3, PublicID: "0190a6e2-5c3b-7c1e-9f3a-2b4c6d8e0f14"},
+	}}}
+
+	r := chi.NewRouter()
+	r.Use(app.requireAuthenticatedUser)
+	r.Use(app.requirePermission(models.PermissionUsersAdmin))
+	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	adminToken, err := JWT.GenerateJWT("0190a6e2-5c3b-7c1e-9f3a-2b4c6d8e0f12")
+	if err != nil {
+		t.Fatalf("Unexpected error generating token: %v", err)
+	}
+	supportToken, err := JWT.GenerateJWT("0190a6e2-5c3b-7c1e-9f3a-2b4c6d8e0f13")
+	if err != nil {
+		t.Fatalf("Unexpected error generating token: %v", err)
+	}
+	userToken, err := JWT.GenerateJWT("0190a6e2-5c3b-7c1e-9f3a-2b4c6d8e0f14")
+	if err != nil {
+		t.Fatalf("Unexpected error generating token: %v", err)
+	}
+	// issued while the user was still an admin, the role has been revoked since
+	staleToken, err := JWT.GenerateJWTWithClaims(JWT.Claims{
+		Subject:     "0190a6e2-5c3b-7c1e-9f3a-2b4c6d8e0f14",
+		Roles:       []string{models.RoleAdmin},
+		Permissions: models.DefaultRolePermissions[models.RoleAdmin],
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error generating token: %v", err)
+	}
+
+	tests := []struct {
+		name         string
+		token        string
+		expectedCode int
+	}{
+		{name: "Admin token", token: adminToken, expectedCode: http.StatusOK},
+		{name: "Support token", token: supportToken, expectedCode: http.StatusForbidden},
+		{name: "User token", token: userToken, expectedCode: http.StatusForbidden},
+		{name: "Revoked role", token: staleToken, expectedCode: http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.AddCookie(&http.Cookie{Name: "auth_token", Value: test.token})
+			rr := httptest.NewRecorder()
+
+			r.ServeHTTP(rr, req)
+
+			if rr.Code != test.expectedCode {
+				t.Errorf("Expected status %d, got %d", test.expectedCode, rr.Code)
+			}
+		})
+	}
+}
+
+func TestRequireOrgRole(t *testing.T) {
+	mock := &models.UserModelMock{DB: []*models.User{
+		{ID: 1, PublicID: "owner"}, {ID: 2, PublicID: "member"}, {ID: 3, PublicID: "someone"}, {ID: 4, PublicID: "demoted"}, {ID: 5, PublicID: "removed"},
+	}}
+	mock.Memberships = []*models.Membership{
+		{OrgID: 2, OrgSlug: "acme", UserID: 1, Role: models.OrgRoleOwner},
+		{OrgID: 2, OrgSlug: "acme", UserID: 2, Role: models.OrgRoleMember},
+		{OrgID: 2, OrgSlug: "acme", UserID: 4, Role: models.OrgRoleMember},
+	}
+	app := &App{userModel: mock}
+
+	r := chi.NewRouter()
+	r.Use(app.requireAuthenticatedUser)
+	r.Route("/orgs/{org}", func(r chi.Router) {
+		r.With(app.requireOrgRole()).Get("/members", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		})
+		r.With(app.requireOrgRole(models.OrgRoleOwner)).Delete("/members", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		})
+	})
+
+	token := func(claims JWT.Claims) string {
+		token, err := JWT.GenerateJWTWithClaims(claims)
+		if err != nil {
+			t.Fatalf("Unexpected error generating token: %v", err)
+		}
+		return token
+	}
+	ownerToken := token(JWT.Claims{Subject: "owner", Org: "acme", OrgRole: models.OrgRoleOwner})
+	memberToken := token(JWT.Claims{Subject: "member", Org: "acme", OrgRole: models.OrgRoleMember})
+	unscopedToken := token(JWT.Claims{Subject: "someone"})
+	// both were owners when they signed in
+	demotedToken := token(JWT.Claims{Subject: "demoted", Org: "acme", OrgRole: models.OrgRoleOwner})
+	removedToken := token(JWT.Claims{Subject: "removed", Org: "acme", OrgRole: models.OrgRoleOwner})
+
+	tests := []struct {
+		name         string
+		method       string
+		path         string
+		token        string
+		expectedCode int
+	}{
+		{name: "Member lists", method: "GET", path: "/orgs/acme/members", token: memberToken, expectedCode: http.StatusOK},
+		{name: "Owner removes", method: "DELETE", path: "/orgs/acme/members", token: ownerToken, expectedCode: http.StatusOK},
+		{name: "Member removes", method: "DELETE", path: "/orgs/acme/members", token: memberToken, expectedCode: http.StatusForbidden},
+		{name: "Other organization", method: "GET", path: "/orgs/other/members", token: ownerToken, expectedCode: http.StatusForbidden},
+		{name: "Unscoped token", method: "GET", path: "/orgs/acme/members", token: unscopedToken, expectedCode: http.StatusForbidden},
+		{name: "Demoted since sign in", method: "DELETE", path: "/orgs/acme/members", token: demotedToken, expectedCode: http.StatusForbidden},
+		{name: "Removed since sign in", method: "GET", path: "/orgs/acme/members", token: removedToken, expectedCode: http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(test.method, test.path, nil)
+			req.AddCookie(&http.Cookie{Name: "auth_token", Value: test.token})
+			rr := httptest.NewRecorder()
+
+			r.ServeHTTP(rr, req)
+
+			if rr.Code != test.expectedCode {
+				t.Errorf("Expected status %d, got %d", test.expectedCode, rr.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	stdErrors "errors"
+	"github.com/go-chi/chi/v5"
+	"net/http"
+	"the_lonely_road/errors"
+	"the_lonely_road/models"
+	"the_lonely_road/validator"
+	"time"
+)
+
+// orgMembership finds the membership a new token for user should be scoped to. With no slug it falls back to the
+// default organization, and a user who isn't in that gets an unscoped token rather than an error.
+func (app *App) orgMembership(user *models.User, slug string) (*models.Membership, error) {
+	if slug != "" {
+		return app.userModel.GetMembership(slug, int(user.ID))
+	}
+	membership, err := app.userModel.GetMembership(models.DefaultOrgSlug, int(user.ID))
+	if stdErrors.Is(err, models.ErrNotMember) {
+		return nil, nil
+	}
+	return membership, err
+}
+
+// createOrg creates an organization owned by the signed-in user, who has to sign in to it to manage it
+func (app *App) createOrg(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Name string `json:"name"`
+		Slug string `json:"slug"`
+	}
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	org := models.Organization{Name: payload.Name, Slug: payload.Slug, CreatedAt: time.Now()}
+	v := validator.New()
+	if models.ValidateOrganization(v, &org); !v.Valid() {
+		v.AddError("message", errors.InvalidOrganization)
+		http.Error(w, v.Errors["message"], http.StatusBadRequest)
+		return
+	}
+
+	user, err := app.userModel.GetByPublicID(app.contextGetSubject(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	err = app.userModel.CreateOrganization(&org, int(user.ID))
+	if err != nil {
+		switch {
+		case stdErrors.Is(err, models.ErrDuplicateSlug):
+			http.Error(w, models.ErrDuplicateSlug.Error(), http.StatusConflict)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, &org)
+	if err != nil {
+		http.Error(w, errors.JsonWriteError, http.StatusInternalServerError)
+		return
+	}
+}
+
+// listOrgMembers lists everyone in the organization in the URL, any member can see it
+func (app *App) listOrgMembers(w http.ResponseWriter, r *http.Request) {
+	org, err := app.userModel.GetOrganization(chi.URLParam(r, "org"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	members, err := app.userModel.ListMembers(int(org.ID))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, map[string]any{"organization": org, "members": members})
+	if err != nil {
+		http.Error(w, errors.JsonWriteError, http.StatusInternalServerError)
+		return
+	}
+}
+
+// removeOrgMember takes the user in the URL out of the organization. Admins can remove members and other
+// admins, only an owner can remove an owner, and the last owner can't be removed at all.
+func (app *App) removeOrgMember(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		http.Error(w, errors.InvalidUserID, http.StatusBadRequest)
+		return
+	}
+
+	org, err := app.userModel.GetOrganization(chi.URLParam(r, "org"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	user, err := app.userModel.GetByPublicID(id)
+	if err != nil {
+		http.Error(w, errors.MemberNotFound, http.StatusNotFound)
+		return
+	}
+	membership, err := app.userModel.GetMembership(org.Slug, int(user.ID))
+	if err != nil {
+		http.Error(w, errors.MemberNotFound, http.StatusNotFound)
+		return
+	}
+	if membership.Role == models.OrgRoleOwner && app.contextGetClaims(r).OrgRole != models.OrgRoleOwner {
+		http.Error(w, errors.OrgRoleRequired, http.StatusForbidden)
+		return
+	}
+
+	err = app.userModel.RemoveMember(int(org.ID), int(user.ID))
+	if err != nil {
+		switch {
+		case stdErrors.Is(err, models.ErrLastOwner):
+			http.Error(w, errors.LastOwner, http.StatusConflict)
+		case stdErrors.Is(err, models.ErrNotMember):
+			http.Error(w, errors.MemberNotFound, http.StatusNotFound)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, errors.MemberRemoved)
+	if err != nil {
+		http.Error(w, errors.JsonWriteError, http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/go-chi/chi/v5"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"the_lonely_road/JWT"
+	"the_lonely_road/errors"
+	"the_lonely_road/models"
+	"time"
+)
+
+// orgTestApp has alice owning acme with bob as an admin and carol as a plain member, everyone is also in the default organization
+func orgTestApp(t *testing.T) (*App, *models.UserModelMock) {
+	mock := &models.UserModelMock{DB: []*models.User{}}
+	for i, user := range []*models.User{
+		{PublicID: alice, Email: "alice@example.com"},
+		{PublicID: bob, Email: "bob@example.com"},
+		{PublicID: carol, Email: "carol@example.com"},
+	} {
+		user.ID = int64(i + 1)
+		user.Password = "securepassword"
+		user.CreatedAt = time.Now()
+		err := mock.Insert(user)
+		if err != nil {
+			t.Fatalf("Unexpected error in inserting user: %s", err)
+		}
+	}
+	org := &models.Organization{Slug: "acme", Name: "Acme", CreatedAt: time.Now()}
+	err := mock.CreateOrganization(org, 1)
+	if err != nil {
+		t.Fatalf("Unexpected error in creating organization: %s", err)
+	}
+	mock.Memberships = append(mock.Memberships,
+		&models.Membership{OrgID: org.ID, OrgSlug: org.Slug, UserID: 2, Role: models.OrgRoleAdmin},
+		&models.Membership{OrgID: org.ID, OrgSlug: org.Slug, UserID: 3, Role: models.OrgRoleMember},
+	)
+	return &App{userModel: mock}, mock
+}
+
+func TestApp_Authenticate_Org(t *testing.T) {
+	app, _ := orgTestApp(t)
+
+	tests := []struct {
+		name            string
+		payload         string
+		expectedCode    int
+		expectedOrg     string
+		expectedOrgRole string
+	}{
+		{name: "Default organization", payload: `{"email": "bob@example.com", "password": "securepassword"}`,
+			expectedCode: http.StatusOK, expectedOrg: models.DefaultOrgSlug, expectedOrgRole: models.OrgRoleMember},
+		{name: "Chosen organization", payload: `{"email": "bob@example.com", "password": "securepassword", "org": "acme"}`,
+			expectedCode: http.StatusOK, expectedOrg: "acme", expectedOrgRole: models.OrgRoleAdmin},
+		{name: "Not a member", payload: `{"email": "bob@example.com", "password": "securepassword", "org": "globex"}`,
+			expectedCode: http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/users/login", bytes.NewBufferString(test.payload))
+			rr := httptest.NewRecorder()
+
+			app.Authenticate(rr, req)
+			if rr.Code != test.expectedCode {
+				t.Fatalf("Expected status code %d, got %d: %s", test.expectedCode, rr.Code, rr.Body.String())
+			}
+			if test.expectedCode != http.StatusOK {
+				if !strings.Contains(rr.Body.String(), errors.NotOrgMember) {
+					t.Errorf("Expected body to contain '%s', got '%s'", errors.NotOrgMember, rr.Body.String())
+				}
+				return
+			}
+			claims, err := JWT.ParseJWT(rr.Result().Cookies()[0].Value)
+			if err != nil {
+				t.Fatalf("Unexpected error parsing token: %s", err)
+			}
+			if claims.Org != test.expectedOrg || claims.OrgRole != test.expectedOrgRole {
+				t.Errorf("Expected %s of %s, got %s of %s", test.expectedOrgRole, test.expectedOrg, claims.OrgRole, claims.Org)
+			}
+		})
+	}
+}
+
+func TestApp_createOrg(t *testing.T) {
+	app, mock := orgTestApp(t)
+
+	tests := []struct {
+		name         string
+		payload      string
+		expectedCode int
+	}{
+		{name: "Create", payload: `{"name": "Globex", "slug": "globex"}`, expectedCode: http.StatusOK},
+		{name: "Slug taken", payload: `{"name": "Acme", "slug": "acme"}`, expectedCode: http.StatusConflict},
+		{name: "Bad slug", payload: `{"name": "Initech", "slug": "Initech Corp"}`, expectedCode: http.StatusBadRequest},
+		{name: "Missing name", payload: `{"slug": "initech"}`, expectedCode: http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/orgs", strings.NewReader(test.payload))
+			req = app.contextSetSubject(req, carol)
+			rr := httptest.NewRecorder()
+
+			app.createOrg(rr, req)
+			if rr.Code != test.expectedCode {
+				t.Errorf("Expected status code %d, got %d: %s", test.expectedCode, rr.Code, rr.Body.String())
+			}
+		})
+	}
+
+	membership, err := mock.GetMembership("globex", 3)
+	if err != nil || membership.Role != models.OrgRoleOwner {
+		t.Errorf("Expected carol to own globex, got %+v, %v", membership, err)
+	}
+}
+
+func TestApp_listOrgMembers(t *testing.T) {
+	app, _ := orgTestApp(t)
+	r := chi.NewRouter()
+	r.Get("/orgs/{org}/members", app.listOrgMembers)
+
+	req := httptest.NewRequest("GET", "/orgs/acme/members", nil)
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, rr.Code)
+	}
+
+	var response struct {
+		Organization models.Organization  `json:"organization"`
+		Members      []*models.Membership `json:"members"`
+	}
+	err := json.Unmarshal(rr.Body.Bytes(), &response)
+	if err != nil {
+		t.Fatalf("Error unmarshaling JSON: %v", err)
+	}
+	if response.Organization.Slug != "acme" || len(response.Members) != 3 {
+		t.Fatalf("Expected three members of acme, got %+v", response)
+	}
+	if response.Members[0].UserPublicID != alice || response.Members[0].Role != models.OrgRoleOwner {
+		t.Errorf("Expected alice to be listed first as owner, got %+v", response.Members[0])
+	}
+}
+
+func TestApp_removeOrgMember(t *testing.T) {
+	tests := []struct {
+		name          string
+		callerRole    string
+		target        string
+		expectedCode  int
+		expectedError string
+	}{
+		{name: "Admin removes member", callerRole: models.OrgRoleAdmin, target: carol, expectedCode: http.StatusOK},
+		{name: "Admin removes owner", callerRole: models.OrgRoleAdmin, target: alice, expectedCode: http.StatusForbidden, expectedError: errors.OrgRoleRequired},
+		{name: "Last owner", callerRole: models.OrgRoleOwner, target: alice, expectedCode: http.StatusConflict, expectedError: errors.LastOwner},
+		{name: "Not a member", callerRole: models.OrgRoleOwner, target: "0190a6e2-5c3b-7c1e-9f3a-000000000009", expectedCode: http.StatusNotFound, expectedError: errors.MemberNotFound},
+		{name: "Bad id", callerRole: models.OrgRoleOwner, target: "3", expectedCode: http.StatusBadRequest, expectedError: errors.InvalidUserID},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			app, mock := orgTestApp(t)
+			r := chi.NewRouter()
+			r.Delete("/orgs/{org}/members/{id}", app.removeOrgMember)
+
+			req := httptest.NewRequest("DELETE", "/orgs/acme/members/"+test.target, nil)
+			req = app.contextSetClaims(req, &JWT.Claims{Subject: bob, Org: "acme", OrgRole: test.callerRole})
+			rr := httptest.NewRecorder()
+
+			r.ServeHTTP(rr, req)
+			if rr.Code != test.expectedCode {
+				t.Errorf("Expected status code %d, got %d", test.expectedCode, rr.Code)
+			}
+			if test.expectedError != "" && !strings.Contains(rr.Body.String(), test.expectedError) {
+				t.Errorf("Expected body to contain '%s', got '%s'", test.expectedError, rr.Body.String())
+			}
+			if test.expectedCode == http.StatusOK {
+				if _, err := mock.GetMembership("acme", 3); err == nil {
+					t.Errorf("Expected carol to be removed from acme")
+				}
+			}
+		})
+	}
+}
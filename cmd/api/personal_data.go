@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"the_lonely_road/errors"
+	"the_lonely_road/models"
+	"the_lonely_road/token"
+	"time"
+)
+
+const personalDataFilename = `attachment; filename="personal-data.json"`
+
+// getPersonalDataExport hands the caller a copy of everything stored about them. Password and token hashes are
+// never part of it. Most accounts get the file straight away, one with more audit events than
+// DATA_EXPORT_MAX_INLINE_EVENTS is built in the background and the download link is emailed instead.
+func (app *App) getPersonalDataExport(w http.ResponseWriter, r *http.Request) {
+	user, err := app.userModel.GetByPublicID(app.contextGetSubject(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	// a single row page is enough to learn the total
+	_, metadata, err := app.userModel.ListAuditEvents(models.AuditFilters{
+		Filters: models.Filters{Page: 1, PageSize: 1, Sort: "created_at", SortSafelist: models.AuditSortSafelist},
+		User:    user.PublicID,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	app.audit(r, models.AuditEvent{Type: models.AuditDataExported, ActorID: user.PublicID, SubjectID: user.PublicID, Email: user.Email})
+	sessionsSince := time.Now().Add(-app.loginHistoryWindow())
+
+	if metadata.TotalRecords > app.dataExportMaxInlineEvents() {
+		app.background(func() {
+			err := app.emailDataExport(user, sessionsSince)
+			if err != nil {
+				fmt.Println(err)
+			}
+		})
+		err = app.writeJSON(w, http.StatusAccepted, map[string]string{"message": errors.DataExportEmailed})
+		if err != nil {
+			http.Error(w, errors.JsonWriteError, http.StatusInternalServerError)
+			return
+		}
+		return
+	}
+
+	data, err := models.CollectPersonalData(app.userModel, user, sessionsSince)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Disposition", personalDataFilename)
+	err = app.writeJSON(w, http.StatusOK, data)
+	if err != nil {
+		http.Error(w, errors.JsonWriteError, http.StatusInternalServerError)
+		return
+	}
+}
+
+// emailDataExport collects and stores user's personal data and emails them a link to it, only the link's token
+// hash is kept
+func (app *App) emailDataExport(user *models.User, sessionsSince time.Time) error {
+	data, err := models.CollectPersonalData(app.userModel, user, sessionsSince)
+	if err != nil {
+		return err
+	}
+	content, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	downloadToken, salt, err := token.GenerateTokenAndSalt(32, 16)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	export := models.DataExport{
+		UserID:    user.ID,
+		TokenHash: token.HashToken(downloadToken, salt),
+		TokenSalt: salt,
+		Content:   content,
+		CreatedAt: now,
+		ExpiresAt: now.Add(app.dataExportLinkTTL()),
+	}
+	err = app.userModel.CreateDataExport(&export)
+	if err != nil {
+		return err
+	}
+
+	downloadURL := fmt.Sprintf("localhost:8080/users/me/exports/%s?token=%s", export.PublicID, downloadToken)
+	return app.emailer.DataExportReady(user.Email, downloadURL, export.ExpiresAt)
+}
+
+// downloadPersonalDataExport serves an export built by emailDataExport. It needs both the emailed token and the
+// account it was made for, so a forwarded link is no use to anyone else.
+func (app *App) downloadPersonalDataExport(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		http.Error(w, errors.DataExportNotFound, http.StatusNotFound)
+		return
+	}
+	export, err := app.userModel.GetDataExport(id)
+	if err != nil {
+		http.Error(w, errors.DataExportNotFound, http.StatusNotFound)
+		return
+	}
+	user, err := app.userModel.GetByPublicID(app.contextGetSubject(r))
+	if err != nil || user.ID != export.UserID {
+		http.Error(w, errors.DataExportNotFound, http.StatusNotFound)
+		return
+	}
+	if !token.IsValidToken(r.URL.Query().Get("token"), export.TokenHash, export.TokenSalt) {
+		http.Error(w, errors.InvalidToken, http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", personalDataFilename)
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(export.Content)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+func (app *App) dataExportMaxInlineEvents() int {
+	if app.Config.dataExport.maxInlineEvents < 0 {
+		return 0
+	}
+	return app.Config.dataExport.maxInlineEvents
+}
+
+func (app *App) dataExportLinkTTL() time.Duration {
+	if app.Config.dataExport.linkTTL <= 0 {
+		return models.DefaultDataExportTTL
+	}
+	return app.Config.dataExport.linkTTL
+}
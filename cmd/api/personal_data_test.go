@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/go-chi/chi/v5"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"the_lonely_road/errors"
+	"the_lonely_road/models"
+	"the_lonely_road/token"
+	"time"
+)
+
+func TestApp_getPersonalDataExport(t *testing.T) {
+	tests := []struct {
+		name            string
+		maxInlineEvents int
+		expectedCode    int
+		expectedExports int
+	}{
+		{name: "Inline", maxInlineEvents: 10, expectedCode: http.StatusOK},
+		{name: "Emailed", maxInlineEvents: 0, expectedCode: http.StatusAccepted, expectedExports: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			app, mock := orgTestApp(t)
+			app.Config.dataExport.maxInlineEvents = test.maxInlineEvents
+			_ = mock.RecordAuditEvent(&models.AuditEvent{Type: models.AuditLoginSucceeded, SubjectID: alice, Method: models.LoginMethodPassword, CreatedAt: time.Now()})
+			req := httptest.NewRequest("GET", "/users/me/export", nil)
+			req = app.contextSetSubject(req, alice)
+			rr := httptest.NewRecorder()
+
+			app.getPersonalDataExport(rr, req)
+			// the emailed export is stored before the email fails, there is no SMTP server in tests
+			app.wg.Wait()
+			if rr.Code != test.expectedCode {
+				t.Fatalf("Expected status code %d, got %d: %s", test.expectedCode, rr.Code, rr.Body.String())
+			}
+			if len(mock.DataExports) != test.expectedExports {
+				t.Fatalf("Expected %d stored exports, got %d", test.expectedExports, len(mock.DataExports))
+			}
+			last := mock.AuditEvents[len(mock.AuditEvents)-1]
+			if last.Type != models.AuditDataExported || last.ActorID != alice {
+				t.Errorf("Expected the export to be audited, got %+v", last)
+			}
+
+			body := rr.Body.Bytes()
+			if test.expectedCode == http.StatusAccepted {
+				if !strings.Contains(rr.Body.String(), errors.DataExportEmailed) {
+					t.Errorf("Expected body to contain '%s', got '%s'", errors.DataExportEmailed, rr.Body.String())
+				}
+				body = mock.DataExports[0].Content
+			} else if !strings.Contains(rr.Header().Get("Content-Disposition"), "attachment") {
+				t.Errorf("Expected the export as an attachment, got %q", rr.Header().Get("Content-Disposition"))
+			}
+			var data models.PersonalData
+			err := json.Unmarshal(body, &data)
+			if err != nil {
+				t.Fatalf("Error unmarshaling JSON: %v", err)
+			}
+			if data.Profile.PublicID != alice || len(data.Sessions) != 1 || len(data.Organizations) != 2 {
+				t.Errorf("Expected alice's profile, sign in and organizations, got %+v", data)
+			}
+			if strings.Contains(string(body), mock.DB[0].Password) {
+				t.Errorf("Expected the password hash to be left out")
+			}
+		})
+	}
+}
+
+func TestApp_downloadPersonalDataExport(t *testing.T) {
+	app, mock := orgTestApp(t)
+	downloadToken, salt, err := token.GenerateTokenAndSalt(32, 16)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	export := &models.DataExport{UserID: 1, TokenHash: token.HashToken(downloadToken, salt), TokenSalt: salt,
+		Content: []byte(`{"profile":{}}`), CreatedAt: time.Now(), ExpiresAt: time.Now().Add(time.Hour)}
+	err = mock.CreateDataExport(export)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	tests := []struct {
+		name         string
+		subject      string
+		id           string
+		token        string
+		expectedCode int
+	}{
+		{name: "Valid", subject: alice, id: export.PublicID, token: downloadToken, expectedCode: http.StatusOK},
+		{name: "Wrong token", subject: alice, id: export.PublicID, token: "wrong", expectedCode: http.StatusBadRequest},
+		{name: "Someone else's export", subject: bob, id: export.PublicID, token: downloadToken, expectedCode: http.StatusNotFound},
+		{name: "Unknown export", subject: alice, id: "0190a6e2-5c3b-7c1e-9f3a-0000000000ff", token: downloadToken, expectedCode: http.StatusNotFound},
+		{name: "Invalid id", subject: alice, id: "1", token: downloadToken, expectedCode: http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := chi.NewRouter()
+			r.Get("/users/me/exports/{id}", app.downloadPersonalDataExport)
+
+			req := httptest.NewRequest("GET", "/users/me/exports/"+test.id+"?token="+test.token, nil)
+			req = app.contextSetSubject(req, test.subject)
+			rr := httptest.NewRecorder()
+
+			r.ServeHTTP(rr, req)
+			if rr.Code != test.expectedCode {
+				t.Fatalf("Expected status code %d, got %d: %s", test.expectedCode, rr.Code, rr.Body.String())
+			}
+			if test.expectedCode == http.StatusOK && rr.Body.String() != string(export.Content) {
+				t.Errorf("Expected the stored export, got %s", rr.Body.String())
+			}
+		})
+	}
+}
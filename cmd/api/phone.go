@@ -0,0 +1,305 @@
+package main
+
+import (
+	stdErrors "errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"the_lonely_road/errors"
+	"the_lonely_road/mailer"
+	"the_lonely_road/models"
+	"the_lonely_road/token"
+	"the_lonely_road/validator"
+	"time"
+)
+
+// smsResendInterval is how long a user waits before another code is texted for the same purpose
+const smsResendInterval = time.Minute
+
+// smsAttemptWindow is how long wrong guesses carry over to the next code texted for the same purpose. Without it every
+// new code would come with MaxSMSCodeAttempts more guesses.
+const smsAttemptWindow = time.Hour
+
+// errInvalidSMSCode covers every reason a texted code is refused, callers shouldn't learn which
+var errInvalidSMSCode = stdErrors.New("invalid sms code")
+
+// SMS providers SMS_PROVIDER can pick
+const (
+	smsProviderFile = "file"
+)
+
+// newSMSSender is the SMSSender SMS_PROVIDER names, file writes texts to logPath or stdout instead of sending them
+func newSMSSender(provider, logPath string) (mailer.SMSSender, error) {
+	switch provider {
+	case smsProviderFile, "":
+		return &mailer.FileSMSSender{Path: logPath}, nil
+	}
+	return nil, fmt.Errorf("unknown SMS_PROVIDER %q, use %s", provider, smsProviderFile)
+}
+
+func (app *App) smsCodeTTL() time.Duration {
+	if app.Config.sms.codeTTL <= 0 {
+		return models.DefaultSMSCodeTTL
+	}
+	return app.Config.sms.codeTTL
+}
+
+// sendSMSCode texts a new code for purpose to phone, replacing the user's last one. If the last one went out less
+// than smsResendInterval ago nothing is sent and how long is left to wait is returned instead. The new code starts
+// with the attempts used on the last one when that went out within smsAttemptWindow.
+func (app *App) sendSMSCode(userID int64, phone, purpose string) (time.Duration, error) {
+	attempts := 0
+	previous, err := app.userModel.GetSMSCode(int(userID), purpose)
+	switch {
+	case err == nil:
+		if wait := smsResendInterval - time.Since(previous.CreatedAt); wait > 0 {
+			return wait, nil
+		}
+		if time.Since(previous.CreatedAt) < smsAttemptWindow {
+			attempts = previous.Attempts
+		}
+	case !stdErrors.Is(err, models.ErrRecordNotFound):
+		return 0, err
+	}
+
+	code, salt, err := token.GenerateCode(6)
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	smsCode := &models.SMSCode{
+		UserID:    userID,
+		Purpose:   purpose,
+		Phone:     phone,
+		CodeHash:  token.HashCode(code, salt),
+		CodeSalt:  salt,
+		Attempts:  attempts,
+		CreatedAt: now,
+		ExpiresAt: now.Add(app.smsCodeTTL()),
+	}
+	err = app.userModel.CreateSMSCode(smsCode)
+	if err != nil {
+		return 0, err
+	}
+
+	app.background(func() {
+		send := mailer.PhoneVerificationCode
+		if purpose == models.SMSCodePasswordReset {
+			send = mailer.PasswordResetCode
+		}
+		err := send(app.sms, phone, code, smsCode.ExpiresAt)
+		if err != nil {
+			fmt.Println(err)
+		}
+	})
+	return 0, nil
+}
+
+// checkSMSCode compares code with the last one texted to the user for purpose. Every guess uses up one of the code's
+// attempts, and the caller deletes the code once whatever it was sent for is done.
+func (app *App) checkSMSCode(userID int64, purpose, code string) (*models.SMSCode, error) {
+	stored, err := app.userModel.GetSMSCode(int(userID), purpose)
+	switch {
+	case stdErrors.Is(err, models.ErrRecordNotFound):
+		return nil, errInvalidSMSCode
+	case err != nil:
+		return nil, err
+	}
+	if !stored.Usable(time.Now()) {
+		return nil, errInvalidSMSCode
+	}
+
+	err = app.userModel.RecordSMSCodeAttempt(int(stored.ID))
+	switch {
+	case stdErrors.Is(err, models.ErrRecordNotFound):
+		return nil, errInvalidSMSCode
+	case err != nil:
+		return nil, err
+	}
+	if !token.IsValidCode(code, stored.CodeHash, stored.CodeSalt) {
+		return nil, errInvalidSMSCode
+	}
+	return stored, nil
+}
+
+// smsCodeRefused answers a code that checkSMSCode turned down
+func (app *App) smsCodeRefused(w http.ResponseWriter, err error) {
+	switch {
+	case stdErrors.Is(err, errInvalidSMSCode):
+		http.Error(w, errors.InvalidSMSCode, http.StatusBadRequest)
+	default:
+		http.Error(w, errors.InternalServerError, http.StatusInternalServerError)
+	}
+}
+
+// smsResendTooSoon answers a request for a code while the last one is still within smsResendInterval
+func (app *App) smsResendTooSoon(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, errors.RateLimited, http.StatusTooManyRequests)
+}
+
+// setPhone saves a phone number for the signed in user and texts it a code to verify it with, asking again sends a
+// fresh code. The password is needed because a verified phone can reset it.
+func (app *App) setPhone(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Phone    string
+		Password string
+	}
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	phone := models.NormalizePhone(payload.Phone)
+	v := validator.New()
+	if models.ValidatePhone(v, phone); !v.Valid() {
+		http.Error(w, errors.InvalidPhone, http.StatusBadRequest)
+		return
+	}
+
+	user, err := app.userModel.GetByPublicID(app.contextGetSubject(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	_, err = app.authenticate(user.Email, payload.Password)
+	if err != nil {
+		app.authenticationFailed(w, err)
+		return
+	}
+	// nothing to verify
+	if user.Phone == phone && user.PhoneVerified {
+		err = app.writeJSON(w, http.StatusOK, user)
+		if err != nil {
+			http.Error(w, errors.JsonWriteError, http.StatusInternalServerError)
+		}
+		return
+	}
+
+	err = app.userModel.SetPhone(int(user.ID), phone)
+	if err != nil {
+		http.Error(w, errors.InternalServerError, http.StatusInternalServerError)
+		return
+	}
+	wait, err := app.sendSMSCode(user.ID, phone, models.SMSCodeVerifyPhone)
+	if err != nil {
+		http.Error(w, errors.InternalServerError, http.StatusInternalServerError)
+		return
+	}
+	if wait > 0 {
+		app.smsResendTooSoon(w, wait)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusAccepted, errors.PhoneCodeSent)
+	if err != nil {
+		http.Error(w, errors.JsonWriteError, http.StatusInternalServerError)
+		return
+	}
+}
+
+// verifyPhone takes the code texted by setPhone and marks the number as verified
+func (app *App) verifyPhone(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Code string
+	}
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	user, err := app.userModel.GetByPublicID(app.contextGetSubject(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	smsCode, err := app.checkSMSCode(user.ID, models.SMSCodeVerifyPhone, payload.Code)
+	if err != nil {
+		app.smsCodeRefused(w, err)
+		return
+	}
+	err = app.userModel.VerifyPhone(int(user.ID), smsCode.Phone)
+	if err != nil {
+		switch {
+		case stdErrors.Is(err, models.ErrPhoneChanged):
+			http.Error(w, errors.InvalidSMSCode, http.StatusBadRequest)
+		default:
+			http.Error(w, errors.InternalServerError, http.StatusInternalServerError)
+		}
+		return
+	}
+	err = app.userModel.DeleteSMSCode(int(smsCode.ID))
+	if err != nil {
+		http.Error(w, errors.InternalServerError, http.StatusInternalServerError)
+		return
+	}
+	app.audit(r, models.AuditEvent{Type: models.AuditPhoneVerified, ActorID: user.PublicID, SubjectID: user.PublicID, Email: user.Email})
+
+	user, err = app.userModel.GetByID(int(user.ID))
+	if err != nil {
+		http.Error(w, errors.InternalServerError, http.StatusInternalServerError)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, user)
+	if err != nil {
+		http.Error(w, errors.JsonWriteError, http.StatusInternalServerError)
+		return
+	}
+}
+
+// removePhone takes the phone off the account, codes already texted to it stop working
+func (app *App) removePhone(w http.ResponseWriter, r *http.Request) {
+	user, err := app.userModel.GetByPublicID(app.contextGetSubject(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if user.Phone != "" {
+		err = app.userModel.SetPhone(int(user.ID), "")
+		if err != nil {
+			http.Error(w, errors.InternalServerError, http.StatusInternalServerError)
+			return
+		}
+		app.audit(r, models.AuditEvent{Type: models.AuditPhoneRemoved, ActorID: user.PublicID, SubjectID: user.PublicID, Email: user.Email})
+	}
+
+	user, err = app.userModel.GetByID(int(user.ID))
+	if err != nil {
+		http.Error(w, errors.InternalServerError, http.StatusInternalServerError)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, user)
+	if err != nil {
+		http.Error(w, errors.JsonWriteError, http.StatusInternalServerError)
+		return
+	}
+}
+
+// requestSMSPasswordReset is updateUserPassword for users who chose to get the reset code on their verified phone.
+// It answers the same whether or not a code was texted, so it can't be used to learn which accounts have a verified
+// phone or asked for a code recently.
+func (app *App) requestSMSPasswordReset(w http.ResponseWriter, r *http.Request, user *models.User) {
+	if ok, wait := app.smsLimiter.allow(clientIP(r)); !ok {
+		app.smsResendTooSoon(w, wait)
+		return
+	}
+	if user.Phone != "" && user.PhoneVerified {
+		wait, err := app.sendSMSCode(user.ID, user.Phone, models.SMSCodePasswordReset)
+		if err != nil {
+			http.Error(w, errors.InternalServerError, http.StatusInternalServerError)
+			return
+		}
+		if wait == 0 {
+			app.audit(r, models.AuditEvent{Type: models.AuditPasswordResetRequested, SubjectID: user.PublicID, Email: user.Email,
+				Method: models.ResetMethodSMS})
+		}
+	}
+
+	err := app.writeJSON(w, http.StatusOK, errors.PasswordResetSMS)
+	if err != nil {
+		http.Error(w, errors.JsonWriteError, http.StatusInternalServerError)
+		return
+	}
+}
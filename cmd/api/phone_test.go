@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"the_lonely_road/errors"
+	"the_lonely_road/mailer"
+	"the_lonely_road/models"
+	"time"
+)
+
+var smsCodeRX = regexp.MustCompile(`code is ([0-9]{6})`)
+
+func phoneTestApp(t *testing.T) (*App, *models.UserModelMock, *mailer.FileSMSSender) {
+	mock := &models.UserModelMock{DB: []*models.User{}}
+	err := mock.Insert(&models.User{ID: 1, PublicID: alice, Email: "alice@example.com", Password: "securepassword", CreatedAt: time.Now()})
+	if err != nil {
+		t.Fatalf("Unexpected error in inserting user: %s", err)
+	}
+	sms := &mailer.FileSMSSender{}
+	return &App{userModel: mock, sms: sms}, mock, sms
+}
+
+// lastSMSCode waits for the background sends and returns the code in the last text
+func lastSMSCode(t *testing.T, app *App, sms *mailer.FileSMSSender) string {
+	app.wg.Wait()
+	sent := sms.Sent()
+	if len(sent) == 0 {
+		t.Fatal("Expected a text to be sent")
+	}
+	match := smsCodeRX.FindStringSubmatch(sent[len(sent)-1].Body)
+	if match == nil {
+		t.Fatalf("Expected a code in %q", sent[len(sent)-1].Body)
+	}
+	return match[1]
+}
+
+func phoneRequest(app *App, handler http.HandlerFunc, method, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "/users/me/phone", bytes.NewBufferString(body))
+	req = app.contextSetSubject(req, alice)
+	rr := httptest.NewRecorder()
+	handler(rr, req)
+	return rr
+}
+
+func TestApp_setPhone(t *testing.T) {
+	tests := []struct {
+		name         string
+		body         string
+		expectedCode int
+		expectedBody string
+	}{
+		{name: "Invalid phone", body: `{"phone": "0044 20 7946 0958", "password": "securepassword"}`, expectedCode: http.StatusBadRequest,
+			expectedBody: errors.InvalidPhone},
+		{name: "Wrong password", body: `{"phone": "+44 20 7946 0958", "password": "wrongpassword"}`, expectedCode: http.StatusBadRequest,
+			expectedBody: errors.InvalidCredentials},
+		{name: "Code sent", body: `{"phone": "+44 (20) 7946-0958", "password": "securepassword"}`, expectedCode: http.StatusAccepted,
+			expectedBody: errors.PhoneCodeSent},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			app, mock, sms := phoneTestApp(t)
+			rr := phoneRequest(app, app.setPhone, "POST", test.body)
+			if rr.Code != test.expectedCode {
+				t.Errorf("Expected status code %d, got %d", test.expectedCode, rr.Code)
+			}
+			if !strings.Contains(rr.Body.String(), test.expectedBody) {
+				t.Errorf("Expected body to contain %q, got %q", test.expectedBody, rr.Body.String())
+			}
+			app.wg.Wait()
+			if test.expectedCode != http.StatusAccepted {
+				if len(sms.Sent()) != 0 || mock.DB[0].Phone != "" {
+					t.Errorf("Expected no phone and no texts, got %q and %v", mock.DB[0].Phone, sms.Sent())
+				}
+				return
+			}
+			if mock.DB[0].Phone != "+442079460958" || mock.DB[0].PhoneVerified {
+				t.Errorf("Expected unverified +442079460958, got %q verified %t", mock.DB[0].Phone, mock.DB[0].PhoneVerified)
+			}
+			if sent := sms.Sent(); len(sent) != 1 || sent[0].To != "+442079460958" {
+				t.Errorf("Expected one text to +442079460958, got %v", sent)
+			}
+		})
+	}
+}
+
+func TestApp_setPhone_ResendTooSoon(t *testing.T) {
+	app, _, sms := phoneTestApp(t)
+	body := `{"phone": "+442079460958", "password": "securepassword"}`
+	rr := phoneRequest(app, app.setPhone, "POST", body)
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("Expected status code %d, got %d", http.StatusAccepted, rr.Code)
+	}
+
+	rr = phoneRequest(app, app.setPhone, "POST", body)
+	if rr.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected status code %d, got %d", http.StatusTooManyRequests, rr.Code)
+	}
+	if retry := rr.Header().Get("Retry-After"); retry != "60" {
+		t.Errorf("Expected Retry-After 60, got %q", retry)
+	}
+	app.wg.Wait()
+	if len(sms.Sent()) != 1 {
+		t.Errorf("Expected one text, got %d", len(sms.Sent()))
+	}
+}
+
+func TestApp_verifyPhone(t *testing.T) {
+	app, mock, sms := phoneTestApp(t)
+	rr := phoneRequest(app, app.setPhone, "POST", `{"phone": "+442079460958", "password": "securepassword"}`)
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("Expected status code %d, got %d", http.StatusAccepted, rr.Code)
+	}
+	code := lastSMSCode(t, app, sms)
+
+	wrong := "000000"
+	if code == wrong {
+		wrong = "111111"
+	}
+	rr = phoneRequest(app, app.verifyPhone, "POST", `{"code": "`+wrong+`"}`)
+	if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), errors.InvalidSMSCode) {
+		t.Errorf("Expected %d %q, got %d %q", http.StatusBadRequest, errors.InvalidSMSCode, rr.Code, rr.Body.String())
+	}
+	if mock.SMSCodes[0].Attempts != 1 {
+		t.Errorf("Expected the wrong guess to use an attempt, got %d", mock.SMSCodes[0].Attempts)
+	}
+
+	rr = phoneRequest(app, app.verifyPhone, "POST", `{"code": "`+code+`"}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+	if !strings.Contains(rr.Body.String(), `"phone_verified":true`) || !mock.DB[0].PhoneVerified {
+		t.Errorf("Expected the phone to be verified, got %s", rr.Body.String())
+	}
+	if len(mock.SMSCodes) != 0 {
+		t.Errorf("Expected the code to be deleted, got %d codes", len(mock.SMSCodes))
+	}
+	if n := len(mock.AuditEvents); n == 0 || mock.AuditEvents[n-1].Type != models.AuditPhoneVerified {
+		t.Errorf("Expected a %s audit event", models.AuditPhoneVerified)
+	}
+
+	rr = phoneRequest(app, app.verifyPhone, "POST", `{"code": "`+code+`"}`)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected a used code to be refused with %d, got %d", http.StatusBadRequest, rr.Code)
+	}
+}
+
+func TestApp_verifyPhone_AttemptsUsedUp(t *testing.T) {
+	app, _, sms := phoneTestApp(t)
+	phoneRequest(app, app.setPhone, "POST", `{"phone": "+442079460958", "password": "securepassword"}`)
+	code := lastSMSCode(t, app, sms)
+
+	wrong := "000000"
+	if code == wrong {
+		wrong = "111111"
+	}
+	for i := 0; i < models.MaxSMSCodeAttempts; i++ {
+		phoneRequest(app, app.verifyPhone, "POST", `{"code": "`+wrong+`"}`)
+	}
+	rr := phoneRequest(app, app.verifyPhone, "POST", `{"code": "`+code+`"}`)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected the right code to be refused once attempts are used up, got %d", rr.Code)
+	}
+}
+
+func TestApp_removePhone(t *testing.T) {
+	app, mock, _ := phoneTestApp(t)
+	mock.DB[0].Phone = "+442079460958"
+	mock.DB[0].PhoneVerified = true
+
+	rr := phoneRequest(app, app.removePhone, "DELETE", "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, rr.Code)
+	}
+	if mock.DB[0].Phone != "" || mock.DB[0].PhoneVerified {
+		t.Errorf("Expected the phone to be removed, got %q verified %t", mock.DB[0].Phone, mock.DB[0].PhoneVerified)
+	}
+	if n := len(mock.AuditEvents); n != 1 || mock.AuditEvents[0].Type != models.AuditPhoneRemoved {
+		t.Errorf("Expected one %s audit event, got %d events", models.AuditPhoneRemoved, n)
+	}
+
+	phoneRequest(app, app.removePhone, "DELETE", "")
+	if len(mock.AuditEvents) != 1 {
+		t.Errorf("Expected nothing audited when there is no phone, got %d events", len(mock.AuditEvents))
+	}
+}
+
+func TestApp_PasswordReset_SMS(t *testing.T) {
+	resetRequest := func(app *App, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("PATCH", "/users", bytes.NewBufferString(body))
+		rr := httptest.NewRecorder()
+		app.updateUserPassword(rr, req)
+		return rr
+	}
+
+	t.Run("Unverified phone", func(t *testing.T) {
+		app, mock, sms := phoneTestApp(t)
+		mock.DB[0].Phone = "+442079460958"
+		rr := resetRequest(app, `{"email": "alice@example.com", "channel": "sms"}`)
+		// the same answer as a phone that got a code, so the account's phone can't be told from it
+		if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), errors.PasswordResetSMS) {
+			t.Errorf("Expected %d %q, got %d %q", http.StatusOK, errors.PasswordResetSMS, rr.Code, rr.Body.String())
+		}
+		app.wg.Wait()
+		if len(sms.Sent()) != 0 || len(mock.SMSCodes) != 0 {
+			t.Errorf("Expected nothing texted to an unverified phone, got %v", sms.Sent())
+		}
+	})
+
+	t.Run("Asked again too soon", func(t *testing.T) {
+		app, mock, sms := phoneTestApp(t)
+		mock.DB[0].Phone = "+442079460958"
+		mock.DB[0].PhoneVerified = true
+		for i := 0; i < 2; i++ {
+			rr := resetRequest(app, `{"email": "alice@example.com", "channel": "sms"}`)
+			if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), errors.PasswordResetSMS) {
+				t.Errorf("Expected %d %q, got %d %q", http.StatusOK, errors.PasswordResetSMS, rr.Code, rr.Body.String())
+			}
+		}
+		app.wg.Wait()
+		if len(sms.Sent()) != 1 {
+			t.Errorf("Expected one text, got %d", len(sms.Sent()))
+		}
+	})
+
+	t.Run("Rate limited", func(t *testing.T) {
+		app, mock, _ := phoneTestApp(t)
+		mock.DB[0].Phone = "+442079460958"
+		mock.DB[0].PhoneVerified = true
+		app.smsLimiter = newRateLimiter(1, 1)
+		resetRequest(app, `{"email": "alice@example.com", "channel": "sms"}`)
+		rr := resetRequest(app, `{"email": "alice@example.com", "channel": "sms"}`)
+		if rr.Code != http.StatusTooManyRequests || rr.Header().Get("Retry-After") == "" {
+			t.Errorf("Expected %d with a Retry-After, got %d %q", http.StatusTooManyRequests, rr.Code, rr.Body.String())
+		}
+	})
+
+	t.Run("Attempts carry over to the next code", func(t *testing.T) {
+		app, mock, sms := phoneTestApp(t)
+		mock.DB[0].Phone = "+442079460958"
+		mock.DB[0].PhoneVerified = true
+		resetRequest(app, `{"email": "alice@example.com", "channel": "sms"}`)
+		lastSMSCode(t, app, sms)
+		mock.SMSCodes[0].Attempts = models.MaxSMSCodeAttempts
+		mock.SMSCodes[0].CreatedAt = time.Now().Add(-2 * smsResendInterval)
+
+		resetRequest(app, `{"email": "alice@example.com", "channel": "sms"}`)
+		code := lastSMSCode(t, app, sms)
+		body := `{"email": "alice@example.com", "password": "newsecurepassword", "code": "` + code + `"}`
+		req := httptest.NewRequest("POST", "/users/password/reset", bytes.NewBufferString(body))
+		rr := httptest.NewRecorder()
+		app.ProcessPasswordReset(rr, req)
+		if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), errors.InvalidSMSCode) {
+			t.Errorf("Expected a fresh code not to bring fresh guesses, got %d %q", rr.Code, rr.Body.String())
+		}
+
+		mock.SMSCodes[0].CreatedAt = time.Now().Add(-smsAttemptWindow)
+		resetRequest(app, `{"email": "alice@example.com", "channel": "sms"}`)
+		lastSMSCode(t, app, sms)
+		if mock.SMSCodes[0].Attempts != 0 {
+			t.Errorf("Expected the attempts to start over after %s, got %d", smsAttemptWindow, mock.SMSCodes[0].Attempts)
+		}
+	})
+
+	t.Run("Unknown channel", func(t *testing.T) {
+		app, _, _ := phoneTestApp(t)
+		rr := resetRequest(app, `{"email": "alice@example.com", "channel": "pigeon"}`)
+		if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), errors.InvalidResetChannel) {
+			t.Errorf("Expected %d %q, got %d %q", http.StatusBadRequest, errors.InvalidResetChannel, rr.Code, rr.Body.String())
+		}
+	})
+
+	t.Run("Happy Path", func(t *testing.T) {
+		app, mock, sms := phoneTestApp(t)
+		mock.DB[0].Phone = "+442079460958"
+		mock.DB[0].PhoneVerified = true
+
+		rr := resetRequest(app, `{"email": "alice@example.com", "channel": "sms"}`)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+		}
+		code := lastSMSCode(t, app, sms)
+		if sent := sms.Sent(); sent[0].To != "+442079460958" || !strings.Contains(sent[0].Body, "password reset") {
+			t.Errorf("Expected a password reset text to the verified phone, got %v", sent[0])
+		}
+
+		body := `{"email": "alice@example.com", "password": "newsecurepassword", "code": "` + code + `"}`
+		req := httptest.NewRequest("POST", "/users/password/reset", bytes.NewBufferString(body))
+		rr = httptest.NewRecorder()
+		app.ProcessPasswordReset(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+		}
+		_, err := app.authenticate("alice@example.com", "newsecurepassword")
+		if err != nil {
+			t.Errorf("Expected the new password to work, got %v", err)
+		}
+		if len(mock.SMSCodes) != 0 {
+			t.Errorf("Expected the code to be deleted, got %d codes", len(mock.SMSCodes))
+		}
+
+		req = httptest.NewRequest("POST", "/users/password/reset", bytes.NewBufferString(body))
+		rr = httptest.NewRecorder()
+		app.ProcessPasswordReset(rr, req)
+		if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), errors.InvalidSMSCode) {
+			t.Errorf("Expected a used code to be refused, got %d %q", rr.Code, rr.Body.String())
+		}
+	})
+}
+
+func TestNewSMSSender(t *testing.T) {
+	sender, err := newSMSSender("", "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, ok := sender.(*mailer.FileSMSSender); !ok {
+		t.Errorf("Expected the file sender by default, got %T", sender)
+	}
+	_, err = newSMSSender("carrier-pigeon", "")
+	if err == nil {
+		t.Error("Expected an unknown provider to be refused")
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"the_lonely_road/errors"
+	"time"
+)
+
+// rateLimiter keeps a token bucket for every client: a client can make burst requests straight away and then one
+// more each interval. Buckets that have filled back up are dropped, so clients that went away don't hold memory.
+type rateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	burst    int
+	clients  map[string]*tokenBucket
+	swept    time.Time
+	now      func() time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter lets each client make perMinute requests a minute after an initial burst. A perMinute of zero or
+// less turns the limit off, which the nil limiter it returns stands for.
+func newRateLimiter(perMinute, burst int) *rateLimiter {
+	if perMinute <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		interval: time.Minute / time.Duration(perMinute),
+		burst:    burst,
+		clients:  map[string]*tokenBucket{},
+		now:      time.Now,
+	}
+}
+
+// allow takes a token from key's bucket. When there is none it returns false and how long until there will be.
+func (l *rateLimiter) allow(key string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+	bucket, ok := l.clients[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(l.burst), last: now}
+		l.clients[key] = bucket
+	}
+	refilled := float64(now.Sub(bucket.last)) / float64(l.interval)
+	bucket.tokens = math.Min(float64(l.burst), bucket.tokens+refilled)
+	bucket.last = now
+
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) * float64(l.interval))
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// sweep drops the buckets that are full again, at most once a minute
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < time.Minute {
+		return
+	}
+	l.swept = now
+	refill := time.Duration(l.burst) * l.interval
+	for key, bucket := range l.clients {
+		if now.Sub(bucket.last) >= refill {
+			delete(l.clients, key)
+		}
+	}
+}
+
+// rateLimit answers 429 with a Retry-After once the client IP has used up what limiter allows it
+func (app *App) rateLimit(limiter *rateLimiter) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if ok, wait := limiter.allow(clientIP(r)); !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				http.Error(w, errors.RateLimited, http.StatusTooManyRequests)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
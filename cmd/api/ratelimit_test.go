@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"the_lonely_road/errors"
+	"time"
+)
+
+func TestRateLimiter_allow(t *testing.T) {
+	now := time.Now()
+	limiter := newRateLimiter(60, 2)
+	limiter.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := limiter.allow("a"); !ok {
+			t.Fatalf("Expected request %d of the burst to be allowed", i+1)
+		}
+	}
+	ok, wait := limiter.allow("a")
+	if ok || wait != time.Second {
+		t.Fatalf("Expected the third request to wait a second, got %t, %s", ok, wait)
+	}
+	if ok, _ := limiter.allow("b"); !ok {
+		t.Errorf("Expected another client to have its own bucket")
+	}
+
+	now = now.Add(time.Second)
+	if ok, _ := limiter.allow("a"); !ok {
+		t.Errorf("Expected a token to have refilled after a second")
+	}
+
+	now = now.Add(time.Hour)
+	limiter.allow("c")
+	if _, ok := limiter.clients["a"]; ok {
+		t.Errorf("Expected full buckets to be swept")
+	}
+
+	var off *rateLimiter
+	if newRateLimiter(0, 10) != nil {
+		t.Errorf("Expected a rate of zero to turn the limit off")
+	}
+	if ok, _ := off.allow("a"); !ok {
+		t.Errorf("Expected a nil limiter to allow everything")
+	}
+}
+
+func TestApp_rateLimit(t *testing.T) {
+	app := App{}
+	limiter := newRateLimiter(2, 1)
+	handler := app.rateLimit(limiter)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	expected := []int{http.StatusNoContent, http.StatusTooManyRequests}
+	for i, code := range expected {
+		req := httptest.NewRequest("GET", "/users/username-available", nil)
+		rr := httptest.NewRecorder()
+
+		handler.ServeHTTP(rr, req)
+		if rr.Code != code {
+			t.Fatalf("Expected request %d to get status code %d, got %d", i+1, code, rr.Code)
+		}
+		if code == http.StatusTooManyRequests {
+			if rr.Body.String() != errors.RateLimited+"\n" {
+				t.Errorf("Expected response '%s', got '%s'", errors.RateLimited, rr.Body.String())
+			}
+			if retry := rr.Header().Get("Retry-After"); retry != "30" {
+				t.Errorf("Expected to retry after 30 seconds, got %q", retry)
+			}
+		}
+	}
+}
@@ -3,25 +3,88 @@ package main
 import (
 	"github.com/go-chi/chi/v5"
 	"net/http"
+	"the_lonely_road/models"
 )
 
 func (app *App) SetRoutes() http.Handler {
 	r := chi.NewRouter()
+	app.smsLimiter = newRateLimiter(app.Config.sms.rate, app.Config.sms.burst)
 
 	//middleware
 	r.Use(app.recoverPanic)
+	r.Use(app.requestID)
 	r.Use(app.enableCORS)
 
 	r.Group(func(r chi.Router) {
 		r.Use(app.RequireCookieMiddleware)
 		r.Get("/", app.HandleHome)
+	})
+
+	r.Group(func(r chi.Router) {
+		r.Use(app.requireAuthenticatedUser)
+		r.Get("/users/me", app.getCurrentUser)
+		r.Patch("/users/me", app.updateCurrentUserProfile)
+		r.Patch("/users/me/metadata", app.updateCurrentUserMetadata)
+		r.Get("/users/me/login-history", app.getLoginHistory)
+		r.Get("/users/me/export", app.getPersonalDataExport)
+		r.Get("/users/me/exports/{id}", app.downloadPersonalDataExport)
+		r.Delete("/users/me", app.deleteCurrentUser)
+		r.Post("/users/me/email", app.requestEmailChange)
+		r.Post("/users/me/email/confirm", app.confirmEmailChange)
+		r.With(app.rateLimit(app.smsLimiter)).Post("/users/me/phone", app.setPhone)
+		r.Post("/users/me/phone/verify", app.verifyPhone)
+		r.Delete("/users/me/phone", app.removePhone)
+	})
+
+	r.Group(func(r chi.Router) {
+		r.Use(app.requireAuthenticatedUser)
+		r.Use(app.requirePermission(models.PermissionUsersRead))
 		r.Get("/users", app.getUserByEmail)
+		r.Get("/admin/users", app.listUsers)
+		r.Get("/admin/users/search", app.searchUsers)
+	})
+
+	r.Group(func(r chi.Router) {
+		r.Use(app.requireAuthenticatedUser)
+		r.Use(app.requirePermission(models.PermissionUsersAdmin))
+		r.Post("/admin/users/{id}/roles", app.assignUserRole)
+		r.Delete("/admin/users/{id}/roles/{role}", app.revokeUserRole)
+		r.Post("/admin/users/{id}/unlock", app.unlockUser)
+		r.Patch("/admin/users/{id}/metadata", app.updateAppMetadata)
+		r.Post("/admin/users/import", app.importUsers)
+		r.Get("/admin/users/export", app.exportUsers)
+	})
+
+	r.Group(func(r chi.Router) {
+		r.Use(app.requireAuthenticatedUser)
+		r.Use(app.requirePermission(models.PermissionAuditRead))
+		r.Get("/admin/audit-events", app.listAuditEvents)
+	})
+
+	r.Group(func(r chi.Router) {
+		r.Use(app.requireAuthenticatedUser)
+		r.Post("/orgs", app.createOrg)
+		r.Route("/orgs/{org}", func(r chi.Router) {
+			r.With(app.requireOrgRole()).Get("/members", app.listOrgMembers)
+			r.Group(func(r chi.Router) {
+				r.Use(app.requireOrgRole(models.OrgRoleOwner, models.OrgRoleAdmin))
+				r.Delete("/members/{id}", app.removeOrgMember)
+				r.Post("/invitations", app.createInvitation)
+				r.Get("/invitations", app.listInvitations)
+				r.Delete("/invitations/{id}", app.revokeInvitation)
+			})
+		})
 	})
 
 	r.Post("/users", app.CreateUser)
 	r.Post("/users/login", app.Authenticate)
+	usernameLimiter := newRateLimiter(app.Config.usernameCheck.rate, app.Config.usernameCheck.burst)
+	r.With(app.rateLimit(usernameLimiter)).Get("/users/username-available", app.checkUsernameAvailability)
 	r.Patch("/users", app.updateUserPassword)
 	r.Post("/users/password/reset", app.ProcessPasswordReset)
 	r.Post("/users/logout", app.SignOut)
+	r.Post("/users/email/cancel", app.cancelEmailChange)
+	r.Post("/users/restore", app.restoreUser)
+	r.Post("/invitations/{id}/accept", app.acceptInvitation)
 	return r
 }
@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
@@ -20,6 +22,7 @@ func (app *App) Serve() error {
 	}
 
 	shutDownError := make(chan error)
+	stopJobs := make(chan struct{})
 
 	go func() {
 		quit := make(chan os.Signal, 1)
@@ -41,38 +44,139 @@ func (app *App) Serve() error {
 		err := svr.Shutdown(ctx)
 		if err != nil {
 			shutDownError <- err
+			return
 		}
 
 		fmt.Println("completing background tasks", map[string]string{
 			"addr": svr.Addr,
 		})
 
+		close(stopJobs)
 		app.wg.Wait()
 		shutDownError <- nil
 	}()
 
-	db, err := data.OpenDSN("DSN_DB")
+	userModel, closeUserModel, err := app.openUserModel()
 	if err != nil {
 		return err
 	}
-	fmt.Println("Connected to database")
-
 	defer func() {
-		if err := db.Close(); err != nil {
-			fmt.Println("Error closing server:", err)
+		if err := closeUserModel(); err != nil {
+			fmt.Println("Error closing user store:", err)
 		}
 	}()
 
+	switch userModel := userModel.(type) {
+	case *models.UserModel:
+		if userModel.Dialect == models.DialectSQLite {
+			fmt.Println("Connected to SQLite database")
+		} else {
+			fmt.Println("Connected to database")
+		}
+		// the reencrypt command doesn't come through here, it is how a mismatch is fixed
+		err = userModel.CheckEncryption()
+		if err != nil {
+			return err
+		}
+		fixed, err := userModel.CanonicalizeEmails()
+		if err != nil {
+			return fmt.Errorf("canonicalize emails: %w", err)
+		}
+		if fixed > 0 {
+			fmt.Println("Canonicalized", fixed, "email addresses")
+		}
+	case *models.MemoryUserModel:
+		fmt.Println("Keeping users in memory", map[string]string{
+			"snapshot": app.Config.userStore.snapshotPath,
+		})
+		if app.Config.userStore.snapshotPath != "" {
+			app.startSnapshotJob(userModel, app.snapshotInterval(), stopJobs)
+		}
+	}
+
 	mailCfg := mailer.DefaultSMTPConfig()
 	appMailer := mailer.NewEmailService(mailCfg)
-	app.userModel = &models.UserModel{
-		DB: db,
+	smsSender, err := newSMSSender(app.Config.sms.provider, app.Config.sms.logPath)
+	if err != nil {
+		return err
 	}
+	// sign ins pick the email or username lookup by the @, accounts stored without one have to be fixed by hand
+	invalid, err := models.InvalidEmails(userModel)
+	if err != nil {
+		return fmt.Errorf("check emails: %w", err)
+	}
+	if len(invalid) > 0 {
+		fmt.Println("Accounts whose email isn't a valid address, they can only sign in by username:", invalid)
+	}
+	app.userModel = userModel
 	app.emailer = appMailer
+	app.sms = smsSender
+	err = app.bootstrapAdmin()
+	if err != nil {
+		return err
+	}
+	app.startPurgeJob(purgeInterval, stopJobs)
 	fmt.Println("Server running on port 8080")
 	err = svr.ListenAndServe()
-	if err != nil {
+	if !errors.Is(err, http.ErrServerClosed) {
 		return err
 	}
-	return nil
+	// wait for the background jobs, the user store is closed after them
+	return <-shutDownError
+}
+
+const (
+	userStorePostgres = "postgres"
+	userStoreMemory   = "memory"
+)
+
+// openUserModel opens the store USER_STORE picks, shared by the server and the commands. closeUserModel closes the
+// database or saves the in-memory snapshot, and is called once nothing uses the model any more.
+func (app *App) openUserModel() (userModel models.IUserModel, closeUserModel func() error, err error) {
+	switch app.Config.userStore.kind {
+	case userStoreMemory:
+		memory := models.NewMemoryUserModel(app.Config.lockout, app.Config.passwordHistory, app.Config.hasher, app.Config.cipher)
+		if app.Config.userStore.snapshotPath != "" {
+			err = memory.LoadSnapshot(app.Config.userStore.snapshotPath)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		return memory, memory.SaveSnapshot, nil
+	case userStorePostgres, "":
+		// a sqlite: DSN swaps Postgres for a SQLite file, which keeps its schema up to date itself
+		if dsn := os.Getenv("DSN_DB"); data.IsSQLiteDSN(dsn) {
+			db, err := data.OpenSQLite(dsn)
+			if err != nil {
+				return nil, nil, err
+			}
+			return app.newUserModel(db, models.DialectSQLite), db.Close, nil
+		}
+		db, err := data.OpenDSN("DSN_DB")
+		if err != nil {
+			return nil, nil, err
+		}
+		return app.newUserModel(db, models.DialectPostgres), db.Close, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown USER_STORE %q, use %s or %s", app.Config.userStore.kind, userStorePostgres, userStoreMemory)
+	}
+}
+
+func (app *App) snapshotInterval() time.Duration {
+	if app.Config.userStore.snapshotInterval <= 0 {
+		return time.Minute
+	}
+	return app.Config.userStore.snapshotInterval
+}
+
+// newUserModel is the database backed model configured from app.Config
+func (app *App) newUserModel(db *sql.DB, dialect models.Dialect) *models.UserModel {
+	return &models.UserModel{
+		DB:              db,
+		Lockout:         app.Config.lockout,
+		PasswordHistory: app.Config.passwordHistory,
+		Hasher:          app.Config.hasher,
+		Cipher:          app.Config.cipher,
+		Dialect:         dialect,
+	}
 }
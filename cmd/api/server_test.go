@@ -0,0 +1,79 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"the_lonely_road/models"
+	"time"
+)
+
+func TestApp_openUserModel(t *testing.T) {
+	app := &App{}
+	app.Config.hasher = models.Hasher{Current: models.BcryptHasher{Cost: 4}}
+	app.Config.userStore.kind = userStoreMemory
+	app.Config.userStore.snapshotPath = filepath.Join(t.TempDir(), "users.json")
+
+	userModel, closeUserModel, err := app.openUserModel()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, ok := userModel.(*models.MemoryUserModel); !ok {
+		t.Fatalf("Expected the in-memory store, got %T", userModel)
+	}
+	err = userModel.Insert(&models.User{Email: "alice@example.com", Password: "securepassword", CreatedAt: time.Now()})
+	if err != nil {
+		t.Fatalf("Unexpected error inserting user: %s", err)
+	}
+	// closing saves the snapshot the next open starts from
+	err = closeUserModel()
+	if err != nil {
+		t.Fatalf("Unexpected error closing: %s", err)
+	}
+
+	reopened, _, err := app.openUserModel()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, err := reopened.Authenticate("alice@example.com", "securepassword"); err != nil {
+		t.Errorf("Expected alice to be kept in the snapshot, got %s", err)
+	}
+
+	app.Config.userStore.kind = "mongodb"
+	_, _, err = app.openUserModel()
+	if err == nil || !strings.Contains(err.Error(), "unknown USER_STORE") {
+		t.Errorf("Expected an unknown store to be refused, got %v", err)
+	}
+}
+
+func TestApp_openUserModel_SQLite(t *testing.T) {
+	app := &App{}
+	app.Config.hasher = models.Hasher{Current: models.BcryptHasher{Cost: 4}}
+	t.Setenv("DSN_DB", "sqlite://"+filepath.Join(t.TempDir(), "users.db"))
+
+	userModel, closeUserModel, err := app.openUserModel()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if m, ok := userModel.(*models.UserModel); !ok || m.Dialect != models.DialectSQLite {
+		t.Fatalf("Expected the SQLite model, got %#v", userModel)
+	}
+	err = userModel.Insert(&models.User{Email: "alice@example.com", Password: "securepassword", CreatedAt: time.Now()})
+	if err != nil {
+		t.Fatalf("Unexpected error inserting user: %s", err)
+	}
+	err = closeUserModel()
+	if err != nil {
+		t.Fatalf("Unexpected error closing: %s", err)
+	}
+
+	// opening the file again doesn't run the migrations twice
+	reopened, closeUserModel, err := app.openUserModel()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer closeUserModel()
+	if _, err := reopened.Authenticate("alice@example.com", "securepassword"); err != nil {
+		t.Errorf("Expected alice to be kept in the database, got %s", err)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	stdErrors "errors"
+	"net/http"
+	"the_lonely_road/errors"
+	"the_lonely_road/models"
+	"the_lonely_road/validator"
+)
+
+// checkUsernameAvailability tells a sign up or profile form whether ?username= can be taken, and if not why not.
+// Anyone can call it, so it sits behind a per-client rate limit to stop it being used to list accounts.
+func (app *App) checkUsernameAvailability(w http.ResponseWriter, r *http.Request) {
+	username := app.readString(r.URL.Query(), "username", "")
+	response := struct {
+		Username  string `json:"username"`
+		Available bool   `json:"available"`
+		Reason    string `json:"reason,omitempty"`
+	}{Username: username}
+
+	v := validator.New()
+	if models.ValidateUsername(v, username); !v.Valid() {
+		response.Reason = v.Errors["Username"]
+	} else {
+		_, err := app.userModel.GetByUsername(username)
+		switch {
+		case err == nil:
+			response.Reason = "is already taken"
+		case stdErrors.Is(err, models.ErrRecordNotFound):
+			response.Available = true
+		default:
+			http.Error(w, errors.InternalServerError, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	err := app.writeJSON(w, http.StatusOK, response)
+	if err != nil {
+		http.Error(w, errors.JsonWriteError, http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"the_lonely_road/models"
+)
+
+func TestApp_checkUsernameAvailability(t *testing.T) {
+	app := App{userModel: &models.UserModelMock{DB: []*models.User{{ID: 1, Email: "alice@example.com", Username: "Alice_W"}}}}
+
+	tests := []struct {
+		name      string
+		username  string
+		available bool
+		reason    string
+	}{
+		{name: "Available", username: "bob.b", available: true},
+		{name: "Taken whatever the case", username: "ALICE_W", reason: "is already taken"},
+		{name: "Reserved", username: "Ad-min", reason: "is reserved"},
+		{name: "Too short", username: "ab", reason: "must be at least 3 characters long"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/users/username-available?username="+test.username, nil)
+			rr := httptest.NewRecorder()
+
+			app.checkUsernameAvailability(rr, req)
+			if rr.Code != http.StatusOK {
+				t.Fatalf("Expected status code %d, got %d", http.StatusOK, rr.Code)
+			}
+			var response struct {
+				Username  string `json:"username"`
+				Available bool   `json:"available"`
+				Reason    string `json:"reason"`
+			}
+			err := json.Unmarshal(rr.Body.Bytes(), &response)
+			if err != nil {
+				t.Fatalf("Error unmarshaling JSON: %v", err)
+			}
+			if response.Username != test.username || response.Available != test.available || response.Reason != test.reason {
+				t.Errorf("Expected %s to be available %t because %q, got %+v", test.username, test.available, test.reason, response)
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	sqlitemigrations "the_lonely_road/migrations/sqlite"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// SQLiteScheme starts a DSN_DB that names a SQLite database instead of a Postgres one, e.g. sqlite:///var/lib/users.db,
+// sqlite:users.db or sqlite::memory:
+const SQLiteScheme = "sqlite:"
+
+const sqliteMemory = ":memory:"
+
+// IsSQLiteDSN reports whether dsn should be opened with OpenSQLite
+func IsSQLiteDSN(dsn string) bool {
+	return strings.HasPrefix(dsn, SQLiteScheme)
+}
+
+// OpenSQLite opens the SQLite database dsn names and applies any migrations from migrations/sqlite it hasn't seen yet.
+// Foreign keys are switched on, times are written as UTC text that sorts the way it compares, and transactions take
+// the write lock up front so two of them can't deadlock upgrading their locks.
+func OpenSQLite(dsn string) (*sql.DB, error) {
+	driverDSN, memory, err := sqliteDriverDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite", driverDSN)
+	if err != nil {
+		return nil, fmt.Errorf("error Opening DB: %w", err)
+	}
+	if memory {
+		// every connection to :memory: gets its own empty database
+		db.SetMaxOpenConns(1)
+	}
+
+	err = MigrateSQLite(db, sqlitemigrations.FS)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+func sqliteDriverDSN(dsn string) (string, bool, error) {
+	if !IsSQLiteDSN(dsn) {
+		return "", false, fmt.Errorf("%q is not a sqlite DSN", dsn)
+	}
+	path := strings.TrimPrefix(strings.TrimPrefix(dsn, SQLiteScheme), "//")
+	path, rawQuery, _ := strings.Cut(path, "?")
+	if path == "" {
+		return "", false, fmt.Errorf("%q has no database path", dsn)
+	}
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return "", false, fmt.Errorf("sqlite DSN: %w", err)
+	}
+	memory := path == sqliteMemory
+	query.Add("_pragma", "foreign_keys(1)")
+	query.Add("_pragma", "busy_timeout(5000)")
+	if !memory {
+		query.Add("_pragma", "journal_mode(WAL)")
+	}
+	query.Set("_time_format", "sqlite")
+	query.Set("_txlock", "immediate")
+	return "file:" + path + "?" + query.Encode(), memory, nil
+}
+
+// MigrateSQLite applies the up migrations in migrations that are newer than the version recorded in
+// schema_migrations, each in its own transaction. The table is laid out the way the migrate CLI lays it out.
+func MigrateSQLite(db *sql.DB, migrations fs.FS) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	_, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (version bigint NOT NULL PRIMARY KEY, dirty boolean NOT NULL)`)
+	if err != nil {
+		return fmt.Errorf("migrate: %w", err)
+	}
+	var current int64
+	var dirty bool
+	err = db.QueryRowContext(ctx, `SELECT version, dirty FROM schema_migrations LIMIT 1`).Scan(&current, &dirty)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("migrate: %w", err)
+	}
+	if dirty {
+		return fmt.Errorf("migrate: version %d is dirty, fix the database by hand", current)
+	}
+
+	names, err := fs.Glob(migrations, "*.up.sql")
+	if err != nil {
+		return fmt.Errorf("migrate: %w", err)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		version, err := strconv.ParseInt(strings.SplitN(name, "_", 2)[0], 10, 64)
+		if err != nil {
+			return fmt.Errorf("migrate: %s: %w", name, err)
+		}
+		if version <= current {
+			continue
+		}
+		script, err := fs.ReadFile(migrations, name)
+		if err != nil {
+			return fmt.Errorf("migrate: %w", err)
+		}
+		err = applySQLiteMigration(ctx, db, version, string(script))
+		if err != nil {
+			return fmt.Errorf("migrate: %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func applySQLiteMigration(ctx context.Context, db *sql.DB, version int64, script string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, script)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `DELETE FROM schema_migrations`)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, dirty) VALUES ($1, false)`, version)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
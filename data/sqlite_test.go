@@ -0,0 +1,102 @@
+package data
+
+import (
+	"database/sql"
+	"net/url"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestSqliteDriverDSN(t *testing.T) {
+	tests := []struct {
+		dsn    string
+		path   string
+		memory bool
+	}{
+		{dsn: "sqlite:///var/lib/users.db", path: "/var/lib/users.db"},
+		{dsn: "sqlite:users.db", path: "users.db"},
+		{dsn: "sqlite::memory:", path: ":memory:", memory: true},
+		{dsn: "sqlite:users.db?_pragma=cache_size(-2000)", path: "users.db"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.dsn, func(t *testing.T) {
+			driverDSN, memory, err := sqliteDriverDSN(tt.dsn)
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			path, rawQuery, _ := strings.Cut(strings.TrimPrefix(driverDSN, "file:"), "?")
+			query, _ := url.ParseQuery(rawQuery)
+			if path != tt.path || memory != tt.memory {
+				t.Errorf("Expected %s, got %s", tt.path, path)
+			}
+			if query.Get("_time_format") != "sqlite" || query.Get("_txlock") != "immediate" {
+				t.Errorf("Expected UTC text times and immediate transactions, got %s", rawQuery)
+			}
+			pragmas := strings.Join(query["_pragma"], " ")
+			if !strings.Contains(pragmas, "foreign_keys(1)") || strings.Contains(pragmas, "journal_mode") == tt.memory {
+				t.Errorf("Unexpected pragmas %s", pragmas)
+			}
+		})
+	}
+
+	for _, dsn := range []string{"host=localhost port=5432", "sqlite:", "sqlite://"} {
+		if _, _, err := sqliteDriverDSN(dsn); err == nil {
+			t.Errorf("Expected %q to be refused", dsn)
+		}
+	}
+}
+
+func TestMigrateSQLite(t *testing.T) {
+	db, err := OpenSQLite("sqlite::memory:")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer db.Close()
+
+	var version int64
+	err = db.QueryRow(`SELECT version FROM schema_migrations`).Scan(&version)
+	if err != nil || version == 0 {
+		t.Fatalf("Expected the migrations to be recorded, got %d, %v", version, err)
+	}
+	var orgs int
+	err = db.QueryRow(`SELECT count(*) FROM organizations WHERE slug = 'default'`).Scan(&orgs)
+	if err != nil || orgs != 1 {
+		t.Errorf("Expected the default organization, got %d, %v", orgs, err)
+	}
+
+	scratch, err := sql.Open("sqlite", "file::memory:")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer scratch.Close()
+	scratch.SetMaxOpenConns(1)
+
+	migrations := fstest.MapFS{
+		"1_first.up.sql":    {Data: []byte(`CREATE TABLE first (id integer);`)},
+		"1_first.down.sql":  {Data: []byte(`DROP TABLE first;`)},
+		"2_second.up.sql":   {Data: []byte(`CREATE TABLE second (id integer); INSERT INTO nowhere VALUES (1);`)},
+		"2_second.down.sql": {Data: []byte(`DROP TABLE second;`)},
+	}
+	// a failing migration is rolled back and leaves the version at the last one that worked
+	err = MigrateSQLite(scratch, migrations)
+	if err == nil || !strings.Contains(err.Error(), "2_second.up.sql") {
+		t.Fatalf("Expected the second migration to fail, got %v", err)
+	}
+	var tables int
+	_ = scratch.QueryRow(`SELECT count(*) FROM sqlite_master WHERE name IN ('first', 'second')`).Scan(&tables)
+	_ = scratch.QueryRow(`SELECT version FROM schema_migrations`).Scan(&version)
+	if tables != 1 || version != 1 {
+		t.Errorf("Expected only the first migration to be applied, got %d tables at version %d", tables, version)
+	}
+
+	migrations["2_second.up.sql"] = &fstest.MapFile{Data: []byte(`CREATE TABLE second (id integer);`)}
+	err = MigrateSQLite(scratch, migrations)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	_ = scratch.QueryRow(`SELECT version FROM schema_migrations`).Scan(&version)
+	if version != 2 {
+		t.Errorf("Expected version 2, got %d", version)
+	}
+}
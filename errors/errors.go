@@ -9,4 +9,54 @@ const (
 	PasswordResetExpired = "Password reset token has expired"
 	JsonWriteError       = "Error writing JSON"
 	Unauthorized         = "Unauthorized"
+	Forbidden            = "You do not have permission to use this resource"
+	EmailChangeEmail     = "Confirmation email sent to the new address, please check your inbox"
+	EmailChangeExpired   = "Email change token has expired"
+	NoPendingEmail       = "There is no pending email change"
+	SameEmail            = "New email must be different from the current email"
+	EmailChangeCancelled = "Email change cancelled"
+	AccountDeleted       = "Account deleted, check your inbox for a link to restore it"
+	AccountRestored      = "Account restored, you can sign in again"
+	AccountNotDeleted    = "Account is not deleted"
+	RestoreExpired       = "Account restore token has expired"
+	InvalidFilters       = "Invalid filters, page and page_size must be positive, sort must be a known column, dates must be 2006-01-02, flags true or false and role a known role"
+	InvalidProfile       = "Profile names must be at most 100 characters, locale must be a language tag, time zone must be an IANA zone and username 3 to 30 letters, digits, dots, dashes or underscores that isn't reserved"
+	InvalidUserID        = "User id must be a UUID"
+	UnknownRole          = "Unknown role"
+	RoleNotAssigned      = "User does not have that role"
+	LoginThrottled       = "Too many failed sign in attempts, please wait a moment before trying again"
+	AccountLocked        = "Account is temporarily locked after too many failed sign in attempts"
+	AccountUnlocked      = "Account unlocked"
+	InvalidPassword      = "Password must be between 4 and 256 bytes long"
+	PasswordReused       = "Password was used recently, please choose a different one"
+	InvalidOrganization  = "Organization name must be 1 to 100 characters and slug lowercase letters, digits and hyphens up to 40 characters"
+	NotOrgMember         = "You are not a member of that organization"
+	OrgRoleRequired      = "Your role in the organization does not allow this"
+	MemberNotFound       = "User is not a member of the organization"
+	LastOwner            = "An organization must keep at least one owner"
+	MemberRemoved        = "Member removed from the organization"
+	InvalidInvitation    = "Invitation needs a valid email and a role of owner, admin or member"
+	InvalidInvitationID  = "Invitation id must be a UUID"
+	AlreadyMember        = "That user is already a member of the organization"
+	InvitationNotFound   = "Invitation not found"
+	InvitationClosed     = "Invitation has expired or was already accepted or revoked"
+	InvitationRevoked    = "Invitation revoked"
+	InvalidMetadata      = "Metadata patch must be a JSON object"
+	MetadataTooLarge     = "Metadata must not be larger than 16KB once the patch is applied"
+	InvalidPage          = "Invalid page, page and page_size must be positive and page_size at most 100"
+	InvalidAuditFilters  = "Invalid filters, page and page_size must be positive, sort must be created_at or -created_at, type a known event type, user a UUID and dates 2006-01-02 or RFC 3339"
+	EditConflict         = "The user was changed by another request, reload it and try again"
+	PreconditionFailed   = "The user has changed since it was read, If-Match no longer matches its ETag"
+	InvalidImportOptions = "Invalid import, format must be csv or ndjson, dry_run true or false and batch_size between 1 and 5000"
+	ImportTooLarge       = "Import file is too large, split it or use the import command"
+	DataExportEmailed    = "Your data export is being prepared, a download link will be emailed to you"
+	DataExportNotFound   = "Data export not found or its link has expired"
+	UsernameTaken        = "That username is already taken"
+	InvalidLogin         = "Sign in with an email address or a username, and a password"
+	RateLimited          = "Too many requests, please slow down"
+	InvalidPhone         = "Phone must be an international number, a + followed by the country code and number"
+	PhoneCodeSent        = "A verification code has been texted to your phone"
+	InvalidSMSCode       = "The code is wrong or has expired, ask for a new one"
+	PasswordResetSMS     = "If the account has a verified phone, a code to reset your password has been texted to it"
+	InvalidResetChannel  = "Channel must be email or sms"
 )
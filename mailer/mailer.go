@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"github.com/go-mail/mail/v2"
 	"github.com/spf13/viper"
+	"time"
 )
 
 const (
@@ -101,3 +102,112 @@ func (es *EmailService) ForgotPassword(to, resetURL string) error {
 
 	return nil
 }
+
+func (es *EmailService) ConfirmEmailChange(to, confirmURL string) error {
+	email := Email{
+		Subject:   "Confirm your new email address",
+		To:        to,
+		Plaintext: "To finish changing your email address, please visit the following link: " + confirmURL,
+		HTML: `<p> To finish changing your email address, please visit the following link: <a href="` + confirmURL + `">` +
+			confirmURL + `</a></p>`,
+	}
+	err := es.SendEmail(email)
+	if err != nil {
+		return fmt.Errorf("confirm email change email: %v", err)
+	}
+
+	return nil
+}
+
+// EmailChangeNotice goes to the old address so the owner can stop a change they didn't ask for
+func (es *EmailService) EmailChangeNotice(to, newEmail, cancelURL string) error {
+	email := Email{
+		Subject: "Your email address is being changed",
+		To:      to,
+		Plaintext: "Someone asked to change the email on your account to " + newEmail +
+			". If this wasn't you, cancel the change by visiting the following link: " + cancelURL,
+		HTML: `<p> Someone asked to change the email on your account to ` + newEmail +
+			`. If this wasn't you, cancel the change by visiting the following link: <a href="` + cancelURL + `">` +
+			cancelURL + `</a></p>`,
+	}
+	err := es.SendEmail(email)
+	if err != nil {
+		return fmt.Errorf("email change notice email: %v", err)
+	}
+
+	return nil
+}
+
+// AccountLocked tells the owner their password is being guessed
+func (es *EmailService) AccountLocked(to string, lockedUntil time.Time) error {
+	until := lockedUntil.UTC().Format("2006-01-02 15:04 MST")
+	email := Email{
+		Subject: "Your account has been locked",
+		To:      to,
+		Plaintext: "There were too many failed attempts to sign in to your account, so it is locked until " + until +
+			". If this wasn't you, consider changing your password once it unlocks.",
+		HTML: `<p> There were too many failed attempts to sign in to your account, so it is locked until ` + until +
+			`. If this wasn't you, consider changing your password once it unlocks.</p>`,
+	}
+	err := es.SendEmail(email)
+	if err != nil {
+		return fmt.Errorf("account locked email: %v", err)
+	}
+
+	return nil
+}
+
+func (es *EmailService) AccountDeleted(to, restoreURL string, restoreDays int) error {
+	email := Email{
+		Subject: "Your account has been deleted",
+		To:      to,
+		Plaintext: fmt.Sprintf("Your account has been deleted. If you change your mind within %d days you can restore it by visiting the following link: %s",
+			restoreDays, restoreURL),
+		HTML: fmt.Sprintf(`<p> Your account has been deleted. If you change your mind within %d days you can restore it by visiting the following link: <a href="%s">%s</a></p>`,
+			restoreDays, restoreURL, restoreURL),
+	}
+	err := es.SendEmail(email)
+	if err != nil {
+		return fmt.Errorf("account deleted email: %v", err)
+	}
+
+	return nil
+}
+
+// OrgInvitation asks someone to join an organization, the link works whether or not they already have an account
+func (es *EmailService) OrgInvitation(to, orgName, acceptURL string, expires time.Time) error {
+	until := expires.UTC().Format("2006-01-02 15:04 MST")
+	email := Email{
+		Subject: "You have been invited to join " + orgName,
+		To:      to,
+		Plaintext: "You have been invited to join " + orgName + ". To accept, please visit the following link before " + until +
+			": " + acceptURL,
+		HTML: `<p> You have been invited to join ` + orgName + `. To accept, please visit the following link before ` + until +
+			`: <a href="` + acceptURL + `">` + acceptURL + `</a></p>`,
+	}
+	err := es.SendEmail(email)
+	if err != nil {
+		return fmt.Errorf("org invitation email: %v", err)
+	}
+
+	return nil
+}
+
+// DataExportReady sends the link to a personal data export that was too large to return straight away
+func (es *EmailService) DataExportReady(to, downloadURL string, expires time.Time) error {
+	until := expires.UTC().Format("2006-01-02 15:04 MST")
+	email := Email{
+		Subject: "Your data export is ready",
+		To:      to,
+		Plaintext: "The copy of your personal data you asked for is ready. To download it, sign in and visit the following link before " +
+			until + ": " + downloadURL,
+		HTML: `<p> The copy of your personal data you asked for is ready. To download it, sign in and visit the following link before ` +
+			until + `: <a href="` + downloadURL + `">` + downloadURL + `</a></p>`,
+	}
+	err := es.SendEmail(email)
+	if err != nil {
+		return fmt.Errorf("data export email: %v", err)
+	}
+
+	return nil
+}
@@ -8,6 +8,7 @@ import (
 	"strings"
 	"testing"
 	"the_lonely_road/token"
+	"time"
 )
 
 func TestNewEmailService(t *testing.T) {
@@ -161,3 +162,73 @@ func TestEmailService_ForgotPassword(t *testing.T) {
 		t.Errorf("Token should be in URL")
 	}
 }
+
+func TestEmailService_EmailChange(t *testing.T) {
+	viper.SetConfigFile("../email.env")
+	if err := viper.ReadInConfig(); err != nil {
+		t.Fatalf("failed to read config file: %v", err)
+	}
+
+	emailService := NewEmailService(DefaultSMTPConfig())
+	changeToken, _, err := token.GenerateTokenAndSalt(32, 16)
+	if err != nil {
+		t.Errorf("Error generating token: %v", err)
+	}
+
+	err = emailService.ConfirmEmailChange("admin@admin.com", fmt.Sprintf("localhost:8080/users/me/email/confirm?token=%s", changeToken))
+	if err != nil {
+		t.Errorf("Error sending email: %v", err)
+	}
+	err = emailService.EmailChangeNotice("admin@admin.com", "new@admin.com", fmt.Sprintf("localhost:8080/users/email/cancel?token=%s", changeToken))
+	if err != nil {
+		t.Errorf("Error sending email: %v", err)
+	}
+}
+
+func TestEmailService_AccountDeleted(t *testing.T) {
+	viper.SetConfigFile("../email.env")
+	if err := viper.ReadInConfig(); err != nil {
+		t.Fatalf("failed to read config file: %v", err)
+	}
+
+	emailService := NewEmailService(DefaultSMTPConfig())
+	restoreToken, _, err := token.GenerateTokenAndSalt(32, 16)
+	if err != nil {
+		t.Errorf("Error generating token: %v", err)
+	}
+	err = emailService.AccountDeleted("admin@admin.com", fmt.Sprintf("localhost:8080/users/restore?token=%s", restoreToken), 30)
+	if err != nil {
+		t.Errorf("Error sending email: %v", err)
+	}
+}
+
+func TestEmailService_AccountLocked(t *testing.T) {
+	viper.SetConfigFile("../email.env")
+	if err := viper.ReadInConfig(); err != nil {
+		t.Fatalf("failed to read config file: %v", err)
+	}
+
+	emailService := NewEmailService(DefaultSMTPConfig())
+	err := emailService.AccountLocked("admin@admin.com", time.Now().Add(15*time.Minute))
+	if err != nil {
+		t.Errorf("Error sending email: %v", err)
+	}
+}
+
+func TestEmailService_OrgInvitation(t *testing.T) {
+	viper.SetConfigFile("../email.env")
+	if err := viper.ReadInConfig(); err != nil {
+		t.Fatalf("failed to read config file: %v", err)
+	}
+
+	emailService := NewEmailService(DefaultSMTPConfig())
+	inviteToken, _, err := token.GenerateTokenAndSalt(32, 16)
+	if err != nil {
+		t.Errorf("Error generating token: %v", err)
+	}
+	acceptURL := fmt.Sprintf("localhost:8080/invitations/0190a6e2-5c3b-7c1e-9f3a-2b4c6d8e0f12/accept?token=%s", inviteToken)
+	err = emailService.OrgInvitation("admin@admin.com", "Acme", acceptURL, time.Now().Add(7*24*time.Hour))
+	if err != nil {
+		t.Errorf("Error sending email: %v", err)
+	}
+}
@@ -0,0 +1,89 @@
+package mailer
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// SMSSender delivers text messages, the SMS counterpart of EmailService. Providers plug in behind it,
+// FileSMSSender stands in for one in development and tests.
+type SMSSender interface {
+	SendSMS(sms SMS) error
+}
+
+type SMS struct {
+	To   string
+	Body string
+}
+
+// FileSMSSender sends nothing. Every text is appended to the file at Path, or printed when Path is empty, and kept
+// for tests to read back with Sent.
+type FileSMSSender struct {
+	Path string
+
+	mu   sync.Mutex
+	sent []SMS
+}
+
+func (fs *FileSMSSender) SendSMS(sms SMS) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.sent = append(fs.sent, sms)
+
+	line := fmt.Sprintf("%s SMS to %s: %s\n", time.Now().UTC().Format(time.RFC3339), sms.To, sms.Body)
+	if fs.Path == "" {
+		fmt.Print(line)
+		return nil
+	}
+	// the codes in the file are as good as passwords until they expire
+	file, err := os.OpenFile(fs.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("send sms: %w", err)
+	}
+	_, err = file.WriteString(line)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("send sms: %w", err)
+	}
+	return nil
+}
+
+// Sent returns the texts sent so far, oldest first
+func (fs *FileSMSSender) Sent() []SMS {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return append([]SMS{}, fs.sent...)
+}
+
+// PhoneVerificationCode texts the code that proves to is the owner's number
+func PhoneVerificationCode(sender SMSSender, to, code string, expires time.Time) error {
+	until := expires.UTC().Format("15:04 MST")
+	err := sender.SendSMS(SMS{
+		To:   to,
+		Body: "Your verification code is " + code + ". It works until " + until + ", don't share it with anyone.",
+	})
+	if err != nil {
+		return fmt.Errorf("phone verification sms: %v", err)
+	}
+
+	return nil
+}
+
+// PasswordResetCode texts a code to reset the password with, for users who chose their verified phone over email
+func PasswordResetCode(sender SMSSender, to, code string, expires time.Time) error {
+	until := expires.UTC().Format("15:04 MST")
+	err := sender.SendSMS(SMS{
+		To: to,
+		Body: "Your password reset code is " + code + ". It works until " + until +
+			". If you didn't ask to reset your password, ignore this message.",
+	})
+	if err != nil {
+		return fmt.Errorf("password reset sms: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,54 @@
+package mailer
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileSMSSender(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sms.log")
+	sender := &FileSMSSender{Path: path}
+	expires := time.Date(2026, 10, 19, 9, 30, 0, 0, time.UTC)
+
+	err := PhoneVerificationCode(sender, "+14155552671", "123456", expires)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	err = PasswordResetCode(sender, "+14155552671", "654321", expires)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	sent := sender.Sent()
+	if len(sent) != 2 || sent[0].To != "+14155552671" || !strings.Contains(sent[0].Body, "123456") ||
+		!strings.Contains(sent[0].Body, "09:30 UTC") || !strings.Contains(sent[1].Body, "654321") {
+		t.Errorf("Expected both codes to be kept, got %+v", sent)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], "SMS to +14155552671: Your verification code is 123456") {
+		t.Errorf("Expected a line per text, got %q", content)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Expected the log to be private, got %s", info.Mode().Perm())
+	}
+}
+
+func TestFileSMSSender_Unwritable(t *testing.T) {
+	sender := &FileSMSSender{Path: filepath.Join(t.TempDir(), "missing", "sms.log")}
+	err := PhoneVerificationCode(sender, "+14155552671", "123456", time.Now())
+	if err == nil || !strings.Contains(err.Error(), "phone verification sms") {
+		t.Errorf("Expected the failure to say which text it was, got %v", err)
+	}
+}
@@ -0,0 +1,7 @@
+ALTER TABLE users
+    DROP COLUMN IF EXISTS display_name,
+    DROP COLUMN IF EXISTS given_name,
+    DROP COLUMN IF EXISTS family_name,
+    DROP COLUMN IF EXISTS locale,
+    DROP COLUMN IF EXISTS time_zone,
+    DROP COLUMN IF EXISTS updated_at;
@@ -0,0 +1,7 @@
+ALTER TABLE users
+    ADD COLUMN display_name text NOT NULL DEFAULT '',
+    ADD COLUMN given_name text NOT NULL DEFAULT '',
+    ADD COLUMN family_name text NOT NULL DEFAULT '',
+    ADD COLUMN locale text NOT NULL DEFAULT '',
+    ADD COLUMN time_zone text NOT NULL DEFAULT '',
+    ADD COLUMN updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP;
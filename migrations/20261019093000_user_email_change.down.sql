@@ -0,0 +1,7 @@
+ALTER TABLE users
+    DROP COLUMN IF EXISTS pending_email,
+    DROP COLUMN IF EXISTS email_change_token,
+    DROP COLUMN IF EXISTS email_change_salt,
+    DROP COLUMN IF EXISTS email_change_cancel_token,
+    DROP COLUMN IF EXISTS email_change_cancel_salt,
+    DROP COLUMN IF EXISTS email_change_expires;
@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS users_deleted_at_idx;
+
+ALTER TABLE users
+    DROP COLUMN IF EXISTS deleted_at,
+    DROP COLUMN IF EXISTS restore_token,
+    DROP COLUMN IF EXISTS restore_salt,
+    DROP COLUMN IF EXISTS restore_expires;
@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS users_created_at_idx;
+
+ALTER TABLE users
+    DROP COLUMN IF EXISTS verified,
+    DROP COLUMN IF EXISTS locked_until;
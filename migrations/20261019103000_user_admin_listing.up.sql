@@ -0,0 +1,5 @@
+ALTER TABLE users
+    ADD COLUMN verified boolean NOT NULL DEFAULT false,
+    ADD COLUMN locked_until TIMESTAMP;
+
+CREATE INDEX IF NOT EXISTS users_created_at_idx ON users (created_at);
@@ -0,0 +1,3 @@
+ALTER TABLE users
+    ADD COLUMN failed_logins integer NOT NULL DEFAULT 0,
+    ADD COLUMN last_failed_login TIMESTAMP;
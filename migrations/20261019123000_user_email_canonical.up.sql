@@ -0,0 +1,34 @@
+-- in a transaction so a collision leaves the table as it was
+BEGIN;
+
+ALTER TABLE users ADD COLUMN email_canonical text;
+
+-- SQL can't do IDNA, the server fixes up internationalised domains at startup with models.CanonicalEmail
+UPDATE users SET email_canonical = lower(normalize(btrim(email), NFC));
+
+-- two accounts that only differ by case or normalisation can't both keep their address, list them all so they
+-- can be merged or renamed by hand before running this again
+DO $$
+DECLARE
+    collision record;
+    collisions integer := 0;
+BEGIN
+    FOR collision IN
+        SELECT email_canonical, string_agg(id || ' <' || email || '>', ', ' ORDER BY id) AS accounts
+        FROM users
+        GROUP BY email_canonical
+        HAVING count(*) > 1
+    LOOP
+        RAISE WARNING 'email collision on %: %', collision.email_canonical, collision.accounts;
+        collisions := collisions + 1;
+    END LOOP;
+
+    IF collisions > 0 THEN
+        RAISE EXCEPTION '% canonical email collision(s) found, resolve them and run the migration again', collisions;
+    END IF;
+END $$;
+
+ALTER TABLE users ALTER COLUMN email_canonical SET NOT NULL;
+CREATE UNIQUE INDEX users_email_canonical_key ON users (email_canonical);
+
+COMMIT;
@@ -0,0 +1,14 @@
+-- the server writes UUIDv7s on insert, the v4 default only covers rows added by hand
+ALTER TABLE users ADD COLUMN public_id uuid DEFAULT gen_random_uuid();
+
+-- backfill version 7 ids whose timestamp is created_at so existing users sort the same way new ones do
+UPDATE users SET public_id = encode(
+    set_bit(set_bit(
+        overlay(uuid_send(gen_random_uuid())
+            placing substring(int8send(floor(extract(epoch FROM created_at) * 1000)::bigint) FROM 3)
+            FROM 1 FOR 6),
+        52, 1), 53, 1),
+    'hex')::uuid;
+
+ALTER TABLE users ALTER COLUMN public_id SET NOT NULL;
+CREATE UNIQUE INDEX users_public_id_key ON users (public_id);
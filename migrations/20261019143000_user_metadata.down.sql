@@ -0,0 +1,3 @@
+ALTER TABLE users DROP COLUMN IF EXISTS user_metadata;
+
+ALTER TABLE users DROP COLUMN IF EXISTS app_metadata;
@@ -0,0 +1,5 @@
+-- app_metadata is written by admins, user_metadata by the user, both are merge-patched objects capped in size by the server
+ALTER TABLE users ADD COLUMN app_metadata jsonb NOT NULL DEFAULT '{}'
+    CONSTRAINT users_app_metadata_object CHECK (jsonb_typeof(app_metadata) = 'object');
+ALTER TABLE users ADD COLUMN user_metadata jsonb NOT NULL DEFAULT '{}'
+    CONSTRAINT users_user_metadata_object CHECK (jsonb_typeof(user_metadata) = 'object');
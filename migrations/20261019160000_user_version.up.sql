@@ -0,0 +1,2 @@
+-- version goes up by one on every write to the row so updates can check nothing changed since the user was read
+ALTER TABLE users ADD COLUMN version integer NOT NULL DEFAULT 1;
@@ -0,0 +1,13 @@
+-- personal data exports too large to send back straight away, downloaded through an emailed link until they expire
+CREATE TABLE IF NOT EXISTS data_exports (
+    id SERIAL PRIMARY KEY,
+    public_id uuid UNIQUE NOT NULL,
+    user_id integer NOT NULL REFERENCES users ON DELETE CASCADE,
+    token_hash text NOT NULL,
+    token_salt text NOT NULL,
+    content bytea NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS data_exports_expires_at_idx ON data_exports (expires_at);
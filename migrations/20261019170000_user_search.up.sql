@@ -0,0 +1,6 @@
+-- trigram indexes behind the admin user search, they serve both the substring LIKE and the fuzzy <% match
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+CREATE INDEX IF NOT EXISTS users_email_trgm_idx ON users USING gin (lower(email) gin_trgm_ops);
+CREATE INDEX IF NOT EXISTS users_name_trgm_idx ON users
+    USING gin (lower(display_name || ' ' || given_name || ' ' || family_name) gin_trgm_ops);
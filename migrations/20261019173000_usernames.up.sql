@@ -0,0 +1,4 @@
+-- an optional handle to sign in with instead of the email, unique ignoring case
+ALTER TABLE users ADD COLUMN username text;
+
+CREATE UNIQUE INDEX IF NOT EXISTS users_username_key ON users (lower(username));
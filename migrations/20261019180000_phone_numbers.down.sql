@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS sms_codes;
+ALTER TABLE users
+    DROP COLUMN IF EXISTS phone,
+    DROP COLUMN IF EXISTS phone_verified;
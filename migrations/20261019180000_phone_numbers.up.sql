@@ -0,0 +1,18 @@
+-- an optional E.164 phone number, verified by texting it a code, and the codes themselves. A user has at most one
+-- outstanding code per purpose, sending a new one replaces it.
+ALTER TABLE users
+    ADD COLUMN phone text NOT NULL DEFAULT '',
+    ADD COLUMN phone_verified boolean NOT NULL DEFAULT false;
+
+CREATE TABLE IF NOT EXISTS sms_codes (
+    id SERIAL PRIMARY KEY,
+    user_id integer NOT NULL REFERENCES users ON DELETE CASCADE,
+    purpose text NOT NULL,
+    phone text NOT NULL,
+    code_hash text NOT NULL,
+    code_salt text NOT NULL,
+    attempts integer NOT NULL DEFAULT 0,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP NOT NULL,
+    UNIQUE (user_id, purpose)
+);
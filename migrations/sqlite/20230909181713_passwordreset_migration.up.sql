@@ -0,0 +1,2 @@
+ALTER TABLE users ADD COLUMN password_reset_token text NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN password_reset_expires TIMESTAMP NOT NULL DEFAULT '1970-01-01 00:00:00';
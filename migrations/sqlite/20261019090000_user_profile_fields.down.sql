@@ -0,0 +1,6 @@
+ALTER TABLE users DROP COLUMN display_name;
+ALTER TABLE users DROP COLUMN given_name;
+ALTER TABLE users DROP COLUMN family_name;
+ALTER TABLE users DROP COLUMN locale;
+ALTER TABLE users DROP COLUMN time_zone;
+ALTER TABLE users DROP COLUMN updated_at;
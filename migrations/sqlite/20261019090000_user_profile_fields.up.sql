@@ -0,0 +1,8 @@
+ALTER TABLE users ADD COLUMN display_name text NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN given_name text NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN family_name text NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN locale text NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN time_zone text NOT NULL DEFAULT '';
+-- SQLite only allows constant defaults on added columns
+ALTER TABLE users ADD COLUMN updated_at TIMESTAMP NOT NULL DEFAULT '1970-01-01 00:00:00';
+UPDATE users SET updated_at = created_at;
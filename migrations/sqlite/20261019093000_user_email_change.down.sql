@@ -0,0 +1,6 @@
+ALTER TABLE users DROP COLUMN pending_email;
+ALTER TABLE users DROP COLUMN email_change_token;
+ALTER TABLE users DROP COLUMN email_change_salt;
+ALTER TABLE users DROP COLUMN email_change_cancel_token;
+ALTER TABLE users DROP COLUMN email_change_cancel_salt;
+ALTER TABLE users DROP COLUMN email_change_expires;
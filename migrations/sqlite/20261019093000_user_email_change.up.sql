@@ -0,0 +1,7 @@
+ALTER TABLE users ADD COLUMN pending_email text NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN email_change_token text NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN email_change_salt text NOT NULL DEFAULT '';
+-- the notice to the old address carries its own token, so the confirmation link can't be used to cancel and back
+ALTER TABLE users ADD COLUMN email_change_cancel_token text NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN email_change_cancel_salt text NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN email_change_expires TIMESTAMP NOT NULL DEFAULT '1970-01-01 00:00:00';
@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS users_deleted_at_idx;
+
+ALTER TABLE users DROP COLUMN deleted_at;
+ALTER TABLE users DROP COLUMN restore_token;
+ALTER TABLE users DROP COLUMN restore_salt;
+ALTER TABLE users DROP COLUMN restore_expires;
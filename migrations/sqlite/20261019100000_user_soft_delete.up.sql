@@ -0,0 +1,6 @@
+ALTER TABLE users ADD COLUMN deleted_at TIMESTAMP;
+ALTER TABLE users ADD COLUMN restore_token text NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN restore_salt text NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN restore_expires TIMESTAMP NOT NULL DEFAULT '1970-01-01 00:00:00';
+
+CREATE INDEX IF NOT EXISTS users_deleted_at_idx ON users (restore_expires) WHERE deleted_at IS NOT NULL;
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS users_created_at_idx;
+
+ALTER TABLE users DROP COLUMN verified;
+ALTER TABLE users DROP COLUMN locked_until;
@@ -0,0 +1,4 @@
+ALTER TABLE users ADD COLUMN verified boolean NOT NULL DEFAULT false;
+ALTER TABLE users ADD COLUMN locked_until TIMESTAMP;
+
+CREATE INDEX IF NOT EXISTS users_created_at_idx ON users (created_at);
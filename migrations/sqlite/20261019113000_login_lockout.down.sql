@@ -0,0 +1,2 @@
+ALTER TABLE users DROP COLUMN failed_logins;
+ALTER TABLE users DROP COLUMN last_failed_login;
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS users_email_canonical_key;
+
+ALTER TABLE users DROP COLUMN email_canonical;
@@ -0,0 +1,7 @@
+-- SQLite can't normalise unicode, addresses stored before this are only lower cased, see UserModel.CanonicalizeEmails.
+-- The migration runs in a transaction, a collision on the unique index leaves the table as it was.
+ALTER TABLE users ADD COLUMN email_canonical text NOT NULL DEFAULT '';
+
+UPDATE users SET email_canonical = lower(trim(email));
+
+CREATE UNIQUE INDEX users_email_canonical_key ON users (email_canonical);
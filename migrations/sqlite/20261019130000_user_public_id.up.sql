@@ -0,0 +1,7 @@
+-- the server writes UUIDv7s on insert, existing rows get a random version 4 id as SQLite has no uuid functions
+ALTER TABLE users ADD COLUMN public_id text NOT NULL DEFAULT '';
+
+UPDATE users SET public_id = lower(hex(randomblob(4)) || '-' || hex(randomblob(2)) || '-4' || substr(hex(randomblob(2)), 2) || '-' ||
+    substr('89ab', 1 + (abs(random()) % 4), 1) || substr(hex(randomblob(2)), 2) || '-' || hex(randomblob(6)));
+
+CREATE UNIQUE INDEX users_public_id_key ON users (public_id);
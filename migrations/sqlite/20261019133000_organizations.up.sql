@@ -0,0 +1,29 @@
+CREATE TABLE IF NOT EXISTS organizations (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    slug text UNIQUE NOT NULL,
+    name text NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS memberships (
+    organization_id integer NOT NULL REFERENCES organizations ON DELETE CASCADE,
+    user_id integer NOT NULL REFERENCES users ON DELETE CASCADE,
+    role text NOT NULL DEFAULT 'member' CHECK (role IN ('owner', 'admin', 'member')),
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (organization_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS memberships_user_id_idx ON memberships (user_id);
+
+-- single-tenant deployments carry on in the default organization, admins own it
+INSERT INTO organizations (slug, name) VALUES ('default', 'Default');
+
+INSERT INTO memberships (organization_id, user_id, role, created_at)
+SELECT organizations.id, users.id,
+    CASE WHEN EXISTS (
+        SELECT 1 FROM user_roles JOIN roles ON roles.id = user_roles.role_id
+        WHERE user_roles.user_id = users.id AND roles.name = 'admin'
+    ) THEN 'owner' ELSE 'member' END,
+    users.created_at
+FROM organizations, users
+WHERE organizations.slug = 'default';
@@ -0,0 +1,19 @@
+CREATE TABLE IF NOT EXISTS invitations (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    public_id text UNIQUE NOT NULL,
+    organization_id integer NOT NULL REFERENCES organizations ON DELETE CASCADE,
+    email text NOT NULL,
+    email_canonical text NOT NULL,
+    role text NOT NULL CHECK (role IN ('owner', 'admin', 'member')),
+    invited_by integer REFERENCES users ON DELETE SET NULL,
+    token_hash text NOT NULL,
+    token_salt text NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP NOT NULL,
+    accepted_at TIMESTAMP,
+    revoked_at TIMESTAMP
+);
+
+-- only the newest invitation for an address is left open, see UserModel.CreateInvitation
+CREATE UNIQUE INDEX IF NOT EXISTS invitations_open_key ON invitations (organization_id, email_canonical)
+    WHERE accepted_at IS NULL AND revoked_at IS NULL;
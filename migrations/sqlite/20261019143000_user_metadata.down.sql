@@ -0,0 +1,3 @@
+ALTER TABLE users DROP COLUMN user_metadata;
+
+ALTER TABLE users DROP COLUMN app_metadata;
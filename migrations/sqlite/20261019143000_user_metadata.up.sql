@@ -0,0 +1,5 @@
+-- app_metadata is written by admins, user_metadata by the user, both are merge-patched objects capped in size by the server
+ALTER TABLE users ADD COLUMN app_metadata text NOT NULL DEFAULT '{}'
+    CONSTRAINT users_app_metadata_object CHECK (json_type(app_metadata) = 'object');
+ALTER TABLE users ADD COLUMN user_metadata text NOT NULL DEFAULT '{}'
+    CONSTRAINT users_user_metadata_object CHECK (json_type(user_metadata) = 'object');
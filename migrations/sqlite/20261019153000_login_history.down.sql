@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS audit_events_login_idx;
+ALTER TABLE audit_events DROP COLUMN method;
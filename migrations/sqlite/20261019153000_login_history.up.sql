@@ -0,0 +1,5 @@
+-- how a sign in was attempted, empty for events that aren't sign ins
+ALTER TABLE audit_events ADD COLUMN method text NOT NULL DEFAULT '';
+
+CREATE INDEX IF NOT EXISTS audit_events_login_idx ON audit_events (subject_id, created_at)
+    WHERE event_type IN ('login.succeeded', 'login.failed');
@@ -0,0 +1,2 @@
+-- SQLite has no trigram indexes, SearchUsers ranks users in process, so this only keeps the versions in step
+SELECT 1;
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS sms_codes;
+ALTER TABLE users DROP COLUMN phone_verified;
+ALTER TABLE users DROP COLUMN phone;
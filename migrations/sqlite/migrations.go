@@ -0,0 +1,9 @@
+// Package sqlite holds the SQLite versions of the migrations one directory up. Every migration there has one here
+// with the same version and name, and the files are compiled into the binary so a SQLite deployment needs no
+// migrate CLI, see data.OpenSQLite.
+package sqlite
+
+import "embed"
+
+//go:embed *.sql
+var FS embed.FS
@@ -1,12 +1,181 @@
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
 CREATE TABLE IF NOT EXISTS users (
      id SERIAL PRIMARY KEY,
+     public_id uuid NOT NULL DEFAULT gen_random_uuid(),
      password_hash text NOT NULL,
      email text UNIQUE NOT NULL,
+     email_canonical text NOT NULL,
      created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
      password_reset_token text,
      password_reset_expires TIMESTAMP,
-     password_reset_salt text
+     password_reset_salt text,
+     display_name text NOT NULL DEFAULT '',
+     given_name text NOT NULL DEFAULT '',
+     family_name text NOT NULL DEFAULT '',
+     locale text NOT NULL DEFAULT '',
+     time_zone text NOT NULL DEFAULT '',
+     updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+     pending_email text NOT NULL DEFAULT '',
+     email_change_token text NOT NULL DEFAULT '',
+     email_change_salt text NOT NULL DEFAULT '',
+     email_change_cancel_token text NOT NULL DEFAULT '',
+     email_change_cancel_salt text NOT NULL DEFAULT '',
+     email_change_expires TIMESTAMP NOT NULL DEFAULT '1970-01-01 00:00:00',
+     deleted_at TIMESTAMP,
+     restore_token text NOT NULL DEFAULT '',
+     restore_salt text NOT NULL DEFAULT '',
+     restore_expires TIMESTAMP NOT NULL DEFAULT '1970-01-01 00:00:00',
+     verified boolean NOT NULL DEFAULT false,
+     locked_until TIMESTAMP,
+     failed_logins integer NOT NULL DEFAULT 0,
+     last_failed_login TIMESTAMP,
+     app_metadata jsonb NOT NULL DEFAULT '{}' CONSTRAINT users_app_metadata_object CHECK (jsonb_typeof(app_metadata) = 'object'),
+     user_metadata jsonb NOT NULL DEFAULT '{}' CONSTRAINT users_user_metadata_object CHECK (jsonb_typeof(user_metadata) = 'object'),
+     version integer NOT NULL DEFAULT 1,
+     username text,
+     phone text NOT NULL DEFAULT '',
+     phone_verified boolean NOT NULL DEFAULT false
+);
+
+CREATE TABLE IF NOT EXISTS password_history (
+     id SERIAL PRIMARY KEY,
+     user_id integer NOT NULL REFERENCES users ON DELETE CASCADE,
+     password_hash text NOT NULL,
+     created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS roles (
+     id SERIAL PRIMARY KEY,
+     name text UNIQUE NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS permissions (
+     id SERIAL PRIMARY KEY,
+     code text UNIQUE NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS role_permissions (
+     role_id integer NOT NULL REFERENCES roles ON DELETE CASCADE,
+     permission_id integer NOT NULL REFERENCES permissions ON DELETE CASCADE,
+     PRIMARY KEY (role_id, permission_id)
+);
+
+CREATE TABLE IF NOT EXISTS user_roles (
+     user_id integer NOT NULL REFERENCES users ON DELETE CASCADE,
+     role_id integer NOT NULL REFERENCES roles ON DELETE CASCADE,
+     PRIMARY KEY (user_id, role_id)
+);
+
+INSERT INTO roles (name) VALUES ('admin'), ('support');
+INSERT INTO permissions (code) VALUES ('users:read'), ('users:admin'), ('audit:read');
+INSERT INTO role_permissions (role_id, permission_id)
+SELECT roles.id, permissions.id FROM roles, permissions
+WHERE roles.name = 'admin' OR (roles.name = 'support' AND permissions.code = 'users:read');
+
+CREATE UNIQUE INDEX IF NOT EXISTS users_email_canonical_key ON users (email_canonical);
+CREATE UNIQUE INDEX IF NOT EXISTS users_public_id_key ON users (public_id);
+CREATE UNIQUE INDEX IF NOT EXISTS users_username_key ON users (lower(username));
+CREATE INDEX IF NOT EXISTS users_email_trgm_idx ON users USING gin (lower(email) gin_trgm_ops);
+CREATE INDEX IF NOT EXISTS users_name_trgm_idx ON users
+     USING gin (lower(display_name || ' ' || given_name || ' ' || family_name) gin_trgm_ops);
+
+CREATE TABLE IF NOT EXISTS organizations (
+     id SERIAL PRIMARY KEY,
+     slug text UNIQUE NOT NULL,
+     name text NOT NULL,
+     created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS memberships (
+     organization_id integer NOT NULL REFERENCES organizations ON DELETE CASCADE,
+     user_id integer NOT NULL REFERENCES users ON DELETE CASCADE,
+     role text NOT NULL DEFAULT 'member' CHECK (role IN ('owner', 'admin', 'member')),
+     created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+     PRIMARY KEY (organization_id, user_id)
 );
 
-INSERT INTO users (password_hash, email, created_at, password_reset_token, password_reset_expires, password_reset_salt)
-VALUES ('$2a$10$m2RvoCSnhAMGZggN1SPPsOwlSC8Ne0EX.wi7EHK2/pKKmoOmDQsUe', 'admin@localhost', now(), 'testhash', now(), 'testsalt');
+CREATE INDEX IF NOT EXISTS memberships_user_id_idx ON memberships (user_id);
+
+CREATE TABLE IF NOT EXISTS invitations (
+     id SERIAL PRIMARY KEY,
+     public_id uuid UNIQUE NOT NULL,
+     organization_id integer NOT NULL REFERENCES organizations ON DELETE CASCADE,
+     email text NOT NULL,
+     email_canonical text NOT NULL,
+     role text NOT NULL CHECK (role IN ('owner', 'admin', 'member')),
+     invited_by integer REFERENCES users ON DELETE SET NULL,
+     token_hash text NOT NULL,
+     token_salt text NOT NULL,
+     created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+     expires_at TIMESTAMP NOT NULL,
+     accepted_at TIMESTAMP,
+     revoked_at TIMESTAMP
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS invitations_open_key ON invitations (organization_id, email_canonical)
+     WHERE accepted_at IS NULL AND revoked_at IS NULL;
+
+CREATE TABLE IF NOT EXISTS audit_events (
+     id BIGSERIAL PRIMARY KEY,
+     event_type text NOT NULL,
+     actor_id uuid,
+     subject_id uuid,
+     email text NOT NULL DEFAULT '',
+     ip text NOT NULL DEFAULT '',
+     user_agent text NOT NULL DEFAULT '',
+     request_id text NOT NULL DEFAULT '',
+     method text NOT NULL DEFAULT '',
+     created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS audit_events_created_at_idx ON audit_events (created_at, id);
+CREATE INDEX IF NOT EXISTS audit_events_subject_id_idx ON audit_events (subject_id, created_at);
+CREATE INDEX IF NOT EXISTS audit_events_login_idx ON audit_events (subject_id, created_at)
+     WHERE event_type IN ('login.succeeded', 'login.failed');
+
+CREATE OR REPLACE FUNCTION audit_events_append_only() RETURNS trigger AS $$
+BEGIN
+     RAISE EXCEPTION 'audit_events is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_events_append_only BEFORE UPDATE OR DELETE ON audit_events
+     FOR EACH ROW EXECUTE FUNCTION audit_events_append_only();
+
+CREATE TABLE IF NOT EXISTS data_exports (
+     id SERIAL PRIMARY KEY,
+     public_id uuid UNIQUE NOT NULL,
+     user_id integer NOT NULL REFERENCES users ON DELETE CASCADE,
+     token_hash text NOT NULL,
+     token_salt text NOT NULL,
+     content bytea NOT NULL,
+     created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+     expires_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS data_exports_expires_at_idx ON data_exports (expires_at);
+
+CREATE TABLE IF NOT EXISTS sms_codes (
+     id SERIAL PRIMARY KEY,
+     user_id integer NOT NULL REFERENCES users ON DELETE CASCADE,
+     purpose text NOT NULL,
+     phone text NOT NULL,
+     code_hash text NOT NULL,
+     code_salt text NOT NULL,
+     attempts integer NOT NULL DEFAULT 0,
+     created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+     expires_at TIMESTAMP NOT NULL,
+     UNIQUE (user_id, purpose)
+);
+
+INSERT INTO organizations (slug, name) VALUES ('default', 'Default');
+
+INSERT INTO users (password_hash, email, email_canonical, created_at, password_reset_token, password_reset_expires, password_reset_salt, verified)
+VALUES ('$2a$10$m2RvoCSnhAMGZggN1SPPsOwlSC8Ne0EX.wi7EHK2/pKKmoOmDQsUe', 'admin@localhost', 'admin@localhost', now(), 'testhash', now(), 'testsalt', true);
+
+INSERT INTO user_roles (user_id, role_id)
+SELECT users.id, roles.id FROM users, roles WHERE users.email = 'admin@localhost' AND roles.name = 'admin';
+
+INSERT INTO memberships (organization_id, user_id, role)
+SELECT organizations.id, users.id, 'owner' FROM organizations, users WHERE organizations.slug = 'default' AND users.email = 'admin@localhost';
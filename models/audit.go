@@ -0,0 +1,155 @@
+package models
+
+import (
+	"context"
+	"time"
+)
+
+// Audit event types, written by the handlers that act on an account
+const (
+	AuditLoginSucceeded         = "login.succeeded"
+	AuditLoginFailed            = "login.failed"
+	AuditUserCreated            = "user.created"
+	AuditPasswordResetRequested = "password.reset_requested"
+	AuditPasswordReset          = "password.reset"
+	AuditPasswordResetFailed    = "password.reset_failed"
+	AuditSignedOut              = "user.signed_out"
+	AuditUsersImported          = "users.imported"
+	AuditUsersExported          = "users.exported"
+	AuditDataExported           = "user.data_exported"
+	AuditPhoneVerified          = "user.phone_verified"
+	AuditPhoneRemoved           = "user.phone_removed"
+)
+
+// LoginMethodPassword is the only way to sign in for now, other flows record their own method on their login events
+const LoginMethodPassword = "password"
+
+// ResetMethodSMS marks the password reset events of a reset done with a texted code rather than the emailed link
+const ResetMethodSMS = "sms"
+
+// AuditEventTypes lists every type the admin listing can filter on
+var AuditEventTypes = []string{AuditLoginSucceeded, AuditLoginFailed, AuditUserCreated, AuditPasswordResetRequested,
+	AuditPasswordReset, AuditPasswordResetFailed, AuditSignedOut, AuditUsersImported, AuditUsersExported,
+	AuditDataExported, AuditPhoneVerified, AuditPhoneRemoved}
+
+// AuditEvent is one row of the append-only security log. ActorID is the public id of whoever made the request
+// and SubjectID the account it was about, either is empty when nobody was signed in or the email matched no
+// account. Email is the address as it was submitted so attempts against unknown accounts are still recorded, with field
+// encryption on it is the address's blind index instead, see FieldCipher.EmailIndex. The log can't be rewritten, so
+// events recorded before encryption was turned on keep their plaintext address.
+type AuditEvent struct {
+	ID        int64  `json:"id"`
+	Type      string `json:"type"`
+	ActorID   string `json:"actor_id,omitempty"`
+	SubjectID string `json:"subject_id,omitempty"`
+	Email     string `json:"email,omitempty"`
+	IP        string `json:"ip"`
+	UserAgent string `json:"user_agent"`
+	RequestID string `json:"request_id"`
+	// Method is how a sign in was attempted, see LoginMethodPassword, or ResetMethodSMS for a reset by text
+	Method    string    `json:"method,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// maxUserAgent keeps a hostile client from filling the log with one header
+const maxUserAgent = 512
+
+// RecordAuditEvent appends event to the log and fills in its ID
+func (m *UserModel) RecordAuditEvent(event *AuditEvent) error {
+	if len(event.UserAgent) > maxUserAgent {
+		event.UserAgent = event.UserAgent[:maxUserAgent]
+	}
+	query := `INSERT INTO audit_events (event_type, actor_id, subject_id, email, ip, user_agent, request_id, method, created_at)
+	VALUES ($1, NULLIF($2, '')::uuid, NULLIF($3, '')::uuid, $4, $5, $6, $7, $8, $9)
+	RETURNING id`
+	email := event.Email
+	if m.Cipher != nil && email != "" {
+		email = m.Cipher.EmailIndex(email)
+	}
+	args := []any{event.Type, event.ActorID, event.SubjectID, email, event.IP, event.UserAgent, event.RequestID, event.Method,
+		event.CreatedAt.UTC()}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	return m.DB.QueryRowContext(ctx, m.rebind(query), args...).Scan(&event.ID)
+}
+
+// ListAuditEvents pages through the log, see AuditFilters for what it can be narrowed by
+func (m *UserModel) ListAuditEvents(filters AuditFilters) ([]*AuditEvent, Metadata, error) {
+	query := `
+	SELECT count(*) OVER(), id, event_type, COALESCE(actor_id::text, ''), COALESCE(subject_id::text, ''), email, ip,
+		user_agent, request_id, method, created_at
+	FROM audit_events
+	WHERE ($1 = '' OR event_type = $1)
+	AND ($2 = '' OR actor_id::text = $2 OR subject_id::text = $2)
+	AND ($3::timestamp IS NULL OR created_at >= $3)
+	AND ($4::timestamp IS NULL OR created_at < $4)
+	ORDER BY created_at ` + filters.sortDirection() + `, id ` + filters.sortDirection() + `
+	LIMIT $5 OFFSET $6`
+	args := []any{filters.Type, filters.User, utcOrNil(filters.After), utcOrNil(filters.Before), filters.limit(), filters.offset()}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, m.rebind(query), args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	events := []*AuditEvent{}
+	for rows.Next() {
+		var e AuditEvent
+		err := rows.Scan(&totalRecords, &e.ID, &e.Type, &e.ActorID, &e.SubjectID, &e.Email, &e.IP, &e.UserAgent, &e.RequestID, &e.Method,
+			&e.CreatedAt)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		events = append(events, &e)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	return events, calculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
+
+func (mockUM *UserModelMock) RecordAuditEvent(event *AuditEvent) error {
+	if len(event.UserAgent) > maxUserAgent {
+		event.UserAgent = event.UserAgent[:maxUserAgent]
+	}
+	event.ID = int64(len(mockUM.AuditEvents) + 1)
+	mockUM.AuditEvents = append(mockUM.AuditEvents, event)
+	return nil
+}
+
+func (mockUM *UserModelMock) ListAuditEvents(filters AuditFilters) ([]*AuditEvent, Metadata, error) {
+	matched := []*AuditEvent{}
+	for _, e := range mockUM.AuditEvents {
+		switch {
+		case filters.Type != "" && e.Type != filters.Type:
+		case filters.User != "" && e.ActorID != filters.User && e.SubjectID != filters.User:
+		case filters.After != nil && e.CreatedAt.Before(*filters.After):
+		case filters.Before != nil && !e.CreatedAt.Before(*filters.Before):
+		default:
+			matched = append(matched, e)
+		}
+	}
+	// events are appended in order, so the slice is already oldest first
+	if filters.sortDirection() == "DESC" {
+		for i, j := 0, len(matched)-1; i < j; i, j = i+1, j-1 {
+			matched[i], matched[j] = matched[j], matched[i]
+		}
+	}
+
+	metadata := calculateMetadata(len(matched), filters.Page, filters.PageSize)
+	start, end := filters.offset(), filters.offset()+filters.limit()
+	if start > len(matched) {
+		start = len(matched)
+	}
+	if end > len(matched) {
+		end = len(matched)
+	}
+	return matched[start:end], metadata, nil
+}
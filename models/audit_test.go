@@ -0,0 +1,78 @@
+package models
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUserModelMock_AuditEvents(t *testing.T) {
+	userModel := UserModelMock{DB: []*User{}}
+	alice := "0190a6e2-5c3b-7c1e-9f3a-000000000001"
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, event := range []*AuditEvent{
+		{Type: AuditUserCreated, ActorID: alice, SubjectID: alice},
+		{Type: AuditLoginFailed, SubjectID: alice, UserAgent: strings.Repeat("x", 1000)},
+		{Type: AuditLoginFailed, Email: "nobody@example.com"},
+		{Type: AuditLoginSucceeded, ActorID: alice, SubjectID: alice},
+	} {
+		event.CreatedAt = start.Add(time.Duration(i) * time.Hour)
+		err := userModel.RecordAuditEvent(event)
+		if err != nil {
+			t.Fatalf("Expected no error, got %s", err)
+		}
+		if event.ID != int64(i+1) {
+			t.Errorf("Expected id %d, got %d", i+1, event.ID)
+		}
+	}
+	if len(userModel.AuditEvents[1].UserAgent) != maxUserAgent {
+		t.Errorf("Expected the user agent to be cut to %d bytes, got %d", maxUserAgent, len(userModel.AuditEvents[1].UserAgent))
+	}
+
+	after := start.Add(30 * time.Minute)
+	tests := []struct {
+		name          string
+		filters       AuditFilters
+		expectedIDs   []int64
+		expectedTotal int
+	}{
+		{name: "Newest first", filters: AuditFilters{}, expectedIDs: []int64{4, 3, 2, 1}, expectedTotal: 4},
+		{name: "Oldest first", filters: AuditFilters{Filters: Filters{Sort: "created_at"}}, expectedIDs: []int64{1, 2, 3, 4}, expectedTotal: 4},
+		{name: "By type", filters: AuditFilters{Type: AuditLoginFailed}, expectedIDs: []int64{3, 2}, expectedTotal: 2},
+		{name: "By user", filters: AuditFilters{User: alice, After: &after}, expectedIDs: []int64{4, 2}, expectedTotal: 2},
+		{name: "Second page", filters: AuditFilters{Filters: Filters{Page: 2, PageSize: 3}}, expectedIDs: []int64{1}, expectedTotal: 4},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filters := test.filters
+			if filters.Page == 0 {
+				filters.Page, filters.PageSize = 1, 20
+			}
+			if filters.Sort == "" {
+				filters.Sort = "-created_at"
+			}
+			filters.SortSafelist = AuditSortSafelist
+
+			events, metadata, err := userModel.ListAuditEvents(filters)
+			if err != nil {
+				t.Fatalf("Expected no error, got %s", err)
+			}
+			if metadata.TotalRecords != test.expectedTotal {
+				t.Errorf("Expected %d records, got %d", test.expectedTotal, metadata.TotalRecords)
+			}
+			ids := []int64{}
+			for _, event := range events {
+				ids = append(ids, event.ID)
+			}
+			if len(ids) != len(test.expectedIDs) {
+				t.Fatalf("Expected ids %v, got %v", test.expectedIDs, ids)
+			}
+			for i := range ids {
+				if ids[i] != test.expectedIDs[i] {
+					t.Fatalf("Expected ids %v, got %v", test.expectedIDs, ids)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package models_test
+
+import (
+	"encoding/base64"
+	"path/filepath"
+	"testing"
+	"the_lonely_road/data"
+	"the_lonely_road/models"
+	"the_lonely_road/models/modeltest"
+)
+
+var conformanceHasher = models.Hasher{Current: models.BcryptHasher{Cost: 4}}
+
+func TestUserModelMock_Conformance(t *testing.T) {
+	// the mock is only ever used from one goroutine at a time, MemoryUserModel is the one to share
+	modeltest.RunSequential(t, func(t *testing.T) models.IUserModel {
+		return &models.UserModelMock{Hasher: conformanceHasher}
+	})
+}
+
+func TestMemoryUserModel_Conformance(t *testing.T) {
+	modeltest.Run(t, func(t *testing.T) models.IUserModel {
+		return models.NewMemoryUserModel(models.LockoutPolicy{}, 0, conformanceHasher, nil)
+	})
+}
+
+func TestUserModel_Conformance(t *testing.T) {
+	t.Run("postgres", func(t *testing.T) {
+		modeltest.Run(t, func(t *testing.T) models.IUserModel {
+			db, err := data.Open(data.TestPostgresConfig())
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			t.Cleanup(func() { _ = db.Close() })
+			return &models.UserModel{DB: db, Hasher: conformanceHasher}
+		})
+	})
+	t.Run("sqlite", func(t *testing.T) {
+		modeltest.Run(t, func(t *testing.T) models.IUserModel {
+			db, err := data.OpenSQLite(data.SQLiteScheme + filepath.Join(t.TempDir(), "users.db"))
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			t.Cleanup(func() { _ = db.Close() })
+			return &models.UserModel{DB: db, Dialect: models.DialectSQLite, Hasher: conformanceHasher}
+		})
+	})
+	t.Run("sqlite encrypted", func(t *testing.T) {
+		modeltest.Run(t, func(t *testing.T) models.IUserModel {
+			db, err := data.OpenSQLite(data.SQLiteScheme + filepath.Join(t.TempDir(), "users.db"))
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			t.Cleanup(func() { _ = db.Close() })
+			return &models.UserModel{DB: db, Dialect: models.DialectSQLite, Hasher: conformanceHasher, Cipher: conformanceCipher(t)}
+		})
+	})
+}
+
+// conformanceCipher encrypts with throwaway keys, the backends have to behave the same with encryption on
+func conformanceCipher(t *testing.T) *models.FieldCipher {
+	key := base64.StdEncoding.EncodeToString(make([]byte, 32))
+	c, err := models.NewFieldCipher("test:"+key, key)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	return c
+}
@@ -0,0 +1,93 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"golang.org/x/net/idna"
+	"golang.org/x/text/unicode/norm"
+	"strings"
+	"time"
+)
+
+// CanonicalEmail is the form every address is looked up and compared in. It is NFC normalised, the domain is
+// converted to its ASCII form (so bücher.de and xn--bcher-kva.de are the same) and the whole address is lowercased.
+// The address the user typed is still what gets stored in email and mailed to.
+func CanonicalEmail(email string) string {
+	email = norm.NFC.String(strings.TrimSpace(email))
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return strings.ToLower(email)
+	}
+	local, domain := email[:at], email[at+1:]
+	// invalid domains are left as they are, ValidateEmail is what rejects them
+	if ascii, err := idna.Lookup.ToASCII(domain); err == nil {
+		domain = ascii
+	}
+	return strings.ToLower(local) + "@" + strings.ToLower(domain)
+}
+
+// CanonicalizeEmails recomputes email_canonical for addresses with non-ASCII characters. The migration that added the
+// column can only lowercase and NFC normalise in SQL, so internationalised domains are finished off here at startup.
+// Encrypted addresses never match, they were indexed in full when they were written. SQLite can't pick out the
+// non-ASCII addresses and its migration only lower cased existing ones, so there every address is checked. It all
+// happens in one transaction, if one address collides with another account none of them are changed.
+func (m *UserModel) CanonicalizeEmails() (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	query := `SELECT id, public_id, email, email_canonical FROM users WHERE email ~ '[^[:ascii:]]' FOR UPDATE`
+	if m.Dialect == DialectSQLite {
+		query = `SELECT id, public_id, email, email_canonical FROM users`
+	}
+	rows, err := tx.QueryContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+	type pending struct {
+		id        int64
+		canonical string
+	}
+	updates := []pending{}
+	for rows.Next() {
+		var id int64
+		var publicID, email, canonical string
+		err = rows.Scan(&id, &publicID, &email, &canonical)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		email, err = m.Cipher.Decrypt(email, publicID)
+		if err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("user %d email: %w", id, err)
+		}
+		if want := m.Cipher.EmailIndex(email); want != canonical {
+			updates = append(updates, pending{id: id, canonical: want})
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, u := range updates {
+		_, err = tx.ExecContext(ctx, `UPDATE users SET email_canonical = $2, version = version + 1 WHERE id = $1`, u.id, u.canonical)
+		if err != nil {
+			if uniqueViolation(err, "users_email_canonical_key") {
+				return 0, fmt.Errorf("user %d collides with another account on %s: %w", u.id, u.canonical, ErrDuplicateEmail)
+			}
+			return 0, err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(updates)), nil
+}
@@ -0,0 +1,57 @@
+package models
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCanonicalEmail(t *testing.T) {
+	tests := []struct {
+		name  string
+		email string
+		want  string
+	}{
+		{name: "Already canonical", email: "bob@example.com", want: "bob@example.com"},
+		{name: "Mixed case", email: "Bob@Example.COM", want: "bob@example.com"},
+		{name: "Surrounding space", email: "  bob@example.com\t", want: "bob@example.com"},
+		{name: "Decomposed accent", email: "jose\u0301@example.com", want: "jos\u00e9@example.com"},
+		{name: "Internationalised domain", email: "Anna@Bücher.de", want: "anna@xn--bcher-kva.de"},
+		{name: "Punycode domain", email: "anna@XN--BCHER-KVA.de", want: "anna@xn--bcher-kva.de"},
+		{name: "No at sign", email: "Not An Email", want: "not an email"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := CanonicalEmail(test.email); got != test.want {
+				t.Errorf("Expected %q, got %q", test.want, got)
+			}
+		})
+	}
+}
+
+func TestUserModelMock_CanonicalEmail(t *testing.T) {
+	userModel := UserModelMock{DB: []*User{}}
+	err := userModel.Insert(&User{ID: 1, Email: "Bob@Example.com", Password: "veryinsecurepassword"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+
+	err = userModel.Insert(&User{ID: 2, Email: "bob@example.COM", Password: "veryinsecurepassword"})
+	if !errors.Is(err, ErrDuplicateEmail) {
+		t.Errorf("Expected ErrDuplicateEmail for a case-only duplicate, got %v", err)
+	}
+	user, err := userModel.GetByEmail("BOB@example.com")
+	if err != nil || user.ID != 1 {
+		t.Errorf("Expected to find user 1, got %v and %v", user, err)
+	}
+	if user != nil && user.Email != "Bob@Example.com" {
+		t.Errorf("Expected the address to be kept as typed, got %s", user.Email)
+	}
+	_, err = userModel.Authenticate("bob@example.com", "veryinsecurepassword")
+	if err != nil {
+		t.Errorf("Expected to sign in with a differently cased address, got %s", err)
+	}
+	err = userModel.DeleteUser("BOB@EXAMPLE.COM")
+	if err != nil {
+		t.Errorf("Expected no error, got %s", err)
+	}
+}
@@ -0,0 +1,418 @@
+package models
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var (
+	ErrUnknownEncryptionKey = errors.New("value was encrypted with a master key that is not configured")
+	ErrEncryptionDisabled   = errors.New("field encryption is not configured")
+	ErrEncryptionMismatch   = errors.New("stored emails don't match the encryption settings")
+)
+
+// encryptedPrefix starts every encrypted value, what follows is $keyID:$wrappedDataKey:$ciphertext. ValidateEmail
+// refuses addresses starting with enc:, so values stored before encryption was turned on are told apart and read as
+// they are.
+const encryptedPrefix = "enc:v1:"
+
+// DefaultReencryptBatchSize is how many rows ReencryptUsers rewrites per transaction unless told otherwise
+const DefaultReencryptBatchSize = 500
+
+var encryptionKeyIDRX = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+// FieldCipher encrypts PII columns with AES-256-GCM. Every value is sealed with a fresh data key, which is itself
+// sealed with the active master key and stored next to it, so a leaked row or backup is useless without the master
+// keys in configuration. Master keys are rotated by adding a new one in front and running ReencryptUsers, the old
+// one can be dropped once that is done.
+//
+// Emails also get a blind index, an HMAC of CanonicalEmail under its own key, stored in email_canonical so lookups
+// and the unique constraint keep working on ciphertext. A nil FieldCipher stores everything in plaintext with the
+// canonical email as the index, every method can be called on it.
+type FieldCipher struct {
+	activeKeyID string
+	masterKeys  map[string]cipher.AEAD
+	indexKey    []byte
+}
+
+// NewFieldCipher takes ENCRYPTION_KEYS, a comma separated list of id:base64 32 byte keys with the one to encrypt
+// with first, and ENCRYPTION_INDEX_KEY, a base64 32 byte key that never rotates. Leaving both empty turns encryption
+// off and returns a nil FieldCipher.
+func NewFieldCipher(masterKeys, indexKey string) (*FieldCipher, error) {
+	masterKeys, indexKey = strings.TrimSpace(masterKeys), strings.TrimSpace(indexKey)
+	if masterKeys == "" && indexKey == "" {
+		return nil, nil
+	}
+	if masterKeys == "" || indexKey == "" {
+		return nil, errors.New("ENCRYPTION_KEYS and ENCRYPTION_INDEX_KEY have to be set together")
+	}
+
+	c := &FieldCipher{masterKeys: map[string]cipher.AEAD{}}
+	for _, entry := range strings.Split(masterKeys, ",") {
+		id, encoded, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		if !ok || !encryptionKeyIDRX.MatchString(id) {
+			return nil, fmt.Errorf("ENCRYPTION_KEYS entries must be id:key, with ids of up to 32 letters, digits, - and _")
+		}
+		if _, ok := c.masterKeys[id]; ok {
+			return nil, fmt.Errorf("ENCRYPTION_KEYS has key id %q twice", id)
+		}
+		key, err := decodeKey(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("ENCRYPTION_KEYS key %q: %w", id, err)
+		}
+		c.masterKeys[id], err = newGCM(key)
+		if err != nil {
+			return nil, err
+		}
+		if c.activeKeyID == "" {
+			c.activeKeyID = id
+		}
+	}
+	var err error
+	c.indexKey, err = decodeKey(indexKey)
+	if err != nil {
+		return nil, fmt.Errorf("ENCRYPTION_INDEX_KEY: %w", err)
+	}
+	return c, nil
+}
+
+func decodeKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errors.New("must be base64")
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("must be 32 bytes, got %d", len(key))
+	}
+	return key, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts plaintext with aead under a random nonce, which leads the result
+func seal(aead cipher.AEAD, plaintext, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func open(aead cipher.AEAD, sealed, additionalData []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("encrypted value is too short")
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], additionalData)
+}
+
+// Encrypt seals plaintext for storage in the row with publicID, which is authenticated along with it so a value copied
+// into another row won't decrypt there. Empty values stay empty, pending_email uses the empty string for none.
+func (c *FieldCipher) Encrypt(plaintext, publicID string) (string, error) {
+	if c == nil || plaintext == "" {
+		return plaintext, nil
+	}
+	dataKey := make([]byte, 32)
+	_, err := rand.Read(dataKey)
+	if err != nil {
+		return "", err
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := seal(aead, []byte(plaintext), []byte(publicID))
+	if err != nil {
+		return "", err
+	}
+	// the key id is authenticated with the data key, so a wrapped key can't be passed off as another master key's
+	wrappedKey, err := seal(c.masterKeys[c.activeKeyID], dataKey, []byte(c.activeKeyID))
+	if err != nil {
+		return "", err
+	}
+	return encryptedPrefix + c.activeKeyID + ":" + base64.RawURLEncoding.EncodeToString(wrappedKey) + ":" +
+		base64.RawURLEncoding.EncodeToString(ciphertext), nil
+}
+
+// Decrypt opens a value Encrypt sealed for the row with publicID, anything stored before encryption was turned on is
+// returned as it is
+func (c *FieldCipher) Decrypt(value, publicID string) (string, error) {
+	if !strings.HasPrefix(value, encryptedPrefix) {
+		return value, nil
+	}
+	parts := strings.Split(strings.TrimPrefix(value, encryptedPrefix), ":")
+	if len(parts) != 3 {
+		return "", errors.New("malformed encrypted value")
+	}
+	if c == nil {
+		return "", ErrUnknownEncryptionKey
+	}
+	masterKey, ok := c.masterKeys[parts[0]]
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrUnknownEncryptionKey, parts[0])
+	}
+	wrappedKey, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", errors.New("malformed encrypted value")
+	}
+	ciphertext, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", errors.New("malformed encrypted value")
+	}
+	dataKey, err := open(masterKey, wrappedKey, []byte(parts[0]))
+	if err != nil {
+		return "", fmt.Errorf("unwrap data key: %w", err)
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := open(aead, ciphertext, []byte(publicID))
+	if err != nil {
+		return "", fmt.Errorf("decrypt: %w", err)
+	}
+	return string(plaintext), nil
+}
+
+// EmailIndex is what email_canonical holds for email, and so what every lookup by email compares against
+func (c *FieldCipher) EmailIndex(email string) string {
+	canonical := CanonicalEmail(email)
+	if c == nil {
+		return canonical
+	}
+	mac := hmac.New(sha256.New, c.indexKey)
+	mac.Write([]byte(canonical))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// current reports whether value is already sealed with the active master key, or is empty and needs no sealing
+func (c *FieldCipher) current(value string) bool {
+	return value == "" || strings.HasPrefix(value, encryptedPrefix+c.activeKeyID+":")
+}
+
+// decryptUser opens the encrypted columns scanned into user
+func (c *FieldCipher) decryptUser(user *User) error {
+	var err error
+	user.Email, err = c.Decrypt(user.Email, user.PublicID)
+	if err != nil {
+		return fmt.Errorf("user %d email: %w", user.ID, err)
+	}
+	user.PendingEmail, err = c.Decrypt(user.PendingEmail, user.PublicID)
+	if err != nil {
+		return fmt.Errorf("user %d pending email: %w", user.ID, err)
+	}
+	return nil
+}
+
+// encryptedEmails is the part of a users or invitations row that ReencryptUsers rewrites, invitations have no
+// pending email
+type encryptedEmails struct {
+	id           int64
+	publicID     string
+	email        string
+	pendingEmail string
+	index        string
+}
+
+// reencrypt returns row sealed with the active master key and indexed with the index key, and whether that differs
+// from what is stored. Rows that are already up to date are left alone so the command can be run again after a failure.
+func (c *FieldCipher) reencrypt(row encryptedEmails) (encryptedEmails, bool, error) {
+	email, err := c.Decrypt(row.email, row.publicID)
+	if err != nil {
+		return row, false, fmt.Errorf("%d email: %w", row.id, err)
+	}
+	pendingEmail, err := c.Decrypt(row.pendingEmail, row.publicID)
+	if err != nil {
+		return row, false, fmt.Errorf("%d pending email: %w", row.id, err)
+	}
+	index := c.EmailIndex(email)
+	if c.current(row.email) && c.current(row.pendingEmail) && row.index == index {
+		return row, false, nil
+	}
+
+	updated := encryptedEmails{id: row.id, publicID: row.publicID, index: index}
+	updated.email, err = c.Encrypt(email, row.publicID)
+	if err != nil {
+		return row, false, err
+	}
+	updated.pendingEmail, err = c.Encrypt(pendingEmail, row.publicID)
+	if err != nil {
+		return row, false, err
+	}
+	return updated, true, nil
+}
+
+// emailFilter splits the admin listing's email filter into a LIKE pattern and an index to match exactly. Ciphertext
+// can't be searched, so with encryption on only the whole address finds its user.
+func (c *FieldCipher) emailFilter(email string) (like, index string) {
+	if c == nil || email == "" {
+		return escapeLike(email), ""
+	}
+	return "", c.EmailIndex(email)
+}
+
+// encryptedTable is how ReencryptUsers reads and writes the encrypted emails of one table
+type encryptedTable struct {
+	name   string
+	query  string
+	update func(row encryptedEmails) (string, []any)
+}
+
+var encryptedTables = []encryptedTable{
+	{
+		name:  "user",
+		query: `SELECT id, public_id, email, pending_email, email_canonical FROM users`,
+		update: func(row encryptedEmails) (string, []any) {
+			return `UPDATE users SET email = $2, pending_email = $3, email_canonical = $4, version = version + 1 WHERE id = $1`,
+				[]any{row.id, row.email, row.pendingEmail, row.index}
+		},
+	},
+	{
+		name:  "invitation",
+		query: `SELECT id, public_id, email, '', email_canonical FROM invitations`,
+		update: func(row encryptedEmails) (string, []any) {
+			return `UPDATE invitations SET email = $2, email_canonical = $3 WHERE id = $1`, []any{row.id, row.email, row.index}
+		},
+	},
+}
+
+// ReencryptUsers seals the email columns of every user and invitation with the active master key and recomputes
+// their index, batchSize rows per transaction so neither table is locked as a whole. Rows already up to date are
+// skipped, so it can be run again after a failure. It returns how many rows were rewritten. Data exports are left
+// alone, an old key has to be kept until the exports sealed with it have expired.
+func (m *UserModel) ReencryptUsers(batchSize int) (int64, error) {
+	if m.Cipher == nil {
+		return 0, ErrEncryptionDisabled
+	}
+	var rewritten int64
+	for _, table := range encryptedTables {
+		var lastID int64
+		for {
+			count, next, err := m.reencryptBatch(table, lastID, batchSize)
+			rewritten += count
+			if err != nil {
+				return rewritten, err
+			}
+			if next == lastID {
+				break
+			}
+			lastID = next
+		}
+	}
+	return rewritten, nil
+}
+
+// reencryptBatch rewrites the batchSize rows of table after afterID and returns the last id it looked at, which is
+// afterID once there are none left
+func (m *UserModel) reencryptBatch(table encryptedTable, afterID int64, batchSize int) (int64, int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, afterID, err
+	}
+	defer tx.Rollback()
+
+	// the rows stay locked until the batch commits, so a concurrent email change can't be overwritten with the old one
+	rows, err := tx.QueryContext(ctx, m.rebind(table.query+`
+	WHERE id > $1
+	ORDER BY id
+	LIMIT $2
+	FOR UPDATE`), afterID, batchSize)
+	if err != nil {
+		return 0, afterID, err
+	}
+	stored := []encryptedEmails{}
+	for rows.Next() {
+		var row encryptedEmails
+		err = rows.Scan(&row.id, &row.publicID, &row.email, &row.pendingEmail, &row.index)
+		if err != nil {
+			rows.Close()
+			return 0, afterID, err
+		}
+		stored = append(stored, row)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, afterID, err
+	}
+	if len(stored) == 0 {
+		return 0, afterID, nil
+	}
+
+	var rewritten int64
+	for _, row := range stored {
+		updated, changed, err := m.Cipher.reencrypt(row)
+		if err != nil {
+			return 0, afterID, fmt.Errorf("%s %w", table.name, err)
+		}
+		if !changed {
+			continue
+		}
+		query, args := table.update(updated)
+		_, err = tx.ExecContext(ctx, query, args...)
+		if err != nil {
+			if uniqueViolation(err, "users_email_canonical_key") {
+				return 0, afterID, fmt.Errorf("user %d collides with another account: %w", row.id, ErrDuplicateEmail)
+			}
+			return 0, afterID, err
+		}
+		rewritten++
+	}
+	err = tx.Commit()
+	if err != nil {
+		return 0, afterID, err
+	}
+	return rewritten, stored[len(stored)-1].id, nil
+}
+
+// ReencryptUsers has nothing to do, the mock keeps every column in plaintext
+func (mockUM *UserModelMock) ReencryptUsers(batchSize int) (int64, error) {
+	return 0, ErrEncryptionDisabled
+}
+
+// CheckEncryption returns ErrEncryptionMismatch when the stored emails don't match whether field encryption is on.
+// Lookups go through the blind index, so with encryption newly turned on every account written before would be
+// unreachable until ReencryptUsers has run, and with it turned off the stored ciphertext can't be read.
+func (m *UserModel) CheckEncryption() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	condition := `email LIKE '` + encryptedPrefix + `%'`
+	if m.Cipher != nil {
+		condition = `email NOT LIKE '` + encryptedPrefix + `%'`
+	}
+	var users, invitations int64
+	err := m.DB.QueryRowContext(ctx, `SELECT (SELECT count(*) FROM users WHERE `+condition+`),
+		(SELECT count(*) FROM invitations WHERE `+condition+`)`).Scan(&users, &invitations)
+	if err != nil {
+		return err
+	}
+	switch {
+	case users+invitations == 0:
+		return nil
+	case m.Cipher != nil:
+		return fmt.Errorf("%w: %d users and %d invitations have plaintext emails, run reencrypt first", ErrEncryptionMismatch,
+			users, invitations)
+	default:
+		return fmt.Errorf("%w: %d users and %d invitations have encrypted emails, set ENCRYPTION_KEYS and ENCRYPTION_INDEX_KEY",
+			ErrEncryptionMismatch, users, invitations)
+	}
+}
@@ -0,0 +1,361 @@
+package models
+
+import (
+	"encoding/base64"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"the_lonely_road/data"
+	"the_lonely_road/validator"
+	"time"
+)
+
+func testKey(b byte) string {
+	return base64.StdEncoding.EncodeToString([]byte(strings.Repeat(string(rune(b)), 32)))
+}
+
+func testCipher(t *testing.T, masterKeys string) *FieldCipher {
+	c, err := NewFieldCipher(masterKeys, testKey('i'))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	return c
+}
+
+func TestNewFieldCipher(t *testing.T) {
+	tests := []struct {
+		name       string
+		masterKeys string
+		indexKey   string
+		valid      bool
+	}{
+		{name: "Off", valid: true},
+		{name: "One key", masterKeys: "k1:" + testKey('a'), indexKey: testKey('i'), valid: true},
+		{name: "Rotating", masterKeys: "k2:" + testKey('b') + ", k1:" + testKey('a'), indexKey: testKey('i'), valid: true},
+		{name: "No index key", masterKeys: "k1:" + testKey('a')},
+		{name: "No master key", indexKey: testKey('i')},
+		{name: "No key id", masterKeys: testKey('a'), indexKey: testKey('i')},
+		{name: "Bad key id", masterKeys: "k:1:" + testKey('a'), indexKey: testKey('i')},
+		{name: "Same key id twice", masterKeys: "k1:" + testKey('a') + ",k1:" + testKey('b'), indexKey: testKey('i')},
+		{name: "Not base64", masterKeys: "k1:not base64!", indexKey: testKey('i')},
+		{name: "Short key", masterKeys: "k1:" + base64.StdEncoding.EncodeToString([]byte("short")), indexKey: testKey('i')},
+		{name: "Short index key", masterKeys: "k1:" + testKey('a'), indexKey: base64.StdEncoding.EncodeToString([]byte("short"))},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, err := NewFieldCipher(test.masterKeys, test.indexKey)
+			if test.valid != (err == nil) {
+				t.Fatalf("Expected valid %t, got %v", test.valid, err)
+			}
+			if test.valid && (c == nil) != (test.masterKeys == "") {
+				t.Errorf("Expected a cipher only when keys are set, got %v", c)
+			}
+		})
+	}
+}
+
+func TestFieldCipher_EncryptDecrypt(t *testing.T) {
+	old := testCipher(t, "k1:"+testKey('a'))
+	sealed, err := old.Encrypt("alice@example.com", "row-1")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !strings.HasPrefix(sealed, "enc:v1:k1:") || strings.Contains(sealed, "alice") {
+		t.Fatalf("Expected an encrypted value under k1, got %q", sealed)
+	}
+	again, _ := old.Encrypt("alice@example.com", "row-1")
+	if again == sealed {
+		t.Errorf("Expected every encryption to use a fresh data key and nonce")
+	}
+	if empty, _ := old.Encrypt("", "row-1"); empty != "" {
+		t.Errorf("Expected an empty value to stay empty, got %q", empty)
+	}
+
+	rotated := testCipher(t, "k2:"+testKey('b')+",k1:"+testKey('a'))
+	tests := []struct {
+		name     string
+		cipher   *FieldCipher
+		value    string
+		publicID string
+		expected string
+		err      error
+	}{
+		{name: "Same key", cipher: old, value: sealed, expected: "alice@example.com"},
+		{name: "Old key after rotation", cipher: rotated, value: sealed, expected: "alice@example.com"},
+		{name: "Stored before encryption", cipher: old, value: "bob@example.com", expected: "bob@example.com"},
+		{name: "Key dropped", cipher: testCipher(t, "k2:"+testKey('b')), value: sealed, err: ErrUnknownEncryptionKey},
+		{name: "No cipher", value: sealed, err: ErrUnknownEncryptionKey},
+		{name: "Same id, different key", cipher: testCipher(t, "k1:"+testKey('c')), value: sealed, err: errors.New("any")},
+		{name: "Tampered", cipher: old, value: sealed[:len(sealed)-2] + "AA", err: errors.New("any")},
+		{name: "Truncated", cipher: old, value: "enc:v1:k1:abc", err: errors.New("any")},
+		{name: "Copied to another row", cipher: old, value: sealed, publicID: "row-2", err: errors.New("any")},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.publicID == "" {
+				test.publicID = "row-1"
+			}
+			got, err := test.cipher.Decrypt(test.value, test.publicID)
+			switch {
+			case test.err == nil && err != nil:
+				t.Fatalf("Unexpected error: %s", err)
+			case test.err != nil && err == nil:
+				t.Fatalf("Expected an error, got %q", got)
+			case errors.Is(test.err, ErrUnknownEncryptionKey) && !errors.Is(err, ErrUnknownEncryptionKey):
+				t.Fatalf("Expected ErrUnknownEncryptionKey, got %v", err)
+			}
+			if got != test.expected {
+				t.Errorf("Expected %q, got %q", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestFieldCipher_EmailIndex(t *testing.T) {
+	c := testCipher(t, "k1:"+testKey('a'))
+	index := c.EmailIndex("Alice@Bücher.de")
+	if index != c.EmailIndex(" alice@xn--bcher-kva.de") {
+		t.Errorf("Expected addresses with the same canonical form to share an index")
+	}
+	if index == c.EmailIndex("bob@bücher.de") || strings.Contains(index, "alice") {
+		t.Errorf("Expected an index that tells addresses apart without giving them away, got %q", index)
+	}
+	// rotating master keys leaves the index alone
+	if testCipher(t, "k2:"+testKey('b')).EmailIndex("alice@bücher.de") != index {
+		t.Errorf("Expected the index not to depend on the master key")
+	}
+	var off *FieldCipher
+	if got := off.EmailIndex("Alice@Bücher.de"); got != "alice@xn--bcher-kva.de" {
+		t.Errorf("Expected the canonical email without a cipher, got %q", got)
+	}
+}
+
+func TestUserModel_SQLiteEncryption(t *testing.T) {
+	db, err := data.OpenSQLite(data.SQLiteScheme + filepath.Join(t.TempDir(), "users.db"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer db.Close()
+	plain := &UserModel{DB: db, Dialect: DialectSQLite, Hasher: Hasher{Current: testBcrypt}}
+	m := &UserModel{DB: db, Dialect: DialectSQLite, Hasher: Hasher{Current: testBcrypt}, Cipher: testCipher(t, "k1:"+testKey('a'))}
+
+	stored := func(email string) (string, string) {
+		var raw, index string
+		err := db.QueryRow(`SELECT email, email_canonical FROM users WHERE email_canonical = $1`, m.Cipher.EmailIndex(email)).Scan(&raw, &index)
+		if err != nil {
+			t.Fatalf("Expected a row for %s, got %s", email, err)
+		}
+		return raw, index
+	}
+
+	alice := &User{Email: "Alice@example.com", Password: "securepassword", CreatedAt: time.Now()}
+	if err := m.Insert(alice); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if raw, index := stored(alice.Email); !strings.HasPrefix(raw, "enc:v1:k1:") || strings.Contains(raw+index, "alice") {
+		t.Fatalf("Expected only ciphertext and the blind index to be stored, got %q and %q", raw, index)
+	}
+	if err := m.Insert(&User{Email: "alice@EXAMPLE.com", Password: "securepassword"}); !errors.Is(err, ErrDuplicateEmail) {
+		t.Errorf("Expected the index to keep emails unique, got %v", err)
+	}
+	got, err := m.Authenticate("ALICE@example.com", "securepassword")
+	if err != nil || got.Email != "Alice@example.com" {
+		t.Fatalf("Expected alice to sign in with her address as she typed it, got %+v, %v", got, err)
+	}
+
+	err = m.RequestEmailChange(int(alice.ID), "alice@example.org", "hash", "salt", "cancelhash", "cancelsalt")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	var pending string
+	_ = db.QueryRow(`SELECT pending_email FROM users WHERE id = $1`, alice.ID).Scan(&pending)
+	if !strings.HasPrefix(pending, "enc:v1:k1:") {
+		t.Errorf("Expected the pending email to be encrypted, got %q", pending)
+	}
+	if got, _ := m.GetByID(int(alice.ID)); got.PendingEmail != "alice@example.org" {
+		t.Errorf("Expected the pending email to be decrypted, got %q", got.PendingEmail)
+	}
+	if err := m.ConfirmEmailChange(int(alice.ID)); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, err := m.GetByEmail("alice@example.org"); err != nil {
+		t.Errorf("Expected alice under her new address, got %s", err)
+	}
+
+	filters := UserFilters{Filters: Filters{Page: 1, PageSize: 10, Sort: "id", SortSafelist: UserSortSafelist}}
+	filters.Email = "ALICE@example.org"
+	if users, _, err := m.ListUsers(filters); err != nil || len(users) != 1 {
+		t.Errorf("Expected the whole address to find alice, got %d users and %v", len(users), err)
+	}
+	filters.Email = "alice"
+	if users, _, err := m.ListUsers(filters); err != nil || len(users) != 0 {
+		t.Errorf("Expected part of an address to find nothing in ciphertext, got %d users and %v", len(users), err)
+	}
+
+	// bob was stored before encryption was turned on, he can't be found by email until the rows are re-encrypted
+	bob := &User{Email: "bob@example.com", Password: "securepassword", CreatedAt: time.Now()}
+	if err := plain.Insert(bob); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, err := m.GetByEmail(bob.Email); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("Expected bob's plaintext index not to match, got %v", err)
+	}
+	if got, err := m.GetByID(int(bob.ID)); err != nil || got.Email != bob.Email {
+		t.Errorf("Expected bob's plaintext email to be read as it is, got %+v, %v", got, err)
+	}
+	if err := m.CheckEncryption(); !errors.Is(err, ErrEncryptionMismatch) {
+		t.Errorf("Expected the server to refuse to start with bob in plaintext, got %v", err)
+	}
+	if err := plain.CheckEncryption(); !errors.Is(err, ErrEncryptionMismatch) {
+		t.Errorf("Expected the server to refuse to start without keys with alice encrypted, got %v", err)
+	}
+
+	rotated := &UserModel{DB: db, Dialect: DialectSQLite, Hasher: Hasher{Current: testBcrypt}, Cipher: testCipher(t, "k2:"+testKey('b')+",k1:"+testKey('a'))}
+	rewritten, err := rotated.ReencryptUsers(1)
+	if err != nil || rewritten != 2 {
+		t.Fatalf("Expected both users to be re-encrypted, got %d, %v", rewritten, err)
+	}
+	if rewritten, err := rotated.ReencryptUsers(1); err != nil || rewritten != 0 {
+		t.Errorf("Expected a second run to have nothing left to do, got %d, %v", rewritten, err)
+	}
+	if err := rotated.CheckEncryption(); err != nil {
+		t.Errorf("Expected every email to be encrypted now, got %s", err)
+	}
+	if _, err := plain.ReencryptUsers(1); !errors.Is(err, ErrEncryptionDisabled) {
+		t.Errorf("Expected ErrEncryptionDisabled without a cipher, got %v", err)
+	}
+
+	// k1 can go now
+	current := &UserModel{DB: db, Dialect: DialectSQLite, Hasher: Hasher{Current: testBcrypt}, Cipher: testCipher(t, "k2:"+testKey('b'))}
+	for _, email := range []string{"alice@example.org", "bob@example.com"} {
+		if raw, _ := stored(email); !strings.HasPrefix(raw, "enc:v1:k2:") {
+			t.Errorf("Expected %s under k2, got %q", email, raw)
+		}
+		if got, err := current.GetByEmail(email); err != nil || got.Email != email {
+			t.Errorf("Expected %s to be found with k2 alone, got %+v, %v", email, got, err)
+		}
+	}
+	if _, err := m.GetByID(int(bob.ID)); !errors.Is(err, ErrUnknownEncryptionKey) {
+		t.Errorf("Expected a model without k2 to refuse bob, got %v", err)
+	}
+
+	// the ciphertext is bound to its row, an address sealed for alice doesn't open in bob's
+	sealed, err := current.Cipher.Encrypt("mallory@example.com", alice.PublicID)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, err := db.Exec(`UPDATE users SET email = $1 WHERE id = $2`, sealed, bob.ID); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, err := current.GetByID(int(bob.ID)); err == nil {
+		t.Errorf("Expected an address sealed for alice not to decrypt in bob's row")
+	}
+}
+
+// An unencrypted store mustn't take an address that reads as ciphertext, CheckEncryption would then refuse to start
+func TestUserModel_SQLitePlaintextLookalike(t *testing.T) {
+	db, err := data.OpenSQLite(data.SQLiteScheme + filepath.Join(t.TempDir(), "users.db"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer db.Close()
+	plain := &UserModel{DB: db, Dialect: DialectSQLite, Hasher: Hasher{Current: testBcrypt}}
+
+	lookalike := &User{Email: "enc:v1:a:b:c", Password: "securepassword", CreatedAt: time.Now()}
+	v := validator.New()
+	if ValidateUser(v, lookalike, nil); v.Valid() {
+		t.Fatalf("Expected %q to be refused at signup", lookalike.Email)
+	}
+	invitation := &Invitation{OrgID: 1, Email: lookalike.Email, Role: OrgRoleMember}
+	v = validator.New()
+	if ValidateInvitation(v, invitation); v.Valid() {
+		t.Errorf("Expected %q to be refused as an invitation", invitation.Email)
+	}
+
+	if err := plain.Insert(&User{Email: "alice@example.com", Password: "securepassword", CreatedAt: time.Now()}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := plain.CheckEncryption(); err != nil {
+		t.Errorf("Expected a store with only plaintext addresses to start, got %s", err)
+	}
+	// this is what the validation keeps out
+	if err := plain.Insert(lookalike); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := plain.CheckEncryption(); !errors.Is(err, ErrEncryptionMismatch) {
+		t.Errorf("Expected the lookalike to read as ciphertext, got %v", err)
+	}
+}
+
+func TestUserModel_SQLiteEncryptionBeyondUsers(t *testing.T) {
+	db, err := data.OpenSQLite(data.SQLiteScheme + filepath.Join(t.TempDir(), "users.db"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer db.Close()
+	m := &UserModel{DB: db, Dialect: DialectSQLite, Hasher: Hasher{Current: testBcrypt}, Cipher: testCipher(t, "k1:"+testKey('a'))}
+	org, err := m.GetOrganization(DefaultOrgSlug)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	now := time.Now()
+	inv := &Invitation{OrgID: org.ID, Email: "Carol@example.com", Role: OrgRoleMember, TokenHash: "hash", TokenSalt: "salt",
+		CreatedAt: now, ExpiresAt: now.Add(time.Hour)}
+	if err := m.CreateInvitation(inv); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	var raw, index string
+	_ = db.QueryRow(`SELECT email, email_canonical FROM invitations WHERE id = $1`, inv.ID).Scan(&raw, &index)
+	if !strings.HasPrefix(raw, "enc:v1:k1:") || index != m.Cipher.EmailIndex("carol@example.com") {
+		t.Errorf("Expected the invitation email encrypted and indexed, got %q and %q", raw, index)
+	}
+	if got, err := m.GetInvitation(inv.PublicID); err != nil || got.Email != "Carol@example.com" {
+		t.Errorf("Expected the invitation email to be decrypted, got %+v, %v", got, err)
+	}
+	// a new invitation for the same address still revokes the open one
+	if err := m.CreateInvitation(&Invitation{OrgID: org.ID, Email: "carol@EXAMPLE.com", Role: OrgRoleAdmin, TokenHash: "hash",
+		TokenSalt: "salt", CreatedAt: now, ExpiresAt: now.Add(time.Hour)}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if pending, err := m.ListPendingInvitations(int(org.ID)); err != nil || len(pending) != 1 || pending[0].Email != "carol@EXAMPLE.com" {
+		t.Errorf("Expected only the newest invitation open, got %+v, %v", pending, err)
+	}
+
+	if err := m.RecordAuditEvent(&AuditEvent{Type: AuditLoginFailed, Email: "Dave@example.com", CreatedAt: now}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	_ = db.QueryRow(`SELECT email FROM audit_events`).Scan(&raw)
+	if raw != m.Cipher.EmailIndex("dave@example.com") {
+		t.Errorf("Expected only the blind index in the audit log, got %q", raw)
+	}
+
+	erin := &User{Email: "erin@example.com", Password: "securepassword", CreatedAt: now}
+	if err := m.Insert(erin); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	export := &DataExport{UserID: erin.ID, TokenHash: "hash", TokenSalt: "salt", Content: []byte(`{"email":"erin@example.com"}`),
+		CreatedAt: now, ExpiresAt: now.Add(time.Hour)}
+	if err := m.CreateDataExport(export); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	var content []byte
+	_ = db.QueryRow(`SELECT content FROM data_exports WHERE id = $1`, export.ID).Scan(&content)
+	if strings.Contains(string(content), "erin") {
+		t.Errorf("Expected the export to be stored encrypted, got %q", content)
+	}
+	if got, err := m.GetDataExport(export.PublicID); err != nil || string(got.Content) != `{"email":"erin@example.com"}` {
+		t.Errorf("Expected the export to be decrypted, got %+v, %v", got, err)
+	}
+
+	rotated := &UserModel{DB: db, Dialect: DialectSQLite, Hasher: Hasher{Current: testBcrypt}, Cipher: testCipher(t, "k2:"+testKey('b')+",k1:"+testKey('a'))}
+	if rewritten, err := rotated.ReencryptUsers(DefaultReencryptBatchSize); err != nil || rewritten != 3 {
+		t.Errorf("Expected erin and both invitations to be re-encrypted, got %d, %v", rewritten, err)
+	}
+	_ = db.QueryRow(`SELECT email FROM invitations WHERE id = $1`, inv.ID).Scan(&raw)
+	if !strings.HasPrefix(raw, "enc:v1:k2:") {
+		t.Errorf("Expected the invitation under k2, got %q", raw)
+	}
+}
@@ -0,0 +1,121 @@
+package models
+
+import (
+	"math"
+	"strings"
+	"the_lonely_road/validator"
+	"time"
+)
+
+// Filters holds the paging and sorting options shared by every list endpoint
+type Filters struct {
+	Page         int
+	PageSize     int
+	Sort         string
+	SortSafelist []string
+}
+
+// UserFilters narrows the admin user listing, nil pointers mean the filter wasn't asked for
+type UserFilters struct {
+	Filters
+	Email         string
+	CreatedAfter  *time.Time
+	CreatedBefore *time.Time
+	Verified      *bool
+	Locked        *bool
+	Role          string
+}
+
+// AuditFilters narrows the audit log, User matches events where the public id is either the actor or the subject
+type AuditFilters struct {
+	Filters
+	Type   string
+	User   string
+	After  *time.Time
+	Before *time.Time
+}
+
+type Metadata struct {
+	CurrentPage  int `json:"current_page,omitempty"`
+	PageSize     int `json:"page_size,omitempty"`
+	FirstPage    int `json:"first_page,omitempty"`
+	LastPage     int `json:"last_page,omitempty"`
+	TotalRecords int `json:"total_records"`
+}
+
+// UserSortSafelist is every column the admin listing can be ordered by, a leading "-" sorts descending
+var UserSortSafelist = []string{"id", "email", "created_at", "updated_at", "-id", "-email", "-created_at", "-updated_at"}
+
+// AuditSortSafelist only allows time order, newest first by default
+var AuditSortSafelist = []string{"created_at", "-created_at"}
+
+func ValidateFilters(v *validator.Validator, f Filters) {
+	v.Check(f.Page > 0, "page", "must be greater than zero")
+	v.Check(f.Page <= 10_000_000, "page", "must be a maximum of 10 million")
+	v.Check(f.PageSize > 0, "page_size", "must be greater than zero")
+	v.Check(f.PageSize <= 100, "page_size", "must be a maximum of 100")
+	v.Check(validator.PermittedValue(f.Sort, f.SortSafelist...), "sort", "invalid sort value")
+}
+
+func ValidateUserFilters(v *validator.Validator, f UserFilters) {
+	ValidateFilters(v, f.Filters)
+	v.Check(validator.MaxChars(f.Email, 500), "email", "must not be more than 500 characters long")
+	if f.CreatedAfter != nil && f.CreatedBefore != nil {
+		v.Check(f.CreatedAfter.Before(*f.CreatedBefore), "created_after", "must be before created_before")
+	}
+	if f.Role != "" {
+		_, ok := DefaultRolePermissions[f.Role]
+		v.Check(ok, "role", "must be a known role")
+	}
+}
+
+func ValidateAuditFilters(v *validator.Validator, f AuditFilters) {
+	ValidateFilters(v, f.Filters)
+	if f.Type != "" {
+		v.Check(validator.PermittedValue(f.Type, AuditEventTypes...), "type", "must be a known event type")
+	}
+	if f.User != "" {
+		v.Check(validator.Matches(f.User, validator.UUIDRX), "user", "must be a UUID")
+	}
+	if f.After != nil && f.Before != nil {
+		v.Check(f.After.Before(*f.Before), "after", "must be earlier than before")
+	}
+}
+
+// sortColumn is only ever interpolated into SQL after checking it against the safelist
+func (f Filters) sortColumn() string {
+	for _, safeValue := range f.SortSafelist {
+		if f.Sort == safeValue {
+			return strings.TrimPrefix(f.Sort, "-")
+		}
+	}
+	panic("unsafe sort parameter: " + f.Sort)
+}
+
+func (f Filters) sortDirection() string {
+	if strings.HasPrefix(f.Sort, "-") {
+		return "DESC"
+	}
+	return "ASC"
+}
+
+func (f Filters) limit() int {
+	return f.PageSize
+}
+
+func (f Filters) offset() int {
+	return (f.Page - 1) * f.PageSize
+}
+
+func calculateMetadata(totalRecords, page, pageSize int) Metadata {
+	if totalRecords == 0 {
+		return Metadata{}
+	}
+	return Metadata{
+		CurrentPage:  page,
+		PageSize:     pageSize,
+		FirstPage:    1,
+		LastPage:     int(math.Ceil(float64(totalRecords) / float64(pageSize))),
+		TotalRecords: totalRecords,
+	}
+}
@@ -0,0 +1,95 @@
+package models
+
+import (
+	"testing"
+	"the_lonely_road/validator"
+	"time"
+)
+
+func TestValidateFilters(t *testing.T) {
+	tests := []struct {
+		name    string
+		filters Filters
+		valid   bool
+	}{
+		{name: "Happy path", filters: Filters{Page: 1, PageSize: 20, Sort: "-email", SortSafelist: UserSortSafelist}, valid: true},
+		{name: "Zero page", filters: Filters{Page: 0, PageSize: 20, Sort: "id", SortSafelist: UserSortSafelist}, valid: false},
+		{name: "Page size too big", filters: Filters{Page: 1, PageSize: 101, Sort: "id", SortSafelist: UserSortSafelist}, valid: false},
+		{name: "Unsafe sort", filters: Filters{Page: 1, PageSize: 20, Sort: "password_hash", SortSafelist: UserSortSafelist}, valid: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			v := validator.New()
+			ValidateFilters(v, test.filters)
+			if v.Valid() != test.valid {
+				t.Errorf("Expected valid to be %v, got errors %v", test.valid, v.Errors)
+			}
+		})
+	}
+}
+
+func TestValidateUserFilters(t *testing.T) {
+	after := time.Date(2023, 9, 1, 0, 0, 0, 0, time.UTC)
+	before := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	v := validator.New()
+	ValidateUserFilters(v, UserFilters{
+		Filters:       Filters{Page: 1, PageSize: 20, Sort: "id", SortSafelist: UserSortSafelist},
+		CreatedAfter:  &after,
+		CreatedBefore: &before,
+	})
+	if _, ok := v.Errors["created_after"]; !ok {
+		t.Errorf("Expected an inverted date range to be rejected")
+	}
+}
+
+func TestValidateAuditFilters(t *testing.T) {
+	page := Filters{Page: 1, PageSize: 20, Sort: "-created_at", SortSafelist: AuditSortSafelist}
+	after := time.Date(2023, 9, 1, 0, 0, 0, 0, time.UTC)
+	before := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		filters AuditFilters
+		valid   bool
+	}{
+		{name: "Happy path", filters: AuditFilters{Filters: page, Type: AuditLoginFailed, User: "0190a6e2-5c3b-7c1e-9f3a-2b4c6d8e0f12"}, valid: true},
+		{name: "Unknown type", filters: AuditFilters{Filters: page, Type: "login.maybe"}, valid: false},
+		{name: "User is not a UUID", filters: AuditFilters{Filters: page, User: "1"}, valid: false},
+		{name: "Inverted range", filters: AuditFilters{Filters: page, After: &after, Before: &before}, valid: false},
+		{name: "Sort by email", filters: AuditFilters{Filters: Filters{Page: 1, PageSize: 20, Sort: "email", SortSafelist: AuditSortSafelist}}, valid: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			v := validator.New()
+			ValidateAuditFilters(v, test.filters)
+			if v.Valid() != test.valid {
+				t.Errorf("Expected valid to be %v, got errors %v", test.valid, v.Errors)
+			}
+		})
+	}
+}
+
+func TestFilters_Sort(t *testing.T) {
+	f := Filters{Sort: "-created_at", SortSafelist: UserSortSafelist}
+	if f.sortColumn() != "created_at" || f.sortDirection() != "DESC" {
+		t.Errorf("Expected created_at DESC, got %s %s", f.sortColumn(), f.sortDirection())
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Expected sortColumn to panic on a value outside the safelist")
+		}
+	}()
+	f.Sort = "id; DROP TABLE users"
+	f.sortColumn()
+}
+
+func TestCalculateMetadata(t *testing.T) {
+	metadata := calculateMetadata(45, 2, 20)
+	want := Metadata{CurrentPage: 2, PageSize: 20, FirstPage: 1, LastPage: 3, TotalRecords: 45}
+	if metadata != want {
+		t.Errorf("Expected %+v, got %+v", want, metadata)
+	}
+	if calculateMetadata(0, 1, 20) != (Metadata{}) {
+		t.Errorf("Expected empty metadata when there are no records")
+	}
+}
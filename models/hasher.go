@@ -0,0 +1,342 @@
+package models
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+	"strings"
+)
+
+var (
+	ErrPasswordMismatch = errors.New("password does not match")
+	ErrUnknownHash      = errors.New("unknown password hash format")
+	ErrPepperMissing    = errors.New("password hash was peppered but no pepper is configured")
+)
+
+// PasswordHasher turns plaintext into a self-describing encoded hash and checks passwords against it later.
+// Verify returns ErrPasswordMismatch for a wrong password, and needsRehash when the hash was made with
+// weaker settings than the hasher would use today. Algorithm names what it writes, e.g. argon2id.
+type PasswordHasher interface {
+	Hash(password string) (string, error)
+	Verify(password, encoded string) (needsRehash bool, err error)
+	Algorithm() string
+}
+
+// Argon2idHasher encodes hashes as $argon2id$v=19$m=<KiB>,t=<passes>,p=<threads>$<salt>$<key>
+type Argon2idHasher struct {
+	Memory  uint32
+	Time    uint32
+	Threads uint8
+	KeyLen  uint32
+	SaltLen int
+}
+
+// ScryptHasher encodes hashes as $scrypt$ln=<log2 N>,r=<r>,p=<p>$<salt>$<key>
+type ScryptHasher struct {
+	LogN    int
+	R       int
+	P       int
+	KeyLen  int
+	SaltLen int
+}
+
+// BcryptHasher writes the standard $2a$ format, which is also what every password stored before the hashers came along uses
+type BcryptHasher struct {
+	Cost int
+}
+
+// the OWASP minimums at the time of writing
+var (
+	DefaultArgon2id = Argon2idHasher{Memory: 19 * 1024, Time: 2, Threads: 1, KeyLen: 32, SaltLen: 16}
+	DefaultScrypt   = ScryptHasher{LogN: 15, R: 8, P: 1, KeyLen: 32, SaltLen: 16}
+	DefaultBcrypt   = BcryptHasher{Cost: bcrypt.DefaultCost}
+)
+
+// the parameters a stored hash may ask for. The settings come out of the database, or an import, so without a ceiling
+// one row could make a login use gigabytes of memory, and without a floor an empty key would match any password.
+const (
+	minHashKeyLen  = 16
+	maxHashKeyLen  = 64
+	minHashSaltLen = 8
+	maxHashSaltLen = 64
+
+	maxArgon2idMemory  = 256 * 1024 // KiB
+	maxArgon2idTime    = 16
+	maxArgon2idThreads = 16
+
+	maxScryptLogN   = 20
+	maxScryptR      = 32
+	maxScryptP      = 16
+	maxScryptMemory = 256 << 20 // bytes, scrypt needs 128 * r * N of them
+
+	maxBcryptCost = 16
+)
+
+// DefaultHasher is used by models that weren't given a Hasher
+var DefaultHasher PasswordHasher = Hasher{Current: DefaultArgon2id}
+
+var b64 = base64.RawStdEncoding
+
+func randomSalt(n int) ([]byte, error) {
+	salt := make([]byte, n)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+func (h Argon2idHasher) Algorithm() string { return "argon2id" }
+
+// validSaltAndKey decodes the salt and key of a stored hash and checks they are within bounds
+func validSaltAndKey(encodedSalt, encodedKey string) (salt, key []byte, err error) {
+	salt, err = b64.DecodeString(encodedSalt)
+	if err != nil || len(salt) < minHashSaltLen || len(salt) > maxHashSaltLen {
+		return nil, nil, ErrUnknownHash
+	}
+	key, err = b64.DecodeString(encodedKey)
+	if err != nil || len(key) < minHashKeyLen || len(key) > maxHashKeyLen {
+		return nil, nil, ErrUnknownHash
+	}
+	return salt, key, nil
+}
+
+// parseArgon2id reads the parameters, salt and key out of a hash Argon2idHasher wrote, refusing any that are out of bounds
+func parseArgon2id(encoded string) (params Argon2idHasher, salt, key []byte, err error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return params, nil, nil, ErrUnknownHash
+	}
+	var version int
+	_, err = fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return params, nil, nil, ErrUnknownHash
+	}
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads)
+	if err != nil || params.Time < 1 || params.Time > maxArgon2idTime || params.Threads < 1 || params.Threads > maxArgon2idThreads ||
+		params.Memory < 8*uint32(params.Threads) || params.Memory > maxArgon2idMemory {
+		return params, nil, nil, ErrUnknownHash
+	}
+	salt, key, err = validSaltAndKey(parts[4], parts[5])
+	if err != nil {
+		return params, nil, nil, err
+	}
+	params.KeyLen, params.SaltLen = uint32(len(key)), len(salt)
+	return params, salt, key, nil
+}
+
+func (h Argon2idHasher) Hash(password string) (string, error) {
+	salt, err := randomSalt(h.SaltLen)
+	if err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, h.Time, h.Memory, h.Threads, h.KeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, h.Memory, h.Time, h.Threads, b64.EncodeToString(salt), b64.EncodeToString(key)), nil
+}
+
+func (h Argon2idHasher) Verify(password, encoded string) (bool, error) {
+	stored, salt, key, err := parseArgon2id(encoded)
+	if err != nil {
+		return false, err
+	}
+
+	candidate := argon2.IDKey([]byte(password), salt, stored.Time, stored.Memory, stored.Threads, stored.KeyLen)
+	if subtle.ConstantTimeCompare(key, candidate) != 1 {
+		return false, ErrPasswordMismatch
+	}
+	weaker := stored.Memory < h.Memory || stored.Time < h.Time || stored.Threads < h.Threads ||
+		stored.KeyLen < h.KeyLen || stored.SaltLen < h.SaltLen
+	return weaker, nil
+}
+
+func (h ScryptHasher) Algorithm() string { return "scrypt" }
+
+// parseScrypt reads the parameters, salt and key out of a hash ScryptHasher wrote, refusing any that are out of bounds
+func parseScrypt(encoded string) (params ScryptHasher, salt, key []byte, err error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 5 || parts[1] != "scrypt" {
+		return params, nil, nil, ErrUnknownHash
+	}
+	_, err = fmt.Sscanf(parts[2], "ln=%d,r=%d,p=%d", &params.LogN, &params.R, &params.P)
+	if err != nil || params.LogN < 1 || params.LogN > maxScryptLogN || params.R < 1 || params.R > maxScryptR ||
+		params.P < 1 || params.P > maxScryptP || 128*params.R<<params.LogN > maxScryptMemory {
+		return params, nil, nil, ErrUnknownHash
+	}
+	salt, key, err = validSaltAndKey(parts[3], parts[4])
+	if err != nil {
+		return params, nil, nil, err
+	}
+	params.KeyLen, params.SaltLen = len(key), len(salt)
+	return params, salt, key, nil
+}
+
+func (h ScryptHasher) Hash(password string) (string, error) {
+	salt, err := randomSalt(h.SaltLen)
+	if err != nil {
+		return "", err
+	}
+	key, err := scrypt.Key([]byte(password), salt, 1<<h.LogN, h.R, h.P, h.KeyLen)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("$scrypt$ln=%d,r=%d,p=%d$%s$%s",
+		h.LogN, h.R, h.P, b64.EncodeToString(salt), b64.EncodeToString(key)), nil
+}
+
+func (h ScryptHasher) Verify(password, encoded string) (bool, error) {
+	stored, salt, key, err := parseScrypt(encoded)
+	if err != nil {
+		return false, err
+	}
+
+	candidate, err := scrypt.Key([]byte(password), salt, 1<<stored.LogN, stored.R, stored.P, stored.KeyLen)
+	if err != nil {
+		return false, err
+	}
+	if subtle.ConstantTimeCompare(key, candidate) != 1 {
+		return false, ErrPasswordMismatch
+	}
+	weaker := stored.LogN < h.LogN || stored.R < h.R || stored.P < h.P || stored.KeyLen < h.KeyLen || stored.SaltLen < h.SaltLen
+	return weaker, nil
+}
+
+func (h BcryptHasher) Algorithm() string { return "bcrypt" }
+
+// parseBcrypt returns the cost of a bcrypt hash, refusing costs that would take minutes to check
+func parseBcrypt(encoded string) (int, error) {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	if err != nil || cost > maxBcryptCost {
+		return 0, ErrUnknownHash
+	}
+	return cost, nil
+}
+
+func (h BcryptHasher) Hash(password string) (string, error) {
+	hashedBytes, err := bcrypt.GenerateFromPassword([]byte(password), h.Cost)
+	if err != nil {
+		return "", err
+	}
+	return string(hashedBytes), nil
+}
+
+func (h BcryptHasher) Verify(password, encoded string) (bool, error) {
+	cost, err := parseBcrypt(encoded)
+	if err != nil {
+		return false, err
+	}
+	err = bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+	if err != nil {
+		return false, ErrPasswordMismatch
+	}
+	return cost < h.Cost, nil
+}
+
+// pepperPrefix marks hashes whose password went through HMAC-SHA256 with the pepper before hashing
+const pepperPrefix = "$pepper"
+
+// Hasher hashes new passwords with Current and verifies anything Argon2id, Scrypt or Bcrypt produced, asking for a
+// rehash whenever the stored hash isn't what Current would write today. A Pepper is mixed in before hashing and
+// is kept out of the database, so a leaked table alone can't be brute forced.
+type Hasher struct {
+	Current PasswordHasher
+	Pepper  []byte
+}
+
+// NewHasher builds a Hasher from config, algorithm is one of argon2id, scrypt or bcrypt
+func NewHasher(algorithm, pepper string) (Hasher, error) {
+	h := Hasher{}
+	switch algorithm {
+	case "argon2id", "":
+		h.Current = DefaultArgon2id
+	case "scrypt":
+		h.Current = DefaultScrypt
+	case "bcrypt":
+		h.Current = DefaultBcrypt
+	default:
+		return h, fmt.Errorf("unknown password hash algorithm %q", algorithm)
+	}
+	if pepper != "" {
+		h.Pepper = []byte(pepper)
+	}
+	return h, nil
+}
+
+// pepper returns the HMAC of password, base64 so it stays inside bcrypt's 72 byte limit
+func (h Hasher) pepper(password string) string {
+	mac := hmac.New(sha256.New, h.Pepper)
+	mac.Write([]byte(password))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Algorithm is the one new hashes are written with
+func (h Hasher) Algorithm() string { return h.Current.Algorithm() }
+
+func (h Hasher) Hash(password string) (string, error) {
+	if len(h.Pepper) == 0 {
+		return h.Current.Hash(password)
+	}
+	encoded, err := h.Current.Hash(h.pepper(password))
+	if err != nil {
+		return "", err
+	}
+	return pepperPrefix + encoded, nil
+}
+
+func (h Hasher) Verify(password, encoded string) (bool, error) {
+	inner, peppered := strings.CutPrefix(encoded, pepperPrefix)
+	if peppered {
+		if len(h.Pepper) == 0 {
+			return false, ErrPepperMissing
+		}
+		password = h.pepper(password)
+	}
+
+	// verify with Current when it wrote this kind of hash so its parameters are the ones compared against
+	var algorithm PasswordHasher
+	switch {
+	case strings.HasPrefix(inner, "$argon2id$"):
+		algorithm = DefaultArgon2id
+	case strings.HasPrefix(inner, "$scrypt$"):
+		algorithm = DefaultScrypt
+	case strings.HasPrefix(inner, "$2"):
+		algorithm = DefaultBcrypt
+	default:
+		return false, ErrUnknownHash
+	}
+	sameAlgorithm := algorithm.Algorithm() == h.Current.Algorithm()
+	if sameAlgorithm {
+		algorithm = h.Current
+	}
+
+	needsRehash, err := algorithm.Verify(password, inner)
+	if err != nil {
+		return false, err
+	}
+	return needsRehash || !sameAlgorithm || peppered != (len(h.Pepper) > 0), nil
+}
+
+// IsPasswordHash reports whether encoded parses, with parameters in bounds, as something Hasher.Verify can check,
+// without the cost of hashing. Imports use it so neither a plaintext password nor a broken hash can be stored.
+func IsPasswordHash(encoded string) bool {
+	inner, _ := strings.CutPrefix(encoded, pepperPrefix)
+	var err error
+	switch {
+	case strings.HasPrefix(inner, "$argon2id$"):
+		_, _, _, err = parseArgon2id(inner)
+	case strings.HasPrefix(inner, "$scrypt$"):
+		_, _, _, err = parseScrypt(inner)
+	case strings.HasPrefix(inner, "$2"):
+		_, err = parseBcrypt(inner)
+	default:
+		return false
+	}
+	return err == nil
+}
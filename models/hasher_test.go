@@ -0,0 +1,210 @@
+package models
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// cheap settings so the tests don't spend their time hashing
+var (
+	testArgon2id = Argon2idHasher{Memory: 1024, Time: 1, Threads: 1, KeyLen: 32, SaltLen: 16}
+	testScrypt   = ScryptHasher{LogN: 10, R: 8, P: 1, KeyLen: 32, SaltLen: 16}
+	testBcrypt   = BcryptHasher{Cost: 4}
+)
+
+func TestPasswordHashers(t *testing.T) {
+	tests := []struct {
+		name     string
+		hasher   PasswordHasher
+		stronger PasswordHasher
+		prefix   string
+	}{
+		{name: "argon2id", hasher: testArgon2id, stronger: Argon2idHasher{Memory: 2048, Time: 1, Threads: 1, KeyLen: 32, SaltLen: 16}, prefix: "$argon2id$v=19$m=1024,t=1,p=1$"},
+		{name: "scrypt", hasher: testScrypt, stronger: ScryptHasher{LogN: 11, R: 8, P: 1, KeyLen: 32, SaltLen: 16}, prefix: "$scrypt$ln=10,r=8,p=1$"},
+		{name: "bcrypt", hasher: testBcrypt, stronger: BcryptHasher{Cost: 5}, prefix: "$2a$04$"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encoded, err := test.hasher.Hash("correct horse")
+			if err != nil {
+				t.Fatalf("Expected no error, got %s", err)
+			}
+			if !strings.HasPrefix(encoded, test.prefix) {
+				t.Errorf("Expected hash to start with %s, got %s", test.prefix, encoded)
+			}
+			again, _ := test.hasher.Hash("correct horse")
+			if again == encoded {
+				t.Errorf("Expected a fresh salt for every hash")
+			}
+
+			needsRehash, err := test.hasher.Verify("correct horse", encoded)
+			if err != nil || needsRehash {
+				t.Errorf("Expected a match without rehash, got %v and %v", needsRehash, err)
+			}
+			_, err = test.hasher.Verify("battery staple", encoded)
+			if !errors.Is(err, ErrPasswordMismatch) {
+				t.Errorf("Expected ErrPasswordMismatch, got %v", err)
+			}
+			needsRehash, err = test.stronger.Verify("correct horse", encoded)
+			if err != nil || !needsRehash {
+				t.Errorf("Expected stronger settings to ask for a rehash, got %v and %v", needsRehash, err)
+			}
+			_, err = test.hasher.Verify("correct horse", "$unknown$hash")
+			if !errors.Is(err, ErrUnknownHash) {
+				t.Errorf("Expected ErrUnknownHash, got %v", err)
+			}
+		})
+	}
+}
+
+func TestHasher(t *testing.T) {
+	legacy, err := testBcrypt.Hash("correct horse")
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	plain := Hasher{Current: testArgon2id}
+	peppered := Hasher{Current: testArgon2id, Pepper: []byte("pepper")}
+
+	t.Run("Upgrades other algorithms", func(t *testing.T) {
+		needsRehash, err := plain.Verify("correct horse", legacy)
+		if err != nil || !needsRehash {
+			t.Errorf("Expected bcrypt hash to need a rehash, got %v and %v", needsRehash, err)
+		}
+	})
+	t.Run("Current algorithm", func(t *testing.T) {
+		encoded, _ := plain.Hash("correct horse")
+		needsRehash, err := plain.Verify("correct horse", encoded)
+		if err != nil || needsRehash {
+			t.Errorf("Expected a match without rehash, got %v and %v", needsRehash, err)
+		}
+	})
+	t.Run("Pepper", func(t *testing.T) {
+		encoded, _ := peppered.Hash("correct horse")
+		if !strings.HasPrefix(encoded, pepperPrefix+"$argon2id$") {
+			t.Errorf("Expected a peppered argon2id hash, got %s", encoded)
+		}
+		needsRehash, err := peppered.Verify("correct horse", encoded)
+		if err != nil || needsRehash {
+			t.Errorf("Expected a match without rehash, got %v and %v", needsRehash, err)
+		}
+		_, err = Hasher{Current: testArgon2id, Pepper: []byte("other")}.Verify("correct horse", encoded)
+		if !errors.Is(err, ErrPasswordMismatch) {
+			t.Errorf("Expected the wrong pepper not to match, got %v", err)
+		}
+		_, err = plain.Verify("correct horse", encoded)
+		if !errors.Is(err, ErrPepperMissing) {
+			t.Errorf("Expected ErrPepperMissing, got %v", err)
+		}
+		needsRehash, err = peppered.Verify("correct horse", legacy)
+		if err != nil || !needsRehash {
+			t.Errorf("Expected an unpeppered hash to need a rehash, got %v and %v", needsRehash, err)
+		}
+	})
+	t.Run("Peppered bcrypt takes long passwords", func(t *testing.T) {
+		long := strings.Repeat("a", 100)
+		_, err := testBcrypt.Hash(long)
+		if err == nil {
+			t.Errorf("Expected bcrypt to refuse more than 72 bytes")
+		}
+		encoded, err := Hasher{Current: testBcrypt, Pepper: []byte("pepper")}.Hash(long)
+		if err != nil {
+			t.Fatalf("Expected no error, got %s", err)
+		}
+		_, err = Hasher{Current: testBcrypt, Pepper: []byte("pepper")}.Verify(strings.Repeat("a", 99)+"b", encoded)
+		if !errors.Is(err, ErrPasswordMismatch) {
+			t.Errorf("Expected the last byte to matter, got %v", err)
+		}
+	})
+}
+
+func TestNewHasher(t *testing.T) {
+	for _, algorithm := range []string{"", "argon2id", "scrypt", "bcrypt"} {
+		_, err := NewHasher(algorithm, "")
+		if err != nil {
+			t.Errorf("Expected no error for %q, got %s", algorithm, err)
+		}
+	}
+	_, err := NewHasher("md5", "")
+	if err == nil {
+		t.Errorf("Expected error for an unknown algorithm, got nil")
+	}
+	h, _ := NewHasher("scrypt", "pepper")
+	if string(h.Pepper) != "pepper" {
+		t.Errorf("Expected pepper to be set, got %q", h.Pepper)
+	}
+}
+
+func TestIsPasswordHash(t *testing.T) {
+	peppered, _ := Hasher{Current: testArgon2id, Pepper: []byte("pepper")}.Hash("correct horse")
+	for _, hasher := range []PasswordHasher{testArgon2id, testScrypt, testBcrypt} {
+		encoded, _ := hasher.Hash("correct horse")
+		if !IsPasswordHash(encoded) {
+			t.Errorf("Expected %s to be recognised", encoded)
+		}
+	}
+	if !IsPasswordHash(peppered) {
+		t.Errorf("Expected a peppered hash to be recognised")
+	}
+	for _, encoded := range []string{"", "correct horse", "$2a$", "$argon2id$v=19", "$unknown$hash"} {
+		if IsPasswordHash(encoded) {
+			t.Errorf("Expected %q not to be taken for a hash", encoded)
+		}
+	}
+}
+
+func TestHasher_OutOfBoundsHashes(t *testing.T) {
+	salt, key := b64.EncodeToString([]byte("saltsaltsaltsalt")), b64.EncodeToString(make([]byte, 32))
+	tests := []struct {
+		name    string
+		encoded string
+	}{
+		{name: "scrypt empty key", encoded: "$scrypt$ln=4,r=8,p=1$c2FsdHNhbHQ$"},
+		{name: "scrypt short key", encoded: "$scrypt$ln=4,r=8,p=1$" + salt + "$AAAA"},
+		{name: "scrypt empty salt", encoded: "$scrypt$ln=4,r=8,p=1$$" + key},
+		{name: "scrypt huge N", encoded: "$scrypt$ln=30,r=8,p=1$" + salt + "$" + key},
+		{name: "scrypt huge r", encoded: "$scrypt$ln=15,r=1024,p=1$" + salt + "$" + key},
+		{name: "scrypt p=0", encoded: "$scrypt$ln=4,r=8,p=0$" + salt + "$" + key},
+		{name: "argon2id empty key", encoded: "$argon2id$v=19$m=1024,t=1,p=1$" + salt + "$"},
+		{name: "argon2id t=0", encoded: "$argon2id$v=19$m=1024,t=0,p=1$" + salt + "$" + key},
+		{name: "argon2id p=0", encoded: "$argon2id$v=19$m=1024,t=1,p=0$" + salt + "$" + key},
+		{name: "argon2id huge m", encoded: "$argon2id$v=19$m=4294967295,t=1,p=1$" + salt + "$" + key},
+		{name: "argon2id huge t", encoded: "$argon2id$v=19$m=1024,t=100000,p=1$" + salt + "$" + key},
+		{name: "bcrypt cost 31", encoded: "$2a$31$" + strings.Repeat("a", 53)},
+	}
+
+	h := Hasher{Current: testArgon2id}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if IsPasswordHash(test.encoded) {
+				t.Errorf("Expected %q not to be taken for a hash", test.encoded)
+			}
+			_, err := h.Verify("any password", test.encoded)
+			if !errors.Is(err, ErrUnknownHash) {
+				t.Errorf("Expected ErrUnknownHash, got %v", err)
+			}
+		})
+	}
+}
+
+func TestUserModelMock_RehashOnLogin(t *testing.T) {
+	userModel := UserModelMock{DB: []*User{}, Hasher: Hasher{Current: testBcrypt}}
+	err := userModel.Insert(&User{ID: 1, Email: "rehash@localhost", Password: "correct horse"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+
+	userModel.Hasher = Hasher{Current: testArgon2id}
+	_, err = userModel.Authenticate("rehash@localhost", "correct horse")
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	if !strings.HasPrefix(userModel.DB[0].Password, "$argon2id$") {
+		t.Errorf("Expected the hash to be upgraded to argon2id, got %s", userModel.DB[0].Password)
+	}
+	_, err = userModel.Authenticate("rehash@localhost", "correct horse")
+	if err != nil {
+		t.Errorf("Expected the upgraded hash to verify, got %s", err)
+	}
+}
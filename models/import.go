@@ -0,0 +1,766 @@
+package models
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"the_lonely_road/validator"
+	"time"
+)
+
+// File formats users can be imported from and exported to
+const (
+	FormatCSV    = "csv"
+	FormatNDJSON = "ndjson"
+)
+
+const (
+	// DefaultImportBatchSize is how many users go into each import transaction
+	DefaultImportBatchSize = 500
+	// MaxImportBatchSize keeps a single transaction from holding its locks for too long
+	MaxImportBatchSize = 5000
+	// MaxImportErrors caps the rows listed in a report, the failed count keeps going
+	MaxImportErrors = 1000
+	// maxImportLine is the longest NDJSON line, enough for both metadata objects at their largest
+	maxImportLine = 4 * MaxMetadataBytes
+)
+
+var (
+	// ErrUserExists means an imported user's email, username or id is already taken
+	ErrUserExists = errors.New("a user with this email, username or id already exists")
+	ErrInvalidRow = errors.New("invalid user")
+)
+
+// ParseUserFileFormat accepts csv, ndjson or its other name jsonl
+func ParseUserFileFormat(format string) (string, error) {
+	switch strings.ToLower(format) {
+	case FormatCSV:
+		return FormatCSV, nil
+	case FormatNDJSON, "jsonl":
+		return FormatNDJSON, nil
+	}
+	return "", fmt.Errorf("unknown format %q, use csv or ndjson", format)
+}
+
+// UserRecord is one user in an import or export file. Password is plaintext to be hashed on import and PasswordHash
+// an existing hash, a record has one or the other. Exports only ever write PasswordHash.
+type UserRecord struct {
+	Row          int             `json:"-"`
+	ID           string          `json:"id,omitempty"`
+	Email        string          `json:"email"`
+	Username     string          `json:"username,omitempty"`
+	Phone        string          `json:"phone,omitempty"`
+	Password     string          `json:"password,omitempty"`
+	PasswordHash string          `json:"password_hash,omitempty"`
+	DisplayName  string          `json:"display_name,omitempty"`
+	GivenName    string          `json:"given_name,omitempty"`
+	FamilyName   string          `json:"family_name,omitempty"`
+	Locale       string          `json:"locale,omitempty"`
+	TimeZone     string          `json:"time_zone,omitempty"`
+	Verified     bool            `json:"verified"`
+	CreatedAt    *time.Time      `json:"created_at,omitempty"`
+	AppMetadata  json.RawMessage `json:"app_metadata,omitempty"`
+	UserMetadata json.RawMessage `json:"user_metadata,omitempty"`
+	// PhoneVerified only counts when there is a Phone
+	PhoneVerified bool `json:"phone_verified,omitempty"`
+}
+
+// userRecordColumns are the CSV columns an import understands, only email is required
+var userRecordColumns = []string{"id", "email", "password", "password_hash", "display_name", "given_name", "family_name",
+	"locale", "time_zone", "verified", "created_at", "app_metadata", "user_metadata", "username", "phone",
+	"phone_verified"}
+
+// NewUserRecord is what an export writes for user
+func NewUserRecord(user *User) *UserRecord {
+	createdAt := user.CreatedAt
+	return &UserRecord{
+		ID:            user.PublicID,
+		Email:         user.Email,
+		Username:      user.Username,
+		Phone:         user.Phone,
+		PasswordHash:  user.Password,
+		DisplayName:   user.DisplayName,
+		GivenName:     user.GivenName,
+		FamilyName:    user.FamilyName,
+		Locale:        user.Locale,
+		TimeZone:      user.TimeZone,
+		Verified:      user.Verified,
+		PhoneVerified: user.PhoneVerified,
+		CreatedAt:     &createdAt,
+		AppMetadata:   user.AppMetadata,
+		UserMetadata:  user.UserMetadata,
+	}
+}
+
+func (record *UserRecord) set(column, value string) error {
+	var err error
+	switch column {
+	case "id":
+		record.ID = value
+	case "email":
+		record.Email = value
+	case "username":
+		record.Username = value
+	case "phone":
+		record.Phone = value
+	case "password":
+		record.Password = value
+	case "password_hash":
+		record.PasswordHash = value
+	case "display_name":
+		record.DisplayName = value
+	case "given_name":
+		record.GivenName = value
+	case "family_name":
+		record.FamilyName = value
+	case "locale":
+		record.Locale = value
+	case "time_zone":
+		record.TimeZone = value
+	case "verified":
+		if value != "" {
+			record.Verified, err = strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("verified must be true or false")
+			}
+		}
+	case "phone_verified":
+		if value != "" {
+			record.PhoneVerified, err = strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("phone_verified must be true or false")
+			}
+		}
+	case "created_at":
+		if value != "" {
+			createdAt, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return fmt.Errorf("created_at must be an RFC 3339 timestamp")
+			}
+			record.CreatedAt = &createdAt
+		}
+	case "app_metadata":
+		if value != "" {
+			record.AppMetadata = json.RawMessage(value)
+		}
+	case "user_metadata":
+		if value != "" {
+			record.UserMetadata = json.RawMessage(value)
+		}
+	}
+	return nil
+}
+
+func (record *UserRecord) get(column string) string {
+	switch column {
+	case "id":
+		return record.ID
+	case "email":
+		return record.Email
+	case "username":
+		return record.Username
+	case "phone":
+		return record.Phone
+	case "password":
+		return record.Password
+	case "password_hash":
+		return record.PasswordHash
+	case "display_name":
+		return record.DisplayName
+	case "given_name":
+		return record.GivenName
+	case "family_name":
+		return record.FamilyName
+	case "locale":
+		return record.Locale
+	case "time_zone":
+		return record.TimeZone
+	case "verified":
+		return strconv.FormatBool(record.Verified)
+	case "phone_verified":
+		return strconv.FormatBool(record.PhoneVerified)
+	case "created_at":
+		if record.CreatedAt == nil {
+			return ""
+		}
+		return record.CreatedAt.UTC().Format(time.RFC3339Nano)
+	case "app_metadata":
+		return string(record.AppMetadata)
+	case "user_metadata":
+		return string(record.UserMetadata)
+	}
+	return ""
+}
+
+// ImportRowError is a row that couldn't be read, the reader can carry on with the next one
+type ImportRowError struct {
+	Row int
+	Err error
+}
+
+func (e *ImportRowError) Error() string {
+	return fmt.Sprintf("row %d: %s", e.Row, e.Err)
+}
+
+func (e *ImportRowError) Unwrap() error {
+	return e.Err
+}
+
+// UserReader streams records out of an import file. Read returns io.EOF at the end and an *ImportRowError for a
+// row it had to skip, any other error means the rest of the file can't be read.
+type UserReader interface {
+	Read() (*UserRecord, error)
+}
+
+// NewUserReader reads CSV with a header row naming the columns, or NDJSON with one object per line
+func NewUserReader(r io.Reader, format string) (UserReader, error) {
+	switch format {
+	case FormatCSV:
+		return newCSVUserReader(r)
+	case FormatNDJSON:
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 0, 64*1024), maxImportLine)
+		return &ndjsonUserReader{scanner: scanner}, nil
+	}
+	return nil, fmt.Errorf("unknown format %q, use csv or ndjson", format)
+}
+
+type csvUserReader struct {
+	reader *csv.Reader
+	header []string
+}
+
+func newCSVUserReader(r io.Reader) (*csvUserReader, error) {
+	reader := csv.NewReader(r)
+	header, err := reader.Read()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, errors.New("csv must start with a header row")
+		}
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	for i, column := range header {
+		column = strings.ToLower(strings.TrimSpace(column))
+		if !validator.PermittedValue(column, userRecordColumns...) {
+			return nil, fmt.Errorf("unknown column %q, columns are %s", column, strings.Join(userRecordColumns, ", "))
+		}
+		if seen[column] {
+			return nil, fmt.Errorf("column %q appears twice", column)
+		}
+		seen[column] = true
+		header[i] = column
+	}
+	if !seen["email"] {
+		return nil, errors.New("csv must have an email column")
+	}
+	reader.FieldsPerRecord = len(header)
+	return &csvUserReader{reader: reader, header: header}, nil
+}
+
+func (cr *csvUserReader) Read() (*UserRecord, error) {
+	fields, err := cr.reader.Read()
+	if err != nil {
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			return nil, &ImportRowError{Row: parseErr.StartLine, Err: parseErr.Err}
+		}
+		return nil, err
+	}
+
+	row, _ := cr.reader.FieldPos(0)
+	record := &UserRecord{Row: row}
+	for i, value := range fields {
+		err = record.set(cr.header[i], value)
+		if err != nil {
+			return nil, &ImportRowError{Row: row, Err: err}
+		}
+	}
+	return record, nil
+}
+
+type ndjsonUserReader struct {
+	scanner *bufio.Scanner
+	line    int
+}
+
+func (nr *ndjsonUserReader) Read() (*UserRecord, error) {
+	for nr.scanner.Scan() {
+		nr.line++
+		line := bytes.TrimSpace(nr.scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		record := &UserRecord{Row: nr.line}
+		dec := json.NewDecoder(bytes.NewReader(line))
+		dec.DisallowUnknownFields()
+		err := dec.Decode(record)
+		if err == nil && dec.More() {
+			err = errors.New("line must only contain a single JSON object")
+		}
+		if err != nil {
+			return nil, &ImportRowError{Row: nr.line, Err: err}
+		}
+		return record, nil
+	}
+	if err := nr.scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+// UserWriter streams users into an export file, Flush must be called once they have all been written
+type UserWriter interface {
+	Write(user *User) error
+	Flush() error
+}
+
+// NewUserWriter writes the same CSV or NDJSON an import reads, with password_hash instead of password
+func NewUserWriter(w io.Writer, format string) (UserWriter, error) {
+	switch format {
+	case FormatCSV:
+		columns := []string{}
+		for _, column := range userRecordColumns {
+			if column != "password" {
+				columns = append(columns, column)
+			}
+		}
+		writer := csv.NewWriter(w)
+		err := writer.Write(columns)
+		if err != nil {
+			return nil, err
+		}
+		return &csvUserWriter{writer: writer, columns: columns}, nil
+	case FormatNDJSON:
+		buffered := bufio.NewWriter(w)
+		return &ndjsonUserWriter{buffered: buffered, encoder: json.NewEncoder(buffered)}, nil
+	}
+	return nil, fmt.Errorf("unknown format %q, use csv or ndjson", format)
+}
+
+type csvUserWriter struct {
+	writer  *csv.Writer
+	columns []string
+}
+
+func (cw *csvUserWriter) Write(user *User) error {
+	record := NewUserRecord(user)
+	fields := make([]string, len(cw.columns))
+	for i, column := range cw.columns {
+		fields[i] = record.get(column)
+	}
+	return cw.writer.Write(fields)
+}
+
+func (cw *csvUserWriter) Flush() error {
+	cw.writer.Flush()
+	return cw.writer.Error()
+}
+
+type ndjsonUserWriter struct {
+	buffered *bufio.Writer
+	encoder  *json.Encoder
+}
+
+func (nw *ndjsonUserWriter) Write(user *User) error {
+	return nw.encoder.Encode(NewUserRecord(user))
+}
+
+func (nw *ndjsonUserWriter) Flush() error {
+	return nw.buffered.Flush()
+}
+
+// ImportError is one row of an import report. Fields holds the validation messages when the row was invalid.
+type ImportError struct {
+	Row    int               `json:"row"`
+	Email  string            `json:"email,omitempty"`
+	Error  string            `json:"error"`
+	Fields map[string]string `json:"fields,omitempty"`
+}
+
+// ImportReport sums up an import. In a dry run Imported counts the users that would have been added.
+type ImportReport struct {
+	DryRun   bool          `json:"dry_run"`
+	Rows     int           `json:"rows"`
+	Imported int           `json:"imported"`
+	Failed   int           `json:"failed"`
+	Errors   []ImportError `json:"errors"`
+}
+
+func (report *ImportReport) fail(row int, email string, err error) {
+	report.Failed++
+	if len(report.Errors) >= MaxImportErrors {
+		return
+	}
+	importErr := ImportError{Row: row, Email: email, Error: err.Error()}
+	var fieldErr *importFieldError
+	if errors.As(err, &fieldErr) {
+		importErr.Error = ErrInvalidRow.Error()
+		importErr.Fields = fieldErr.fields
+	}
+	report.Errors = append(report.Errors, importErr)
+}
+
+// importFieldError carries a row's validation messages into the report
+type importFieldError struct {
+	fields map[string]string
+}
+
+func (e *importFieldError) Error() string {
+	keys := make([]string, 0, len(e.fields))
+	for key := range e.fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	messages := make([]string, len(keys))
+	for i, key := range keys {
+		messages[i] = key + " " + e.fields[key]
+	}
+	return "invalid user: " + strings.Join(messages, ", ")
+}
+
+// Importer adds the users in a file in batches, each batch in its own transaction so one bad row only costs
+// itself and a failure part way through keeps the batches before it. A dry run checks every row, including
+// against the users already stored, and then rolls each batch back.
+type Importer struct {
+	Users IUserModel
+	// Hasher hashes plaintext passwords, it defaults to DefaultHasher when nil
+	Hasher    PasswordHasher
+	BatchSize int
+	DryRun    bool
+}
+
+// Import reads r to the end and reports on every row. The error is only for failures that stop the import,
+// rows that can't be imported are in the report.
+func (im *Importer) Import(r UserReader) (*ImportReport, error) {
+	report := &ImportReport{DryRun: im.DryRun, Errors: []ImportError{}}
+	batchSize := im.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultImportBatchSize
+	}
+
+	// duplicates inside the file are caught here since a dry run never commits the batches that came before
+	seenEmails, seenIDs, seenUsernames := map[string]int{}, map[string]int{}, map[string]int{}
+	var batch []*User
+	var rows []int
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		errs, err := im.Users.ImportUsers(batch, im.DryRun)
+		if err != nil {
+			return err
+		}
+		for i, err := range errs {
+			if err != nil {
+				report.fail(rows[i], batch[i].Email, err)
+				continue
+			}
+			report.Imported++
+		}
+		batch, rows = nil, nil
+		return nil
+	}
+
+	for {
+		record, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		var rowErr *ImportRowError
+		if errors.As(err, &rowErr) {
+			report.Rows++
+			report.fail(rowErr.Row, "", rowErr.Err)
+			continue
+		}
+		if err != nil {
+			return report, err
+		}
+		report.Rows++
+
+		user, err := im.newUser(record)
+		if err != nil {
+			report.fail(record.Row, record.Email, err)
+			continue
+		}
+		email := CanonicalEmail(user.Email)
+		if first, ok := seenEmails[email]; ok {
+			report.fail(record.Row, record.Email, fmt.Errorf("%w, the email is already on row %d", ErrUserExists, first))
+			continue
+		}
+		if first, ok := seenIDs[user.PublicID]; ok && user.PublicID != "" {
+			report.fail(record.Row, record.Email, fmt.Errorf("%w, the id is already on row %d", ErrUserExists, first))
+			continue
+		}
+		if first, ok := seenUsernames[usernameKey(user.Username)]; ok && user.Username != "" {
+			report.fail(record.Row, record.Email, fmt.Errorf("%w, the username is already on row %d", ErrUserExists, first))
+			continue
+		}
+		seenEmails[email] = record.Row
+		if user.PublicID != "" {
+			seenIDs[user.PublicID] = record.Row
+		}
+		if user.Username != "" {
+			seenUsernames[usernameKey(user.Username)] = record.Row
+		}
+
+		batch = append(batch, user)
+		rows = append(rows, record.Row)
+		if len(batch) >= batchSize {
+			err = flush()
+			if err != nil {
+				return report, err
+			}
+		}
+	}
+
+	err := flush()
+	if err != nil {
+		return report, err
+	}
+	// rows refused by the database are only reported when their batch is written, so put them back in file order
+	sort.SliceStable(report.Errors, func(i, j int) bool { return report.Errors[i].Row < report.Errors[j].Row })
+	return report, nil
+}
+
+// newUser validates record and turns it into a user whose Password is a hash ready to store
+func (im *Importer) newUser(record *UserRecord) (*User, error) {
+	user := &User{
+		PublicID:    record.ID,
+		Email:       record.Email,
+		Username:    record.Username,
+		Phone:       NormalizePhone(record.Phone),
+		DisplayName: record.DisplayName,
+		GivenName:   record.GivenName,
+		FamilyName:  record.FamilyName,
+		Locale:      record.Locale,
+		TimeZone:    record.TimeZone,
+		Verified:    record.Verified,
+		CreatedAt:   time.Now(),
+	}
+	user.PhoneVerified = record.PhoneVerified && user.Phone != ""
+	if record.CreatedAt != nil {
+		user.CreatedAt = *record.CreatedAt
+	}
+
+	v := validator.New()
+	ValidateEmail(v, user.Email)
+	v.Check(len(user.Email) <= 500, "Email", "must be less than 500 bytes long")
+	ValidateProfile(v, user)
+	if user.Phone != "" {
+		ValidatePhone(v, user.Phone)
+	}
+	if user.PublicID != "" {
+		v.Check(validator.Matches(user.PublicID, validator.UUIDRX), "ID", "must be a UUID")
+	}
+	v.Check((record.Password == "") != (record.PasswordHash == ""), "Password", "set exactly one of password and password_hash")
+	if record.Password != "" {
+		ValidatePasswordPlaintext(v, record.Password, im.Hasher)
+	}
+	if record.PasswordHash != "" {
+		v.Check(IsPasswordHash(record.PasswordHash), "PasswordHash", "must be a well-formed bcrypt, argon2id or scrypt hash")
+	}
+
+	var err error
+	if len(record.AppMetadata) > 0 {
+		user.AppMetadata, err = MergePatch(nil, record.AppMetadata)
+		if err != nil {
+			v.AddError("AppMetadata", err.Error())
+		}
+	}
+	if len(record.UserMetadata) > 0 {
+		user.UserMetadata, err = MergePatch(nil, record.UserMetadata)
+		if err != nil {
+			v.AddError("UserMetadata", err.Error())
+		}
+	}
+	if !v.Valid() {
+		return nil, &importFieldError{fields: v.Errors}
+	}
+
+	// a dry run never stores the hash, so it skips the slow part
+	user.Password = record.PasswordHash
+	if record.Password != "" && !im.DryRun {
+		user.Password, err = hasherOrDefault(im.Hasher).Hash(record.Password)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return user, nil
+}
+
+// ImportUsers inserts users in one transaction, user.Password must already be a hash. A user whose email, username
+// or id is taken is skipped with ErrUserExists in its place in the returned slice, the error is for the batch as a
+// whole. dryRun rolls the transaction back once every user has been tried.
+func (m *UserModel) ImportUsers(users []*User, dryRun bool) ([]error, error) {
+	query := m.rebind(`INSERT INTO users (public_id, email, email_canonical, password_hash, created_at, updated_at,
+		display_name, given_name, family_name, locale, time_zone, verified, app_metadata, user_metadata, username, phone,
+		phone_verified)
+	VALUES ($1, $2, $3, $4, $5, $5, $6, $7, $8, $9, $10, $11, $12::jsonb, $13::jsonb, NULLIF($14, ''), $15, $16)
+	ON CONFLICT DO NOTHING
+	RETURNING id`)
+
+	// a batch is a few thousand inserts at most, well past the usual 3 seconds
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	errs := make([]error, len(users))
+	for i, user := range users {
+		if user.PublicID == "" {
+			user.PublicID, err = NewPublicID()
+			if err != nil {
+				return nil, err
+			}
+		}
+		if len(user.AppMetadata) == 0 {
+			user.AppMetadata = emptyMetadata
+		}
+		if len(user.UserMetadata) == 0 {
+			user.UserMetadata = emptyMetadata
+		}
+		user.UpdatedAt = user.CreatedAt
+
+		email, err := m.Cipher.Encrypt(user.Email, user.PublicID)
+		if err != nil {
+			return nil, err
+		}
+		args := []any{user.PublicID, email, m.Cipher.EmailIndex(user.Email), user.Password, user.CreatedAt.UTC(),
+			user.DisplayName, user.GivenName, user.FamilyName, user.Locale, user.TimeZone, user.Verified,
+			string(user.AppMetadata), string(user.UserMetadata), user.Username, user.Phone, user.PhoneVerified}
+		err = tx.QueryRowContext(ctx, query, args...).Scan(&user.ID)
+		if err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				errs[i] = ErrUserExists
+				continue
+			default:
+				return nil, err
+			}
+		}
+		err = m.joinDefaultOrganization(ctx, tx, user)
+		if err != nil {
+			return nil, err
+		}
+		user.Version = 1
+	}
+
+	if dryRun {
+		return errs, nil
+	}
+	return errs, tx.Commit()
+}
+
+// ExportUsers calls fn with every user that hasn't been deleted, in the order they signed up, stopping at the
+// first error fn returns
+func (m *UserModel) ExportUsers(fn func(user *User) error) error {
+	query := `SELECT ` + m.columns() + ` FROM users WHERE deleted_at IS NULL ORDER BY id`
+
+	// the rows are streamed to the caller, so this is how long the slowest reader gets
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var user User
+		err = rows.Scan(user.scanDestinations()...)
+		if err != nil {
+			return err
+		}
+		err = m.Cipher.decryptUser(&user)
+		if err != nil {
+			return err
+		}
+		err = fn(&user)
+		if err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (mockUM *UserModelMock) ImportUsers(users []*User, dryRun bool) ([]error, error) {
+	errs := make([]error, len(users))
+	taken := func(user *User, others []*User) bool {
+		for _, other := range others {
+			if CanonicalEmail(other.Email) == CanonicalEmail(user.Email) || (user.PublicID != "" && other.PublicID == user.PublicID) ||
+				sameUsername(other, user) {
+				return true
+			}
+		}
+		return false
+	}
+
+	added := []*User{}
+	nextID := mockUM.nextUserID()
+	for i, user := range users {
+		if taken(user, mockUM.DB) || taken(user, added) {
+			errs[i] = ErrUserExists
+			continue
+		}
+		if user.PublicID == "" {
+			publicID, err := NewPublicID()
+			if err != nil {
+				return nil, err
+			}
+			user.PublicID = publicID
+		}
+		if len(user.AppMetadata) == 0 {
+			user.AppMetadata = emptyMetadata
+		}
+		if len(user.UserMetadata) == 0 {
+			user.UserMetadata = emptyMetadata
+		}
+		if user.ID == 0 {
+			user.ID = nextID
+			nextID++
+		}
+		user.UpdatedAt = user.CreatedAt
+		user.Version = 1
+		user.Roles, user.Permissions = []string{}, []string{}
+		added = append(added, user)
+	}
+
+	if dryRun {
+		return errs, nil
+	}
+	for _, user := range added {
+		mockUM.DB = append(mockUM.DB, user)
+		mockUM.addMembership(mockUM.defaultOrg(), user, OrgRoleMember)
+	}
+	return errs, nil
+}
+
+func (mockUM *UserModelMock) ExportUsers(fn func(user *User) error) error {
+	for _, user := range mockUM.DB {
+		if user.DeletedAt != nil {
+			continue
+		}
+		err := fn(user)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
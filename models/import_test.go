@@ -0,0 +1,299 @@
+package models
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readAll collects the records and skipped rows of an import file
+func readAll(t *testing.T, r UserReader) ([]*UserRecord, []*ImportRowError) {
+	var records []*UserRecord
+	var skipped []*ImportRowError
+	for {
+		record, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			return records, skipped
+		}
+		var rowErr *ImportRowError
+		if errors.As(err, &rowErr) {
+			skipped = append(skipped, rowErr)
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error reading: %s", err)
+		}
+		records = append(records, record)
+	}
+}
+
+func TestNewUserReader_CSV(t *testing.T) {
+	input := "Email,password,verified,created_at,app_metadata\n" +
+		"alice@example.com,securepassword,true,2024-01-02T03:04:05Z,\"{\"\"plan\"\": \"\"pro\"\"}\"\n" +
+		"bob@example.com,securepassword\n" +
+		"carol@example.com,securepassword,maybe,,\n" +
+		"\"dave@example.com\nsecond line\",securepassword,false,,\n"
+	reader, err := NewUserReader(strings.NewReader(input), FormatCSV)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	records, skipped := readAll(t, reader)
+	if len(records) != 2 || len(skipped) != 2 {
+		t.Fatalf("Expected 2 records and 2 skipped rows, got %d and %d", len(records), len(skipped))
+	}
+	alice := records[0]
+	if alice.Row != 2 || alice.Email != "alice@example.com" || !alice.Verified || string(alice.AppMetadata) != `{"plan": "pro"}` {
+		t.Errorf("Expected alice from row 2, got %+v", alice)
+	}
+	if alice.CreatedAt == nil || !alice.CreatedAt.Equal(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)) {
+		t.Errorf("Expected created_at to be parsed, got %v", alice.CreatedAt)
+	}
+	if skipped[0].Row != 3 || skipped[1].Row != 4 {
+		t.Errorf("Expected rows 3 and 4 to be skipped, got %d and %d", skipped[0].Row, skipped[1].Row)
+	}
+	// a quoted field can run over several lines, the row is where the user starts
+	if records[1].Row != 5 || !strings.HasPrefix(records[1].Email, "dave@example.com") {
+		t.Errorf("Expected dave from row 5, got %+v", records[1])
+	}
+
+	for _, header := range []string{"", "password\n", "email,email\n", "email,fax\n"} {
+		_, err := NewUserReader(strings.NewReader(header), FormatCSV)
+		if err == nil {
+			t.Errorf("Expected header %q to be refused", header)
+		}
+	}
+}
+
+func TestNewUserReader_NDJSON(t *testing.T) {
+	input := `{"email": "alice@example.com", "password": "securepassword", "user_metadata": {"theme": "dark"}}
+
+{"email": "bob@example.com", "fax": "555"}
+not json
+{"email": "carol@example.com", "password_hash": "$2a$04$abc"} {"email": "extra"}
+{"email": "dave@example.com", "password": "securepassword"}
+`
+	reader, err := NewUserReader(strings.NewReader(input), FormatNDJSON)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	records, skipped := readAll(t, reader)
+	if len(records) != 2 || len(skipped) != 3 {
+		t.Fatalf("Expected 2 records and 3 skipped rows, got %d and %d", len(records), len(skipped))
+	}
+	if records[0].Row != 1 || string(records[0].UserMetadata) != `{"theme": "dark"}` {
+		t.Errorf("Expected alice from line 1 with her metadata, got %+v", records[0])
+	}
+	if records[1].Row != 6 || records[1].Email != "dave@example.com" {
+		t.Errorf("Expected dave from line 6, got %+v", records[1])
+	}
+	for i, row := range []int{3, 4, 5} {
+		if skipped[i].Row != row {
+			t.Errorf("Expected line %d to be skipped, got %d", row, skipped[i].Row)
+		}
+	}
+
+	_, err = NewUserReader(strings.NewReader(input), "xml")
+	if err == nil {
+		t.Errorf("Expected an unknown format to be refused")
+	}
+}
+
+func TestParseUserFileFormat(t *testing.T) {
+	for input, expected := range map[string]string{"csv": FormatCSV, "CSV": FormatCSV, "ndjson": FormatNDJSON, "jsonl": FormatNDJSON} {
+		format, err := ParseUserFileFormat(input)
+		if err != nil || format != expected {
+			t.Errorf("Expected %q to be %s, got %q, %v", input, expected, format, err)
+		}
+	}
+	if _, err := ParseUserFileFormat("json"); err == nil {
+		t.Errorf("Expected json to be refused")
+	}
+}
+
+func TestImporter_Import(t *testing.T) {
+	bcryptHash, _ := testBcrypt.Hash("oldsystempassword")
+	input := "email,password,password_hash,display_name,time_zone,id\n" +
+		"alice@example.com,securepassword,,Alice,Europe/London,\n" +
+		"bob@example.com,," + bcryptHash + ",Bob,,0190a6e2-5c3b-7c1e-9f3a-2b4c6d8e0f12\n" +
+		"taken@example.com,securepassword,,,,\n" +
+		"Alice@Example.com,securepassword,,,,\n" +
+		"nopassword@example.com,,,,,\n" +
+		"plaintext@example.com,,notahash,,,\n" +
+		"crafted@example.com,,\"$scrypt$ln=4,r=8,p=1$c2FsdHNhbHQ$\",,,\n" +
+		"badzone@example.com,securepassword,,,Mars/Olympus_Mons,\n" +
+		"carol@example.com,securepassword,,Carol,,\n"
+
+	tests := []struct {
+		name   string
+		dryRun bool
+	}{
+		{name: "Import"},
+		{name: "Dry run", dryRun: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mock := &UserModelMock{DB: []*User{}, Hasher: Hasher{Current: testBcrypt}}
+			err := mock.Insert(&User{ID: 1, Email: "taken@example.com", Password: "securepassword"})
+			if err != nil {
+				t.Fatalf("Unexpected error inserting user: %s", err)
+			}
+			reader, err := NewUserReader(strings.NewReader(input), FormatCSV)
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+
+			importer := Importer{Users: mock, Hasher: mock.Hasher, BatchSize: 2, DryRun: test.dryRun}
+			report, err := importer.Import(reader)
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			if report.Rows != 9 || report.Imported != 3 || report.Failed != 6 || report.DryRun != test.dryRun {
+				t.Fatalf("Expected 3 of 9 rows imported, got %+v", report)
+			}
+			expectedRows := []int{4, 5, 6, 7, 8, 9}
+			for i, importErr := range report.Errors {
+				if importErr.Row != expectedRows[i] {
+					t.Errorf("Expected error %d to be for row %d, got %+v", i, expectedRows[i], importErr)
+				}
+			}
+			if !strings.Contains(report.Errors[1].Error, "row 2") {
+				t.Errorf("Expected the duplicate to point at row 2, got %s", report.Errors[1].Error)
+			}
+			if report.Errors[4].Fields["PasswordHash"] == "" {
+				t.Errorf("Expected a hash with an empty key to be refused, got %+v", report.Errors[4])
+			}
+			if report.Errors[5].Fields["TimeZone"] == "" {
+				t.Errorf("Expected the field that failed to be reported, got %+v", report.Errors[5])
+			}
+
+			if test.dryRun {
+				if len(mock.DB) != 1 {
+					t.Errorf("Expected a dry run to store nothing, got %d users", len(mock.DB))
+				}
+				return
+			}
+			if len(mock.DB) != 4 {
+				t.Fatalf("Expected 3 users to be added, got %d users", len(mock.DB))
+			}
+			alice, _ := mock.GetByEmail("alice@example.com")
+			if _, err := mock.Hasher.Verify("securepassword", alice.Password); err != nil || alice.TimeZone != "Europe/London" {
+				t.Errorf("Expected alice's plaintext password to be hashed, got %+v, %v", alice, err)
+			}
+			bob, _ := mock.GetByEmail("bob@example.com")
+			if bob.Password != bcryptHash || bob.PublicID != "0190a6e2-5c3b-7c1e-9f3a-2b4c6d8e0f12" {
+				t.Errorf("Expected bob's hash and id to be kept, got %+v", bob)
+			}
+			if _, err := mock.Authenticate("bob@example.com", "oldsystempassword"); err != nil {
+				t.Errorf("Expected bob to sign in with his old password, got %s", err)
+			}
+			if _, err := mock.GetMembership(DefaultOrgSlug, int(bob.ID)); err != nil {
+				t.Errorf("Expected imported users to join the default organization, got %s", err)
+			}
+		})
+	}
+}
+
+func TestImporter_Usernames(t *testing.T) {
+	input := "email,password,username\n" +
+		"alice@example.com,securepassword,Alice_W\n" +
+		"bob@example.com,securepassword,alice_w\n" +
+		"carol@example.com,securepassword,Ad.min\n" +
+		"dave@example.com,securepassword,TAKEN\n" +
+		"erin@example.com,securepassword,\n"
+
+	mock := &UserModelMock{DB: []*User{}, Hasher: Hasher{Current: testBcrypt}}
+	err := mock.Insert(&User{Email: "taken@example.com", Password: "securepassword", Username: "taken"})
+	if err != nil {
+		t.Fatalf("Unexpected error inserting user: %s", err)
+	}
+	reader, err := NewUserReader(strings.NewReader(input), FormatCSV)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	report, err := (&Importer{Users: mock, Hasher: mock.Hasher}).Import(reader)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if report.Imported != 2 || report.Failed != 3 {
+		t.Fatalf("Expected alice and erin to be imported, got %+v", report)
+	}
+	if !strings.Contains(report.Errors[0].Error, "username is already on row 2") {
+		t.Errorf("Expected the duplicate in the file to point at alice's row, got %+v", report.Errors[0])
+	}
+	if report.Errors[1].Fields["Username"] != "is reserved" {
+		t.Errorf("Expected the reserved username to be refused, got %+v", report.Errors[1])
+	}
+	if !strings.Contains(report.Errors[2].Error, ErrUserExists.Error()) {
+		t.Errorf("Expected the stored username to be taken whatever its case, got %+v", report.Errors[2])
+	}
+	if alice, err := mock.GetByUsername("alice_w"); err != nil || alice.Email != "alice@example.com" {
+		t.Errorf("Expected alice to keep her username, got %v, %v", alice, err)
+	}
+}
+
+func TestNewUserWriter_RoundTrip(t *testing.T) {
+	for _, format := range []string{FormatCSV, FormatNDJSON} {
+		t.Run(format, func(t *testing.T) {
+			source := &UserModelMock{DB: []*User{}, Hasher: Hasher{Current: testBcrypt}}
+			deletedAt := time.Now()
+			for i, user := range []*User{
+				{Email: "alice@example.com", DisplayName: "Alice, A.", Verified: true, AppMetadata: []byte(`{"plan":"pro"}`)},
+				{Email: "bob@example.com", Locale: "en-GB", Username: "Bob_B"},
+				{Email: "deleted@example.com", DeletedAt: &deletedAt},
+			} {
+				user.ID = int64(i + 1)
+				user.Password = "securepassword"
+				user.CreatedAt = time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+				err := source.Insert(user)
+				if err != nil {
+					t.Fatalf("Unexpected error inserting user: %s", err)
+				}
+			}
+
+			var file bytes.Buffer
+			writer, err := NewUserWriter(&file, format)
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			err = source.ExportUsers(writer.Write)
+			if err != nil {
+				t.Fatalf("Unexpected error exporting: %s", err)
+			}
+			err = writer.Flush()
+			if err != nil {
+				t.Fatalf("Unexpected error flushing: %s", err)
+			}
+			if strings.Contains(file.String(), "deleted@example.com") {
+				t.Errorf("Expected deleted users to be left out of the export")
+			}
+
+			target := &UserModelMock{DB: []*User{}, Hasher: source.Hasher}
+			reader, err := NewUserReader(&file, format)
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			report, err := (&Importer{Users: target, Hasher: target.Hasher}).Import(reader)
+			if err != nil || report.Imported != 2 || report.Failed != 0 {
+				t.Fatalf("Expected the export to import cleanly, got %+v, %v", report, err)
+			}
+			for _, original := range source.DB[:2] {
+				imported, err := target.GetByEmail(original.Email)
+				if err != nil {
+					t.Fatalf("Expected %s to be imported, got %s", original.Email, err)
+				}
+				if imported.PublicID != original.PublicID || imported.Password != original.Password || imported.DisplayName != original.DisplayName ||
+					imported.Verified != original.Verified || !imported.CreatedAt.Equal(original.CreatedAt) || imported.Username != original.Username ||
+					string(imported.AppMetadata) != string(original.AppMetadata) {
+					t.Errorf("Expected %+v to survive the round trip, got %+v", original, imported)
+				}
+			}
+		})
+	}
+}
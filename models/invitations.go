@@ -0,0 +1,309 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"the_lonely_road/validator"
+	"time"
+)
+
+// DefaultInvitationTTL is how long an invitation link works for
+const DefaultInvitationTTL = 7 * 24 * time.Hour
+
+// ErrInvitationClosed means the invitation was accepted, revoked or has expired
+var ErrInvitationClosed = errors.New("invitation is no longer open")
+
+// Invitation asks Email to join an organization with Role. Only the hash of the emailed token is kept,
+// and it stops working once accepted, revoked or past ExpiresAt.
+type Invitation struct {
+	ID         int64      `json:"-"`
+	PublicID   string     `json:"id"`
+	OrgID      int64      `json:"-"`
+	OrgSlug    string     `json:"org"`
+	Email      string     `json:"email"`
+	Role       string     `json:"role"`
+	InvitedBy  int64      `json:"-"`
+	TokenHash  string     `json:"-"`
+	TokenSalt  string     `json:"-"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	AcceptedAt *time.Time `json:"accepted_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+// Pending reports whether the invitation can still be accepted at now
+func (inv *Invitation) Pending(now time.Time) bool {
+	return inv.AcceptedAt == nil && inv.RevokedAt == nil && now.Before(inv.ExpiresAt)
+}
+
+func ValidateInvitation(v *validator.Validator, inv *Invitation) {
+	ValidateEmail(v, inv.Email)
+	v.Check(validator.PermittedValue(inv.Role, OrgRoleOwner, OrgRoleAdmin, OrgRoleMember), "Role", "must be owner, admin or member")
+}
+
+const invitationColumns = `i.id, i.public_id, i.organization_id, o.slug, i.email, i.role, COALESCE(i.invited_by, 0),
+	i.token_hash, i.token_salt, i.created_at, i.expires_at, i.accepted_at, i.revoked_at`
+
+func (inv *Invitation) scanDestinations() []any {
+	return []any{&inv.ID, &inv.PublicID, &inv.OrgID, &inv.OrgSlug, &inv.Email, &inv.Role, &inv.InvitedBy,
+		&inv.TokenHash, &inv.TokenSalt, &inv.CreatedAt, &inv.ExpiresAt, &inv.AcceptedAt, &inv.RevokedAt}
+}
+
+// CreateInvitation stores inv, revoking any invitation still open for the same address so only the newest link works
+func (m *UserModel) CreateInvitation(inv *Invitation) error {
+	var err error
+	if inv.PublicID == "" {
+		inv.PublicID, err = NewPublicID()
+		if err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `UPDATE invitations SET revoked_at = $3
+	WHERE organization_id = $1 AND email_canonical = $2 AND accepted_at IS NULL AND revoked_at IS NULL`,
+		inv.OrgID, m.Cipher.EmailIndex(inv.Email), inv.CreatedAt.UTC())
+	if err != nil {
+		return err
+	}
+
+	query := `INSERT INTO invitations (public_id, organization_id, email, email_canonical, role, invited_by, token_hash, token_salt,
+		created_at, expires_at)
+	VALUES ($1, $2, $3, $4, $5, NULLIF($6, 0), $7, $8, $9, $10)
+	RETURNING id`
+	email, err := m.Cipher.Encrypt(inv.Email, inv.PublicID)
+	if err != nil {
+		return err
+	}
+	args := []any{inv.PublicID, inv.OrgID, email, m.Cipher.EmailIndex(inv.Email), inv.Role, inv.InvitedBy, inv.TokenHash, inv.TokenSalt,
+		inv.CreatedAt.UTC(), inv.ExpiresAt.UTC()}
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&inv.ID)
+	if err != nil {
+		switch {
+		case foreignKeyViolation(err, "invitations_organization_id_fkey"):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (m *UserModel) GetInvitation(publicID string) (*Invitation, error) {
+	if !validator.Matches(publicID, validator.UUIDRX) {
+		return nil, ErrRecordNotFound
+	}
+	query := `SELECT ` + invitationColumns + ` FROM invitations i JOIN organizations o ON o.id = i.organization_id
+	WHERE i.public_id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var inv Invitation
+	err := m.DB.QueryRowContext(ctx, query, publicID).Scan(inv.scanDestinations()...)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	inv.Email, err = m.Cipher.Decrypt(inv.Email, inv.PublicID)
+	if err != nil {
+		return nil, err
+	}
+	return &inv, nil
+}
+
+// ListPendingInvitations returns the organization's invitations that can still be accepted, newest first
+func (m *UserModel) ListPendingInvitations(orgID int) ([]*Invitation, error) {
+	query := `SELECT ` + invitationColumns + ` FROM invitations i JOIN organizations o ON o.id = i.organization_id
+	WHERE i.organization_id = $1 AND i.accepted_at IS NULL AND i.revoked_at IS NULL AND i.expires_at > $2
+	ORDER BY i.created_at DESC, i.id DESC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, orgID, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invitations := []*Invitation{}
+	for rows.Next() {
+		var inv Invitation
+		err = rows.Scan(inv.scanDestinations()...)
+		if err != nil {
+			return nil, err
+		}
+		inv.Email, err = m.Cipher.Decrypt(inv.Email, inv.PublicID)
+		if err != nil {
+			return nil, err
+		}
+		invitations = append(invitations, &inv)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return invitations, nil
+}
+
+// RevokeInvitation returns ErrInvitationClosed when there is no open invitation with that id in the organization
+func (m *UserModel) RevokeInvitation(orgID int, publicID string) error {
+	if !validator.Matches(publicID, validator.UUIDRX) {
+		return ErrInvitationClosed
+	}
+	query := `UPDATE invitations SET revoked_at = $3
+	WHERE organization_id = $1 AND public_id = $2 AND accepted_at IS NULL AND revoked_at IS NULL AND expires_at > $3`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, orgID, publicID, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		return ErrInvitationClosed
+	}
+	return nil
+}
+
+// AcceptInvitation closes the invitation and adds userID to the organization with the invited role. Marking it
+// accepted only succeeds while it is still open, so the token can't be used twice. A user who is already a
+// member keeps the role they have.
+func (m *UserModel) AcceptInvitation(invitationID, userID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	var orgID int
+	var role string
+	err = tx.QueryRowContext(ctx, `UPDATE invitations SET accepted_at = $2
+	WHERE id = $1 AND accepted_at IS NULL AND revoked_at IS NULL AND expires_at > $2
+	RETURNING organization_id, role`, invitationID, now).Scan(&orgID, &role)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrInvitationClosed
+		default:
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO memberships (organization_id, user_id, role, created_at) VALUES ($1, $2, $3, $4)
+	ON CONFLICT (organization_id, user_id) DO NOTHING`, orgID, userID, role, now)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (mockUM *UserModelMock) CreateInvitation(inv *Invitation) error {
+	var err error
+	if inv.PublicID == "" {
+		inv.PublicID, err = NewPublicID()
+		if err != nil {
+			return err
+		}
+	}
+	var org *Organization
+	for _, existing := range mockUM.Orgs {
+		if existing.ID == inv.OrgID {
+			org = existing
+		}
+	}
+	if org == nil {
+		return ErrRecordNotFound
+	}
+	for _, existing := range mockUM.Invitations {
+		if existing.OrgID == inv.OrgID && CanonicalEmail(existing.Email) == CanonicalEmail(inv.Email) &&
+			existing.AcceptedAt == nil && existing.RevokedAt == nil {
+			revokedAt := inv.CreatedAt
+			existing.RevokedAt = &revokedAt
+		}
+	}
+	inv.ID = int64(len(mockUM.Invitations) + 1)
+	inv.OrgSlug = org.Slug
+	mockUM.Invitations = append(mockUM.Invitations, inv)
+	return nil
+}
+
+func (mockUM *UserModelMock) GetInvitation(publicID string) (*Invitation, error) {
+	for _, inv := range mockUM.Invitations {
+		if publicID != "" && inv.PublicID == publicID {
+			return inv, nil
+		}
+	}
+	return nil, ErrRecordNotFound
+}
+
+func (mockUM *UserModelMock) ListPendingInvitations(orgID int) ([]*Invitation, error) {
+	invitations := []*Invitation{}
+	now := time.Now()
+	// newest first, like the query
+	for i := len(mockUM.Invitations) - 1; i >= 0; i-- {
+		inv := mockUM.Invitations[i]
+		if inv.OrgID == int64(orgID) && inv.Pending(now) {
+			invitations = append(invitations, inv)
+		}
+	}
+	return invitations, nil
+}
+
+func (mockUM *UserModelMock) RevokeInvitation(orgID int, publicID string) error {
+	now := time.Now()
+	for _, inv := range mockUM.Invitations {
+		if inv.OrgID == int64(orgID) && inv.PublicID == publicID && inv.Pending(now) {
+			inv.RevokedAt = &now
+			return nil
+		}
+	}
+	return ErrInvitationClosed
+}
+
+func (mockUM *UserModelMock) AcceptInvitation(invitationID, userID int) error {
+	now := time.Now()
+	for _, inv := range mockUM.Invitations {
+		if inv.ID != int64(invitationID) {
+			continue
+		}
+		if !inv.Pending(now) {
+			return ErrInvitationClosed
+		}
+		user, err := mockUM.GetByID(userID)
+		if err != nil {
+			return errors.New("user not found")
+		}
+		inv.AcceptedAt = &now
+		if _, err := mockUM.GetMembership(inv.OrgSlug, userID); err == nil {
+			return nil
+		}
+		for _, org := range mockUM.Orgs {
+			if org.ID == inv.OrgID {
+				mockUM.addMembership(org, user, inv.Role)
+			}
+		}
+		return nil
+	}
+	return ErrInvitationClosed
+}
@@ -0,0 +1,84 @@
+package models
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestInvitation_Pending(t *testing.T) {
+	now := time.Now()
+	earlier := now.Add(-time.Minute)
+	tests := []struct {
+		name string
+		inv  Invitation
+		want bool
+	}{
+		{name: "Open", inv: Invitation{ExpiresAt: now.Add(time.Hour)}, want: true},
+		{name: "Expired", inv: Invitation{ExpiresAt: earlier}, want: false},
+		{name: "Accepted", inv: Invitation{ExpiresAt: now.Add(time.Hour), AcceptedAt: &earlier}, want: false},
+		{name: "Revoked", inv: Invitation{ExpiresAt: now.Add(time.Hour), RevokedAt: &earlier}, want: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.inv.Pending(now); got != test.want {
+				t.Errorf("Expected %v, got %v", test.want, got)
+			}
+		})
+	}
+}
+
+func TestUserModelMock_Invitations(t *testing.T) {
+	userModel := UserModelMock{DB: []*User{}}
+	err := userModel.Insert(&User{ID: 1, Email: "owner@localhost", Password: "veryinsecurepassword"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	org := &Organization{Slug: "acme", Name: "Acme"}
+	err = userModel.CreateOrganization(org, 1)
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+
+	now := time.Now()
+	first := &Invitation{OrgID: org.ID, Email: "invitee@localhost", Role: OrgRoleAdmin, CreatedAt: now, ExpiresAt: now.Add(time.Hour)}
+	second := &Invitation{OrgID: org.ID, Email: "Invitee@Localhost", Role: OrgRoleMember, CreatedAt: now, ExpiresAt: now.Add(time.Hour)}
+	for _, inv := range []*Invitation{first, second} {
+		err = userModel.CreateInvitation(inv)
+		if err != nil {
+			t.Fatalf("Expected no error, got %s", err)
+		}
+	}
+	if first.RevokedAt == nil {
+		t.Errorf("Expected inviting the same address again to revoke the first invitation")
+	}
+	pending, err := userModel.ListPendingInvitations(int(org.ID))
+	if err != nil || len(pending) != 1 || pending[0] != second {
+		t.Errorf("Expected only the second invitation to be pending, got %v, %v", pending, err)
+	}
+
+	err = userModel.Insert(&User{ID: 2, Email: "invitee@localhost", Password: "veryinsecurepassword"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	err = userModel.AcceptInvitation(int(first.ID), 2)
+	if !errors.Is(err, ErrInvitationClosed) {
+		t.Errorf("Expected ErrInvitationClosed for a revoked invitation, got %v", err)
+	}
+	err = userModel.AcceptInvitation(int(second.ID), 2)
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	membership, err := userModel.GetMembership("acme", 2)
+	if err != nil || membership.Role != OrgRoleMember {
+		t.Errorf("Expected invitee to be a member, got %+v, %v", membership, err)
+	}
+	err = userModel.AcceptInvitation(int(second.ID), 2)
+	if !errors.Is(err, ErrInvitationClosed) {
+		t.Errorf("Expected ErrInvitationClosed accepting twice, got %v", err)
+	}
+	err = userModel.RevokeInvitation(int(org.ID), second.PublicID)
+	if !errors.Is(err, ErrInvitationClosed) {
+		t.Errorf("Expected ErrInvitationClosed revoking an accepted invitation, got %v", err)
+	}
+}
@@ -0,0 +1,90 @@
+package models
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLockoutPolicy_delay(t *testing.T) {
+	policy := LockoutPolicy{BaseDelay: time.Second, MaxDelay: 10 * time.Second}
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{failures: 0, want: 0},
+		{failures: 1, want: time.Second},
+		{failures: 2, want: 2 * time.Second},
+		{failures: 4, want: 8 * time.Second},
+		{failures: 5, want: 10 * time.Second},
+		{failures: 1000, want: 10 * time.Second},
+	}
+	for _, test := range tests {
+		if got := policy.delay(test.failures); got != test.want {
+			t.Errorf("Expected %s after %d failures, got %s", test.want, test.failures, got)
+		}
+	}
+	if got := (LockoutPolicy{}).delay(3); got != 0 {
+		t.Errorf("Expected the zero policy not to back off, got %s", got)
+	}
+}
+
+func TestUserModelMock_Lockout(t *testing.T) {
+	userModel := UserModelMock{DB: []*User{}, Lockout: LockoutPolicy{Threshold: 3, LockDuration: time.Hour, BaseDelay: time.Minute}}
+	user := &User{ID: 1, Email: "lockout@localhost", Password: "veryinsecurepassword"}
+	err := userModel.Insert(user)
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	// pretend the back-off has passed since the last failure
+	waitOut := func() {
+		if user.LastFailedLogin != nil {
+			earlier := user.LastFailedLogin.Add(-time.Hour)
+			user.LastFailedLogin = &earlier
+		}
+	}
+
+	_, err = userModel.Authenticate(user.Email, "wrong")
+	if err == nil || user.FailedLogins != 1 {
+		t.Fatalf("Expected a failed login to be counted, got %v and %d", err, user.FailedLogins)
+	}
+	_, err = userModel.Authenticate(user.Email, "veryinsecurepassword")
+	if !errors.Is(err, ErrLoginThrottled) {
+		t.Errorf("Expected ErrLoginThrottled during back-off, got %v", err)
+	}
+
+	waitOut()
+	_, err = userModel.Authenticate(user.Email, "veryinsecurepassword")
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	if user.FailedLogins != 0 || user.LastFailedLogin != nil {
+		t.Errorf("Expected a successful login to reset the counter, got %d", user.FailedLogins)
+	}
+
+	for i := 1; i < 3; i++ {
+		_, err = userModel.Authenticate(user.Email, "wrong")
+		waitOut()
+	}
+	_, err = userModel.Authenticate(user.Email, "wrong")
+	if !errors.Is(err, ErrTooManyAttempts) {
+		t.Fatalf("Expected ErrTooManyAttempts on the third failure, got %v", err)
+	}
+	_, err = userModel.Authenticate(user.Email, "veryinsecurepassword")
+	if !errors.Is(err, ErrAccountLocked) {
+		t.Errorf("Expected ErrAccountLocked with the right password, got %v", err)
+	}
+
+	err = userModel.UnlockUser(1)
+	if err != nil {
+		t.Errorf("Expected no error, got %s", err)
+	}
+	_, err = userModel.Authenticate(user.Email, "veryinsecurepassword")
+	if err != nil {
+		t.Errorf("Expected login after unlock, got %s", err)
+	}
+	err = userModel.UnlockUser(2)
+	if err == nil {
+		t.Errorf("Expected error unlocking a missing user, got nil")
+	}
+}
@@ -0,0 +1,93 @@
+package models
+
+import (
+	"context"
+	"time"
+)
+
+// DefaultLoginHistoryWindow is how long sign ins are shown to their user. The audit log is append-only so older
+// ones are left there and only filtered out of the history.
+const DefaultLoginHistoryWindow = 90 * 24 * time.Hour
+
+// LoginHistoryEntry is one sign in attempt as its user sees it, built from a login audit event
+type LoginHistoryEntry struct {
+	Time      time.Time `json:"time"`
+	Succeeded bool      `json:"succeeded"`
+	Method    string    `json:"method"`
+	IP        string    `json:"ip"`
+	Browser   string    `json:"browser"`
+	OS        string    `json:"os"`
+}
+
+func newLoginHistoryEntry(event *AuditEvent) *LoginHistoryEntry {
+	browser, os := ParseUserAgent(event.UserAgent)
+	return &LoginHistoryEntry{
+		Time:      event.CreatedAt,
+		Succeeded: event.Type == AuditLoginSucceeded,
+		Method:    event.Method,
+		IP:        event.IP,
+		Browser:   browser,
+		OS:        os,
+	}
+}
+
+// ListLoginHistory pages through the sign ins against the account with publicID since the given time, newest first.
+// since is where the window starts, older sign ins stay in the audit log. Only filters.Page and filters.PageSize are used.
+func (m *UserModel) ListLoginHistory(publicID string, since time.Time, filters Filters) ([]*LoginHistoryEntry, Metadata, error) {
+	query := `
+	SELECT count(*) OVER(), event_type, ip, user_agent, method, created_at
+	FROM audit_events
+	WHERE subject_id = $1::uuid AND event_type IN ('login.succeeded', 'login.failed') AND created_at >= $2
+	ORDER BY created_at DESC, id DESC
+	LIMIT $3 OFFSET $4`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, m.rebind(query), publicID, since.UTC(), filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	entries := []*LoginHistoryEntry{}
+	for rows.Next() {
+		var e AuditEvent
+		err := rows.Scan(&totalRecords, &e.Type, &e.IP, &e.UserAgent, &e.Method, &e.CreatedAt)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		entries = append(entries, newLoginHistoryEntry(&e))
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	return entries, calculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
+
+func (mockUM *UserModelMock) ListLoginHistory(publicID string, since time.Time, filters Filters) ([]*LoginHistoryEntry, Metadata, error) {
+	entries := []*LoginHistoryEntry{}
+	// newest first, like the query
+	for i := len(mockUM.AuditEvents) - 1; i >= 0; i-- {
+		e := mockUM.AuditEvents[i]
+		if publicID != "" && e.SubjectID == publicID && isLoginEvent(e) && !e.CreatedAt.Before(since) {
+			entries = append(entries, newLoginHistoryEntry(e))
+		}
+	}
+
+	metadata := calculateMetadata(len(entries), filters.Page, filters.PageSize)
+	start, end := filters.offset(), filters.offset()+filters.limit()
+	if start > len(entries) {
+		start = len(entries)
+	}
+	if end > len(entries) {
+		end = len(entries)
+	}
+	return entries[start:end], metadata, nil
+}
+
+func isLoginEvent(e *AuditEvent) bool {
+	return e.Type == AuditLoginSucceeded || e.Type == AuditLoginFailed
+}
@@ -0,0 +1,37 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUserModelMock_LoginHistory(t *testing.T) {
+	userModel := UserModelMock{DB: []*User{}}
+	alice := "0190a6e2-5c3b-7c1e-9f3a-000000000001"
+	now := time.Now()
+	firefox := "Mozilla/5.0 (X11; Linux x86_64; rv:121.0) Gecko/20100101 Firefox/121.0"
+	for _, event := range []*AuditEvent{
+		{Type: AuditLoginSucceeded, SubjectID: alice, Method: LoginMethodPassword, CreatedAt: now.Add(-100 * 24 * time.Hour)},
+		{Type: AuditLoginFailed, SubjectID: alice, Method: LoginMethodPassword, IP: "192.0.2.1", UserAgent: firefox, CreatedAt: now.Add(-2 * time.Hour)},
+		{Type: AuditPasswordReset, SubjectID: alice, CreatedAt: now.Add(-90 * time.Minute)},
+		{Type: AuditLoginSucceeded, SubjectID: "0190a6e2-5c3b-7c1e-9f3a-000000000002", CreatedAt: now.Add(-time.Hour)},
+		{Type: AuditLoginSucceeded, SubjectID: alice, Method: LoginMethodPassword, IP: "192.0.2.2", CreatedAt: now.Add(-time.Minute)},
+	} {
+		_ = userModel.RecordAuditEvent(event)
+	}
+
+	since := now.Add(-DefaultLoginHistoryWindow)
+	history, metadata, err := userModel.ListLoginHistory(alice, since, Filters{Page: 1, PageSize: 20})
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	if metadata.TotalRecords != 2 || len(history) != 2 {
+		t.Fatalf("Expected alice's two sign ins within the window, got %+v", history)
+	}
+	if !history[0].Succeeded || history[0].IP != "192.0.2.2" {
+		t.Errorf("Expected the newest successful sign in first, got %+v", history[0])
+	}
+	if history[1].Succeeded || history[1].Browser != "Firefox" || history[1].OS != "Linux" || history[1].Method != LoginMethodPassword {
+		t.Errorf("Expected a failed Firefox on Linux password sign in, got %+v", history[1])
+	}
+}
@@ -0,0 +1,908 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// MemoryUserModel is an IUserModel kept in process memory, so the service can run without Postgres. It behaves
+// like UserModelMock, whose tables it keeps, but is safe for concurrent use: every method takes the lock, callers
+// get copies rather than the stored rows, users are indexed by id, public id, canonical email and username and ids are
+// handed out like a serial column. With a snapshot path the store survives restarts, see LoadSnapshot. A cipher
+// encrypts the emails and data exports in the snapshot, the store itself is only ever in memory, and like UserModel
+// it keeps only the blind index of the addresses in audit events.
+type MemoryUserModel struct {
+	mu         sync.RWMutex
+	tables     *UserModelMock
+	byID       map[int64]*User
+	byPublicID map[string]*User
+	byEmail    map[string]*User
+	byUsername map[string]*User
+	nextID     int64
+	// changes counts writes so SaveSnapshot can skip a store that hasn't changed
+	changes uint64
+
+	saveMu       sync.Mutex
+	saved        uint64
+	snapshotPath string
+	cipher       *FieldCipher
+}
+
+func NewMemoryUserModel(lockout LockoutPolicy, passwordHistory int, hasher PasswordHasher, cipher *FieldCipher) *MemoryUserModel {
+	m := &MemoryUserModel{
+		tables: &UserModelMock{DB: []*User{}, Lockout: lockout, PasswordHistory: passwordHistory, Hasher: hasher},
+		nextID: 1,
+		cipher: cipher,
+	}
+	// the mock adds the default organization on first use, which would be a write under the read lock
+	m.tables.defaultOrg()
+	m.reindex()
+	return m
+}
+
+func (m *MemoryUserModel) reindex() {
+	m.byID = make(map[int64]*User, len(m.tables.DB))
+	m.byPublicID = make(map[string]*User, len(m.tables.DB))
+	m.byEmail = make(map[string]*User, len(m.tables.DB))
+	m.byUsername = make(map[string]*User)
+	for _, user := range m.tables.DB {
+		m.index(user)
+	}
+}
+
+func (m *MemoryUserModel) index(user *User) {
+	m.byID[user.ID] = user
+	m.byPublicID[user.PublicID] = user
+	m.byEmail[CanonicalEmail(user.Email)] = user
+	if user.Username != "" {
+		m.byUsername[usernameKey(user.Username)] = user
+	}
+	if user.ID >= m.nextID {
+		m.nextID = user.ID + 1
+	}
+}
+
+// write runs fn against the tables under the write lock
+func (m *MemoryUserModel) write(fn func(tables *UserModelMock) error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.changes++
+	return fn(m.tables)
+}
+
+func (m *MemoryUserModel) getUser(user *User, ok bool) (*User, error) {
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+	return user.clone(), nil
+}
+
+func (m *MemoryUserModel) Insert(user *User) error {
+	// hashing is the slow part, so it happens before the lock is taken
+	hashedPassword, err := hasherOrDefault(m.tables.Hasher).Hash(user.Password)
+	if err != nil {
+		return err
+	}
+	stored := user.clone()
+	stored.Password = hashedPassword
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.byEmail[CanonicalEmail(stored.Email)]; ok {
+		return ErrDuplicateEmail
+	}
+	if _, ok := m.byUsername[usernameKey(stored.Username)]; ok && stored.Username != "" {
+		return ErrDuplicateUsername
+	}
+	if _, ok := m.byPublicID[stored.PublicID]; ok && stored.PublicID != "" {
+		return ErrUserExists
+	}
+	stored.ID = m.nextID
+	err = m.tables.insertHashed(stored)
+	if err != nil {
+		return err
+	}
+	m.changes++
+	m.index(stored)
+	*user = *stored.clone()
+	return nil
+}
+
+func (m *MemoryUserModel) GetByEmail(email string) (*User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	user, ok := m.byEmail[CanonicalEmail(email)]
+	return m.getUser(user, ok && user.DeletedAt == nil)
+}
+
+func (m *MemoryUserModel) GetDeletedByEmail(email string) (*User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	user, ok := m.byEmail[CanonicalEmail(email)]
+	return m.getUser(user, ok && user.DeletedAt != nil)
+}
+
+func (m *MemoryUserModel) GetByID(id int) (*User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	user, ok := m.byID[int64(id)]
+	return m.getUser(user, ok)
+}
+
+func (m *MemoryUserModel) GetByUsername(username string) (*User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	user, ok := m.byUsername[usernameKey(username)]
+	return m.getUser(user, ok && user.DeletedAt == nil)
+}
+
+// byLogin finds the account Authenticate was given, by email or by username
+func (m *MemoryUserModel) byLogin(login string) (*User, bool) {
+	if IsEmailLogin(login) {
+		user, ok := m.byEmail[CanonicalEmail(login)]
+		return user, ok
+	}
+	user, ok := m.byUsername[usernameKey(login)]
+	return user, ok
+}
+
+func (m *MemoryUserModel) GetByPublicID(publicID string) (*User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	user, ok := m.byPublicID[publicID]
+	return m.getUser(user, ok && publicID != "")
+}
+
+func (m *MemoryUserModel) UpdatePassword(userID int, password string, version int) error {
+	return m.write(func(tables *UserModelMock) error { return tables.UpdatePassword(userID, password, version) })
+}
+
+func (m *MemoryUserModel) ResetPassword(userID int, password string, version int) error {
+	return m.write(func(tables *UserModelMock) error { return tables.ResetPassword(userID, password, version) })
+}
+
+func (m *MemoryUserModel) DeleteUser(userEmail string) error {
+	return m.write(func(tables *UserModelMock) error {
+		err := tables.DeleteUser(userEmail)
+		if err == nil {
+			m.reindex()
+		}
+		return err
+	})
+}
+
+// Authenticate compares the password without holding the lock, so slow hashes don't queue every other request
+// behind them. Lockout and the rehash are applied afterwards, and only if the password wasn't changed meanwhile.
+func (m *MemoryUserModel) Authenticate(login, password string) (*User, error) {
+	m.mu.RLock()
+	user, ok := m.byLogin(login)
+	if !ok || user.DeletedAt != nil {
+		m.mu.RUnlock()
+		return nil, fmt.Errorf("authenticate: %w", ErrRecordNotFound)
+	}
+	err := m.tables.Lockout.check(user, time.Now())
+	passwordHash := user.Password
+	m.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	hasher := hasherOrDefault(m.tables.Hasher)
+	needsRehash, verifyErr := hasher.Verify(password, passwordHash)
+	rehashed := ""
+	if verifyErr == nil && needsRehash {
+		if hash, err := hasher.Hash(password); err == nil {
+			rehashed = hash
+		}
+	}
+
+	m.mu.Lock()
+	user, ok = m.byLogin(login)
+	if ok && user.DeletedAt == nil && user.Password != passwordHash {
+		m.mu.Unlock()
+		return m.Authenticate(login, password)
+	}
+	defer m.mu.Unlock()
+	if !ok || user.DeletedAt != nil {
+		return nil, fmt.Errorf("authenticate: %w", ErrRecordNotFound)
+	}
+	m.changes++
+	if verifyErr != nil {
+		lockErr := m.tables.Lockout.recordFailure(user, time.Now())
+		if lockErr != nil {
+			return nil, lockErr
+		}
+		return nil, fmt.Errorf("compare() error: %w", verifyErr)
+	}
+	if rehashed != "" {
+		user.Password = rehashed
+	}
+	if user.FailedLogins > 0 {
+		user.FailedLogins, user.LastFailedLogin = 0, nil
+	}
+	return user.clone(), nil
+}
+
+func (m *MemoryUserModel) EnterPasswordHash(email, passwordHash, salt string, version int) error {
+	return m.write(func(tables *UserModelMock) error { return tables.EnterPasswordHash(email, passwordHash, salt, version) })
+}
+
+func (m *MemoryUserModel) ConsumePasswordReset(email string, version int) error {
+	return m.write(func(tables *UserModelMock) error { return tables.ConsumePasswordReset(email, version) })
+}
+
+func (m *MemoryUserModel) UpdateProfile(user *User) error {
+	return m.write(func(tables *UserModelMock) error {
+		stored, ok := m.byID[user.ID]
+		if !ok {
+			return ErrRecordNotFound
+		}
+		previous := usernameKey(stored.Username)
+		err := tables.UpdateProfile(user)
+		if err != nil {
+			return err
+		}
+		delete(m.byUsername, previous)
+		if stored.Username != "" {
+			m.byUsername[usernameKey(stored.Username)] = stored
+		}
+		return nil
+	})
+}
+
+func (m *MemoryUserModel) RequestEmailChange(userID int, newEmail, tokenHash, salt, cancelTokenHash, cancelSalt string) error {
+	return m.write(func(tables *UserModelMock) error {
+		return tables.RequestEmailChange(userID, newEmail, tokenHash, salt, cancelTokenHash, cancelSalt)
+	})
+}
+
+func (m *MemoryUserModel) ConfirmEmailChange(userID int) error {
+	return m.write(func(tables *UserModelMock) error {
+		user, ok := m.byID[int64(userID)]
+		if !ok {
+			return errors.New("no pending email change")
+		}
+		previous := CanonicalEmail(user.Email)
+		err := tables.ConfirmEmailChange(userID)
+		if err != nil {
+			return err
+		}
+		delete(m.byEmail, previous)
+		m.byEmail[CanonicalEmail(user.Email)] = user
+		return nil
+	})
+}
+
+func (m *MemoryUserModel) CancelEmailChange(userID int) error {
+	return m.write(func(tables *UserModelMock) error { return tables.CancelEmailChange(userID) })
+}
+
+func (m *MemoryUserModel) SetPhone(userID int, phone string) error {
+	return m.write(func(tables *UserModelMock) error { return tables.SetPhone(userID, phone) })
+}
+
+func (m *MemoryUserModel) VerifyPhone(userID int, phone string) error {
+	return m.write(func(tables *UserModelMock) error { return tables.VerifyPhone(userID, phone) })
+}
+
+func (m *MemoryUserModel) CreateSMSCode(code *SMSCode) error {
+	stored := *code
+	return m.write(func(tables *UserModelMock) error {
+		err := tables.CreateSMSCode(&stored)
+		if err == nil {
+			*code = stored
+		}
+		return err
+	})
+}
+
+func (m *MemoryUserModel) GetSMSCode(userID int, purpose string) (*SMSCode, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	code, err := m.tables.GetSMSCode(userID, purpose)
+	if err != nil {
+		return nil, err
+	}
+	copied := *code
+	return &copied, nil
+}
+
+func (m *MemoryUserModel) RecordSMSCodeAttempt(codeID int) error {
+	return m.write(func(tables *UserModelMock) error { return tables.RecordSMSCodeAttempt(codeID) })
+}
+
+func (m *MemoryUserModel) DeleteSMSCode(codeID int) error {
+	return m.write(func(tables *UserModelMock) error { return tables.DeleteSMSCode(codeID) })
+}
+
+func (m *MemoryUserModel) SoftDeleteUser(userID int, tokenHash, salt string, restoreExpiry time.Time) error {
+	return m.write(func(tables *UserModelMock) error {
+		return tables.SoftDeleteUser(userID, tokenHash, salt, restoreExpiry)
+	})
+}
+
+func (m *MemoryUserModel) RestoreUser(userID int) error {
+	return m.write(func(tables *UserModelMock) error { return tables.RestoreUser(userID) })
+}
+
+func (m *MemoryUserModel) PurgeDeletedUsers(now time.Time) (int64, error) {
+	var purged int64
+	err := m.write(func(tables *UserModelMock) error {
+		var err error
+		purged, err = tables.PurgeDeletedUsers(now)
+		if purged > 0 {
+			m.reindex()
+		}
+		return err
+	})
+	return purged, err
+}
+
+func (m *MemoryUserModel) ListUsers(filters UserFilters) ([]*User, Metadata, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	users, metadata, err := m.tables.ListUsers(filters)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	copied := make([]*User, len(users))
+	for i, user := range users {
+		copied[i] = user.clone()
+	}
+	return copied, metadata, nil
+}
+
+func (m *MemoryUserModel) SearchUsers(filters SearchFilters) ([]*UserSearchResult, Metadata, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	results, metadata, err := m.tables.SearchUsers(filters)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	copied := make([]*UserSearchResult, len(results))
+	for i, result := range results {
+		copied[i] = &UserSearchResult{User: result.User.clone(), Rank: result.Rank, Highlights: result.Highlights}
+	}
+	return copied, metadata, nil
+}
+
+func (m *MemoryUserModel) AssignRole(userID int, role string) error {
+	return m.write(func(tables *UserModelMock) error { return tables.AssignRole(userID, role) })
+}
+
+func (m *MemoryUserModel) RevokeRole(userID int, role string) error {
+	return m.write(func(tables *UserModelMock) error { return tables.RevokeRole(userID, role) })
+}
+
+func (m *MemoryUserModel) UnlockUser(userID int) error {
+	return m.write(func(tables *UserModelMock) error { return tables.UnlockUser(userID) })
+}
+
+func (m *MemoryUserModel) CreateOrganization(org *Organization, ownerID int) error {
+	stored := *org
+	return m.write(func(tables *UserModelMock) error {
+		err := tables.CreateOrganization(&stored, ownerID)
+		if err == nil {
+			*org = stored
+		}
+		return err
+	})
+}
+
+func (m *MemoryUserModel) GetOrganization(slug string) (*Organization, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	org, err := m.tables.GetOrganization(slug)
+	if err != nil {
+		return nil, err
+	}
+	copied := *org
+	return &copied, nil
+}
+
+// the membership methods below already return copies, see UserModelMock.withUser
+
+func (m *MemoryUserModel) GetMembership(slug string, userID int) (*Membership, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.tables.GetMembership(slug, userID)
+}
+
+func (m *MemoryUserModel) ListMembers(orgID int) ([]*Membership, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.tables.ListMembers(orgID)
+}
+
+func (m *MemoryUserModel) ListMemberships(userID int) ([]*Membership, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.tables.ListMemberships(userID)
+}
+
+func (m *MemoryUserModel) RemoveMember(orgID, userID int) error {
+	return m.write(func(tables *UserModelMock) error { return tables.RemoveMember(orgID, userID) })
+}
+
+func (m *MemoryUserModel) CreateInvitation(inv *Invitation) error {
+	stored := *inv
+	return m.write(func(tables *UserModelMock) error {
+		err := tables.CreateInvitation(&stored)
+		if err == nil {
+			*inv = stored
+		}
+		return err
+	})
+}
+
+func (m *MemoryUserModel) GetInvitation(publicID string) (*Invitation, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	inv, err := m.tables.GetInvitation(publicID)
+	if err != nil {
+		return nil, err
+	}
+	copied := *inv
+	return &copied, nil
+}
+
+func (m *MemoryUserModel) ListPendingInvitations(orgID int) ([]*Invitation, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	invitations, err := m.tables.ListPendingInvitations(orgID)
+	if err != nil {
+		return nil, err
+	}
+	for i, inv := range invitations {
+		copied := *inv
+		invitations[i] = &copied
+	}
+	return invitations, nil
+}
+
+func (m *MemoryUserModel) RevokeInvitation(orgID int, publicID string) error {
+	return m.write(func(tables *UserModelMock) error { return tables.RevokeInvitation(orgID, publicID) })
+}
+
+func (m *MemoryUserModel) AcceptInvitation(invitationID, userID int) error {
+	return m.write(func(tables *UserModelMock) error { return tables.AcceptInvitation(invitationID, userID) })
+}
+
+func (m *MemoryUserModel) UpdateAppMetadata(user *User, patch json.RawMessage) error {
+	return m.write(func(tables *UserModelMock) error { return tables.UpdateAppMetadata(user, patch) })
+}
+
+func (m *MemoryUserModel) UpdateUserMetadata(user *User, patch json.RawMessage) error {
+	return m.write(func(tables *UserModelMock) error { return tables.UpdateUserMetadata(user, patch) })
+}
+
+func (m *MemoryUserModel) RecordAuditEvent(event *AuditEvent) error {
+	stored := *event
+	if m.cipher != nil && stored.Email != "" {
+		stored.Email = m.cipher.EmailIndex(stored.Email)
+	}
+	return m.write(func(tables *UserModelMock) error {
+		err := tables.RecordAuditEvent(&stored)
+		if err == nil {
+			event.ID, event.UserAgent = stored.ID, stored.UserAgent
+		}
+		return err
+	})
+}
+
+func (m *MemoryUserModel) ListAuditEvents(filters AuditFilters) ([]*AuditEvent, Metadata, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	events, metadata, err := m.tables.ListAuditEvents(filters)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	copied := make([]*AuditEvent, len(events))
+	for i, event := range events {
+		e := *event
+		copied[i] = &e
+	}
+	return copied, metadata, nil
+}
+
+func (m *MemoryUserModel) ListLoginHistory(publicID string, since time.Time, filters Filters) ([]*LoginHistoryEntry, Metadata, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.tables.ListLoginHistory(publicID, since, filters)
+}
+
+func (m *MemoryUserModel) ImportUsers(users []*User, dryRun bool) ([]error, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored := make([]*User, len(users))
+	for i, user := range users {
+		stored[i] = user.clone()
+		stored[i].ID = m.nextID + int64(i)
+	}
+	errs, err := m.tables.ImportUsers(stored, dryRun)
+	if err != nil {
+		return nil, err
+	}
+	for i, user := range stored {
+		if errs[i] != nil {
+			continue
+		}
+		if !dryRun {
+			m.index(user)
+		}
+		*users[i] = *user.clone()
+	}
+	if !dryRun {
+		m.changes++
+	}
+	return errs, nil
+}
+
+// ExportUsers copies the users first and calls fn without the lock, so a slow reader doesn't hold up writes
+func (m *MemoryUserModel) ExportUsers(fn func(user *User) error) error {
+	var users []*User
+	m.mu.RLock()
+	err := m.tables.ExportUsers(func(user *User) error {
+		users = append(users, user.clone())
+		return nil
+	})
+	m.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	for _, user := range users {
+		err = fn(user)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MemoryUserModel) CreateDataExport(export *DataExport) error {
+	stored := *export
+	return m.write(func(tables *UserModelMock) error {
+		err := tables.CreateDataExport(&stored)
+		if err == nil {
+			*export = stored
+		}
+		return err
+	})
+}
+
+func (m *MemoryUserModel) GetDataExport(publicID string) (*DataExport, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	export, err := m.tables.GetDataExport(publicID)
+	if err != nil {
+		return nil, err
+	}
+	copied := *export
+	return &copied, nil
+}
+
+func (m *MemoryUserModel) PurgeDataExports(now time.Time) (int64, error) {
+	var purged int64
+	err := m.write(func(tables *UserModelMock) error {
+		var err error
+		purged, err = tables.PurgeDataExports(now)
+		return err
+	})
+	return purged, err
+}
+
+// clone copies user deeply enough that changing the copy can't reach the stored user
+func (u *User) clone() *User {
+	copied := *u
+	copied.DeletedAt = cloneTime(u.DeletedAt)
+	copied.LockedUntil = cloneTime(u.LockedUntil)
+	copied.LastFailedLogin = cloneTime(u.LastFailedLogin)
+	copied.PasswordHistory = cloneStrings(u.PasswordHistory)
+	copied.Roles = cloneStrings(u.Roles)
+	copied.Permissions = cloneStrings(u.Permissions)
+	copied.AppMetadata = cloneRaw(u.AppMetadata)
+	copied.UserMetadata = cloneRaw(u.UserMetadata)
+	return &copied
+}
+
+func cloneTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	copied := *t
+	return &copied
+}
+
+func cloneStrings(s []string) []string {
+	if s == nil {
+		return nil
+	}
+	return append([]string{}, s...)
+}
+
+func cloneRaw(raw json.RawMessage) json.RawMessage {
+	if raw == nil {
+		return nil
+	}
+	return append(json.RawMessage{}, raw...)
+}
+
+// memorySnapshot is the file a MemoryUserModel is saved to. The snapshot types are the models without their json
+// tags, so hidden fields such as password hashes are kept, and converting to them stops compiling as soon as a
+// model gains a field they don't have.
+type memorySnapshot struct {
+	NextUserID    int64
+	Users         []*snapshotUser
+	Organizations []*snapshotOrganization
+	Memberships   []*snapshotMembership
+	Invitations   []*snapshotInvitation
+	AuditEvents   []*AuditEvent
+	DataExports   []*DataExport
+	SMSCodes      []*SMSCode
+}
+
+type snapshotUser struct {
+	ID                         int64
+	PublicID                   string
+	Password                   string
+	Email                      string
+	CreatedAt                  time.Time
+	UpdatedAt                  time.Time
+	DisplayName                string
+	GivenName                  string
+	FamilyName                 string
+	Locale                     string
+	TimeZone                   string
+	Username                   string
+	Phone                      string
+	PhoneVerified              bool
+	PasswordResetHashToken     string
+	PasswordResetExpiry        time.Time
+	PasswordResetSalt          string
+	PendingEmail               string
+	EmailChangeHashToken       string
+	EmailChangeExpiry          time.Time
+	EmailChangeSalt            string
+	EmailChangeCancelHashToken string
+	EmailChangeCancelSalt      string
+	DeletedAt                  *time.Time
+	RestoreHashToken           string
+	RestoreExpiry              time.Time
+	RestoreSalt                string
+	Verified                   bool
+	LockedUntil                *time.Time
+	FailedLogins               int
+	LastFailedLogin            *time.Time
+	PasswordHistory            []string
+	Roles                      []string
+	Permissions                []string
+	AppMetadata                json.RawMessage
+	UserMetadata               json.RawMessage
+	Version                    int
+}
+
+type snapshotOrganization struct {
+	ID        int64
+	Slug      string
+	Name      string
+	CreatedAt time.Time
+}
+
+type snapshotMembership struct {
+	OrgID        int64
+	OrgSlug      string
+	UserID       int64
+	UserPublicID string
+	Email        string
+	Role         string
+	CreatedAt    time.Time
+}
+
+type snapshotInvitation struct {
+	ID         int64
+	PublicID   string
+	OrgID      int64
+	OrgSlug    string
+	Email      string
+	Role       string
+	InvitedBy  int64
+	TokenHash  string
+	TokenSalt  string
+	CreatedAt  time.Time
+	ExpiresAt  time.Time
+	AcceptedAt *time.Time
+	RevokedAt  *time.Time
+}
+
+// LoadSnapshot replaces the store with the snapshot at path and saves there from then on. A missing file is not an
+// error, the store starts empty and the first save creates it.
+func (m *MemoryUserModel) LoadSnapshot(path string) error {
+	m.saveMu.Lock()
+	defer m.saveMu.Unlock()
+	m.snapshotPath = path
+
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var snapshot memorySnapshot
+	err = json.Unmarshal(content, &snapshot)
+	if err != nil {
+		return fmt.Errorf("snapshot %s: %w", path, err)
+	}
+
+	tables := &UserModelMock{
+		DB:              make([]*User, len(snapshot.Users)),
+		Lockout:         m.tables.Lockout,
+		PasswordHistory: m.tables.PasswordHistory,
+		Hasher:          m.tables.Hasher,
+		Orgs:            make([]*Organization, len(snapshot.Organizations)),
+		Memberships:     make([]*Membership, len(snapshot.Memberships)),
+		Invitations:     make([]*Invitation, len(snapshot.Invitations)),
+		AuditEvents:     snapshot.AuditEvents,
+		DataExports:     snapshot.DataExports,
+		SMSCodes:        snapshot.SMSCodes,
+	}
+	for i, user := range snapshot.Users {
+		tables.DB[i] = (*User)(user)
+		err = m.cipher.decryptUser(tables.DB[i])
+		if err != nil {
+			return fmt.Errorf("snapshot %s: %w", path, err)
+		}
+	}
+	for i, org := range snapshot.Organizations {
+		tables.Orgs[i] = (*Organization)(org)
+	}
+	for i, membership := range snapshot.Memberships {
+		tables.Memberships[i] = (*Membership)(membership)
+		tables.Memberships[i].Email, err = m.cipher.Decrypt(membership.Email, membership.UserPublicID)
+		if err != nil {
+			return fmt.Errorf("snapshot %s: %w", path, err)
+		}
+	}
+	for i, inv := range snapshot.Invitations {
+		tables.Invitations[i] = (*Invitation)(inv)
+		tables.Invitations[i].Email, err = m.cipher.Decrypt(inv.Email, inv.PublicID)
+		if err != nil {
+			return fmt.Errorf("snapshot %s: %w", path, err)
+		}
+	}
+	for _, export := range tables.DataExports {
+		content, err := m.cipher.Decrypt(string(export.Content), export.PublicID)
+		if err != nil {
+			return fmt.Errorf("snapshot %s: %w", path, err)
+		}
+		export.Content = []byte(content)
+	}
+	tables.defaultOrg()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tables = tables
+	m.nextID = snapshot.NextUserID
+	m.reindex()
+	m.saved = m.changes
+	return nil
+}
+
+// SaveSnapshot writes the store to the path given to LoadSnapshot, unless nothing changed since the last save. The
+// file is replaced with a rename so a crash part way through leaves the previous snapshot whole.
+func (m *MemoryUserModel) SaveSnapshot() error {
+	m.saveMu.Lock()
+	defer m.saveMu.Unlock()
+	if m.snapshotPath == "" {
+		return nil
+	}
+
+	m.mu.RLock()
+	changes := m.changes
+	if changes == m.saved {
+		m.mu.RUnlock()
+		return nil
+	}
+	snapshot := memorySnapshot{
+		NextUserID:    m.nextID,
+		Users:         make([]*snapshotUser, len(m.tables.DB)),
+		Organizations: make([]*snapshotOrganization, len(m.tables.Orgs)),
+		Memberships:   make([]*snapshotMembership, len(m.tables.Memberships)),
+		Invitations:   make([]*snapshotInvitation, len(m.tables.Invitations)),
+		AuditEvents:   m.tables.AuditEvents,
+		DataExports:   make([]*DataExport, len(m.tables.DataExports)),
+		SMSCodes:      m.tables.SMSCodes,
+	}
+	var err error
+	for i, user := range m.tables.DB {
+		// copies, the stored users keep their plaintext
+		stored := snapshotUser(*user)
+		stored.Email, err = m.cipher.Encrypt(user.Email, user.PublicID)
+		if err == nil {
+			stored.PendingEmail, err = m.cipher.Encrypt(user.PendingEmail, user.PublicID)
+		}
+		if err != nil {
+			m.mu.RUnlock()
+			return err
+		}
+		snapshot.Users[i] = &stored
+	}
+	for i, org := range m.tables.Orgs {
+		snapshot.Organizations[i] = (*snapshotOrganization)(org)
+	}
+	for i, membership := range m.tables.Memberships {
+		stored := snapshotMembership(*membership)
+		stored.Email, err = m.cipher.Encrypt(membership.Email, membership.UserPublicID)
+		if err != nil {
+			m.mu.RUnlock()
+			return err
+		}
+		snapshot.Memberships[i] = &stored
+	}
+	for i, inv := range m.tables.Invitations {
+		stored := snapshotInvitation(*inv)
+		stored.Email, err = m.cipher.Encrypt(inv.Email, inv.PublicID)
+		if err != nil {
+			m.mu.RUnlock()
+			return err
+		}
+		snapshot.Invitations[i] = &stored
+	}
+	for i, export := range m.tables.DataExports {
+		stored := *export
+		content, err := m.cipher.Encrypt(string(export.Content), export.PublicID)
+		if err != nil {
+			m.mu.RUnlock()
+			return err
+		}
+		stored.Content = []byte(content)
+		snapshot.DataExports[i] = &stored
+	}
+	content, err := json.Marshal(snapshot)
+	m.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	// the temporary file is created 0600, the snapshot holds password hashes
+	file, err := os.CreateTemp(filepath.Dir(m.snapshotPath), filepath.Base(m.snapshotPath)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	_, err = file.Write(content)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Rename(file.Name(), m.snapshotPath)
+	if err != nil {
+		return err
+	}
+	m.saved = changes
+	return nil
+}
+
+// ReencryptUsers marks the store as changed, the next SaveSnapshot seals every email with the active master key.
+// It returns how many users that covers.
+func (m *MemoryUserModel) ReencryptUsers(batchSize int) (int64, error) {
+	if m.cipher == nil {
+		return 0, ErrEncryptionDisabled
+	}
+	var users int64
+	err := m.write(func(tables *UserModelMock) error {
+		users = int64(len(tables.DB))
+		return nil
+	})
+	return users, err
+}
@@ -0,0 +1,326 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMemoryUserModel_Insert(t *testing.T) {
+	m := NewMemoryUserModel(LockoutPolicy{}, 0, Hasher{Current: testBcrypt}, nil)
+	alice := &User{ID: 42, Email: "alice@example.com", Password: "securepassword", CreatedAt: time.Now()}
+	bob := &User{Email: "bob@example.com", Password: "securepassword", CreatedAt: time.Now()}
+	for _, user := range []*User{alice, bob} {
+		err := m.Insert(user)
+		if err != nil {
+			t.Fatalf("Unexpected error inserting user: %s", err)
+		}
+	}
+	// ids come from the store like a serial column, whatever the caller passed in
+	if alice.ID != 1 || bob.ID != 2 || alice.PublicID == "" || alice.Password == "securepassword" {
+		t.Errorf("Expected ids 1 and 2 and a hashed password, got %+v and %+v", alice, bob)
+	}
+	if err := m.Insert(&User{Email: "Alice@Example.com", Password: "securepassword"}); !errors.Is(err, ErrDuplicateEmail) {
+		t.Errorf("Expected ErrDuplicateEmail, got %v", err)
+	}
+	if err := m.Insert(&User{PublicID: bob.PublicID, Email: "carol@example.com", Password: "securepassword"}); !errors.Is(err, ErrUserExists) {
+		t.Errorf("Expected a taken public id to be refused, got %v", err)
+	}
+
+	// neither the caller's user nor one that was read can change the stored user
+	alice.DisplayName = "Mallory"
+	got, err := m.GetByPublicID(alice.PublicID)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	got.Roles = append(got.Roles, RoleAdmin)
+	got.AppMetadata[0] = '['
+	again, _ := m.GetByID(1)
+	if again.DisplayName != "" || len(again.Roles) != 0 || string(again.AppMetadata) != "{}" {
+		t.Errorf("Expected the stored user to be untouched, got %+v", again)
+	}
+	if _, err := m.GetMembership(DefaultOrgSlug, int(bob.ID)); err != nil {
+		t.Errorf("Expected new users to join the default organization, got %s", err)
+	}
+}
+
+func TestMemoryUserModel_Concurrent(t *testing.T) {
+	m := NewMemoryUserModel(LockoutPolicy{}, 0, Hasher{Current: testBcrypt}, nil)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			email := fmt.Sprintf("user%d@example.com", i)
+			err := m.Insert(&User{Email: email, Password: "securepassword", CreatedAt: time.Now()})
+			if err != nil {
+				t.Errorf("Unexpected error inserting %s: %s", email, err)
+				return
+			}
+			user, err := m.Authenticate(email, "securepassword")
+			if err != nil {
+				t.Errorf("Unexpected error signing in %s: %s", email, err)
+				return
+			}
+			user.DisplayName = email
+			err = m.UpdateProfile(user)
+			if err != nil {
+				t.Errorf("Unexpected error updating %s: %s", email, err)
+			}
+			_, _, _ = m.ListUsers(UserFilters{Filters: Filters{Page: 1, PageSize: 100, Sort: "id", SortSafelist: UserSortSafelist}})
+		}(i)
+	}
+	wg.Wait()
+
+	users, metadata, err := m.ListUsers(UserFilters{Filters: Filters{Page: 1, PageSize: 100, Sort: "id", SortSafelist: UserSortSafelist}})
+	if err != nil || metadata.TotalRecords != 20 {
+		t.Fatalf("Expected 20 users, got %d, %v", metadata.TotalRecords, err)
+	}
+	for i, user := range users {
+		if user.ID != int64(i+1) || user.DisplayName != user.Email {
+			t.Errorf("Expected ids 1 to 20 and every profile update kept, got %d with %q", user.ID, user.DisplayName)
+		}
+	}
+}
+
+func TestMemoryUserModel_Authenticate(t *testing.T) {
+	m := NewMemoryUserModel(LockoutPolicy{Threshold: 2, LockDuration: time.Hour}, 0, Hasher{Current: BcryptHasher{Cost: 5}}, nil)
+	user := &User{Email: "alice@example.com", Password: "securepassword"}
+	err := m.Insert(user)
+	if err != nil {
+		t.Fatalf("Unexpected error inserting user: %s", err)
+	}
+
+	// a hash with a weaker cost than the current one is upgraded on sign in
+	m.tables.DB[0].Password, _ = testBcrypt.Hash("securepassword")
+	signedIn, err := m.Authenticate("Alice@Example.com", "securepassword")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if needsRehash, err := m.tables.Hasher.Verify("securepassword", signedIn.Password); err != nil || needsRehash {
+		t.Errorf("Expected the hash to be upgraded, got %v, %v", needsRehash, err)
+	}
+
+	if _, err := m.Authenticate("alice@example.com", "wrongpassword"); err == nil || errors.Is(err, ErrTooManyAttempts) {
+		t.Errorf("Expected the first failure to be refused without a lock, got %v", err)
+	}
+	if _, err := m.Authenticate("alice@example.com", "wrongpassword"); !errors.Is(err, ErrTooManyAttempts) {
+		t.Errorf("Expected ErrTooManyAttempts on the second failure, got %v", err)
+	}
+	if _, err := m.Authenticate("alice@example.com", "securepassword"); !errors.Is(err, ErrAccountLocked) {
+		t.Errorf("Expected the account to be locked, got %v", err)
+	}
+}
+
+func TestMemoryUserModel_Indexes(t *testing.T) {
+	m := NewMemoryUserModel(LockoutPolicy{}, 0, Hasher{Current: testBcrypt}, nil)
+	user := &User{Email: "alice@example.com", Password: "securepassword"}
+	err := m.Insert(user)
+	if err != nil {
+		t.Fatalf("Unexpected error inserting user: %s", err)
+	}
+
+	err = m.RequestEmailChange(int(user.ID), "alice@example.org", "hash", "salt", "cancelhash", "cancelsalt")
+	if err == nil {
+		err = m.ConfirmEmailChange(int(user.ID))
+	}
+	if err != nil {
+		t.Fatalf("Unexpected error changing email: %s", err)
+	}
+	if _, err := m.GetByEmail("alice@example.com"); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("Expected the old email to be gone from the index, got %v", err)
+	}
+	if _, err := m.GetByEmail("alice@example.org"); err != nil {
+		t.Errorf("Expected the new email to be indexed, got %s", err)
+	}
+
+	imported := []*User{{Email: "bob@example.com", Password: user.Password}, {Email: "alice@example.org", Password: user.Password}}
+	errs, err := m.ImportUsers(imported, false)
+	if err != nil || errs[0] != nil || !errors.Is(errs[1], ErrUserExists) {
+		t.Fatalf("Expected only bob to be imported, got %v, %v", errs, err)
+	}
+	if bob, err := m.GetByPublicID(imported[0].PublicID); err != nil || bob.ID != 2 {
+		t.Errorf("Expected bob to be indexed with id 2, got %+v, %v", bob, err)
+	}
+
+	err = m.DeleteUser("bob@example.com")
+	if err != nil {
+		t.Fatalf("Unexpected error deleting: %s", err)
+	}
+	if _, err := m.GetByID(2); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("Expected bob to be gone from the index, got %v", err)
+	}
+	carol := &User{Email: "carol@example.com", Password: "securepassword"}
+	if err := m.Insert(carol); err != nil || carol.ID != 3 {
+		t.Errorf("Expected ids not to be reused, got %d, %v", carol.ID, err)
+	}
+}
+
+func TestMemoryUserModel_Snapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	m := NewMemoryUserModel(LockoutPolicy{}, 0, Hasher{Current: testBcrypt}, nil)
+	err := m.LoadSnapshot(path)
+	if err != nil {
+		t.Fatalf("Expected a missing snapshot to start an empty store, got %s", err)
+	}
+
+	alice := &User{Email: "alice@example.com", Password: "securepassword", CreatedAt: time.Now().UTC()}
+	bob := &User{Email: "bob@example.com", Password: "securepassword", CreatedAt: time.Now().UTC()}
+	for _, user := range []*User{alice, bob} {
+		if err := m.Insert(user); err != nil {
+			t.Fatalf("Unexpected error inserting user: %s", err)
+		}
+	}
+	err = m.EnterPasswordHash(alice.Email, "resethash", "resetsalt", alice.Version)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	org := &Organization{Slug: "acme", Name: "Acme", CreatedAt: time.Now().UTC()}
+	if err := m.CreateOrganization(org, int(alice.ID)); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := m.RecordAuditEvent(&AuditEvent{Type: AuditUserCreated, SubjectID: alice.PublicID, CreatedAt: time.Now().UTC()}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := m.DeleteUser(bob.Email); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	err = m.SaveSnapshot()
+	if err != nil {
+		t.Fatalf("Unexpected error saving: %s", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil || info.Mode().Perm() != 0o600 {
+		t.Fatalf("Expected a snapshot only the owner can read, got %v, %v", info, err)
+	}
+	// nothing changed, so nothing is written
+	_ = os.Remove(path)
+	if err := m.SaveSnapshot(); err != nil {
+		t.Fatalf("Unexpected error saving: %s", err)
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected an unchanged store not to be saved again, got %v", err)
+	}
+	_ = m.RecordAuditEvent(&AuditEvent{Type: AuditLoginSucceeded, SubjectID: alice.PublicID, CreatedAt: time.Now().UTC()})
+	if err := m.SaveSnapshot(); err != nil {
+		t.Fatalf("Unexpected error saving: %s", err)
+	}
+
+	loaded := NewMemoryUserModel(LockoutPolicy{}, 0, Hasher{Current: testBcrypt}, nil)
+	err = loaded.LoadSnapshot(path)
+	if err != nil {
+		t.Fatalf("Unexpected error loading: %s", err)
+	}
+	got, err := loaded.GetByEmail(alice.Email)
+	if err != nil {
+		t.Fatalf("Expected alice to be loaded, got %s", err)
+	}
+	stored, _ := m.GetByEmail(alice.Email)
+	if got.Password != stored.Password || got.PasswordResetHashToken != "resethash" || got.Version != stored.Version ||
+		!got.CreatedAt.Equal(stored.CreatedAt) || got.PublicID != alice.PublicID {
+		t.Errorf("Expected hidden fields to survive the snapshot, got %+v", got)
+	}
+	if _, err := loaded.Authenticate(alice.Email, "securepassword"); err != nil {
+		t.Errorf("Expected alice to sign in after loading, got %s", err)
+	}
+	if membership, err := loaded.GetMembership("acme", int(alice.ID)); err != nil || membership.Role != OrgRoleOwner {
+		t.Errorf("Expected alice to still own acme, got %+v, %v", membership, err)
+	}
+	if events, _, _ := loaded.ListAuditEvents(AuditFilters{Filters: Filters{Page: 1, PageSize: 10, Sort: "created_at", SortSafelist: AuditSortSafelist}}); len(events) != 2 {
+		t.Errorf("Expected both audit events, got %d", len(events))
+	}
+	carol := &User{Email: "carol@example.com", Password: "securepassword"}
+	if err := loaded.Insert(carol); err != nil || carol.ID != 3 {
+		t.Errorf("Expected the id sequence to carry on past deleted users, got %d, %v", carol.ID, err)
+	}
+
+	err = os.WriteFile(path, []byte("not json"), 0o600)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := NewMemoryUserModel(LockoutPolicy{}, 0, nil, nil).LoadSnapshot(path); err == nil {
+		t.Errorf("Expected a broken snapshot to be refused")
+	}
+}
+
+func TestMemoryUserModel_EncryptedSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	m := NewMemoryUserModel(LockoutPolicy{}, 0, Hasher{Current: testBcrypt}, testCipher(t, "k1:"+testKey('a')))
+	if err := m.LoadSnapshot(path); err != nil {
+		t.Fatalf("Unexpected error loading: %s", err)
+	}
+	alice := &User{Email: "alice@example.com", Password: "securepassword", CreatedAt: time.Now()}
+	if err := m.Insert(alice); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := m.RequestEmailChange(int(alice.ID), "alice@example.org", "hash", "salt", "cancelhash", "cancelsalt"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	org, err := m.GetOrganization(DefaultOrgSlug)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	inv := &Invitation{OrgID: org.ID, Email: "carol@example.com", Role: OrgRoleMember, CreatedAt: time.Now(), ExpiresAt: time.Now().Add(time.Hour)}
+	if err := m.CreateInvitation(inv); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	export := &DataExport{UserID: alice.ID, Content: []byte(`{"email":"alice@example.com"}`), CreatedAt: time.Now(),
+		ExpiresAt: time.Now().Add(time.Hour)}
+	if err := m.CreateDataExport(export); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := m.RecordAuditEvent(&AuditEvent{Type: AuditLoginFailed, Email: "dave@example.com", CreatedAt: time.Now()}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := m.SaveSnapshot(); err != nil {
+		t.Fatalf("Unexpected error saving: %s", err)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if strings.Contains(string(content), "@example") || !strings.Contains(string(content), "enc:v1:k1:") {
+		t.Fatalf("Expected the emails to be encrypted in the snapshot, got %s", content)
+	}
+	if got, _ := m.GetByEmail(alice.Email); got.Email != alice.Email {
+		t.Errorf("Expected the store itself to keep the plaintext, got %q", got.Email)
+	}
+
+	// a rotated key set reads the snapshot and seals it again under k2 once told to
+	rotated := NewMemoryUserModel(LockoutPolicy{}, 0, Hasher{Current: testBcrypt}, testCipher(t, "k2:"+testKey('b')+",k1:"+testKey('a')))
+	if err := rotated.LoadSnapshot(path); err != nil {
+		t.Fatalf("Unexpected error loading: %s", err)
+	}
+	got, err := rotated.GetByEmail(alice.Email)
+	if err != nil || got.PendingEmail != "alice@example.org" {
+		t.Fatalf("Expected alice and her pending email back, got %+v, %v", got, err)
+	}
+	if got, err := rotated.GetInvitation(inv.PublicID); err != nil || got.Email != inv.Email {
+		t.Errorf("Expected the invitation email back, got %+v, %v", got, err)
+	}
+	if got, err := rotated.GetDataExport(export.PublicID); err != nil || string(got.Content) != string(export.Content) {
+		t.Errorf("Expected the export back, got %+v, %v", got, err)
+	}
+	if rewritten, err := rotated.ReencryptUsers(DefaultReencryptBatchSize); err != nil || rewritten != 1 {
+		t.Fatalf("Expected one user to re-encrypt, got %d, %v", rewritten, err)
+	}
+	if err := rotated.SaveSnapshot(); err != nil {
+		t.Fatalf("Unexpected error saving: %s", err)
+	}
+
+	if err := NewMemoryUserModel(LockoutPolicy{}, 0, nil, testCipher(t, "k1:"+testKey('a'))).LoadSnapshot(path); !errors.Is(err, ErrUnknownEncryptionKey) {
+		t.Errorf("Expected the old key alone to be refused after rotating, got %v", err)
+	}
+	if err := NewMemoryUserModel(LockoutPolicy{}, 0, nil, testCipher(t, "k2:"+testKey('b'))).LoadSnapshot(path); err != nil {
+		t.Errorf("Expected k2 alone to load the rotated snapshot, got %v", err)
+	}
+	if _, err := NewMemoryUserModel(LockoutPolicy{}, 0, nil, nil).ReencryptUsers(DefaultReencryptBatchSize); !errors.Is(err, ErrEncryptionDisabled) {
+		t.Errorf("Expected ErrEncryptionDisabled without a cipher, got %v", err)
+	}
+}
@@ -0,0 +1,196 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// MaxMetadataBytes caps each metadata object after a patch is applied, it is for a few flags and not for documents
+const MaxMetadataBytes = 16 * 1024
+
+var (
+	ErrMetadataTooLarge  = fmt.Errorf("metadata must not be larger than %d bytes", MaxMetadataBytes)
+	ErrMetadataNotObject = errors.New("metadata must be a JSON object")
+)
+
+// emptyMetadata is what a user starts with, and what the columns default to
+var emptyMetadata = json.RawMessage(`{}`)
+
+// rawJSON scans a json or jsonb column, which the driver may hand over as text or bytes
+type rawJSON json.RawMessage
+
+func (j *rawJSON) Scan(src any) error {
+	switch v := src.(type) {
+	case nil:
+		*j = rawJSON(emptyMetadata)
+	case string:
+		*j = rawJSON(v)
+	case []byte:
+		*j = append(rawJSON(nil), v...)
+	default:
+		return fmt.Errorf("cannot scan %T into rawJSON", src)
+	}
+	return nil
+}
+
+// MergePatch applies an RFC 7396 JSON merge patch to target: objects are merged key by key, a null removes the key
+// and anything else replaces what was there. The result has to be an object of at most MaxMetadataBytes.
+func MergePatch(target, patch json.RawMessage) (json.RawMessage, error) {
+	var doc, changes any
+	if len(target) == 0 {
+		target = emptyMetadata
+	}
+	err := decodeJSON(target, &doc)
+	if err != nil {
+		return nil, err
+	}
+	err = decodeJSON(patch, &changes)
+	if err != nil {
+		return nil, err
+	}
+
+	merged, ok := applyMergePatch(doc, changes).(map[string]any)
+	if !ok {
+		return nil, ErrMetadataNotObject
+	}
+	out, err := json.Marshal(merged)
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > MaxMetadataBytes {
+		return nil, ErrMetadataTooLarge
+	}
+	return out, nil
+}
+
+// decodeJSON keeps numbers as written so a patch never changes the precision of values it doesn't touch
+func decodeJSON(data []byte, dst any) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return dec.Decode(dst)
+}
+
+func applyMergePatch(target, patch any) any {
+	changes, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	doc, ok := target.(map[string]any)
+	if !ok {
+		doc = map[string]any{}
+	}
+	for key, value := range changes {
+		if value == nil {
+			delete(doc, key)
+			continue
+		}
+		doc[key] = applyMergePatch(doc[key], value)
+	}
+	return doc
+}
+
+// ProjectMetadata picks keys out of a metadata object for the token, keys that aren't set are left out
+func ProjectMetadata(metadata json.RawMessage, keys []string) map[string]json.RawMessage {
+	if len(keys) == 0 || len(metadata) == 0 {
+		return nil
+	}
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(metadata, &fields) != nil {
+		return nil
+	}
+	projected := map[string]json.RawMessage{}
+	for _, key := range keys {
+		if value, ok := fields[key]; ok {
+			projected[key] = value
+		}
+	}
+	if len(projected) == 0 {
+		return nil
+	}
+	return projected
+}
+
+// UpdateAppMetadata merge-patches the metadata only admins can write, user.AppMetadata is updated to the result
+func (m *UserModel) UpdateAppMetadata(user *User, patch json.RawMessage) error {
+	return m.patchMetadata(user, "app_metadata", &user.AppMetadata, patch)
+}
+
+// UpdateUserMetadata merge-patches the metadata users can write themselves
+func (m *UserModel) UpdateUserMetadata(user *User, patch json.RawMessage) error {
+	return m.patchMetadata(user, "user_metadata", &user.UserMetadata, patch)
+}
+
+// patchMetadata locks the row while merging so two patches to the same user can't lose each other's keys.
+// column is always one of the two constants above, never user input.
+func (m *UserModel) patchMetadata(user *User, column string, dst *json.RawMessage, patch json.RawMessage) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var current rawJSON
+	err = tx.QueryRowContext(ctx, m.rebind(`SELECT `+column+` FROM users WHERE id = $1 FOR UPDATE`), user.ID).Scan(&current)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	merged, err := MergePatch(json.RawMessage(current), patch)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	query := `UPDATE users SET ` + column + ` = $2::jsonb, updated_at = $3, version = version + 1
+	WHERE id = $1
+	RETURNING version`
+	err = tx.QueryRowContext(ctx, m.rebind(query), user.ID, string(merged), now).Scan(&user.Version)
+	if err != nil {
+		return err
+	}
+	user.UpdatedAt = now
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	*dst = merged
+	return nil
+}
+
+func (mockUM *UserModelMock) UpdateAppMetadata(user *User, patch json.RawMessage) error {
+	return mockUM.patchMetadata(user, func(u *User) *json.RawMessage { return &u.AppMetadata }, patch)
+}
+
+func (mockUM *UserModelMock) UpdateUserMetadata(user *User, patch json.RawMessage) error {
+	return mockUM.patchMetadata(user, func(u *User) *json.RawMessage { return &u.UserMetadata }, patch)
+}
+
+func (mockUM *UserModelMock) patchMetadata(user *User, field func(*User) *json.RawMessage, patch json.RawMessage) error {
+	stored, err := mockUM.GetByID(int(user.ID))
+	if err != nil {
+		return ErrRecordNotFound
+	}
+	merged, err := MergePatch(*field(stored), patch)
+	if err != nil {
+		return err
+	}
+	*field(stored) = merged
+	*field(user) = merged
+	stored.UpdatedAt = time.Now()
+	stored.Version++
+	user.UpdatedAt, user.Version = stored.UpdatedAt, stored.Version
+	return nil
+}
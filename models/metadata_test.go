@@ -0,0 +1,90 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestMergePatch(t *testing.T) {
+	tests := []struct {
+		name          string
+		target        string
+		patch         string
+		expected      string
+		expectedError error
+	}{
+		{name: "Add key", target: `{}`, patch: `{"plan":"pro"}`, expected: `{"plan":"pro"}`},
+		{name: "Replace key", target: `{"plan":"free","seats":3}`, patch: `{"plan":"pro"}`, expected: `{"plan":"pro","seats":3}`},
+		{name: "Null removes key", target: `{"plan":"free","seats":3}`, patch: `{"seats":null}`, expected: `{"plan":"free"}`},
+		{name: "Nested objects merge", target: `{"ui":{"theme":"dark","lang":"en"}}`, patch: `{"ui":{"lang":"fr"}}`, expected: `{"ui":{"lang":"fr","theme":"dark"}}`},
+		{name: "Arrays are replaced", target: `{"tags":["a","b"]}`, patch: `{"tags":["c"]}`, expected: `{"tags":["c"]}`},
+		{name: "Empty target", target: ``, patch: `{"a":1}`, expected: `{"a":1}`},
+		{name: "Numbers keep their precision", target: `{"big":12345678901234567890}`, patch: `{"a":1}`, expected: `{"a":1,"big":12345678901234567890}`},
+		{name: "Patch that is not an object", target: `{"a":1}`, patch: `["a"]`, expectedError: ErrMetadataNotObject},
+		{name: "Null patch", target: `{"a":1}`, patch: `null`, expectedError: ErrMetadataNotObject},
+		{name: "Too large", target: `{}`, patch: `{"blob":"` + strings.Repeat("x", MaxMetadataBytes) + `"}`, expectedError: ErrMetadataTooLarge},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			merged, err := MergePatch(json.RawMessage(test.target), json.RawMessage(test.patch))
+			if !errors.Is(err, test.expectedError) {
+				t.Fatalf("Expected error %v, got %v", test.expectedError, err)
+			}
+			if test.expectedError == nil && string(merged) != test.expected {
+				t.Errorf("Expected %s, got %s", test.expected, merged)
+			}
+		})
+	}
+}
+
+func TestProjectMetadata(t *testing.T) {
+	metadata := json.RawMessage(`{"plan":"pro","tier":2,"note":"internal"}`)
+
+	projected := ProjectMetadata(metadata, []string{"plan", "tier", "missing"})
+	if len(projected) != 2 || string(projected["plan"]) != `"pro"` || string(projected["tier"]) != `2` {
+		t.Errorf("Expected plan and tier only, got %v", projected)
+	}
+	if projected := ProjectMetadata(metadata, nil); projected != nil {
+		t.Errorf("Expected nothing without keys, got %v", projected)
+	}
+	if projected := ProjectMetadata(metadata, []string{"missing"}); projected != nil {
+		t.Errorf("Expected nothing when no key is set, got %v", projected)
+	}
+}
+
+func TestUserModelMock_UpdateMetadata(t *testing.T) {
+	userModel := UserModelMock{DB: []*User{}}
+	err := userModel.Insert(&User{ID: 1, Email: "test@example.com", Password: "veryinsecurepassword"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+
+	user, _ := userModel.GetByID(1)
+	if string(user.AppMetadata) != `{}` || string(user.UserMetadata) != `{}` {
+		t.Fatalf("Expected new users to start with empty metadata, got %s %s", user.AppMetadata, user.UserMetadata)
+	}
+
+	caller := &User{ID: 1}
+	err = userModel.UpdateAppMetadata(caller, json.RawMessage(`{"plan":"pro"}`))
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	err = userModel.UpdateUserMetadata(caller, json.RawMessage(`{"theme":"dark"}`))
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	if string(user.AppMetadata) != `{"plan":"pro"}` || string(user.UserMetadata) != `{"theme":"dark"}` {
+		t.Errorf("Expected each column to hold its own patch, got %s %s", user.AppMetadata, user.UserMetadata)
+	}
+	if string(caller.AppMetadata) != `{"plan":"pro"}` {
+		t.Errorf("Expected the caller's user to be updated too, got %s", caller.AppMetadata)
+	}
+
+	err = userModel.UpdateUserMetadata(&User{ID: 2}, json.RawMessage(`{}`))
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("Expected ErrRecordNotFound, got %v", err)
+	}
+}
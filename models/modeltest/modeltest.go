@@ -0,0 +1,1400 @@
+// Package modeltest holds the conformance suite every models.IUserModel implementation has to pass, so the mock, the
+// in-memory store and the databases can't drift apart. Call Run from a test with a factory for the model under test.
+package modeltest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"the_lonely_road/models"
+	"the_lonely_road/token"
+	"the_lonely_road/validator"
+	"time"
+)
+
+// Factory returns the model a test runs against. It is called once per test, models backed by a shared database can
+// return a model for the same one as the suite only touches the users it creates and deletes them afterwards. A cheap
+// password hasher keeps the suite fast.
+type Factory func(t *testing.T) models.IUserModel
+
+// missingID is an id no test database gets to, small enough for a Postgres integer
+const missingID = 2147483647
+
+// Run checks the whole contract, including that concurrent writers can't both win
+func Run(t *testing.T, newModel Factory) {
+	RunSequential(t, newModel)
+	t.Run("Concurrent", func(t *testing.T) { testConcurrent(t, newModel(t)) })
+}
+
+// RunSequential checks everything but concurrency, for models like UserModelMock that aren't safe to share between
+// goroutines
+func RunSequential(t *testing.T, newModel Factory) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, m models.IUserModel)
+	}{
+		{"Insert", testInsert},
+		{"DuplicateEmail", testDuplicateEmail},
+		{"CanonicalEmail", testCanonicalEmail},
+		{"NotFound", testNotFound},
+		{"Authenticate", testAuthenticate},
+		{"ResetTokenLifecycle", testResetTokenLifecycle},
+		{"ResetPassword", testResetPassword},
+		{"UpdatePassword", testUpdatePassword},
+		{"UpdateProfile", testUpdateProfile},
+		{"DeleteUser", testDeleteUser},
+		{"SoftDelete", testSoftDelete},
+		{"SearchUsers", testSearchUsers},
+		{"Usernames", testUsernames},
+		{"Phones", testPhones},
+		{"EmailChange", testEmailChange},
+		{"PurgeDeletedUsers", testPurgeDeletedUsers},
+		{"ListUsers", testListUsers},
+		{"Roles", testRoles},
+		{"UnlockUser", testUnlockUser},
+		{"Organizations", testOrganizations},
+		{"Invitations", testInvitations},
+		{"Metadata", testMetadata},
+		{"AuditEvents", testAuditEvents},
+		{"LoginHistory", testLoginHistory},
+		{"ImportExport", testImportExport},
+		{"DataExports", testDataExports},
+		{"ReencryptUsers", testReencryptUsers},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) { tt.test(t, newModel(t)) })
+	}
+}
+
+// email is unique to the test and the run, so runs against a shared database don't collide
+func email(t *testing.T, name string) string {
+	test := strings.ToLower(strings.NewReplacer("/", "-", "_", "-").Replace(t.Name()))
+	return fmt.Sprintf("%s-%s-%s@conformance.test", name, test, strconv.FormatInt(time.Now().UnixNano(), 36))
+}
+
+// username is valid and unique to the run, like email
+func username(name string) string {
+	return name + strconv.FormatInt(time.Now().UnixNano(), 36)
+}
+
+// insert adds a user with password "securepassword" and deletes them when the test ends
+func insert(t *testing.T, m models.IUserModel, address string) *models.User {
+	t.Helper()
+	user := &models.User{Email: address, Password: "securepassword", CreatedAt: time.Now()}
+	err := m.Insert(user)
+	if err != nil {
+		t.Fatalf("Unexpected error inserting %s: %s", address, err)
+	}
+	t.Cleanup(func() { _ = m.DeleteUser(address) })
+	return user
+}
+
+// get reads a copy of the stored user, models like the mock hand out the stored row itself
+func get(t *testing.T, m models.IUserModel, address string) models.User {
+	t.Helper()
+	user, err := m.GetByEmail(address)
+	if err != nil {
+		t.Fatalf("Unexpected error reading %s: %s", address, err)
+	}
+	return *user
+}
+
+func testInsert(t *testing.T, m models.IUserModel) {
+	alice := insert(t, m, email(t, "alice"))
+	bob := insert(t, m, email(t, "bob"))
+
+	if alice.ID == 0 || bob.ID == 0 || alice.ID == bob.ID {
+		t.Errorf("Expected the store to assign distinct ids, got %d and %d", alice.ID, bob.ID)
+	}
+	if !validator.Matches(alice.PublicID, validator.UUIDRX) || alice.PublicID == bob.PublicID {
+		t.Errorf("Expected distinct UUID public ids, got %q and %q", alice.PublicID, bob.PublicID)
+	}
+	if alice.Version != 1 {
+		t.Errorf("Expected a new user to be at version 1, got %d", alice.Version)
+	}
+	if alice.Password == "securepassword" {
+		t.Errorf("Expected the password to be hashed")
+	}
+
+	for name, lookup := range map[string]func() (*models.User, error){
+		"email":     func() (*models.User, error) { return m.GetByEmail(alice.Email) },
+		"id":        func() (*models.User, error) { return m.GetByID(int(alice.ID)) },
+		"public id": func() (*models.User, error) { return m.GetByPublicID(alice.PublicID) },
+	} {
+		got, err := lookup()
+		if err != nil {
+			t.Errorf("Unexpected error looking alice up by %s: %s", name, err)
+			continue
+		}
+		if got.ID != alice.ID || got.Email != alice.Email || got.PublicID != alice.PublicID || got.Version != 1 {
+			t.Errorf("Expected alice by %s, got %+v", name, got)
+		}
+	}
+}
+
+func testDuplicateEmail(t *testing.T, m models.IUserModel) {
+	address := email(t, "taken")
+	first := insert(t, m, address)
+
+	for _, duplicate := range []string{address, strings.ToUpper(address), "  " + address + " "} {
+		err := m.Insert(&models.User{Email: duplicate, Password: "securepassword", CreatedAt: time.Now()})
+		if !errors.Is(err, models.ErrDuplicateEmail) {
+			t.Errorf("Expected ErrDuplicateEmail for %q, got %v", duplicate, err)
+		}
+	}
+	if got := get(t, m, address); got.ID != first.ID {
+		t.Errorf("Expected the first user to keep the address, got id %d", got.ID)
+	}
+}
+
+func testCanonicalEmail(t *testing.T, m models.IUserModel) {
+	address := email(t, "Mixed.Case")
+	user := insert(t, m, address)
+
+	got, err := m.GetByEmail(strings.ToUpper(address))
+	if err != nil || got.ID != user.ID {
+		t.Errorf("Expected any case of the address to find the user, got %v", err)
+	}
+	if got != nil && got.Email != address {
+		t.Errorf("Expected the address to be kept as it was typed, got %s", got.Email)
+	}
+	_, err = m.Authenticate(" "+strings.ToLower(address), "securepassword")
+	if err != nil {
+		t.Errorf("Expected to sign in with the address lower cased, got %s", err)
+	}
+}
+
+func testNotFound(t *testing.T, m models.IUserModel) {
+	address := email(t, "missing")
+	publicID, err := models.NewPublicID()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	lookups := map[string]func() (*models.User, error){
+		"GetByEmail":          func() (*models.User, error) { return m.GetByEmail(address) },
+		"GetByID":             func() (*models.User, error) { return m.GetByID(missingID) },
+		"GetByPublicID":       func() (*models.User, error) { return m.GetByPublicID(publicID) },
+		"GetByPublicID(junk)": func() (*models.User, error) { return m.GetByPublicID("not-a-uuid") },
+		"Authenticate":        func() (*models.User, error) { return m.Authenticate(address, "securepassword") },
+	}
+	for name, lookup := range lookups {
+		user, err := lookup()
+		if !errors.Is(err, models.ErrRecordNotFound) || user != nil {
+			t.Errorf("Expected %s to return ErrRecordNotFound, got %+v, %v", name, user, err)
+		}
+	}
+	if err := m.UpdateProfile(&models.User{ID: missingID, Version: 1}); !errors.Is(err, models.ErrRecordNotFound) {
+		t.Errorf("Expected UpdateProfile to return ErrRecordNotFound, got %v", err)
+	}
+
+	// the other writes only promise an error, but a missing user is never an edit conflict
+	writes := map[string]func() error{
+		"UpdatePassword":       func() error { return m.UpdatePassword(missingID, "newsecurepassword", 1) },
+		"EnterPasswordHash":    func() error { return m.EnterPasswordHash(address, "hash", "salt", 1) },
+		"ConsumePasswordReset": func() error { return m.ConsumePasswordReset(address, 1) },
+		"DeleteUser":           func() error { return m.DeleteUser(address) },
+	}
+	for name, write := range writes {
+		err := write()
+		if err == nil || errors.Is(err, models.ErrEditConflict) {
+			t.Errorf("Expected %s to fail without an edit conflict, got %v", name, err)
+		}
+	}
+}
+
+func testAuthenticate(t *testing.T, m models.IUserModel) {
+	user := insert(t, m, email(t, "signin"))
+
+	signedIn, err := m.Authenticate(user.Email, "securepassword")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if signedIn.ID != user.ID || signedIn.PublicID != user.PublicID {
+		t.Errorf("Expected the signed in user, got %+v", signedIn)
+	}
+	signedIn, err = m.Authenticate(user.Email, "wrongpassword")
+	if err == nil || signedIn != nil {
+		t.Errorf("Expected a wrong password to be refused, got %+v, %v", signedIn, err)
+	}
+	if errors.Is(err, models.ErrRecordNotFound) {
+		t.Errorf("Expected a wrong password not to look like a missing user")
+	}
+
+	// someone guessing at the account mustn't turn the owner's edits into conflicts
+	editing := get(t, m, user.Email)
+	if _, err := m.Authenticate(user.Email, "wrongpassword"); err == nil {
+		t.Fatalf("Expected a wrong password to be refused")
+	}
+	if _, err := m.Authenticate(user.Email, "securepassword"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	editing.DisplayName = "Editing"
+	if err := m.UpdateProfile(&editing); err != nil {
+		t.Errorf("Expected failed and successful sign ins to leave the version alone, got %v", err)
+	}
+}
+
+func testResetTokenLifecycle(t *testing.T, m models.IUserModel) {
+	user := insert(t, m, email(t, "reset"))
+	version := get(t, m, user.Email).Version
+
+	resetToken, salt, err := token.GenerateTokenAndSalt(32, 16)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	requested := time.Now()
+	err = m.EnterPasswordHash(strings.ToUpper(user.Email), token.HashToken(resetToken, salt), salt, version)
+	if err != nil {
+		t.Fatalf("Unexpected error storing the reset token: %s", err)
+	}
+	stored := get(t, m, user.Email)
+	if !token.IsValidToken(resetToken, stored.PasswordResetHashToken, stored.PasswordResetSalt) {
+		t.Errorf("Expected the stored hash to verify the token")
+	}
+	if stored.PasswordResetExpiry.Before(requested.Add(29*time.Minute)) || stored.PasswordResetExpiry.After(time.Now().Add(31*time.Minute)) {
+		t.Errorf("Expected the token to expire in 30 minutes, got %s", stored.PasswordResetExpiry)
+	}
+	if stored.Version != version+1 {
+		t.Errorf("Expected storing the token to bump the version to %d, got %d", version+1, stored.Version)
+	}
+
+	// a second request racing the first one read the same version
+	err = m.EnterPasswordHash(user.Email, "otherhash", "othersalt", version)
+	if !errors.Is(err, models.ErrEditConflict) {
+		t.Errorf("Expected ErrEditConflict for a stale version, got %v", err)
+	}
+
+	err = m.ConsumePasswordReset(user.Email, stored.Version)
+	if err != nil {
+		t.Fatalf("Unexpected error consuming the token: %s", err)
+	}
+	consumed := get(t, m, user.Email)
+	if consumed.PasswordResetHashToken != "" || consumed.PasswordResetSalt != "" || !consumed.PasswordResetExpiry.IsZero() {
+		t.Errorf("Expected the token to be cleared, got %q, %q, %s", consumed.PasswordResetHashToken, consumed.PasswordResetSalt,
+			consumed.PasswordResetExpiry)
+	}
+	if consumed.Version != version+2 {
+		t.Errorf("Expected consuming the token to bump the version to %d, got %d", version+2, consumed.Version)
+	}
+	if err := m.ConsumePasswordReset(user.Email, stored.Version); !errors.Is(err, models.ErrEditConflict) {
+		t.Errorf("Expected a token to be consumed only once, got %v", err)
+	}
+}
+
+func testResetPassword(t *testing.T, m models.IUserModel) {
+	user := insert(t, m, email(t, "forgot"))
+	err := m.EnterPasswordHash(user.Email, "hash", "salt", get(t, m, user.Email).Version)
+	if err != nil {
+		t.Fatalf("Unexpected error storing the reset token: %s", err)
+	}
+	stored := get(t, m, user.Email)
+
+	// nothing is written when the password is refused, the token still works
+	err = m.ResetPassword(int(user.ID), "securepassword", stored.Version)
+	if !errors.Is(err, models.ErrPasswordReused) {
+		t.Errorf("Expected ErrPasswordReused, got %v", err)
+	}
+	if refused := get(t, m, user.Email); refused.PasswordResetHashToken != "hash" || refused.Version != stored.Version {
+		t.Errorf("Expected a refused password to keep the token at version %d, got %q at %d", stored.Version,
+			refused.PasswordResetHashToken, refused.Version)
+	}
+
+	err = m.ResetPassword(int(user.ID), "newsecurepassword", stored.Version)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	reset := get(t, m, user.Email)
+	if reset.PasswordResetHashToken != "" || reset.PasswordResetSalt != "" || !reset.PasswordResetExpiry.IsZero() {
+		t.Errorf("Expected the token to be consumed with the password, got %q, %q, %s", reset.PasswordResetHashToken,
+			reset.PasswordResetSalt, reset.PasswordResetExpiry)
+	}
+	if reset.Version != stored.Version+1 {
+		t.Errorf("Expected one version bump, got %d from %d", reset.Version, stored.Version)
+	}
+	if _, err := m.Authenticate(user.Email, "newsecurepassword"); err != nil {
+		t.Errorf("Expected the new password to sign in, got %v", err)
+	}
+	if err := m.ResetPassword(int(user.ID), "othersecurepassword", stored.Version); !errors.Is(err, models.ErrEditConflict) {
+		t.Errorf("Expected a reset to work only once, got %v", err)
+	}
+}
+
+func testUpdatePassword(t *testing.T, m models.IUserModel) {
+	user := insert(t, m, email(t, "password"))
+	version := get(t, m, user.Email).Version
+
+	err := m.UpdatePassword(int(user.ID), "newsecurepassword", version)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, err := m.Authenticate(user.Email, "newsecurepassword"); err != nil {
+		t.Errorf("Expected the new password to work, got %s", err)
+	}
+	if _, err := m.Authenticate(user.Email, "securepassword"); err == nil {
+		t.Errorf("Expected the old password to stop working")
+	}
+	if err := m.UpdatePassword(int(user.ID), "anothersecurepassword", version); !errors.Is(err, models.ErrEditConflict) {
+		t.Errorf("Expected ErrEditConflict for a stale version, got %v", err)
+	}
+}
+
+func testUpdateProfile(t *testing.T, m models.IUserModel) {
+	user := insert(t, m, email(t, "profile"))
+	first, stale := get(t, m, user.Email), get(t, m, user.Email)
+
+	first.DisplayName, first.TimeZone = "First", "Europe/London"
+	err := m.UpdateProfile(&first)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if first.Version != stale.Version+1 || first.UpdatedAt.IsZero() {
+		t.Errorf("Expected the version to go up by one and updated_at to be set, got %d and %s", first.Version, first.UpdatedAt)
+	}
+
+	stale.DisplayName = "Second"
+	err = m.UpdateProfile(&stale)
+	if !errors.Is(err, models.ErrEditConflict) {
+		t.Errorf("Expected ErrEditConflict for a stale version, got %v", err)
+	}
+	got := get(t, m, user.Email)
+	if got.DisplayName != "First" || got.TimeZone != "Europe/London" || got.Version != first.Version {
+		t.Errorf("Expected only the first update to be kept, got %q at version %d", got.DisplayName, got.Version)
+	}
+}
+
+func testDeleteUser(t *testing.T, m models.IUserModel) {
+	user := insert(t, m, email(t, "delete"))
+
+	err := m.DeleteUser(strings.ToUpper(user.Email))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, err := m.GetByID(int(user.ID)); !errors.Is(err, models.ErrRecordNotFound) {
+		t.Errorf("Expected the user to be gone, got %v", err)
+	}
+	if _, err := m.Authenticate(user.Email, "securepassword"); !errors.Is(err, models.ErrRecordNotFound) {
+		t.Errorf("Expected a deleted user not to sign in, got %v", err)
+	}
+	if err := m.DeleteUser(user.Email); err == nil {
+		t.Errorf("Expected deleting twice to fail")
+	}
+	// the address is free again
+	insert(t, m, user.Email)
+}
+
+func testSoftDelete(t *testing.T, m models.IUserModel) {
+	handle := username("deleted")
+	user := &models.User{Email: email(t, "deleted"), Password: "securepassword", Username: handle, CreatedAt: time.Now()}
+	if err := m.Insert(user); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	t.Cleanup(func() { _ = m.DeleteUser(user.Email) })
+
+	err := m.SoftDeleteUser(int(user.ID), "hash", "salt", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, err := m.GetByEmail(user.Email); !errors.Is(err, models.ErrRecordNotFound) {
+		t.Errorf("Expected a deleted user not to be found by email, got %v", err)
+	}
+	if _, err := m.GetByUsername(handle); !errors.Is(err, models.ErrRecordNotFound) {
+		t.Errorf("Expected a deleted user not to be found by username, got %v", err)
+	}
+	if err := m.EnterPasswordHash(user.Email, "hash", "salt", user.Version+1); err == nil {
+		t.Errorf("Expected no password reset for a deleted user")
+	}
+	deleted, err := m.GetDeletedByEmail(strings.ToUpper(user.Email))
+	if err != nil || deleted.ID != user.ID {
+		t.Fatalf("Expected to find the deleted user, got %v, %v", deleted, err)
+	}
+
+	if err := m.RestoreUser(int(user.ID)); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if restored := get(t, m, user.Email); restored.ID != user.ID {
+		t.Errorf("Expected the restored user, got %d", restored.ID)
+	}
+	if _, err := m.GetDeletedByEmail(user.Email); !errors.Is(err, models.ErrRecordNotFound) {
+		t.Errorf("Expected a restored user not to be found as deleted, got %v", err)
+	}
+}
+
+func testSearchUsers(t *testing.T, m models.IUserModel) {
+	user := insert(t, m, email(t, "search"))
+	filters := models.SearchFilters{
+		Filters: models.Filters{Page: 1, PageSize: 20, Sort: "rank", SortSafelist: models.SearchSortSafelist},
+	}
+
+	filters.Query = strings.ToUpper(user.Email)
+	results, metadata, err := m.SearchUsers(filters)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(results) != 1 || results[0].User.ID != user.ID || metadata.TotalRecords != 1 {
+		t.Fatalf("Expected only the user, got %d results and %+v", len(results), metadata)
+	}
+	if results[0].Rank < 1 {
+		t.Errorf("Expected a prefix match to rank at least 1, got %f", results[0].Rank)
+	}
+	if got := results[0].Highlights["email"]; got != "<mark>"+user.Email+"</mark>" {
+		t.Errorf("Expected the whole email to be highlighted, got %q", got)
+	}
+
+	// the run suffix of the address is unique, so searching for it by name only finds this user
+	suffix := user.Email[strings.LastIndex(user.Email, "-")+1 : strings.Index(user.Email, "@")]
+	stored := get(t, m, user.Email)
+	stored.DisplayName = "Searchable " + suffix
+	if err := m.UpdateProfile(&stored); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	filters.Query = "searchable " + suffix
+	results, _, err = m.SearchUsers(filters)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(results) != 1 || results[0].User.DisplayName != stored.DisplayName {
+		t.Fatalf("Expected the user by display name, got %d results", len(results))
+	}
+	if got := results[0].Highlights["display_name"]; got != "<mark>Searchable</mark> <mark>"+suffix+"</mark>" {
+		t.Errorf("Expected the display name to be highlighted, got %q", got)
+	}
+}
+
+func testUsernames(t *testing.T, m models.IUserModel) {
+	handle := username("alice")
+	alice := &models.User{Email: email(t, "alice"), Password: "securepassword", Username: handle, CreatedAt: time.Now()}
+	if err := m.Insert(alice); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	t.Cleanup(func() { _ = m.DeleteUser(alice.Email) })
+
+	taken := &models.User{Email: email(t, "taken"), Password: "securepassword", Username: strings.ToUpper(handle), CreatedAt: time.Now()}
+	if err := m.Insert(taken); !errors.Is(err, models.ErrDuplicateUsername) {
+		_ = m.DeleteUser(taken.Email)
+		t.Errorf("Expected the username to be taken whatever its case, got %v", err)
+	}
+
+	found, err := m.GetByUsername(strings.ToUpper(handle))
+	if err != nil || found.ID != alice.ID || found.Username != handle {
+		t.Errorf("Expected to find alice by username as she wrote it, got %v, %v", found, err)
+	}
+	signedIn, err := m.Authenticate(strings.ToUpper(handle), "securepassword")
+	if err != nil || signedIn.ID != alice.ID {
+		t.Errorf("Expected alice to sign in with her username, got %v", err)
+	}
+	if _, err := m.Authenticate(handle, "wrongpassword"); err == nil {
+		t.Errorf("Expected a wrong password to fail with a username too")
+	}
+
+	// a user without a username can't be found or signed in by an empty one
+	bob := insert(t, m, email(t, "bob"))
+	if got := get(t, m, bob.Email); got.Username != "" {
+		t.Errorf("Expected no username, got %q", got.Username)
+	}
+	if _, err := m.GetByUsername(""); !errors.Is(err, models.ErrRecordNotFound) {
+		t.Errorf("Expected an empty username to find nobody, got %v", err)
+	}
+
+	stored := get(t, m, bob.Email)
+	stored.Username = handle
+	if err := m.UpdateProfile(&stored); !errors.Is(err, models.ErrDuplicateUsername) {
+		t.Errorf("Expected bob not to take alice's username, got %v", err)
+	}
+
+	// renaming frees the old username for someone else
+	renamed := get(t, m, alice.Email)
+	renamed.Username = username("alicia")
+	if err := m.UpdateProfile(&renamed); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, err := m.GetByUsername(handle); !errors.Is(err, models.ErrRecordNotFound) {
+		t.Errorf("Expected the old username to be free, got %v", err)
+	}
+	stored = get(t, m, bob.Email)
+	stored.Username = handle
+	if err := m.UpdateProfile(&stored); err != nil {
+		t.Errorf("Expected bob to take the freed username, got %v", err)
+	}
+	if found, err := m.GetByUsername(handle); err != nil || found.ID != bob.ID {
+		t.Errorf("Expected the username to be bob's now, got %v, %v", found, err)
+	}
+
+	// clearing it is allowed and leaves nothing behind
+	stored = get(t, m, bob.Email)
+	stored.Username = ""
+	if err := m.UpdateProfile(&stored); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, err := m.GetByUsername(handle); !errors.Is(err, models.ErrRecordNotFound) {
+		t.Errorf("Expected a cleared username to find nobody, got %v", err)
+	}
+}
+
+func testPhones(t *testing.T, m models.IUserModel) {
+	alice := insert(t, m, email(t, "alice"))
+	now := time.Now()
+	code := func(phone string) *models.SMSCode {
+		return &models.SMSCode{UserID: alice.ID, Purpose: models.SMSCodeVerifyPhone, Phone: phone, CodeHash: "hash", CodeSalt: "salt",
+			CreatedAt: now, ExpiresAt: now.Add(models.DefaultSMSCodeTTL)}
+	}
+
+	before := get(t, m, alice.Email)
+	if err := m.SetPhone(int(alice.ID), "+14155552671"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if got := get(t, m, alice.Email); got.Phone != "+14155552671" || got.PhoneVerified || got.Version != before.Version+1 {
+		t.Errorf("Expected an unverified phone and the next version, got %q, %t, version %d", got.Phone, got.PhoneVerified, got.Version)
+	}
+	if err := m.SetPhone(0, "+14155552671"); !errors.Is(err, models.ErrRecordNotFound) {
+		t.Errorf("Expected a missing user to be ErrRecordNotFound, got %v", err)
+	}
+
+	first := code("+14155552671")
+	if err := m.CreateSMSCode(first); err != nil || first.ID == 0 {
+		t.Fatalf("Expected the code to be stored with an id, got %d, %v", first.ID, err)
+	}
+	if err := m.CreateSMSCode(&models.SMSCode{UserID: 0, Purpose: models.SMSCodeVerifyPhone, ExpiresAt: now}); !errors.Is(err, models.ErrRecordNotFound) {
+		t.Errorf("Expected a code for a missing user to be ErrRecordNotFound, got %v", err)
+	}
+	// another code for the same purpose replaces the first
+	second := code("+14155552671")
+	if err := m.CreateSMSCode(second); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := m.RecordSMSCodeAttempt(int(second.ID)); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	stored, err := m.GetSMSCode(int(alice.ID), models.SMSCodeVerifyPhone)
+	if err != nil || stored.ID != second.ID || stored.Attempts != 1 || stored.Phone != "+14155552671" ||
+		stored.ExpiresAt.Sub(second.ExpiresAt).Abs() > time.Millisecond {
+		t.Fatalf("Expected the second code with one attempt, got %+v, %v", stored, err)
+	}
+	if _, err := m.GetSMSCode(int(alice.ID), models.SMSCodePasswordReset); !errors.Is(err, models.ErrRecordNotFound) {
+		t.Errorf("Expected no reset code, got %v", err)
+	}
+	for i := 1; i < models.MaxSMSCodeAttempts; i++ {
+		if err := m.RecordSMSCodeAttempt(int(second.ID)); err != nil {
+			t.Fatalf("Unexpected error on attempt %d: %s", i+1, err)
+		}
+	}
+	if err := m.RecordSMSCodeAttempt(int(second.ID)); !errors.Is(err, models.ErrRecordNotFound) {
+		t.Errorf("Expected the attempts to be used up, got %v", err)
+	}
+	if stored, err := m.GetSMSCode(int(alice.ID), models.SMSCodeVerifyPhone); err != nil || stored.Usable(time.Now()) {
+		t.Errorf("Expected a used up code to be kept but unusable, got %+v, %v", stored, err)
+	}
+
+	if err := m.VerifyPhone(int(alice.ID), "+442079460958"); !errors.Is(err, models.ErrPhoneChanged) {
+		t.Errorf("Expected another number not to be verified, got %v", err)
+	}
+	if err := m.VerifyPhone(int(alice.ID), "+14155552671"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := m.DeleteSMSCode(int(second.ID)); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, err := m.GetSMSCode(int(alice.ID), models.SMSCodeVerifyPhone); !errors.Is(err, models.ErrRecordNotFound) {
+		t.Errorf("Expected the used code to be gone, got %v", err)
+	}
+	if err := m.DeleteSMSCode(int(second.ID)); err != nil {
+		t.Errorf("Expected deleting it twice to be fine, got %v", err)
+	}
+
+	// setting the same number keeps it verified, a new one doesn't and drops the codes sent to the old one
+	if err := m.SetPhone(int(alice.ID), "+14155552671"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if got := get(t, m, alice.Email); !got.PhoneVerified {
+		t.Errorf("Expected the same number to stay verified")
+	}
+	if err := m.CreateSMSCode(code("+14155552671")); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := m.SetPhone(int(alice.ID), "+442079460958"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if got := get(t, m, alice.Email); got.PhoneVerified || got.Phone != "+442079460958" {
+		t.Errorf("Expected the new number to be unverified, got %q, %t", got.Phone, got.PhoneVerified)
+	}
+	if _, err := m.GetSMSCode(int(alice.ID), models.SMSCodeVerifyPhone); !errors.Is(err, models.ErrRecordNotFound) {
+		t.Errorf("Expected the code sent to the old number to be gone, got %v", err)
+	}
+
+	if err := m.SetPhone(int(alice.ID), ""); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := m.VerifyPhone(int(alice.ID), ""); !errors.Is(err, models.ErrPhoneChanged) {
+		t.Errorf("Expected a removed phone not to be verified, got %v", err)
+	}
+}
+
+func testEmailChange(t *testing.T, m models.IUserModel) {
+	oldAddress, newAddress := email(t, "moving"), email(t, "moved")
+	user := insert(t, m, oldAddress)
+	t.Cleanup(func() { _ = m.DeleteUser(newAddress) })
+	version := get(t, m, user.Email).Version
+
+	err := m.RequestEmailChange(int(user.ID), newAddress, "hash", "salt", "cancelhash", "cancelsalt")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	requested := get(t, m, user.Email)
+	if requested.PendingEmail != newAddress || requested.EmailChangeHashToken != "hash" || requested.EmailChangeSalt != "salt" ||
+		requested.EmailChangeCancelHashToken != "cancelhash" || requested.EmailChangeCancelSalt != "cancelsalt" {
+		t.Errorf("Expected the pending address and both token hashes, got %+v", requested)
+	}
+	if requested.EmailChangeExpiry.Before(time.Now().Add(23*time.Hour)) || requested.Version != version+1 {
+		t.Errorf("Expected a day to confirm and the next version, got %s and %d", requested.EmailChangeExpiry, requested.Version)
+	}
+
+	if err := m.CancelEmailChange(int(user.ID)); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	cancelled := get(t, m, user.Email)
+	if cancelled.PendingEmail != "" || cancelled.EmailChangeHashToken != "" || cancelled.EmailChangeCancelHashToken != "" ||
+		!cancelled.EmailChangeExpiry.IsZero() {
+		t.Errorf("Expected the change to be cleared, got %+v", cancelled)
+	}
+	if err := m.ConfirmEmailChange(int(user.ID)); err == nil {
+		t.Errorf("Expected nothing to confirm once cancelled")
+	}
+
+	// an address taken since the change was asked for is refused, even when the account holding it is deleted
+	taken := insert(t, m, email(t, "taken"))
+	if err := m.SoftDeleteUser(int(taken.ID), "hash", "salt", time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := m.RequestEmailChange(int(user.ID), strings.ToUpper(taken.Email), "hash", "salt", "cancelhash", "cancelsalt"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := m.ConfirmEmailChange(int(user.ID)); !errors.Is(err, models.ErrDuplicateEmail) {
+		t.Errorf("Expected ErrDuplicateEmail, got %v", err)
+	}
+
+	if err := m.RequestEmailChange(int(user.ID), newAddress, "hash", "salt", "cancelhash", "cancelsalt"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := m.ConfirmEmailChange(int(user.ID)); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	moved, err := m.GetByEmail(strings.ToUpper(newAddress))
+	if err != nil || moved.ID != user.ID || moved.Email != newAddress || moved.PendingEmail != "" || moved.EmailChangeHashToken != "" {
+		t.Fatalf("Expected the user under the new address with the change cleared, got %+v, %v", moved, err)
+	}
+	if _, err := m.GetByEmail(oldAddress); !errors.Is(err, models.ErrRecordNotFound) {
+		t.Errorf("Expected the old address to find nobody, got %v", err)
+	}
+
+	// changing only the case keeps the account's own address, it isn't a duplicate of itself
+	recased := strings.ToUpper(newAddress[:1]) + newAddress[1:]
+	if err := m.RequestEmailChange(int(user.ID), recased, "hash", "salt", "cancelhash", "cancelsalt"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := m.ConfirmEmailChange(int(user.ID)); err != nil {
+		t.Fatalf("Expected a case-only change to go through, got %s", err)
+	}
+	if moved, err := m.GetByEmail(newAddress); err != nil || moved.ID != user.ID || moved.Email != recased {
+		t.Errorf("Expected the user under %s, got %+v, %v", recased, moved, err)
+	}
+	if err := m.RequestEmailChange(missingID, newAddress, "hash", "salt", "cancelhash", "cancelsalt"); err == nil {
+		t.Errorf("Expected a change for a missing user to fail")
+	}
+}
+
+func testPurgeDeletedUsers(t *testing.T, m models.IUserModel) {
+	expired := insert(t, m, email(t, "expired"))
+	kept := insert(t, m, email(t, "kept"))
+
+	if err := m.SoftDeleteUser(int(expired.ID), "hash", "salt", time.Now().Add(-time.Minute)); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := m.SoftDeleteUser(int(kept.ID), "hash", "salt", time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := m.SoftDeleteUser(int(kept.ID), "hash", "salt", time.Now().Add(time.Hour)); err == nil {
+		t.Errorf("Expected deleting twice to fail")
+	}
+	deleted, err := m.GetDeletedByEmail(kept.Email)
+	if err != nil || deleted.DeletedAt == nil || deleted.RestoreHashToken != "hash" || deleted.RestoreSalt != "salt" {
+		t.Fatalf("Expected the deleted user with the restore token, got %+v, %v", deleted, err)
+	}
+
+	purged, err := m.PurgeDeletedUsers(time.Now())
+	if err != nil || purged < 1 {
+		t.Fatalf("Expected the expired user to be purged, got %d, %v", purged, err)
+	}
+	if _, err := m.GetByID(int(expired.ID)); !errors.Is(err, models.ErrRecordNotFound) {
+		t.Errorf("Expected the purged user to be gone, got %v", err)
+	}
+	if got, err := m.GetDeletedByEmail(kept.Email); err != nil || got.ID != kept.ID {
+		t.Errorf("Expected a user still inside the restore window to be kept, got %v", err)
+	}
+	// the purged address is free again
+	insert(t, m, expired.Email)
+
+	if err := m.RestoreUser(int(kept.ID)); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	restored := get(t, m, kept.Email)
+	if restored.DeletedAt != nil || restored.RestoreHashToken != "" || restored.RestoreSalt != "" {
+		t.Errorf("Expected the restore token to be consumed, got %+v", restored)
+	}
+	if err := m.RestoreUser(int(kept.ID)); err == nil {
+		t.Errorf("Expected restoring a user who isn't deleted to fail")
+	}
+}
+
+func testListUsers(t *testing.T, m models.IUserModel) {
+	user := insert(t, m, email(t, "listed"))
+	if err := m.AssignRole(int(user.ID), models.RoleSupport); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	yes, no := true, false
+	earlier, later := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	// every filter is combined with the whole address, which is all an encrypted store can match on
+	tests := []struct {
+		name   string
+		filter func(filters *models.UserFilters)
+		found  bool
+	}{
+		{"Email", func(filters *models.UserFilters) {}, true},
+		{"Email in capitals", func(filters *models.UserFilters) { filters.Email = strings.ToUpper(user.Email) }, true},
+		{"Created after", func(filters *models.UserFilters) { filters.CreatedAfter = &earlier }, true},
+		{"Created after now", func(filters *models.UserFilters) { filters.CreatedAfter = &later }, false},
+		{"Created before", func(filters *models.UserFilters) { filters.CreatedBefore = &later }, true},
+		{"Created before then", func(filters *models.UserFilters) { filters.CreatedBefore = &earlier }, false},
+		{"Unverified", func(filters *models.UserFilters) { filters.Verified = &no }, true},
+		{"Verified", func(filters *models.UserFilters) { filters.Verified = &yes }, false},
+		{"Not locked", func(filters *models.UserFilters) { filters.Locked = &no }, true},
+		{"Locked", func(filters *models.UserFilters) { filters.Locked = &yes }, false},
+		{"Role", func(filters *models.UserFilters) { filters.Role = models.RoleSupport }, true},
+		{"Other role", func(filters *models.UserFilters) { filters.Role = models.RoleAdmin }, false},
+	}
+	for _, test := range tests {
+		filters := models.UserFilters{
+			Filters: models.Filters{Page: 1, PageSize: 20, Sort: "-created_at", SortSafelist: models.UserSortSafelist},
+			Email:   user.Email,
+		}
+		test.filter(&filters)
+		users, metadata, err := m.ListUsers(filters)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", test.name, err)
+		}
+		found := len(users) == 1 && users[0].ID == user.ID && metadata.TotalRecords == 1
+		if found != test.found || (!found && len(users) != 0) {
+			t.Errorf("%s: expected found %t, got %d users and %+v", test.name, test.found, len(users), metadata)
+		}
+	}
+}
+
+func testRoles(t *testing.T, m models.IUserModel) {
+	user := insert(t, m, email(t, "roles"))
+
+	for i := 0; i < 2; i++ {
+		if err := m.AssignRole(int(user.ID), models.RoleAdmin); err != nil {
+			t.Fatalf("Expected assigning a role, even one the user has, to work, got %s", err)
+		}
+	}
+	got := get(t, m, user.Email)
+	if !contains(got.Roles, models.RoleAdmin) || len(got.Roles) != 1 || !contains(got.Permissions, models.PermissionUsersAdmin) {
+		t.Errorf("Expected the admin role once with its permissions, got %v and %v", got.Roles, got.Permissions)
+	}
+	if err := m.AssignRole(int(user.ID), "superuser"); !errors.Is(err, models.ErrUnknownRole) {
+		t.Errorf("Expected ErrUnknownRole, got %v", err)
+	}
+	if err := m.AssignRole(missingID, models.RoleAdmin); err == nil {
+		t.Errorf("Expected assigning a role to a missing user to fail")
+	}
+
+	if err := m.RevokeRole(int(user.ID), models.RoleAdmin); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	got = get(t, m, user.Email)
+	if contains(got.Roles, models.RoleAdmin) || contains(got.Permissions, models.PermissionUsersAdmin) {
+		t.Errorf("Expected the role and its permissions to be gone, got %v and %v", got.Roles, got.Permissions)
+	}
+	if err := m.RevokeRole(int(user.ID), models.RoleAdmin); err == nil {
+		t.Errorf("Expected revoking a role the user doesn't have to fail")
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func testUnlockUser(t *testing.T, m models.IUserModel) {
+	user := insert(t, m, email(t, "locked"))
+	if _, err := m.Authenticate(user.Email, "wrongpassword"); err == nil {
+		t.Fatalf("Expected a wrong password to be refused")
+	}
+	failed := get(t, m, user.Email)
+	if failed.FailedLogins != 1 || failed.LastFailedLogin == nil {
+		t.Errorf("Expected the failed sign in to be counted, got %d at %v", failed.FailedLogins, failed.LastFailedLogin)
+	}
+
+	if err := m.UnlockUser(int(user.ID)); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	unlocked := get(t, m, user.Email)
+	if unlocked.FailedLogins != 0 || unlocked.LastFailedLogin != nil || unlocked.LockedUntil != nil {
+		t.Errorf("Expected the counter and lock to be cleared, got %d, %v, %v", unlocked.FailedLogins, unlocked.LastFailedLogin,
+			unlocked.LockedUntil)
+	}
+	if unlocked.Version != failed.Version+1 {
+		t.Errorf("Expected unlocking to bump the version to %d, got %d", failed.Version+1, unlocked.Version)
+	}
+	if err := m.UnlockUser(missingID); err == nil {
+		t.Errorf("Expected unlocking a missing user to fail")
+	}
+}
+
+// organization creates an organization owned by owner. There is no way to delete one, so on a shared database they
+// are left behind with a slug unique to the run.
+func organization(t *testing.T, m models.IUserModel, owner *models.User) *models.Organization {
+	t.Helper()
+	org := &models.Organization{Slug: "org-" + strconv.FormatInt(time.Now().UnixNano(), 36), Name: "Conformance", CreatedAt: time.Now()}
+	err := m.CreateOrganization(org, int(owner.ID))
+	if err != nil {
+		t.Fatalf("Unexpected error creating %s: %s", org.Slug, err)
+	}
+	return org
+}
+
+func testOrganizations(t *testing.T, m models.IUserModel) {
+	owner := insert(t, m, email(t, "owner"))
+	other := insert(t, m, email(t, "other"))
+	org := organization(t, m, owner)
+	if org.ID == 0 {
+		t.Errorf("Expected the organization to get an id")
+	}
+
+	duplicate := &models.Organization{Slug: org.Slug, Name: "Again", CreatedAt: time.Now()}
+	if err := m.CreateOrganization(duplicate, int(other.ID)); !errors.Is(err, models.ErrDuplicateSlug) {
+		t.Errorf("Expected ErrDuplicateSlug, got %v", err)
+	}
+	orphan := &models.Organization{Slug: org.Slug + "-orphan", Name: "Orphan", CreatedAt: time.Now()}
+	if err := m.CreateOrganization(orphan, missingID); err == nil {
+		t.Errorf("Expected an organization without an owner to fail")
+	}
+	if _, err := m.GetOrganization(orphan.Slug); !errors.Is(err, models.ErrRecordNotFound) {
+		t.Errorf("Expected the failed organization not to be kept, got %v", err)
+	}
+
+	got, err := m.GetOrganization(org.Slug)
+	if err != nil || got.ID != org.ID || got.Name != org.Name {
+		t.Fatalf("Expected the organization, got %+v, %v", got, err)
+	}
+	membership, err := m.GetMembership(org.Slug, int(owner.ID))
+	if err != nil || membership.Role != models.OrgRoleOwner || membership.UserPublicID != owner.PublicID ||
+		membership.Email != owner.Email || membership.OrgID != org.ID {
+		t.Fatalf("Expected the owner's membership, got %+v, %v", membership, err)
+	}
+	if _, err := m.GetMembership(org.Slug, int(other.ID)); !errors.Is(err, models.ErrNotMember) {
+		t.Errorf("Expected ErrNotMember, got %v", err)
+	}
+
+	members, err := m.ListMembers(int(org.ID))
+	if err != nil || len(members) != 1 || members[0].UserID != owner.ID {
+		t.Errorf("Expected only the owner, got %+v, %v", members, err)
+	}
+	memberships, err := m.ListMemberships(int(owner.ID))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	slugs := []string{}
+	for _, membership := range memberships {
+		slugs = append(slugs, membership.OrgSlug)
+	}
+	if !contains(slugs, org.Slug) || !contains(slugs, models.DefaultOrgSlug) {
+		t.Errorf("Expected the owner in the default organization and the new one, got %v", slugs)
+	}
+
+	if err := m.RemoveMember(int(org.ID), int(owner.ID)); !errors.Is(err, models.ErrLastOwner) {
+		t.Errorf("Expected ErrLastOwner, got %v", err)
+	}
+	if err := m.RemoveMember(int(org.ID), int(other.ID)); !errors.Is(err, models.ErrNotMember) {
+		t.Errorf("Expected ErrNotMember, got %v", err)
+	}
+}
+
+func testInvitations(t *testing.T, m models.IUserModel) {
+	owner := insert(t, m, email(t, "owner"))
+	org := organization(t, m, owner)
+	address := email(t, "invited")
+	invite := func(address, role string) *models.Invitation {
+		t.Helper()
+		now := time.Now()
+		inv := &models.Invitation{OrgID: org.ID, Email: address, Role: role, InvitedBy: owner.ID, TokenHash: "hash",
+			TokenSalt: "salt", CreatedAt: now, ExpiresAt: now.Add(models.DefaultInvitationTTL)}
+		if err := m.CreateInvitation(inv); err != nil {
+			t.Fatalf("Unexpected error inviting %s: %s", address, err)
+		}
+		return inv
+	}
+
+	first := invite(address, models.OrgRoleMember)
+	if first.ID == 0 || !validator.Matches(first.PublicID, validator.UUIDRX) {
+		t.Errorf("Expected an id and a UUID public id, got %d and %q", first.ID, first.PublicID)
+	}
+	got, err := m.GetInvitation(first.PublicID)
+	if err != nil || got.Email != address || got.OrgSlug != org.Slug || got.Role != models.OrgRoleMember ||
+		got.InvitedBy != owner.ID || !got.Pending(time.Now()) {
+		t.Fatalf("Expected the open invitation, got %+v, %v", got, err)
+	}
+	if _, err := m.GetInvitation("not-a-uuid"); !errors.Is(err, models.ErrRecordNotFound) {
+		t.Errorf("Expected ErrRecordNotFound, got %v", err)
+	}
+	missing := &models.Invitation{OrgID: missingID, Email: address, Role: models.OrgRoleMember, CreatedAt: time.Now(),
+		ExpiresAt: time.Now().Add(time.Hour)}
+	if err := m.CreateInvitation(missing); !errors.Is(err, models.ErrRecordNotFound) {
+		t.Errorf("Expected an invitation to a missing organization to be ErrRecordNotFound, got %v", err)
+	}
+
+	// inviting the same address again leaves only the newest link open
+	second := invite(strings.ToUpper(address), models.OrgRoleAdmin)
+	pending, err := m.ListPendingInvitations(int(org.ID))
+	if err != nil || len(pending) != 1 || pending[0].PublicID != second.PublicID {
+		t.Fatalf("Expected only the second invitation open, got %+v, %v", pending, err)
+	}
+	if got, err := m.GetInvitation(first.PublicID); err != nil || got.RevokedAt == nil {
+		t.Errorf("Expected the first invitation to be revoked, got %+v, %v", got, err)
+	}
+	if err := m.RevokeInvitation(int(org.ID), second.PublicID); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := m.RevokeInvitation(int(org.ID), second.PublicID); !errors.Is(err, models.ErrInvitationClosed) {
+		t.Errorf("Expected revoking twice to be ErrInvitationClosed, got %v", err)
+	}
+
+	invited := insert(t, m, address)
+	if err := m.AcceptInvitation(int(first.ID), int(invited.ID)); !errors.Is(err, models.ErrInvitationClosed) {
+		t.Errorf("Expected a revoked invitation to be ErrInvitationClosed, got %v", err)
+	}
+	third := invite(address, models.OrgRoleAdmin)
+	if err := m.AcceptInvitation(int(third.ID), int(invited.ID)); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := m.AcceptInvitation(int(third.ID), int(invited.ID)); !errors.Is(err, models.ErrInvitationClosed) {
+		t.Errorf("Expected an invitation to be accepted only once, got %v", err)
+	}
+	if got, err := m.GetInvitation(third.PublicID); err != nil || got.AcceptedAt == nil {
+		t.Errorf("Expected the invitation to be marked accepted, got %+v, %v", got, err)
+	}
+	if pending, err := m.ListPendingInvitations(int(org.ID)); err != nil || len(pending) != 0 {
+		t.Errorf("Expected no open invitations, got %+v, %v", pending, err)
+	}
+
+	membership, err := m.GetMembership(org.Slug, int(invited.ID))
+	if err != nil || membership.Role != models.OrgRoleAdmin || membership.Email != address {
+		t.Fatalf("Expected the invited user to join as admin, got %+v, %v", membership, err)
+	}
+	members, err := m.ListMembers(int(org.ID))
+	if err != nil || len(members) != 2 || members[0].UserID != owner.ID || members[1].UserID != invited.ID {
+		t.Errorf("Expected the owner then the invited user, got %+v, %v", members, err)
+	}
+	if err := m.RemoveMember(int(org.ID), int(invited.ID)); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, err := m.GetMembership(org.Slug, int(invited.ID)); !errors.Is(err, models.ErrNotMember) {
+		t.Errorf("Expected the removed member to be gone, got %v", err)
+	}
+}
+
+// sameJSON reports whether a and b decode to the same value, stores are free to reformat what they keep
+func sameJSON(t *testing.T, a, b []byte) bool {
+	t.Helper()
+	var decodedA, decodedB any
+	if err := json.Unmarshal(a, &decodedA); err != nil {
+		t.Fatalf("Unexpected error decoding %s: %s", a, err)
+	}
+	if err := json.Unmarshal(b, &decodedB); err != nil {
+		t.Fatalf("Unexpected error decoding %s: %s", b, err)
+	}
+	encodedA, _ := json.Marshal(decodedA)
+	encodedB, _ := json.Marshal(decodedB)
+	return string(encodedA) == string(encodedB)
+}
+
+func testMetadata(t *testing.T, m models.IUserModel) {
+	user := insert(t, m, email(t, "metadata"))
+	stored := get(t, m, user.Email)
+	version := stored.Version
+	if !sameJSON(t, stored.AppMetadata, []byte(`{}`)) || !sameJSON(t, stored.UserMetadata, []byte(`{}`)) {
+		t.Errorf("Expected a new user to start with empty metadata, got %s and %s", stored.AppMetadata, stored.UserMetadata)
+	}
+
+	if err := m.UpdateAppMetadata(&stored, json.RawMessage(`{"plan": "pro", "tier": 1}`)); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := m.UpdateAppMetadata(&stored, json.RawMessage(`{"tier": null, "flags": {"beta": true}}`)); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := m.UpdateUserMetadata(&stored, json.RawMessage(`{"theme": "dark"}`)); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	app, userMetadata := []byte(`{"plan": "pro", "flags": {"beta": true}}`), []byte(`{"theme": "dark"}`)
+	if !sameJSON(t, stored.AppMetadata, app) || !sameJSON(t, stored.UserMetadata, userMetadata) || stored.Version != version+3 {
+		t.Errorf("Expected the patched metadata on the user passed in at version %d, got %s, %s and %d", version+3,
+			stored.AppMetadata, stored.UserMetadata, stored.Version)
+	}
+	got := get(t, m, user.Email)
+	if !sameJSON(t, got.AppMetadata, app) || !sameJSON(t, got.UserMetadata, userMetadata) || got.Version != stored.Version {
+		t.Errorf("Expected the patched metadata to be stored, got %s, %s at version %d", got.AppMetadata, got.UserMetadata, got.Version)
+	}
+
+	if err := m.UpdateUserMetadata(&stored, json.RawMessage(`[1]`)); !errors.Is(err, models.ErrMetadataNotObject) {
+		t.Errorf("Expected ErrMetadataNotObject, got %v", err)
+	}
+	big := json.RawMessage(`{"big": "` + strings.Repeat("x", models.MaxMetadataBytes) + `"}`)
+	if err := m.UpdateUserMetadata(&stored, big); !errors.Is(err, models.ErrMetadataTooLarge) {
+		t.Errorf("Expected ErrMetadataTooLarge, got %v", err)
+	}
+	if got := get(t, m, user.Email); !sameJSON(t, got.UserMetadata, userMetadata) {
+		t.Errorf("Expected a refused patch to change nothing, got %s", got.UserMetadata)
+	}
+	if err := m.UpdateAppMetadata(&models.User{ID: missingID}, json.RawMessage(`{}`)); !errors.Is(err, models.ErrRecordNotFound) {
+		t.Errorf("Expected ErrRecordNotFound, got %v", err)
+	}
+}
+
+func testAuditEvents(t *testing.T, m models.IUserModel) {
+	user := insert(t, m, email(t, "audited"))
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	events := []*models.AuditEvent{
+		{Type: models.AuditLoginFailed, SubjectID: user.PublicID, Email: user.Email, IP: "192.0.2.1",
+			UserAgent: strings.Repeat("a", 600), RequestID: "request-1", Method: models.LoginMethodPassword, CreatedAt: start},
+		{Type: models.AuditLoginSucceeded, SubjectID: user.PublicID, Email: user.Email, IP: "192.0.2.1", RequestID: "request-2",
+			Method: models.LoginMethodPassword, CreatedAt: start.Add(time.Minute)},
+		{Type: models.AuditSignedOut, ActorID: user.PublicID, IP: "192.0.2.1", RequestID: "request-3", CreatedAt: start.Add(2 * time.Minute)},
+	}
+	for _, event := range events {
+		if err := m.RecordAuditEvent(event); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if event.ID == 0 {
+			t.Errorf("Expected the event to get an id")
+		}
+	}
+	if len(events[0].UserAgent) != 512 {
+		t.Errorf("Expected the user agent to be cut to 512 bytes, got %d", len(events[0].UserAgent))
+	}
+
+	list := func(filters models.AuditFilters) []string {
+		t.Helper()
+		sort := filters.Sort
+		if sort == "" {
+			sort = "created_at"
+		}
+		filters.Filters = models.Filters{Page: 1, PageSize: 10, Sort: sort, SortSafelist: models.AuditSortSafelist}
+		filters.User = user.PublicID
+		listed, metadata, err := m.ListAuditEvents(filters)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if metadata.TotalRecords != len(listed) {
+			t.Errorf("Expected %d records in the metadata, got %d", len(listed), metadata.TotalRecords)
+		}
+		types := []string{}
+		for _, event := range listed {
+			types = append(types, event.Type)
+		}
+		return types
+	}
+
+	listed, _, err := m.ListAuditEvents(models.AuditFilters{
+		Filters: models.Filters{Page: 1, PageSize: 10, Sort: "created_at", SortSafelist: models.AuditSortSafelist},
+		User:    user.PublicID,
+	})
+	if err != nil || len(listed) != 3 {
+		t.Fatalf("Expected the user's three events, got %d, %v", len(listed), err)
+	}
+	first := listed[0]
+	if first.ID != events[0].ID || first.SubjectID != user.PublicID || first.IP != "192.0.2.1" || first.RequestID != "request-1" ||
+		first.Method != models.LoginMethodPassword || len(first.UserAgent) != 512 || !first.CreatedAt.Equal(start) {
+		t.Errorf("Expected the first event as recorded, got %+v", first)
+	}
+	if listed[2].ActorID != user.PublicID || listed[2].SubjectID != "" {
+		t.Errorf("Expected the user as the actor of the last event, got %+v", listed[2])
+	}
+
+	after, before := start.Add(30*time.Second), start.Add(90*time.Second)
+	tests := []struct {
+		name     string
+		filters  models.AuditFilters
+		expected []string
+	}{
+		{"Oldest first", models.AuditFilters{}, []string{models.AuditLoginFailed, models.AuditLoginSucceeded, models.AuditSignedOut}},
+		{"Newest first", models.AuditFilters{Filters: models.Filters{Sort: "-created_at"}},
+			[]string{models.AuditSignedOut, models.AuditLoginSucceeded, models.AuditLoginFailed}},
+		{"Type", models.AuditFilters{Type: models.AuditLoginSucceeded}, []string{models.AuditLoginSucceeded}},
+		{"After", models.AuditFilters{After: &after}, []string{models.AuditLoginSucceeded, models.AuditSignedOut}},
+		{"Between", models.AuditFilters{After: &after, Before: &before}, []string{models.AuditLoginSucceeded}},
+	}
+	for _, test := range tests {
+		if got := list(test.filters); strings.Join(got, ",") != strings.Join(test.expected, ",") {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, got)
+		}
+	}
+}
+
+func testLoginHistory(t *testing.T, m models.IUserModel) {
+	user := insert(t, m, email(t, "history"))
+	other := insert(t, m, email(t, "other"))
+	start := time.Now().Add(-time.Hour)
+	browser := "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36"
+	events := []*models.AuditEvent{
+		{Type: models.AuditLoginFailed, SubjectID: user.PublicID, IP: "192.0.2.1", UserAgent: browser, Method: models.LoginMethodPassword,
+			CreatedAt: start},
+		{Type: models.AuditLoginSucceeded, SubjectID: user.PublicID, IP: "192.0.2.2", UserAgent: browser, Method: models.LoginMethodPassword,
+			CreatedAt: start.Add(time.Minute)},
+		{Type: models.AuditPasswordReset, SubjectID: user.PublicID, IP: "192.0.2.2", CreatedAt: start.Add(2 * time.Minute)},
+		{Type: models.AuditLoginSucceeded, SubjectID: other.PublicID, IP: "192.0.2.3", CreatedAt: start.Add(3 * time.Minute)},
+	}
+	for _, event := range events {
+		if err := m.RecordAuditEvent(event); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}
+
+	entries, metadata, err := m.ListLoginHistory(user.PublicID, start.Add(-time.Minute), models.Filters{Page: 1, PageSize: 10})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(entries) != 2 || metadata.TotalRecords != 2 {
+		t.Fatalf("Expected the user's two sign ins, got %d and %+v", len(entries), metadata)
+	}
+	if !entries[0].Succeeded || entries[0].IP != "192.0.2.2" || entries[1].Succeeded || entries[1].IP != "192.0.2.1" {
+		t.Errorf("Expected the success then the failure, got %+v and %+v", entries[0], entries[1])
+	}
+	if entries[0].Method != models.LoginMethodPassword || entries[0].Browser == "" || entries[0].OS == "" {
+		t.Errorf("Expected the method and the parsed user agent, got %+v", entries[0])
+	}
+
+	if entries, _, err := m.ListLoginHistory(user.PublicID, start.Add(30*time.Second), models.Filters{Page: 1, PageSize: 10}); err != nil ||
+		len(entries) != 1 || !entries[0].Succeeded {
+		t.Errorf("Expected only the sign in after since, got %+v, %v", entries, err)
+	}
+	entries, metadata, err = m.ListLoginHistory(user.PublicID, start.Add(-time.Minute), models.Filters{Page: 2, PageSize: 1})
+	if err != nil || len(entries) != 1 || entries[0].Succeeded || metadata.LastPage != 2 {
+		t.Errorf("Expected the failure alone on the second page, got %+v, %+v, %v", entries, metadata, err)
+	}
+}
+
+func testImportExport(t *testing.T, m models.IUserModel) {
+	hash, err := models.BcryptHasher{Cost: 4}.Hash("securepassword")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	address := email(t, "imported")
+	t.Cleanup(func() { _ = m.DeleteUser(address) })
+	record := func() *models.User {
+		return &models.User{Email: address, Password: hash, DisplayName: "Imported", Verified: true,
+			CreatedAt: time.Now().Add(-24 * time.Hour), AppMetadata: json.RawMessage(`{"plan": "pro"}`)}
+	}
+
+	errs, err := m.ImportUsers([]*models.User{record()}, true)
+	if err != nil || len(errs) != 1 || errs[0] != nil {
+		t.Fatalf("Expected the dry run to accept the user, got %v, %v", errs, err)
+	}
+	if _, err := m.GetByEmail(address); !errors.Is(err, models.ErrRecordNotFound) {
+		t.Errorf("Expected a dry run to store nothing, got %v", err)
+	}
+
+	imported := record()
+	errs, err = m.ImportUsers([]*models.User{imported, record()}, false)
+	if err != nil || len(errs) != 2 || errs[0] != nil || !errors.Is(errs[1], models.ErrUserExists) {
+		t.Fatalf("Expected the first user in and the repeat refused, got %v, %v", errs, err)
+	}
+	got := get(t, m, address)
+	if got.ID != imported.ID || got.PublicID != imported.PublicID || got.DisplayName != "Imported" || !got.Verified ||
+		!sameJSON(t, got.AppMetadata, []byte(`{"plan": "pro"}`)) {
+		t.Errorf("Expected the imported user as given, got %+v", got)
+	}
+	if _, err := m.Authenticate(address, "securepassword"); err != nil {
+		t.Errorf("Expected the imported hash to sign in, got %v", err)
+	}
+	if errs, err := m.ImportUsers([]*models.User{record()}, false); err != nil || !errors.Is(errs[0], models.ErrUserExists) {
+		t.Errorf("Expected importing an existing address to be ErrUserExists, got %v, %v", errs, err)
+	}
+
+	deleted := insert(t, m, email(t, "deleted"))
+	if err := m.SoftDeleteUser(int(deleted.ID), "hash", "salt", time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	exported := map[string]models.User{}
+	err = m.ExportUsers(func(user *models.User) error {
+		exported[user.Email] = *user
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if user, ok := exported[address]; !ok || user.PublicID != imported.PublicID || user.Password != hash {
+		t.Errorf("Expected the imported user with their hash in the export, got %+v", user)
+	}
+	if _, ok := exported[deleted.Email]; ok {
+		t.Errorf("Expected a deleted user to be left out of the export")
+	}
+	stop := errors.New("stop")
+	if err := m.ExportUsers(func(*models.User) error { return stop }); !errors.Is(err, stop) {
+		t.Errorf("Expected the export to stop at the first error, got %v", err)
+	}
+}
+
+func testDataExports(t *testing.T, m models.IUserModel) {
+	user := insert(t, m, email(t, "exported"))
+	now := time.Now()
+	export := &models.DataExport{UserID: user.ID, TokenHash: "hash", TokenSalt: "salt", Content: []byte(`{"profile": {}}`),
+		CreatedAt: now, ExpiresAt: now.Add(models.DefaultDataExportTTL)}
+	if err := m.CreateDataExport(export); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if export.ID == 0 || !validator.Matches(export.PublicID, validator.UUIDRX) {
+		t.Errorf("Expected an id and a UUID public id, got %d and %q", export.ID, export.PublicID)
+	}
+	got, err := m.GetDataExport(export.PublicID)
+	if err != nil || got.UserID != user.ID || got.TokenHash != "hash" || got.TokenSalt != "salt" ||
+		string(got.Content) != string(export.Content) {
+		t.Fatalf("Expected the export back as stored, got %+v, %v", got, err)
+	}
+	if _, err := m.GetDataExport("not-a-uuid"); !errors.Is(err, models.ErrRecordNotFound) {
+		t.Errorf("Expected ErrRecordNotFound, got %v", err)
+	}
+	if err := m.CreateDataExport(&models.DataExport{UserID: missingID, CreatedAt: now, ExpiresAt: now}); err == nil {
+		t.Errorf("Expected an export for a missing user to fail")
+	}
+
+	expired := &models.DataExport{UserID: user.ID, TokenHash: "hash", TokenSalt: "salt", Content: []byte(`{}`),
+		CreatedAt: now.Add(-2 * time.Hour), ExpiresAt: now.Add(-time.Hour)}
+	if err := m.CreateDataExport(expired); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, err := m.GetDataExport(expired.PublicID); !errors.Is(err, models.ErrRecordNotFound) {
+		t.Errorf("Expected an expired export to be ErrRecordNotFound, got %v", err)
+	}
+	purged, err := m.PurgeDataExports(now)
+	if err != nil || purged < 1 {
+		t.Errorf("Expected the expired export to be purged, got %d, %v", purged, err)
+	}
+	if _, err := m.GetDataExport(export.PublicID); err != nil {
+		t.Errorf("Expected the export that hasn't expired to be kept, got %v", err)
+	}
+}
+
+func testReencryptUsers(t *testing.T, m models.IUserModel) {
+	user := insert(t, m, email(t, "reencrypted"))
+	_, err := m.ReencryptUsers(models.DefaultReencryptBatchSize)
+	if errors.Is(err, models.ErrEncryptionDisabled) {
+		// a store without a cipher has nothing to rewrite, and says so
+		return
+	}
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if got := get(t, m, user.Email); got.ID != user.ID || got.Email != user.Email {
+		t.Errorf("Expected the user to read the same after re-encrypting, got %+v", got)
+	}
+	if _, err := m.Authenticate(user.Email, "securepassword"); err != nil {
+		t.Errorf("Expected the user to still sign in, got %v", err)
+	}
+}
+
+func testConcurrent(t *testing.T, m models.IUserModel) {
+	const writers = 8
+
+	// run starts every writer at once and collects their errors
+	run := func(write func(i int) error) []error {
+		errs := make([]error, writers)
+		var start, done sync.WaitGroup
+		start.Add(1)
+		for i := 0; i < writers; i++ {
+			done.Add(1)
+			go func(i int) {
+				defer done.Done()
+				start.Wait()
+				errs[i] = write(i)
+			}(i)
+		}
+		start.Done()
+		done.Wait()
+		return errs
+	}
+	// winners counts the nil errors and checks every other one is want
+	winners := func(errs []error, want error) int {
+		won := 0
+		for _, err := range errs {
+			switch {
+			case err == nil:
+				won++
+			case !errors.Is(err, want):
+				t.Errorf("Expected %v, got %v", want, err)
+			}
+		}
+		return won
+	}
+
+	t.Run("Distinct inserts", func(t *testing.T) {
+		users := make([]*models.User, writers)
+		errs := run(func(i int) error {
+			users[i] = &models.User{Email: email(t, "writer"+strconv.Itoa(i)), Password: "securepassword", CreatedAt: time.Now()}
+			return m.Insert(users[i])
+		})
+		ids := map[int64]bool{}
+		for i, err := range errs {
+			if err != nil {
+				t.Errorf("Unexpected error inserting: %s", err)
+				continue
+			}
+			t.Cleanup(func() { _ = m.DeleteUser(users[i].Email) })
+			ids[users[i].ID] = true
+		}
+		if len(ids) != writers {
+			t.Errorf("Expected %d distinct ids, got %v", writers, ids)
+		}
+	})
+
+	t.Run("Same email", func(t *testing.T) {
+		address := email(t, "contested")
+		t.Cleanup(func() { _ = m.DeleteUser(address) })
+		errs := run(func(int) error {
+			return m.Insert(&models.User{Email: address, Password: "securepassword", CreatedAt: time.Now()})
+		})
+		if won := winners(errs, models.ErrDuplicateEmail); won != 1 {
+			t.Errorf("Expected exactly one insert to win, got %d", won)
+		}
+	})
+
+	t.Run("Same version", func(t *testing.T) {
+		user := insert(t, m, email(t, "versioned"))
+		read := get(t, m, user.Email)
+		errs := run(func(i int) error {
+			update := read
+			update.DisplayName = "Writer " + strconv.Itoa(i)
+			return m.UpdateProfile(&update)
+		})
+		if won := winners(errs, models.ErrEditConflict); won != 1 {
+			t.Errorf("Expected exactly one update to win, got %d", won)
+		}
+		if got := get(t, m, user.Email); got.Version != read.Version+1 {
+			t.Errorf("Expected one write on top of version %d, got %d", read.Version, got.Version)
+		}
+
+		errs = run(func(i int) error {
+			return m.EnterPasswordHash(user.Email, "hash"+strconv.Itoa(i), "salt", read.Version+1)
+		})
+		if won := winners(errs, models.ErrEditConflict); won != 1 {
+			t.Errorf("Expected exactly one reset token to be stored, got %d", won)
+		}
+	})
+}
@@ -0,0 +1,380 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"the_lonely_road/validator"
+	"time"
+)
+
+const (
+	// DefaultOrgSlug is the organization the migration puts every existing user in and new users join on sign up,
+	// so single-tenant deployments never have to think about organizations
+	DefaultOrgSlug = "default"
+
+	OrgRoleOwner  = "owner"
+	OrgRoleAdmin  = "admin"
+	OrgRoleMember = "member"
+)
+
+var (
+	ErrDuplicateSlug = errors.New("duplicate organization slug")
+	ErrNotMember     = errors.New("user is not a member of the organization")
+	// ErrLastOwner stops an organization from being left with nobody who can manage it
+	ErrLastOwner = errors.New("organization must keep at least one owner")
+)
+
+type Organization struct {
+	ID        int64     `json:"-"`
+	Slug      string    `json:"slug"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Membership is a user's place in an organization, Role is one of the OrgRole constants
+type Membership struct {
+	OrgID        int64     `json:"-"`
+	OrgSlug      string    `json:"org"`
+	UserID       int64     `json:"-"`
+	UserPublicID string    `json:"user_id"`
+	Email        string    `json:"email"`
+	Role         string    `json:"role"`
+	CreatedAt    time.Time `json:"joined_at"`
+}
+
+func ValidateOrganization(v *validator.Validator, org *Organization) {
+	v.Check(org.Name != "", "Name", "must be provided")
+	v.Check(validator.MaxChars(org.Name, 100), "Name", "must not be more than 100 characters long")
+	v.Check(validator.Matches(org.Slug, validator.SlugRX), "Slug", "must be lowercase letters, digits and hyphens, up to 40 characters")
+}
+
+const membershipColumns = `m.organization_id, o.slug, m.user_id, u.public_id, u.email, m.role, m.created_at`
+
+const membershipJoins = `FROM memberships m
+	JOIN organizations o ON o.id = m.organization_id
+	JOIN users u ON u.id = m.user_id`
+
+func (membership *Membership) scanDestinations() []any {
+	return []any{&membership.OrgID, &membership.OrgSlug, &membership.UserID, &membership.UserPublicID,
+		&membership.Email, &membership.Role, &membership.CreatedAt}
+}
+
+// CreateOrganization inserts org and makes ownerID its first owner
+func (m *UserModel) CreateOrganization(org *Organization, ownerID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `INSERT INTO organizations (slug, name, created_at) VALUES ($1, $2, $3) RETURNING id`
+	err = tx.QueryRowContext(ctx, query, org.Slug, org.Name, org.CreatedAt.UTC()).Scan(&org.ID)
+	if err != nil {
+		switch {
+		case uniqueViolation(err, "organizations_slug_key"):
+			return ErrDuplicateSlug
+		default:
+			return err
+		}
+	}
+
+	query = `INSERT INTO memberships (organization_id, user_id, role, created_at) VALUES ($1, $2, $3, $4)`
+	_, err = tx.ExecContext(ctx, query, org.ID, ownerID, OrgRoleOwner, org.CreatedAt.UTC())
+	if err != nil {
+		switch {
+		case foreignKeyViolation(err, "memberships_user_id_fkey"):
+			return errors.New("user not found")
+		default:
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (m *UserModel) GetOrganization(slug string) (*Organization, error) {
+	query := `SELECT id, slug, name, created_at FROM organizations WHERE slug = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var org Organization
+	err := m.DB.QueryRowContext(ctx, query, slug).Scan(&org.ID, &org.Slug, &org.Name, &org.CreatedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &org, nil
+}
+
+// GetMembership returns ErrNotMember when the organization doesn't exist or the user isn't in it
+func (m *UserModel) GetMembership(slug string, userID int) (*Membership, error) {
+	query := `SELECT ` + membershipColumns + ` ` + membershipJoins + ` WHERE o.slug = $1 AND m.user_id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var membership Membership
+	err := m.DB.QueryRowContext(ctx, query, slug, userID).Scan(membership.scanDestinations()...)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrNotMember
+		default:
+			return nil, err
+		}
+	}
+	membership.Email, err = m.Cipher.Decrypt(membership.Email, membership.UserPublicID)
+	if err != nil {
+		return nil, err
+	}
+	return &membership, nil
+}
+
+// ListMembers returns everyone in the organization, oldest membership first
+func (m *UserModel) ListMembers(orgID int) ([]*Membership, error) {
+	query := `SELECT ` + membershipColumns + ` ` + membershipJoins + `
+	WHERE m.organization_id = $1
+	ORDER BY m.created_at, m.user_id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, orgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []*Membership{}
+	for rows.Next() {
+		var membership Membership
+		err = rows.Scan(membership.scanDestinations()...)
+		if err != nil {
+			return nil, err
+		}
+		membership.Email, err = m.Cipher.Decrypt(membership.Email, membership.UserPublicID)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, &membership)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+// ListMemberships returns every organization the user is in, the one joined first leads
+func (m *UserModel) ListMemberships(userID int) ([]*Membership, error) {
+	query := `SELECT ` + membershipColumns + ` ` + membershipJoins + `
+	WHERE m.user_id = $1
+	ORDER BY m.created_at, o.slug`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	memberships := []*Membership{}
+	for rows.Next() {
+		var membership Membership
+		err = rows.Scan(membership.scanDestinations()...)
+		if err != nil {
+			return nil, err
+		}
+		membership.Email, err = m.Cipher.Decrypt(membership.Email, membership.UserPublicID)
+		if err != nil {
+			return nil, err
+		}
+		memberships = append(memberships, &membership)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return memberships, nil
+}
+
+// RemoveMember takes the user out of the organization, the last owner can't be removed
+func (m *UserModel) RemoveMember(orgID, userID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// lock the owners so two owners can't remove each other at the same time
+	rows, err := tx.QueryContext(ctx, m.rebind(`SELECT user_id FROM memberships WHERE organization_id = $1 AND role = $2 FOR UPDATE`),
+		orgID, OrgRoleOwner)
+	if err != nil {
+		return err
+	}
+	owners := 0
+	isOwner := false
+	for rows.Next() {
+		var ownerID int
+		err = rows.Scan(&ownerID)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		owners++
+		isOwner = isOwner || ownerID == userID
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	if isOwner && owners == 1 {
+		return ErrLastOwner
+	}
+
+	result, err := tx.ExecContext(ctx, `DELETE FROM memberships WHERE organization_id = $1 AND user_id = $2`, orgID, userID)
+	if err != nil {
+		return err
+	}
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		return ErrNotMember
+	}
+
+	return tx.Commit()
+}
+
+// defaultOrg stands in for the organization the migration seeds, the mock creates it on first use
+func (mockUM *UserModelMock) defaultOrg() *Organization {
+	for _, org := range mockUM.Orgs {
+		if org.Slug == DefaultOrgSlug {
+			return org
+		}
+	}
+	org := &Organization{ID: int64(len(mockUM.Orgs) + 1), Slug: DefaultOrgSlug, Name: "Default", CreatedAt: time.Now()}
+	mockUM.Orgs = append(mockUM.Orgs, org)
+	return org
+}
+
+func (mockUM *UserModelMock) addMembership(org *Organization, user *User, role string) {
+	mockUM.Memberships = append(mockUM.Memberships, &Membership{
+		OrgID:     org.ID,
+		OrgSlug:   org.Slug,
+		UserID:    user.ID,
+		Role:      role,
+		CreatedAt: time.Now(),
+	})
+}
+
+// withUser copies membership with the user's current details filled in, the way the join does
+func (mockUM *UserModelMock) withUser(membership *Membership) *Membership {
+	copied := *membership
+	if user, err := mockUM.GetByID(int(membership.UserID)); err == nil {
+		copied.UserPublicID = user.PublicID
+		copied.Email = user.Email
+	}
+	return &copied
+}
+
+// dropMemberships mirrors the ON DELETE CASCADE on memberships.user_id
+func (mockUM *UserModelMock) dropMemberships(userID int64) {
+	kept := mockUM.Memberships[:0]
+	for _, membership := range mockUM.Memberships {
+		if membership.UserID != userID {
+			kept = append(kept, membership)
+		}
+	}
+	mockUM.Memberships = kept
+}
+
+func (mockUM *UserModelMock) CreateOrganization(org *Organization, ownerID int) error {
+	mockUM.defaultOrg()
+	for _, existing := range mockUM.Orgs {
+		if existing.Slug == org.Slug {
+			return ErrDuplicateSlug
+		}
+	}
+	owner, err := mockUM.GetByID(ownerID)
+	if err != nil {
+		return errors.New("user not found")
+	}
+	org.ID = int64(len(mockUM.Orgs) + 1)
+	mockUM.Orgs = append(mockUM.Orgs, org)
+	mockUM.addMembership(org, owner, OrgRoleOwner)
+	return nil
+}
+
+func (mockUM *UserModelMock) GetOrganization(slug string) (*Organization, error) {
+	mockUM.defaultOrg()
+	for _, org := range mockUM.Orgs {
+		if org.Slug == slug {
+			return org, nil
+		}
+	}
+	return nil, ErrRecordNotFound
+}
+
+func (mockUM *UserModelMock) GetMembership(slug string, userID int) (*Membership, error) {
+	for _, membership := range mockUM.Memberships {
+		if membership.OrgSlug == slug && membership.UserID == int64(userID) {
+			return mockUM.withUser(membership), nil
+		}
+	}
+	return nil, ErrNotMember
+}
+
+func (mockUM *UserModelMock) ListMembers(orgID int) ([]*Membership, error) {
+	members := []*Membership{}
+	for _, membership := range mockUM.Memberships {
+		if membership.OrgID == int64(orgID) {
+			members = append(members, mockUM.withUser(membership))
+		}
+	}
+	return members, nil
+}
+
+func (mockUM *UserModelMock) ListMemberships(userID int) ([]*Membership, error) {
+	memberships := []*Membership{}
+	for _, membership := range mockUM.Memberships {
+		if membership.UserID == int64(userID) {
+			memberships = append(memberships, mockUM.withUser(membership))
+		}
+	}
+	return memberships, nil
+}
+
+func (mockUM *UserModelMock) RemoveMember(orgID, userID int) error {
+	owners := 0
+	index := -1
+	for i, membership := range mockUM.Memberships {
+		if membership.OrgID != int64(orgID) {
+			continue
+		}
+		if membership.Role == OrgRoleOwner {
+			owners++
+		}
+		if membership.UserID == int64(userID) {
+			index = i
+		}
+	}
+	if index == -1 {
+		return ErrNotMember
+	}
+	if mockUM.Memberships[index].Role == OrgRoleOwner && owners == 1 {
+		return ErrLastOwner
+	}
+	mockUM.Memberships = append(mockUM.Memberships[:index], mockUM.Memberships[index+1:]...)
+	return nil
+}
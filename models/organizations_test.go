@@ -0,0 +1,87 @@
+package models
+
+import (
+	"errors"
+	"testing"
+	"the_lonely_road/validator"
+)
+
+func TestUserModelMock_Organizations(t *testing.T) {
+	userModel := UserModelMock{DB: []*User{}}
+	for i, email := range []string{"owner@localhost", "member@localhost"} {
+		err := userModel.Insert(&User{ID: int64(i + 1), Email: email, Password: "veryinsecurepassword"})
+		if err != nil {
+			t.Fatalf("Expected no error, got %s", err)
+		}
+	}
+
+	membership, err := userModel.GetMembership(DefaultOrgSlug, 2)
+	if err != nil {
+		t.Fatalf("Expected new users to join the default organization, got %s", err)
+	}
+	if membership.Role != OrgRoleMember || membership.Email != "member@localhost" {
+		t.Errorf("Expected member@localhost as a member, got %+v", membership)
+	}
+
+	org := &Organization{Slug: "acme", Name: "Acme"}
+	err = userModel.CreateOrganization(org, 1)
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	err = userModel.CreateOrganization(&Organization{Slug: "acme", Name: "Acme again"}, 2)
+	if !errors.Is(err, ErrDuplicateSlug) {
+		t.Errorf("Expected ErrDuplicateSlug, got %v", err)
+	}
+	_, err = userModel.GetMembership("acme", 2)
+	if !errors.Is(err, ErrNotMember) {
+		t.Errorf("Expected ErrNotMember, got %v", err)
+	}
+
+	members, err := userModel.ListMembers(int(org.ID))
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	if len(members) != 1 || members[0].Role != OrgRoleOwner || members[0].UserPublicID == "" {
+		t.Errorf("Expected the creator as the only owner, got %+v", members)
+	}
+
+	err = userModel.RemoveMember(int(org.ID), 1)
+	if !errors.Is(err, ErrLastOwner) {
+		t.Errorf("Expected ErrLastOwner, got %v", err)
+	}
+	err = userModel.RemoveMember(int(org.ID), 2)
+	if !errors.Is(err, ErrNotMember) {
+		t.Errorf("Expected ErrNotMember, got %v", err)
+	}
+
+	err = userModel.DeleteUser("member@localhost")
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	_, err = userModel.GetMembership(DefaultOrgSlug, 2)
+	if !errors.Is(err, ErrNotMember) {
+		t.Errorf("Expected memberships to go with the user, got %v", err)
+	}
+}
+
+func TestValidateOrganization(t *testing.T) {
+	tests := []struct {
+		name  string
+		org   Organization
+		valid bool
+	}{
+		{name: "Valid", org: Organization{Name: "Acme", Slug: "acme"}, valid: true},
+		{name: "Missing name", org: Organization{Slug: "acme"}, valid: false},
+		{name: "Uppercase slug", org: Organization{Name: "Acme", Slug: "Acme"}, valid: false},
+		{name: "Missing slug", org: Organization{Name: "Acme"}, valid: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			v := validator.New()
+			ValidateOrganization(v, &test.org)
+			if v.Valid() != test.valid {
+				t.Errorf("Expected valid to be %v, got %v: %v", test.valid, v.Valid(), v.Errors)
+			}
+		})
+	}
+}
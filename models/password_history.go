@@ -0,0 +1,64 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var ErrPasswordReused = errors.New("password was used recently")
+
+// DefaultPasswordHistory is how many previous passwords are remembered when nothing is configured
+const DefaultPasswordHistory = 5
+
+func matchesAny(hasher PasswordHasher, password string, hashes []string) bool {
+	for _, hash := range hashes {
+		if _, err := hasher.Verify(password, hash); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// passwordHistory returns the newest PasswordHistory hashes for the user, newest first
+func (m *UserModel) passwordHistory(ctx context.Context, tx *sql.Tx, userID int) ([]string, error) {
+	if m.PasswordHistory < 1 {
+		return nil, nil
+	}
+	rows, err := tx.QueryContext(ctx, `SELECT password_hash FROM password_history
+	WHERE user_id = $1
+	ORDER BY created_at DESC, id DESC
+	LIMIT $2`, userID, m.PasswordHistory)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hashes := []string{}
+	for rows.Next() {
+		var hash string
+		err = rows.Scan(&hash)
+		if err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, hash)
+	}
+	return hashes, rows.Err()
+}
+
+// rememberPassword stores the outgoing hash and drops anything older than the newest PasswordHistory rows
+func (m *UserModel) rememberPassword(ctx context.Context, tx *sql.Tx, userID int, passwordHash string) error {
+	if m.PasswordHistory > 0 {
+		_, err := tx.ExecContext(ctx, `INSERT INTO password_history (user_id, password_hash, created_at) VALUES ($1, $2, $3)`,
+			userID, passwordHash, time.Now().UTC())
+		if err != nil {
+			return err
+		}
+	}
+	_, err := tx.ExecContext(ctx, `DELETE FROM password_history
+	WHERE user_id = $1 AND id NOT IN (
+		SELECT id FROM password_history WHERE user_id = $1 ORDER BY created_at DESC, id DESC LIMIT $2
+	)`, userID, m.PasswordHistory)
+	return err
+}
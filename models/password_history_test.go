@@ -0,0 +1,35 @@
+package models
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestUserModelMock_PasswordHistory(t *testing.T) {
+	userModel := UserModelMock{DB: []*User{}, PasswordHistory: 2}
+	err := userModel.Insert(&User{ID: 1, Email: "history@localhost", Password: "password-0"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+
+	for _, password := range []string{"password-1", "password-2", "password-3"} {
+		err = userModel.UpdatePassword(1, password, userModel.DB[0].Version)
+		if err != nil {
+			t.Fatalf("Expected no error, got %s", err)
+		}
+	}
+	if len(userModel.DB[0].PasswordHistory) != 2 {
+		t.Errorf("Expected history to be trimmed to 2, got %d", len(userModel.DB[0].PasswordHistory))
+	}
+
+	for _, password := range []string{"password-3", "password-2", "password-1"} {
+		err = userModel.UpdatePassword(1, password, userModel.DB[0].Version)
+		if !errors.Is(err, ErrPasswordReused) {
+			t.Errorf("Expected ErrPasswordReused for %s, got %v", password, err)
+		}
+	}
+	err = userModel.UpdatePassword(1, "password-0", userModel.DB[0].Version)
+	if err != nil {
+		t.Errorf("Expected a password older than the history to be allowed, got %s", err)
+	}
+}
@@ -0,0 +1,216 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"the_lonely_road/validator"
+	"time"
+)
+
+// DefaultDataExportTTL is how long the emailed link to a personal data export works
+const DefaultDataExportTTL = 24 * time.Hour
+
+// PersonalData is everything stored about one user, as handed over for a data access request. The profile is the
+// same view of the user the API gives, so password hashes and token hashes are already left out.
+type PersonalData struct {
+	ExportedAt    time.Time            `json:"exported_at"`
+	Profile       *User                `json:"profile"`
+	Metadata      PersonalMetadata     `json:"metadata"`
+	Organizations []*Membership        `json:"organizations"`
+	Sessions      []*LoginHistoryEntry `json:"sessions"`
+	AuditEvents   []*AuditEvent        `json:"audit_events"`
+}
+
+// PersonalMetadata is the user's app_metadata and user_metadata, repeated on their own so they're easy to find
+type PersonalMetadata struct {
+	App  json.RawMessage `json:"app"`
+	User json.RawMessage `json:"user"`
+}
+
+// personalDataPageSize is how many audit events or sign ins are read at a time while collecting
+const personalDataPageSize = 100
+
+// CollectPersonalData gathers user's profile, organizations, the sign ins still kept since sessionsSince and every
+// audit event where they are the actor or subject, oldest first. Events where they acted on someone else keep what
+// they did but not who it was done to, see redactSubject.
+func CollectPersonalData(users IUserModel, user *User, sessionsSince time.Time) (*PersonalData, error) {
+	data := &PersonalData{
+		ExportedAt:  time.Now(),
+		Profile:     user,
+		Metadata:    PersonalMetadata{App: user.AppMetadata, User: user.UserMetadata},
+		Sessions:    []*LoginHistoryEntry{},
+		AuditEvents: []*AuditEvent{},
+	}
+
+	var err error
+	data.Organizations, err = users.ListMemberships(int(user.ID))
+	if err != nil {
+		return nil, err
+	}
+
+	for page := 1; ; page++ {
+		filters := Filters{Page: page, PageSize: personalDataPageSize}
+		sessions, metadata, err := users.ListLoginHistory(user.PublicID, sessionsSince, filters)
+		if err != nil {
+			return nil, err
+		}
+		data.Sessions = append(data.Sessions, sessions...)
+		if page >= metadata.LastPage {
+			break
+		}
+	}
+
+	for page := 1; ; page++ {
+		filters := AuditFilters{
+			Filters: Filters{Page: page, PageSize: personalDataPageSize, Sort: "created_at", SortSafelist: AuditSortSafelist},
+			User:    user.PublicID,
+		}
+		events, metadata, err := users.ListAuditEvents(filters)
+		if err != nil {
+			return nil, err
+		}
+		for _, event := range events {
+			data.AuditEvents = append(data.AuditEvents, redactSubject(event, user.PublicID))
+		}
+		if page >= metadata.LastPage {
+			break
+		}
+	}
+
+	return data, nil
+}
+
+// redactSubject is a copy of event without the account it was about and that account's address, unless that account is
+// publicID. The IP and user agent stay, they come from the request publicID made.
+func redactSubject(event *AuditEvent, publicID string) *AuditEvent {
+	redacted := *event
+	if redacted.SubjectID != publicID {
+		redacted.SubjectID, redacted.Email = "", ""
+	}
+	return &redacted
+}
+
+// DataExport is a finished personal data export waiting to be downloaded. Only the hash of the emailed token is kept,
+// and the content is encrypted like user emails when field encryption is on.
+type DataExport struct {
+	ID        int64
+	PublicID  string
+	UserID    int64
+	TokenHash string
+	TokenSalt string
+	Content   []byte
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+func (m *UserModel) CreateDataExport(export *DataExport) error {
+	var err error
+	if export.PublicID == "" {
+		export.PublicID, err = NewPublicID()
+		if err != nil {
+			return err
+		}
+	}
+	query := `INSERT INTO data_exports (public_id, user_id, token_hash, token_salt, content, created_at, expires_at)
+	VALUES ($1, $2, $3, $4, $5, $6, $7)
+	RETURNING id`
+	content, err := m.Cipher.Encrypt(string(export.Content), export.PublicID)
+	if err != nil {
+		return err
+	}
+	args := []any{export.PublicID, export.UserID, export.TokenHash, export.TokenSalt, []byte(content), export.CreatedAt.UTC(),
+		export.ExpiresAt.UTC()}
+
+	// the content can run to megabytes
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&export.ID)
+}
+
+// GetDataExport returns ErrRecordNotFound for an export that doesn't exist or has expired
+func (m *UserModel) GetDataExport(publicID string) (*DataExport, error) {
+	if !validator.Matches(publicID, validator.UUIDRX) {
+		return nil, ErrRecordNotFound
+	}
+	query := `SELECT id, public_id, user_id, token_hash, token_salt, content, created_at, expires_at
+	FROM data_exports
+	WHERE public_id = $1 AND expires_at > $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	var export DataExport
+	err := m.DB.QueryRowContext(ctx, query, publicID, time.Now().UTC()).Scan(&export.ID, &export.PublicID, &export.UserID,
+		&export.TokenHash, &export.TokenSalt, &export.Content, &export.CreatedAt, &export.ExpiresAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	content, err := m.Cipher.Decrypt(string(export.Content), export.PublicID)
+	if err != nil {
+		return nil, err
+	}
+	export.Content = []byte(content)
+	return &export, nil
+}
+
+// PurgeDataExports deletes the exports whose link has expired
+func (m *UserModel) PurgeDataExports(now time.Time) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, `DELETE FROM data_exports WHERE expires_at <= $1`, now.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (mockUM *UserModelMock) CreateDataExport(export *DataExport) error {
+	var err error
+	if export.PublicID == "" {
+		export.PublicID, err = NewPublicID()
+		if err != nil {
+			return err
+		}
+	}
+	if _, err := mockUM.GetByID(int(export.UserID)); err != nil {
+		return ErrRecordNotFound
+	}
+	// ids keep counting up after PurgeDataExports removes exports
+	export.ID = 1
+	if n := len(mockUM.DataExports); n > 0 {
+		export.ID = mockUM.DataExports[n-1].ID + 1
+	}
+	mockUM.DataExports = append(mockUM.DataExports, export)
+	return nil
+}
+
+func (mockUM *UserModelMock) GetDataExport(publicID string) (*DataExport, error) {
+	now := time.Now()
+	for _, export := range mockUM.DataExports {
+		if publicID != "" && export.PublicID == publicID && export.ExpiresAt.After(now) {
+			return export, nil
+		}
+	}
+	return nil, ErrRecordNotFound
+}
+
+func (mockUM *UserModelMock) PurgeDataExports(now time.Time) (int64, error) {
+	kept := mockUM.DataExports[:0]
+	var purged int64
+	for _, export := range mockUM.DataExports {
+		if !export.ExpiresAt.After(now) {
+			purged++
+			continue
+		}
+		kept = append(kept, export)
+	}
+	mockUM.DataExports = kept
+	return purged, nil
+}
@@ -0,0 +1,103 @@
+package models
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCollectPersonalData(t *testing.T) {
+	mock := &UserModelMock{DB: []*User{}, Hasher: Hasher{Current: testBcrypt}}
+	alice := &User{ID: 1, Email: "alice@example.com", Password: "securepassword", CreatedAt: time.Now(),
+		UserMetadata: []byte(`{"theme":"dark"}`), PasswordResetHashToken: "resethash"}
+	err := mock.Insert(alice)
+	if err != nil {
+		t.Fatalf("Unexpected error inserting user: %s", err)
+	}
+	err = mock.Insert(&User{ID: 2, Email: "bob@example.com", Password: "securepassword", CreatedAt: time.Now()})
+	if err != nil {
+		t.Fatalf("Unexpected error inserting user: %s", err)
+	}
+	bob, _ := mock.GetByEmail("bob@example.com")
+
+	// more than two pages of sign ins, so every page has to be read
+	start := time.Now().Add(-time.Hour)
+	_ = mock.RecordAuditEvent(&AuditEvent{Type: AuditLoginSucceeded, SubjectID: alice.PublicID, CreatedAt: start.Add(-48 * time.Hour)})
+	_ = mock.RecordAuditEvent(&AuditEvent{Type: AuditLoginSucceeded, SubjectID: bob.PublicID, CreatedAt: start})
+	// alice acting on bob's account is hers to see, who she did it to isn't
+	onBob := &AuditEvent{Type: AuditPasswordResetRequested, ActorID: alice.PublicID, SubjectID: bob.PublicID, Email: bob.Email,
+		IP: "192.0.2.1", CreatedAt: start}
+	_ = mock.RecordAuditEvent(onBob)
+	for i := 0; i < 2*personalDataPageSize+10; i++ {
+		_ = mock.RecordAuditEvent(&AuditEvent{Type: AuditLoginSucceeded, SubjectID: alice.PublicID, Method: LoginMethodPassword,
+			CreatedAt: start.Add(time.Duration(i) * time.Second)})
+	}
+
+	data, err := CollectPersonalData(mock, alice, start.Add(-time.Minute))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(data.AuditEvents) != 2*personalDataPageSize+12 {
+		t.Errorf("Expected every one of alice's audit events, got %d", len(data.AuditEvents))
+	}
+	for i := 1; i < len(data.AuditEvents); i++ {
+		if data.AuditEvents[i].CreatedAt.Before(data.AuditEvents[i-1].CreatedAt) {
+			t.Fatalf("Expected audit events oldest first, event %d is older than the one before", i)
+		}
+	}
+	if len(data.Sessions) != 2*personalDataPageSize+10 {
+		t.Errorf("Expected only the sign ins since sessionsSince, got %d", len(data.Sessions))
+	}
+	if len(data.Organizations) != 1 || data.Organizations[0].OrgSlug != DefaultOrgSlug {
+		t.Errorf("Expected alice's default organization, got %+v", data.Organizations)
+	}
+
+	out, err := json.Marshal(data)
+	if err != nil {
+		t.Fatalf("Unexpected error marshaling: %s", err)
+	}
+	if strings.Contains(string(out), alice.Password) || strings.Contains(string(out), "resethash") {
+		t.Errorf("Expected password and token hashes to be left out of the export")
+	}
+	if strings.Contains(string(out), bob.PublicID) || strings.Contains(string(out), bob.Email) {
+		t.Errorf("Expected bob to be left out of alice's export")
+	}
+	if !strings.Contains(string(out), `"type":"`+AuditPasswordResetRequested+`","actor_id":"`+alice.PublicID+`","ip":"192.0.2.1"`) {
+		t.Errorf("Expected what alice did to bob to be kept without bob")
+	}
+	if onBob.SubjectID != bob.PublicID || onBob.Email != bob.Email {
+		t.Errorf("Expected the audit log itself to be left alone, got %+v", onBob)
+	}
+	if !strings.Contains(string(out), `"metadata":{"app":{},"user":{"theme":"dark"}}`) {
+		t.Errorf("Expected the metadata as JSON objects")
+	}
+}
+
+func TestUserModelMock_DataExports(t *testing.T) {
+	mock := &UserModelMock{DB: []*User{{ID: 1, Email: "alice@example.com"}}}
+	now := time.Now()
+	current := &DataExport{UserID: 1, Content: []byte(`{}`), CreatedAt: now, ExpiresAt: now.Add(time.Hour)}
+	expired := &DataExport{UserID: 1, Content: []byte(`{}`), CreatedAt: now.Add(-2 * time.Hour), ExpiresAt: now.Add(-time.Hour)}
+	for _, export := range []*DataExport{current, expired} {
+		err := mock.CreateDataExport(export)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}
+	if err := mock.CreateDataExport(&DataExport{UserID: 9}); err != ErrRecordNotFound {
+		t.Errorf("Expected an export for an unknown user to fail, got %v", err)
+	}
+
+	if _, err := mock.GetDataExport(current.PublicID); err != nil {
+		t.Errorf("Expected the current export, got %s", err)
+	}
+	if _, err := mock.GetDataExport(expired.PublicID); err != ErrRecordNotFound {
+		t.Errorf("Expected an expired export not to be found, got %v", err)
+	}
+
+	purged, err := mock.PurgeDataExports(now)
+	if err != nil || purged != 1 || len(mock.DataExports) != 1 || mock.DataExports[0] != current {
+		t.Errorf("Expected only the expired export to be purged, got %d, %v", purged, err)
+	}
+}
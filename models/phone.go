@@ -0,0 +1,273 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"the_lonely_road/validator"
+	"time"
+)
+
+// SMS codes are texted for one of these, each user has at most one code per purpose
+const (
+	SMSCodeVerifyPhone   = "verify_phone"
+	SMSCodePasswordReset = "password_reset"
+)
+
+// DefaultSMSCodeTTL is how long a texted code works for
+const DefaultSMSCodeTTL = 10 * time.Minute
+
+// MaxSMSCodeAttempts is how many wrong guesses use up a code, six digits would be guessed without a limit
+const MaxSMSCodeAttempts = 5
+
+// ErrPhoneChanged means the phone number is no longer the one a code was sent to
+var ErrPhoneChanged = errors.New("phone number changed")
+
+// SMSCode is the last code texted to Phone for Purpose, sending another replaces it. Only the hash is kept.
+type SMSCode struct {
+	ID        int64
+	UserID    int64
+	Purpose   string
+	Phone     string
+	CodeHash  string
+	CodeSalt  string
+	Attempts  int
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+// Usable reports whether the code can still be tried at now
+func (code *SMSCode) Usable(now time.Time) bool {
+	return code.Attempts < MaxSMSCodeAttempts && now.Before(code.ExpiresAt)
+}
+
+// NormalizePhone drops the spaces, dashes, dots and brackets people write phone numbers with, what is left is
+// checked by ValidatePhone
+func NormalizePhone(phone string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '-', '.', '(', ')':
+			return -1
+		}
+		return r
+	}, strings.TrimSpace(phone))
+}
+
+func ValidatePhone(v *validator.Validator, phone string) {
+	v.Check(phone != "", "Phone", "must be provided")
+	v.Check(validator.Matches(phone, validator.PhoneRX), "Phone", "must be an international number, a + then the country code and number")
+}
+
+// SetPhone changes the user's phone number, or removes it when phone is empty. A new number starts unverified and the
+// codes sent to the old one stop working, setting the same number again keeps it verified.
+func (m *UserModel) SetPhone(userID int, phone string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// the right hand sides all see the row as it was, so phone_verified compares against the old number
+	query := `UPDATE users
+	SET phone_verified = phone_verified AND phone = $1,
+		phone = $1,
+		updated_at = $3,
+		version = version + 1
+	WHERE id = $2`
+	result, err := tx.ExecContext(ctx, query, phone, userID, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	_, err = tx.ExecContext(ctx, `DELETE FROM sms_codes WHERE user_id = $1 AND phone <> $2`, userID, phone)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// VerifyPhone marks phone as verified, as long as it is still the user's number
+func (m *UserModel) VerifyPhone(userID int, phone string) error {
+	query := `UPDATE users
+	SET phone_verified = true,
+		updated_at = $3,
+		version = version + 1
+	WHERE id = $1 AND phone = $2 AND phone <> ''`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, userID, phone, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		return ErrPhoneChanged
+	}
+	return nil
+}
+
+// CreateSMSCode stores code, replacing any code the user still had for the same purpose
+func (m *UserModel) CreateSMSCode(code *SMSCode) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM sms_codes WHERE user_id = $1 AND purpose = $2`, code.UserID, code.Purpose)
+	if err != nil {
+		return err
+	}
+	query := `INSERT INTO sms_codes (user_id, purpose, phone, code_hash, code_salt, attempts, created_at, expires_at)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	RETURNING id`
+	args := []any{code.UserID, code.Purpose, code.Phone, code.CodeHash, code.CodeSalt, code.Attempts, code.CreatedAt.UTC(),
+		code.ExpiresAt.UTC()}
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&code.ID)
+	if err != nil {
+		switch {
+		case foreignKeyViolation(err, "sms_codes_user_id_fkey"):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetSMSCode returns the user's code for purpose, expired or used up codes included so callers can tell why it failed
+func (m *UserModel) GetSMSCode(userID int, purpose string) (*SMSCode, error) {
+	query := `SELECT id, user_id, purpose, phone, code_hash, code_salt, attempts, created_at, expires_at
+	FROM sms_codes
+	WHERE user_id = $1 AND purpose = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var code SMSCode
+	err := m.DB.QueryRowContext(ctx, query, userID, purpose).Scan(&code.ID, &code.UserID, &code.Purpose, &code.Phone,
+		&code.CodeHash, &code.CodeSalt, &code.Attempts, &code.CreatedAt, &code.ExpiresAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &code, nil
+}
+
+// RecordSMSCodeAttempt takes one of the code's attempts before a guess is compared, so guesses made at the same time
+// can't get past MaxSMSCodeAttempts. It returns ErrRecordNotFound once they are used up or the code is gone.
+func (m *UserModel) RecordSMSCodeAttempt(codeID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, `UPDATE sms_codes SET attempts = attempts + 1 WHERE id = $1 AND attempts < $2`, codeID,
+		MaxSMSCodeAttempts)
+	if err != nil {
+		return err
+	}
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// DeleteSMSCode throws away a code once it has been used, a code that is already gone is not an error
+func (m *UserModel) DeleteSMSCode(codeID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, `DELETE FROM sms_codes WHERE id = $1`, codeID)
+	return err
+}
+
+func (mockUM *UserModelMock) SetPhone(userID int, phone string) error {
+	user, err := mockUM.GetByID(userID)
+	if err != nil {
+		return ErrRecordNotFound
+	}
+	user.PhoneVerified = user.PhoneVerified && user.Phone == phone
+	user.Phone = phone
+	user.UpdatedAt = time.Now()
+	user.Version++
+	mockUM.dropSMSCodes(func(code *SMSCode) bool { return code.UserID == user.ID && code.Phone != phone })
+	return nil
+}
+
+func (mockUM *UserModelMock) VerifyPhone(userID int, phone string) error {
+	user, err := mockUM.GetByID(userID)
+	if err != nil || user.Phone == "" || user.Phone != phone {
+		return ErrPhoneChanged
+	}
+	user.PhoneVerified = true
+	user.UpdatedAt = time.Now()
+	user.Version++
+	return nil
+}
+
+func (mockUM *UserModelMock) CreateSMSCode(code *SMSCode) error {
+	if _, err := mockUM.GetByID(int(code.UserID)); err != nil {
+		return ErrRecordNotFound
+	}
+	// the next id after the highest one still stored
+	code.ID = 1
+	for _, existing := range mockUM.SMSCodes {
+		if existing.ID >= code.ID {
+			code.ID = existing.ID + 1
+		}
+	}
+	mockUM.dropSMSCodes(func(existing *SMSCode) bool {
+		return existing.UserID == code.UserID && existing.Purpose == code.Purpose
+	})
+	mockUM.SMSCodes = append(mockUM.SMSCodes, code)
+	return nil
+}
+
+func (mockUM *UserModelMock) GetSMSCode(userID int, purpose string) (*SMSCode, error) {
+	for _, code := range mockUM.SMSCodes {
+		if code.UserID == int64(userID) && code.Purpose == purpose {
+			return code, nil
+		}
+	}
+	return nil, ErrRecordNotFound
+}
+
+func (mockUM *UserModelMock) RecordSMSCodeAttempt(codeID int) error {
+	for _, code := range mockUM.SMSCodes {
+		if code.ID == int64(codeID) && code.Attempts < MaxSMSCodeAttempts {
+			code.Attempts++
+			return nil
+		}
+	}
+	return ErrRecordNotFound
+}
+
+func (mockUM *UserModelMock) DeleteSMSCode(codeID int) error {
+	mockUM.dropSMSCodes(func(code *SMSCode) bool { return code.ID == int64(codeID) })
+	return nil
+}
+
+// dropSMSCodes removes the codes drop picks, the mock's stand in for deleting rows and ON DELETE CASCADE
+func (mockUM *UserModelMock) dropSMSCodes(drop func(code *SMSCode) bool) {
+	kept := mockUM.SMSCodes[:0]
+	for _, code := range mockUM.SMSCodes {
+		if !drop(code) {
+			kept = append(kept, code)
+		}
+	}
+	mockUM.SMSCodes = kept
+}
@@ -0,0 +1,24 @@
+package models
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// NewPublicID returns a UUIDv7, the id users and clients see. The leading 48 bits are the creation time in
+// milliseconds so new ids still sort roughly in insert order, the rest is random so they can't be guessed.
+func NewPublicID() (string, error) {
+	var b [16]byte
+	_, err := rand.Read(b[6:])
+	if err != nil {
+		return "", err
+	}
+	var ms [8]byte
+	binary.BigEndian.PutUint64(ms[:], uint64(time.Now().UnixMilli()))
+	copy(b[:6], ms[2:])
+	b[6] = (b[6] & 0x0f) | 0x70 // version 7
+	b[8] = (b[8] & 0x3f) | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
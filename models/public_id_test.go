@@ -0,0 +1,62 @@
+package models
+
+import (
+	"errors"
+	"testing"
+	"the_lonely_road/validator"
+)
+
+func TestNewPublicID(t *testing.T) {
+	first, err := NewPublicID()
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	if !validator.Matches(first, validator.UUIDRX) {
+		t.Fatalf("Expected a UUID, got %s", first)
+	}
+	if first[14] != '7' {
+		t.Errorf("Expected a version 7 UUID, got %s", first)
+	}
+	if v := first[19]; v != '8' && v != '9' && v != 'a' && v != 'b' {
+		t.Errorf("Expected the RFC 4122 variant, got %s", first)
+	}
+
+	second, err := NewPublicID()
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	if first == second {
+		t.Errorf("Expected two different ids, got %s twice", first)
+	}
+	// the timestamp prefix only ever moves forward
+	if second[:13] < first[:13] {
+		t.Errorf("Expected %s to sort after %s", second, first)
+	}
+}
+
+func TestUserModelMock_GetByPublicID(t *testing.T) {
+	userModel := UserModelMock{DB: []*User{}}
+	user := &User{ID: 1, Email: "test@example.com", Password: "veryinsecurepassword"}
+	err := userModel.Insert(user)
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	if user.PublicID == "" {
+		t.Fatalf("Expected Insert to set a public id")
+	}
+
+	got, err := userModel.GetByPublicID(user.PublicID)
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	if got.ID != 1 {
+		t.Errorf("Expected user 1, got %d", got.ID)
+	}
+
+	for _, publicID := range []string{"", "1", "0190a6e2-5c3b-7c1e-9f3a-2b4c6d8e0f12"} {
+		_, err = userModel.GetByPublicID(publicID)
+		if !errors.Is(err, ErrRecordNotFound) {
+			t.Errorf("Expected ErrRecordNotFound for %q, got %v", publicID, err)
+		}
+	}
+}
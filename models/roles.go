@@ -0,0 +1,151 @@
+package models
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	RoleAdmin   = "admin"
+	RoleSupport = "support"
+
+	PermissionUsersRead  = "users:read"
+	PermissionUsersAdmin = "users:admin"
+	PermissionAuditRead  = "audit:read"
+)
+
+// DefaultRolePermissions mirrors the roles seeded by the RBAC migration, the mock uses it in place of the join tables
+var DefaultRolePermissions = map[string][]string{
+	RoleAdmin:   {PermissionAuditRead, PermissionUsersAdmin, PermissionUsersRead},
+	RoleSupport: {PermissionUsersRead},
+}
+
+var ErrUnknownRole = errors.New("unknown role")
+
+// stringList scans the comma separated output of string_agg into a slice
+type stringList []string
+
+func (l *stringList) Scan(src any) error {
+	switch v := src.(type) {
+	case nil:
+		*l = nil
+	case string:
+		*l = splitList(v)
+	case []byte:
+		*l = splitList(string(v))
+	default:
+		return fmt.Errorf("cannot scan %T into stringList", src)
+	}
+	return nil
+}
+
+func (l stringList) Value() (driver.Value, error) {
+	return strings.Join(l, ","), nil
+}
+
+func splitList(s string) []string {
+	if s == "" {
+		return []string{}
+	}
+	return strings.Split(s, ",")
+}
+
+// AssignRole grants role to the user, assigning a role they already have is not an error
+func (m *UserModel) AssignRole(userID int, role string) error {
+	query := `INSERT INTO user_roles (user_id, role_id)
+	SELECT $1, id FROM roles WHERE name = $2
+	ON CONFLICT DO NOTHING`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, userID, role)
+	if err != nil {
+		switch {
+		case foreignKeyViolation(err, "user_roles_user_id_fkey"):
+			return errors.New("user not found")
+		default:
+			return err
+		}
+	}
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		// either the role doesn't exist or the user already has it
+		var exists bool
+		err = m.DB.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM roles WHERE name = $1)`, role).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return ErrUnknownRole
+		}
+	}
+	return nil
+}
+
+func (m *UserModel) RevokeRole(userID int, role string) error {
+	query := `DELETE FROM user_roles
+	WHERE user_id = $1 AND role_id IN (SELECT id FROM roles WHERE name = $2)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, userID, role)
+	if err != nil {
+		return err
+	}
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		return errors.New("no data")
+	}
+	return nil
+}
+
+func (mockUM *UserModelMock) AssignRole(userID int, role string) error {
+	if _, ok := DefaultRolePermissions[role]; !ok {
+		return ErrUnknownRole
+	}
+	user, err := mockUM.GetByID(userID)
+	if err != nil {
+		return errors.New("user not found")
+	}
+	for _, existing := range user.Roles {
+		if existing == role {
+			return nil
+		}
+	}
+	user.Roles = append(user.Roles, role)
+	user.Permissions = permissionsForRoles(user.Roles)
+	return nil
+}
+
+func (mockUM *UserModelMock) RevokeRole(userID int, role string) error {
+	user, err := mockUM.GetByID(userID)
+	if err != nil {
+		return errors.New("no data")
+	}
+	for i, existing := range user.Roles {
+		if existing == role {
+			user.Roles = append(user.Roles[:i], user.Roles[i+1:]...)
+			user.Permissions = permissionsForRoles(user.Roles)
+			return nil
+		}
+	}
+	return errors.New("no data")
+}
+
+func permissionsForRoles(roles []string) []string {
+	seen := map[string]bool{}
+	permissions := []string{}
+	for _, role := range roles {
+		for _, permission := range DefaultRolePermissions[role] {
+			if !seen[permission] {
+				seen[permission] = true
+				permissions = append(permissions, permission)
+			}
+		}
+	}
+	return permissions
+}
@@ -0,0 +1,82 @@
+package models
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestUserModelMock_Roles(t *testing.T) {
+	userModel := UserModelMock{DB: []*User{{ID: 1, Email: "roles@localhost"}}}
+
+	err := userModel.AssignRole(1, "owner")
+	if !errors.Is(err, ErrUnknownRole) {
+		t.Errorf("Expected ErrUnknownRole, got %v", err)
+	}
+	err = userModel.AssignRole(2, RoleAdmin)
+	if err == nil {
+		t.Errorf("Expected error for missing user, got nil")
+	}
+
+	for _, role := range []string{RoleSupport, RoleAdmin, RoleSupport} {
+		err = userModel.AssignRole(1, role)
+		if err != nil {
+			t.Errorf("Expected no error, got %s", err)
+		}
+	}
+	user := userModel.DB[0]
+	if len(user.Roles) != 2 {
+		t.Errorf("Expected two roles, got %v", user.Roles)
+	}
+	if len(user.Permissions) != 3 {
+		t.Errorf("Expected users:read, users:admin and audit:read once each, got %v", user.Permissions)
+	}
+
+	_, metadata, err := userModel.ListUsers(UserFilters{
+		Filters: Filters{Page: 1, PageSize: 20, Sort: "id", SortSafelist: UserSortSafelist},
+		Role:    RoleAdmin,
+	})
+	if err != nil || metadata.TotalRecords != 1 {
+		t.Errorf("Expected one admin, got %+v, %v", metadata, err)
+	}
+
+	err = userModel.RevokeRole(1, RoleAdmin)
+	if err != nil {
+		t.Errorf("Expected no error, got %s", err)
+	}
+	if len(user.Permissions) != 1 || user.Permissions[0] != PermissionUsersRead {
+		t.Errorf("Expected only users:read, got %v", user.Permissions)
+	}
+	err = userModel.RevokeRole(1, RoleAdmin)
+	if err == nil {
+		t.Errorf("Expected error revoking a role the user doesn't have, got nil")
+	}
+}
+
+func TestStringList_Scan(t *testing.T) {
+	tests := []struct {
+		name string
+		src  any
+		want int
+	}{
+		{name: "Nil", src: nil, want: 0},
+		{name: "Empty", src: "", want: 0},
+		{name: "String", src: "admin,support", want: 2},
+		{name: "Bytes", src: []byte("admin"), want: 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var l stringList
+			if err := l.Scan(test.src); err != nil {
+				t.Fatalf("Expected no error, got %s", err)
+			}
+			if len(l) != test.want {
+				t.Errorf("Expected %d items, got %v", test.want, l)
+			}
+		})
+	}
+
+	var l stringList
+	if err := l.Scan(42); err == nil {
+		t.Errorf("Expected error scanning an int, got nil")
+	}
+}
@@ -0,0 +1,290 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"sort"
+	"strings"
+	"the_lonely_road/validator"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// searchNameColumns is the profile name text searched by SearchUsers, it has to match the expression in the
+// users_name_trgm_idx index for Postgres to use it
+const searchNameColumns = `lower(display_name || ' ' || given_name || ' ' || family_name)`
+
+// searchWordSimilarity is the pg_trgm.word_similarity_threshold default that the <% operator uses,
+// the in process backends use the same cut off
+const searchWordSimilarity = 0.6
+
+// SearchSortSafelist only allows best match first
+var SearchSortSafelist = []string{"rank"}
+
+// SearchFilters is the paging for SearchUsers and the text to look for
+type SearchFilters struct {
+	Filters
+	Query string
+}
+
+// UserSearchResult is one hit from SearchUsers. Highlights holds every searched field that matched with the
+// matching text wrapped in <mark>, the rest of the value is HTML escaped so it can be shown as is
+type UserSearchResult struct {
+	User       *User             `json:"user"`
+	Rank       float64           `json:"rank"`
+	Highlights map[string]string `json:"highlights"`
+}
+
+func ValidateSearchFilters(v *validator.Validator, f SearchFilters) {
+	ValidateFilters(v, f.Filters)
+	query := strings.TrimSpace(f.Query)
+	v.Check(query != "", "q", "must be provided")
+	v.Check(utf8.RuneCountInString(query) >= 3, "q", "must be at least 3 characters long")
+	v.Check(validator.MaxChars(query, 100), "q", "must not be more than 100 characters long")
+}
+
+// SearchUsers ranks users whose email or profile names contain the query, or are a close enough trigram
+// match for a typo, best first. A prefix of the email or of a name word ranks above a match in the middle.
+// Encrypted emails can't be searched, with a Cipher only a query that is the whole address matches one.
+func (m *UserModel) SearchUsers(filters SearchFilters) ([]*UserSearchResult, Metadata, error) {
+	if m.Dialect == DialectSQLite {
+		return m.searchUsersInProcess(filters)
+	}
+	emailText := "lower(email)"
+	if m.Cipher != nil {
+		emailText = "''"
+	}
+	query := fmt.Sprintf(`
+	SELECT count(*) OVER(), %[1]s,
+		CASE WHEN email_canonical = $5 OR %[3]s LIKE $2 || '%%' OR %[2]s LIKE $2 || '%%' OR %[2]s LIKE '%% ' || $2 || '%%' THEN 1 ELSE 0 END
+			+ GREATEST(word_similarity($1, %[3]s), word_similarity($1, %[2]s)) AS rank
+	FROM users
+	WHERE email_canonical = $5
+	OR %[3]s LIKE '%%' || $2 || '%%'
+	OR %[2]s LIKE '%%' || $2 || '%%'
+	OR $1 <%% %[3]s
+	OR $1 <%% %[2]s
+	ORDER BY rank DESC, id ASC
+	LIMIT $3 OFFSET $4`, userColumns, searchNameColumns, emailText)
+
+	term := searchTerm(filters.Query)
+	args := []any{term, escapeLike(term), filters.limit(), filters.offset(), m.Cipher.EmailIndex(term)}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	results := []*UserSearchResult{}
+	for rows.Next() {
+		var user User
+		var rank float64
+		err := rows.Scan(append(append([]any{&totalRecords}, user.scanDestinations()...), &rank)...)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		err = m.Cipher.decryptUser(&user)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		results = append(results, newUserSearchResult(&user, rank, term))
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	return results, calculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
+
+func (mockUM *UserModelMock) SearchUsers(filters SearchFilters) ([]*UserSearchResult, Metadata, error) {
+	results, metadata := rankUsers(mockUM.DB, filters)
+	return results, metadata, nil
+}
+
+// rankUsers is SearchUsers for the backends without trigram indexes, it scores every user in process the
+// same way the Postgres query does
+func rankUsers(users []*User, filters SearchFilters) ([]*UserSearchResult, Metadata) {
+	term := searchTerm(filters.Query)
+	matched := []*UserSearchResult{}
+	for _, user := range users {
+		if rank, ok := searchRank(user, term); ok {
+			matched = append(matched, newUserSearchResult(user, rank, term))
+		}
+	}
+	sort.SliceStable(matched, func(i, j int) bool {
+		if matched[i].Rank != matched[j].Rank {
+			return matched[i].Rank > matched[j].Rank
+		}
+		return matched[i].User.ID < matched[j].User.ID
+	})
+
+	metadata := calculateMetadata(len(matched), filters.Page, filters.PageSize)
+	start, end := filters.offset(), filters.offset()+filters.limit()
+	if start > len(matched) {
+		start = len(matched)
+	}
+	if end > len(matched) {
+		end = len(matched)
+	}
+	return matched[start:end], metadata
+}
+
+func searchTerm(query string) string {
+	return strings.ToLower(strings.TrimSpace(query))
+}
+
+// searchRank mirrors the WHERE and rank expressions of the Postgres query
+func searchRank(user *User, term string) (float64, bool) {
+	email := strings.ToLower(user.Email)
+	name := strings.ToLower(user.DisplayName + " " + user.GivenName + " " + user.FamilyName)
+	emailSimilarity, nameSimilarity := wordSimilarity(term, email), wordSimilarity(term, name)
+
+	if !strings.Contains(email, term) && !strings.Contains(name, term) &&
+		emailSimilarity < searchWordSimilarity && nameSimilarity < searchWordSimilarity {
+		return 0, false
+	}
+
+	rank := emailSimilarity
+	if nameSimilarity > rank {
+		rank = nameSimilarity
+	}
+	if strings.HasPrefix(email, term) || strings.HasPrefix(name, term) || strings.Contains(name, " "+term) {
+		rank++
+	}
+	return rank, true
+}
+
+func newUserSearchResult(user *User, rank float64, term string) *UserSearchResult {
+	result := &UserSearchResult{User: user, Rank: rank, Highlights: map[string]string{}}
+	fields := []struct {
+		name, value string
+	}{
+		{"email", user.Email},
+		{"display_name", user.DisplayName},
+		{"given_name", user.GivenName},
+		{"family_name", user.FamilyName},
+	}
+	for _, field := range fields {
+		if highlighted, ok := highlight(field.value, term); ok {
+			result.Highlights[field.name] = highlighted
+		}
+	}
+	return result
+}
+
+// highlight marks every place a word of term appears in value, or failing that the words of value that are
+// a fuzzy match for it
+func highlight(value, term string) (string, bool) {
+	runes := []rune(value)
+	marked := make([]bool, len(runes))
+	found := false
+
+	lower := make([]rune, len(runes))
+	for i, r := range runes {
+		lower[i] = unicode.ToLower(r)
+	}
+	for _, word := range strings.Fields(term) {
+		needle := []rune(word)
+		for i := 0; i+len(needle) <= len(lower); i++ {
+			if string(lower[i:i+len(needle)]) == word {
+				for j := i; j < i+len(needle); j++ {
+					marked[j] = true
+				}
+				found = true
+			}
+		}
+	}
+
+	if !found {
+		start := -1
+		for i := 0; i <= len(runes); i++ {
+			inWord := i < len(runes) && isTrigramRune(runes[i])
+			if inWord && start < 0 {
+				start = i
+			}
+			if !inWord && start >= 0 {
+				if wordSimilarity(term, string(lower[start:i])) >= searchWordSimilarity {
+					for j := start; j < i; j++ {
+						marked[j] = true
+					}
+					found = true
+				}
+				start = -1
+			}
+		}
+	}
+	if !found {
+		return "", false
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(runes); {
+		j := i
+		for j < len(runes) && marked[j] == marked[i] {
+			j++
+		}
+		text := html.EscapeString(string(runes[i:j]))
+		if marked[i] {
+			text = "<mark>" + text + "</mark>"
+		}
+		b.WriteString(text)
+		i = j
+	}
+	return b.String(), true
+}
+
+// wordSimilarity follows pg_trgm's word_similarity: the best trigram similarity between term and any run of
+// consecutive trigrams from text, so a short term scores well against the word it was taken from
+func wordSimilarity(term, text string) float64 {
+	needle := map[string]bool{}
+	for _, trigram := range trigrams(term) {
+		needle[trigram] = true
+	}
+	if len(needle) == 0 {
+		return 0
+	}
+
+	haystack := trigrams(text)
+	best := 0.0
+	for i := range haystack {
+		seen := map[string]bool{}
+		shared := 0
+		for _, trigram := range haystack[i:] {
+			if seen[trigram] {
+				continue
+			}
+			seen[trigram] = true
+			if needle[trigram] {
+				shared++
+			}
+			similarity := float64(shared) / float64(len(needle)+len(seen)-shared)
+			if similarity > best {
+				best = similarity
+			}
+		}
+	}
+	return best
+}
+
+// trigrams splits text into words the way pg_trgm does, padding each with two spaces in front and one behind
+func trigrams(text string) []string {
+	var result []string
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool { return !isTrigramRune(r) }) {
+		padded := []rune("  " + word + " ")
+		for i := 0; i+3 <= len(padded); i++ {
+			result = append(result, string(padded[i:i+3]))
+		}
+	}
+	return result
+}
+
+func isTrigramRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
@@ -0,0 +1,139 @@
+package models
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"the_lonely_road/validator"
+)
+
+func TestWordSimilarity(t *testing.T) {
+	tests := []struct {
+		term, text string
+		expected   float64
+	}{
+		{term: "word", text: "two words", expected: 0.8}, // the example in the pg_trgm documentation
+		{term: "word", text: "word", expected: 1},
+		{term: "alice", text: "alice@example.com", expected: 1},
+		{term: "jonathon", text: "jonathan smith", expected: 6.0 / 9.0},
+		{term: "xyz", text: "alice", expected: 0},
+		{term: "", text: "alice", expected: 0},
+	}
+	for _, test := range tests {
+		t.Run(test.term+" in "+test.text, func(t *testing.T) {
+			got := wordSimilarity(test.term, test.text)
+			if math.Abs(got-test.expected) > 0.001 {
+				t.Errorf("Expected %.3f, got %.3f", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestHighlight(t *testing.T) {
+	tests := []struct {
+		name, value, term string
+		expected          string
+		ok                bool
+	}{
+		{name: "Prefix", value: "Alice@example.com", term: "ali", expected: "<mark>Ali</mark>ce@example.com", ok: true},
+		{name: "Every occurrence", value: "anna banana", term: "ana", expected: "anna b<mark>anana</mark>", ok: true},
+		{name: "Every word of the term", value: "Alice Smith", term: "smith alice", expected: "<mark>Alice</mark> <mark>Smith</mark>", ok: true},
+		{name: "Fuzzy word", value: "Jonathan Smith", term: "jonathon", expected: "<mark>Jonathan</mark> Smith", ok: true},
+		{name: "Escaped", value: "<b>Zoë</b>", term: "zoë", expected: "&lt;b&gt;<mark>Zoë</mark>&lt;/b&gt;", ok: true},
+		{name: "No match", value: "Bob", term: "alice", ok: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, ok := highlight(test.value, test.term)
+			if ok != test.ok || got != test.expected {
+				t.Errorf("Expected %q, %t, got %q, %t", test.expected, test.ok, got, ok)
+			}
+		})
+	}
+}
+
+func TestUserModelMock_SearchUsers(t *testing.T) {
+	userModel := UserModelMock{DB: []*User{
+		{ID: 1, Email: "bob@example.com", DisplayName: "Bob Alison"},
+		{ID: 2, Email: "alice@example.com"},
+		{ID: 3, Email: "carol@example.com", GivenName: "Carol", FamilyName: "Jonathan"},
+		{ID: 4, Email: "dave@example.com"},
+		{ID: 5, Email: "malice@example.com"},
+	}}
+	filters := SearchFilters{Filters: Filters{Page: 1, PageSize: 20, Sort: "rank", SortSafelist: SearchSortSafelist}}
+
+	t.Run("Prefixes rank first", func(t *testing.T) {
+		filters.Query = " ALI "
+		results, metadata, err := userModel.SearchUsers(filters)
+		if err != nil {
+			t.Errorf("Expected no error, got %s", err)
+		}
+		var ids []int64
+		for _, result := range results {
+			ids = append(ids, result.User.ID)
+		}
+		// 1 and 2 are both a prefix match and tie on similarity, so the id breaks it
+		if len(ids) != 3 || ids[0] != 1 || ids[1] != 2 || ids[2] != 5 {
+			t.Fatalf("Expected users 1, 2 then 5, got %v", ids)
+		}
+		if metadata.TotalRecords != 3 {
+			t.Errorf("Expected 3 records, got %+v", metadata)
+		}
+		if results[0].Highlights["display_name"] != "Bob <mark>Ali</mark>son" || results[0].Highlights["email"] != "" {
+			t.Errorf("Expected only the display name to be highlighted, got %v", results[0].Highlights)
+		}
+		if results[1].Highlights["email"] != "<mark>ali</mark>ce@example.com" {
+			t.Errorf("Expected the email prefix to be highlighted, got %v", results[1].Highlights)
+		}
+	})
+	t.Run("Typos still match", func(t *testing.T) {
+		filters.Query = "jonathon"
+		results, _, err := userModel.SearchUsers(filters)
+		if err != nil {
+			t.Errorf("Expected no error, got %s", err)
+		}
+		if len(results) != 1 || results[0].User.ID != 3 {
+			t.Fatalf("Expected only user 3, got %v", results)
+		}
+		if results[0].Highlights["family_name"] != "<mark>Jonathan</mark>" {
+			t.Errorf("Expected the family name to be highlighted, got %v", results[0].Highlights)
+		}
+	})
+	t.Run("Paging", func(t *testing.T) {
+		filters.Query = "example"
+		filters.Page, filters.PageSize = 2, 2
+		results, metadata, err := userModel.SearchUsers(filters)
+		if err != nil {
+			t.Errorf("Expected no error, got %s", err)
+		}
+		if len(results) != 2 || results[0].User.ID != 3 || metadata.TotalRecords != 5 || metadata.LastPage != 3 {
+			t.Errorf("Expected users 3 and 4 of 5, got %v and %+v", results, metadata)
+		}
+	})
+}
+
+func TestValidateSearchFilters(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		valid bool
+	}{
+		{name: "Valid", query: "alice", valid: true},
+		{name: "Empty", query: "   ", valid: false},
+		{name: "Too short", query: " al ", valid: false},
+		{name: "Multibyte", query: "Zoë", valid: true},
+		{name: "Too long", query: strings.Repeat("a", 101), valid: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			v := validator.New()
+			ValidateSearchFilters(v, SearchFilters{
+				Filters: Filters{Page: 1, PageSize: 20, Sort: "rank", SortSafelist: SearchSortSafelist},
+				Query:   test.query,
+			})
+			if v.Valid() != test.valid {
+				t.Errorf("Expected valid to be %t, got errors %v", test.valid, v.Errors)
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package models
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Dialect is the SQL spoken by UserModel.DB. Queries are written for Postgres and rebind adapts the ones SQLite
+// reads differently, the few that can't be shared branch on the dialect.
+type Dialect int
+
+const (
+	// DialectPostgres is a database opened with data.OpenDSN, and the zero value
+	DialectPostgres Dialect = iota
+	// DialectSQLite is a database opened with data.OpenSQLite. Times are always bound in UTC so the text SQLite
+	// stores them as compares in time order.
+	DialectSQLite
+)
+
+// sqliteUserColumns is userColumns without the Postgres casts, SQLite only takes DISTINCT in a one argument aggregate
+const sqliteUserColumns = `id, public_id, password_hash, email, created_at, updated_at, password_reset_expires, password_reset_token, password_reset_salt,
+	display_name, given_name, family_name, locale, time_zone, COALESCE(username, ''), phone, phone_verified,
+	pending_email, email_change_token, email_change_expires, email_change_salt, email_change_cancel_token, email_change_cancel_salt,
+	deleted_at, restore_token, restore_expires, restore_salt,
+	verified, locked_until, failed_logins, last_failed_login, app_metadata, user_metadata, version,
+	COALESCE((SELECT string_agg(r.name, ',' ORDER BY r.name)
+		FROM user_roles ur JOIN roles r ON r.id = ur.role_id
+		WHERE ur.user_id = users.id), ''),
+	COALESCE((SELECT string_agg(code, ',' ORDER BY code) FROM (SELECT DISTINCT p.code AS code
+		FROM user_roles ur JOIN role_permissions rp ON rp.role_id = ur.role_id JOIN permissions p ON p.id = rp.permission_id
+		WHERE ur.user_id = users.id)), '')`
+
+// columns is the user column list in the model's dialect, scanned by User.scanDestinations
+func (m *UserModel) columns() string {
+	if m.Dialect == DialectSQLite {
+		return sqliteUserColumns
+	}
+	return userColumns
+}
+
+var (
+	postgresCastRX = regexp.MustCompile(`::[a-z]+`)
+	forUpdateRX    = regexp.MustCompile(`\s+FOR UPDATE`)
+)
+
+// rebind turns a Postgres query into the one SQLite runs. Values are bound with their Go types so the casts go, LIKE
+// already ignores case, and a write transaction locks the whole database so rows aren't locked one by one.
+func (m *UserModel) rebind(query string) string {
+	if m.Dialect != DialectSQLite {
+		return query
+	}
+	query = postgresCastRX.ReplaceAllString(query, "")
+	query = forUpdateRX.ReplaceAllString(query, "")
+	return strings.ReplaceAll(query, " ILIKE ", " LIKE ")
+}
+
+// sqliteUniqueColumns is the column SQLite names when a unique constraint is violated, by the Postgres constraint
+// name. Expression indexes are named by SQLite too, so they need no entry.
+var sqliteUniqueColumns = map[string]string{
+	"users_email_key":           "users.email",
+	"users_email_canonical_key": "users.email_canonical",
+	"organizations_slug_key":    "organizations.slug",
+}
+
+// uniqueViolation reports whether err is the database refusing a write on the unique constraint, named as in Postgres
+func uniqueViolation(err error, constraint string) bool {
+	if strings.Contains(err.Error(), constraint) {
+		return true
+	}
+	column, ok := sqliteUniqueColumns[constraint]
+	return ok && strings.Contains(err.Error(), "UNIQUE constraint failed: "+column)
+}
+
+// foreignKeyViolation reports whether err is the database refusing a write that references a missing row. SQLite
+// doesn't name the constraint, so any foreign key counts there.
+func foreignKeyViolation(err error, constraint string) bool {
+	return strings.Contains(err.Error(), constraint) || strings.Contains(err.Error(), "FOREIGN KEY constraint failed")
+}
+
+// utcOrNil binds an optional filter time so a nil pointer is NULL and anything else compares as UTC
+func utcOrNil(t *time.Time) any {
+	if t == nil {
+		return nil
+	}
+	return t.UTC()
+}
+
+// searchUsersInProcess is SearchUsers for SQLite, which has no trigram index to lean on. It reads the searched fields
+// of every user and ranks them in process like the mock does, then loads the users on the requested page.
+func (m *UserModel) searchUsersInProcess(filters SearchFilters) ([]*UserSearchResult, Metadata, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, `SELECT id, public_id, email, display_name, given_name, family_name FROM users`)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	candidates := []*User{}
+	for rows.Next() {
+		var user User
+		err := rows.Scan(&user.ID, &user.PublicID, &user.Email, &user.DisplayName, &user.GivenName, &user.FamilyName)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		user.Email, err = m.Cipher.Decrypt(user.Email, user.PublicID)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		candidates = append(candidates, &user)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+	rows.Close()
+
+	results, metadata := rankUsers(candidates, filters)
+	for _, result := range results {
+		user, err := m.getUser("id = $1", result.User.ID)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		result.User = user
+	}
+	return results, metadata, nil
+}
@@ -0,0 +1,196 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"testing"
+	"the_lonely_road/data"
+	"time"
+)
+
+// newSQLiteUserModel is cfg on a fresh SQLite file, the Postgres tests in user_integration_test.go need a server
+func newSQLiteUserModel(t *testing.T, cfg UserModel) *UserModel {
+	db, err := data.OpenSQLite(data.SQLiteScheme + filepath.Join(t.TempDir(), "users.db"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	t.Cleanup(func() {
+		if err := db.Close(); err != nil {
+			t.Errorf("Error closing database: %s", err)
+		}
+	})
+	cfg.DB = db
+	cfg.Dialect = DialectSQLite
+	if cfg.Hasher == nil {
+		cfg.Hasher = Hasher{Current: testBcrypt}
+	}
+	return &cfg
+}
+
+func TestRebind(t *testing.T) {
+	query := `SELECT id FROM users WHERE email ILIKE $1 AND created_at > $2::timestamp AND app_metadata = $3::jsonb
+	FOR UPDATE`
+	if got := (&UserModel{}).rebind(query); got != query {
+		t.Errorf("Expected Postgres queries to be left alone, got %s", got)
+	}
+	want := `SELECT id FROM users WHERE email LIKE $1 AND created_at > $2 AND app_metadata = $3`
+	if got := (&UserModel{Dialect: DialectSQLite}).rebind(query); got != want {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+}
+
+func TestUserModel_SQLiteErrors(t *testing.T) {
+	userModel := newSQLiteUserModel(t, UserModel{})
+	user := &User{Email: "errors@localhost", Username: "errors", Password: "veryinsecurepassword", CreatedAt: time.Now()}
+	err := userModel.Insert(user)
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+
+	t.Run("Duplicates", func(t *testing.T) {
+		err := userModel.Insert(&User{Email: "Errors@Localhost", Password: "veryinsecurepassword", CreatedAt: time.Now()})
+		if !errors.Is(err, ErrDuplicateEmail) {
+			t.Errorf("Expected ErrDuplicateEmail, got %v", err)
+		}
+		err = userModel.Insert(&User{Email: "other@localhost", Username: "ERRORS", Password: "veryinsecurepassword", CreatedAt: time.Now()})
+		if !errors.Is(err, ErrDuplicateUsername) {
+			t.Errorf("Expected ErrDuplicateUsername, got %v", err)
+		}
+		org := &Organization{Slug: "acme", Name: "Acme", CreatedAt: time.Now()}
+		if err := userModel.CreateOrganization(org, int(user.ID)); err != nil {
+			t.Fatalf("Expected no error, got %s", err)
+		}
+		err = userModel.CreateOrganization(&Organization{Slug: "acme", Name: "Acme", CreatedAt: time.Now()}, int(user.ID))
+		if !errors.Is(err, ErrDuplicateSlug) {
+			t.Errorf("Expected ErrDuplicateSlug, got %v", err)
+		}
+		if err := userModel.RemoveMember(int(org.ID), int(user.ID)); !errors.Is(err, ErrLastOwner) {
+			t.Errorf("Expected ErrLastOwner, got %v", err)
+		}
+	})
+	t.Run("Missing user", func(t *testing.T) {
+		if _, err := userModel.GetByEmail("missing@localhost"); !errors.Is(err, ErrRecordNotFound) {
+			t.Errorf("Expected ErrRecordNotFound by email, got %v", err)
+		}
+		if _, err := userModel.GetByPublicID("not-a-uuid"); !errors.Is(err, ErrRecordNotFound) {
+			t.Errorf("Expected ErrRecordNotFound by public id, got %v", err)
+		}
+		if err := userModel.UpdateProfile(&User{ID: 999999, Version: 1}); !errors.Is(err, ErrRecordNotFound) {
+			t.Errorf("Expected ErrRecordNotFound updating, got %v", err)
+		}
+		if err := userModel.AssignRole(999999, RoleAdmin); err == nil || err.Error() != "user not found" {
+			t.Errorf("Expected user not found assigning a role, got %v", err)
+		}
+		if err := userModel.DeleteUser("missing@localhost"); err == nil || err.Error() != "no data" {
+			t.Errorf("Expected no data deleting, got %v", err)
+		}
+	})
+	t.Run("Stale version", func(t *testing.T) {
+		err := userModel.EnterPasswordHash(user.Email, "hash", "salt", user.Version+1)
+		if !errors.Is(err, ErrEditConflict) {
+			t.Errorf("Expected ErrEditConflict, got %v", err)
+		}
+	})
+}
+
+func TestUserModel_SQLiteQueries(t *testing.T) {
+	userModel := newSQLiteUserModel(t, UserModel{PasswordHistory: 1})
+	user := &User{Email: "queries@localhost", Password: "veryinsecurepassword", CreatedAt: time.Now().Add(-time.Hour)}
+	err := userModel.Insert(user)
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+
+	t.Run("ListUsers", func(t *testing.T) {
+		after := time.Now().Add(-2 * time.Hour)
+		locked := false
+		users, metadata, err := userModel.ListUsers(UserFilters{
+			Filters:      Filters{Page: 1, PageSize: 20, Sort: "id", SortSafelist: UserSortSafelist},
+			Email:        "QUERIES",
+			CreatedAfter: &after,
+			Locked:       &locked,
+		})
+		if err != nil {
+			t.Fatalf("Expected no error, got %s", err)
+		}
+		if metadata.TotalRecords != 1 || users[0].ID != user.ID {
+			t.Errorf("Expected only %s, got %+v", user.Email, metadata)
+		}
+	})
+	t.Run("SearchUsers", func(t *testing.T) {
+		results, _, err := userModel.SearchUsers(SearchFilters{
+			Filters: Filters{Page: 1, PageSize: 20, Sort: "rank", SortSafelist: SearchSortSafelist},
+			Query:   "queries",
+		})
+		if err != nil {
+			t.Fatalf("Expected no error, got %s", err)
+		}
+		if len(results) != 1 || results[0].User.PublicID != user.PublicID {
+			t.Errorf("Expected %s with its whole row, got %v", user.Email, results)
+		}
+	})
+	t.Run("UpdatePassword", func(t *testing.T) {
+		err := userModel.UpdatePassword(int(user.ID), "anotherinsecurepassword", user.Version)
+		if err != nil {
+			t.Fatalf("Expected no error, got %s", err)
+		}
+		err = userModel.UpdatePassword(int(user.ID), "veryinsecurepassword", user.Version+1)
+		if !errors.Is(err, ErrPasswordReused) {
+			t.Errorf("Expected ErrPasswordReused, got %v", err)
+		}
+	})
+	t.Run("Metadata", func(t *testing.T) {
+		user, err := userModel.GetByID(int(user.ID))
+		if err != nil {
+			t.Fatalf("Expected no error, got %s", err)
+		}
+		err = userModel.UpdateAppMetadata(user, json.RawMessage(`{"plan":"pro"}`))
+		if err != nil {
+			t.Fatalf("Expected no error, got %s", err)
+		}
+		stored, err := userModel.GetByID(int(user.ID))
+		if err != nil || string(stored.AppMetadata) != `{"plan":"pro"}` || stored.Version != user.Version {
+			t.Errorf("Expected the patched metadata at version %d, got %s at %d", user.Version, stored.AppMetadata, stored.Version)
+		}
+	})
+	t.Run("LoginHistory", func(t *testing.T) {
+		old := &AuditEvent{Type: AuditLoginFailed, SubjectID: user.PublicID, CreatedAt: time.Now().Add(-48 * time.Hour)}
+		recent := &AuditEvent{Type: AuditLoginSucceeded, SubjectID: user.PublicID, CreatedAt: time.Now()}
+		for _, event := range []*AuditEvent{old, recent} {
+			if err := userModel.RecordAuditEvent(event); err != nil {
+				t.Fatalf("Expected no error, got %s", err)
+			}
+		}
+		entries, _, err := userModel.ListLoginHistory(user.PublicID, time.Now().Add(-72*time.Hour), Filters{Page: 1, PageSize: 20})
+		if err != nil || len(entries) != 2 || !entries[0].Succeeded {
+			t.Fatalf("Expected both sign ins newest first, got %v, %v", entries, err)
+		}
+		entries, _, err = userModel.ListLoginHistory(user.PublicID, time.Now().Add(-24*time.Hour), Filters{Page: 1, PageSize: 20})
+		if err != nil || len(entries) != 1 {
+			t.Errorf("Expected the old sign in to be past the retention, got %v, %v", entries, err)
+		}
+	})
+	t.Run("Import and export", func(t *testing.T) {
+		imported := &User{Email: "imported@localhost", Password: user.Password, CreatedAt: time.Now()}
+		errs, err := userModel.ImportUsers([]*User{imported, {Email: user.Email, Password: user.Password, CreatedAt: time.Now()}}, false)
+		if err != nil {
+			t.Fatalf("Expected no error, got %s", err)
+		}
+		if errs[0] != nil || !errors.Is(errs[1], ErrUserExists) {
+			t.Errorf("Expected the existing user to be skipped, got %v", errs)
+		}
+		memberships, err := userModel.ListMemberships(int(imported.ID))
+		if err != nil || len(memberships) != 1 {
+			t.Errorf("Expected the imported user in the default organization, got %v, %v", memberships, err)
+		}
+		exported := 0
+		err = userModel.ExportUsers(func(*User) error {
+			exported++
+			return nil
+		})
+		if err != nil || exported != 2 {
+			t.Errorf("Expected 2 users exported, got %d, %v", exported, err)
+		}
+	})
+}
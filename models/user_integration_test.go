@@ -1,7 +1,10 @@
 package models
 
 import (
+	"encoding/json"
+	"errors"
 	"reflect"
+	"strings"
 	"testing"
 	"the_lonely_road/data"
 	"the_lonely_road/token"
@@ -141,7 +144,7 @@ func TestUserModel_UpdatePassword(t *testing.T) {
 		// get user before password update to compare later
 		user, newError := userModel.GetByEmail(userToInsert.Email)
 
-		newError = userModel.UpdatePassword(int(userToInsert.ID), "newsecurepassword")
+		newError = userModel.UpdatePassword(int(userToInsert.ID), "newsecurepassword", user.Version)
 		if err != nil {
 			t.Errorf("Expected no error, got %s", err)
 		}
@@ -158,7 +161,7 @@ func TestUserModel_UpdatePassword(t *testing.T) {
 	})
 
 	t.Run("User not found", func(t *testing.T) {
-		err := userModel.UpdatePassword(999, "newpassword")
+		err := userModel.UpdatePassword(999, "newpassword", 1)
 		if err == nil {
 			t.Errorf("Expected error, got nil")
 		}
@@ -310,7 +313,7 @@ func TestUserModel_EnterPasswordHash(t *testing.T) {
 		}
 
 		hashedToken := token.HashToken(passwordToken, salt)
-		err = userModel.EnterPasswordHash(userToDelete.Email, hashedToken, salt)
+		err = userModel.EnterPasswordHash(userToDelete.Email, hashedToken, salt, userToDelete.Version)
 		if err != nil {
 			t.Errorf("Expected no error, got %s", err)
 		}
@@ -335,7 +338,7 @@ func TestUserModel_EnterPasswordHash(t *testing.T) {
 		if err != nil {
 			t.Errorf("Expected no error, got %s", err)
 		}
-		err = userModel.EnterPasswordHash("notfound", passwordToken, salt)
+		err = userModel.EnterPasswordHash("notfound", passwordToken, salt, 1)
 		if err == nil {
 			t.Errorf("Expected error, got nil")
 		}
@@ -372,11 +375,11 @@ func TestUserModel_ConsumePasswordReset(t *testing.T) {
 		}
 
 		hashedToken := token.HashToken(passwordToken, salt)
-		err = userModel.EnterPasswordHash(userToDelete.Email, hashedToken, salt)
+		err = userModel.EnterPasswordHash(userToDelete.Email, hashedToken, salt, userToDelete.Version)
 		if err != nil {
 			t.Errorf("Expected no error, got %s", err)
 		}
-		err = userModel.ConsumePasswordReset(userToDelete.Email)
+		err = userModel.ConsumePasswordReset(userToDelete.Email, userToDelete.Version+1)
 		if err != nil {
 			t.Errorf("Expected no error, got %s", err)
 		}
@@ -396,9 +399,1052 @@ func TestUserModel_ConsumePasswordReset(t *testing.T) {
 		}
 	})
 	t.Run("User not found", func(t *testing.T) {
-		err = userModel.ConsumePasswordReset("notfound")
+		err = userModel.ConsumePasswordReset("notfound", 1)
 		if err == nil {
 			t.Errorf("Expected error, got nil")
 		}
 	})
 }
+
+func TestUserModel_UpdateProfile(t *testing.T) {
+	cfg := data.TestPostgresConfig()
+	db, err := data.Open(cfg)
+	if err != nil {
+		t.Errorf("Expected no error, got %s", err)
+	}
+
+	defer func() {
+		if err := db.Close(); err != nil {
+			t.Errorf("Error closing server: %s", err)
+		}
+	}()
+
+	userModel := &UserModel{DB: db}
+	t.Run("Happy path", func(t *testing.T) {
+		userToUpdate := User{
+			Email:     "profileuser@localhost",
+			Password:  "veryinsecurepassword",
+			CreatedAt: time.Now(),
+		}
+		err := userModel.Insert(&userToUpdate)
+		if err != nil {
+			t.Errorf("Expected no error, got %s", err)
+		}
+
+		userToUpdate.DisplayName = "Profile User"
+		userToUpdate.TimeZone = "Europe/London"
+		err = userModel.UpdateProfile(&userToUpdate)
+		if err != nil {
+			t.Errorf("Expected no error, got %s", err)
+		}
+
+		user, err := userModel.GetByID(int(userToUpdate.ID))
+		if err != nil {
+			t.Errorf("Expected no error, got %s", err)
+		}
+		if user.DisplayName != "Profile User" || user.TimeZone != "Europe/London" {
+			t.Errorf("Expected profile to be saved, got %+v", user)
+		}
+		if user.UpdatedAt.IsZero() {
+			t.Errorf("Expected updated_at to be set")
+		}
+		err = userModel.DeleteUser(userToUpdate.Email)
+		if err != nil {
+			t.Errorf("Expected no error, got %s", err)
+		}
+	})
+	t.Run("Stale version", func(t *testing.T) {
+		user := User{Email: "staleprofile@localhost", Password: "veryinsecurepassword", CreatedAt: time.Now()}
+		err := userModel.Insert(&user)
+		if err != nil {
+			t.Errorf("Expected no error, got %s", err)
+		}
+		defer func() {
+			_ = userModel.DeleteUser(user.Email)
+		}()
+
+		stale := user
+		user.DisplayName = "First"
+		err = userModel.UpdateProfile(&user)
+		if err != nil {
+			t.Errorf("Expected no error, got %s", err)
+		}
+		if user.Version != stale.Version+1 {
+			t.Errorf("Expected the version to go up by one, got %d from %d", user.Version, stale.Version)
+		}
+		stale.DisplayName = "Second"
+		err = userModel.UpdateProfile(&stale)
+		if !errors.Is(err, ErrEditConflict) {
+			t.Errorf("Expected ErrEditConflict, got %v", err)
+		}
+	})
+	t.Run("User not found", func(t *testing.T) {
+		err = userModel.UpdateProfile(&User{ID: 999999})
+		if err == nil {
+			t.Errorf("Expected error, got nil")
+		}
+	})
+}
+
+func TestUserModel_EmailChange(t *testing.T) {
+	cfg := data.TestPostgresConfig()
+	db, err := data.Open(cfg)
+	if err != nil {
+		t.Errorf("Expected no error, got %s", err)
+	}
+
+	defer func() {
+		if err := db.Close(); err != nil {
+			t.Errorf("Error closing server: %s", err)
+		}
+	}()
+
+	userModel := &UserModel{DB: db}
+	t.Run("Happy path", func(t *testing.T) {
+		userToChange := User{
+			Email:    "changeme@localhost",
+			Password: "veryinsecurepassword",
+		}
+		err := userModel.Insert(&userToChange)
+		if err != nil {
+			t.Errorf("Expected no error, got %s", err)
+		}
+		err = userModel.RequestEmailChange(int(userToChange.ID), "changed@localhost", "test_token", "test_salt", "cancel_token", "cancel_salt")
+		if err != nil {
+			t.Errorf("Expected no error, got %s", err)
+		}
+		user, err := userModel.GetByID(int(userToChange.ID))
+		if err != nil {
+			t.Errorf("Expected no error, got %s", err)
+		}
+		if user.PendingEmail != "changed@localhost" || user.EmailChangeHashToken != "test_token" || user.EmailChangeCancelHashToken != "cancel_token" {
+			t.Errorf("Expected pending change to be stored, got %+v", user)
+		}
+		err = userModel.ConfirmEmailChange(int(userToChange.ID))
+		if err != nil {
+			t.Errorf("Expected no error, got %s", err)
+		}
+		user, err = userModel.GetByEmail("changed@localhost")
+		if err != nil {
+			t.Errorf("Expected no error, got %s", err)
+		}
+		if user.PendingEmail != "" || user.EmailChangeHashToken != "" || user.EmailChangeCancelHashToken != "" {
+			t.Errorf("Expected pending change to be consumed, got %+v", user)
+		}
+		err = userModel.DeleteUser("changed@localhost")
+		if err != nil {
+			t.Errorf("Expected no error, got %s", err)
+		}
+	})
+	t.Run("Duplicate email", func(t *testing.T) {
+		first := User{Email: "firstchange@localhost", Password: "veryinsecurepassword"}
+		second := User{Email: "secondchange@localhost", Password: "veryinsecurepassword"}
+		err := userModel.Insert(&first)
+		if err != nil {
+			t.Errorf("Expected no error, got %s", err)
+		}
+		err = userModel.Insert(&second)
+		if err != nil {
+			t.Errorf("Expected no error, got %s", err)
+		}
+		err = userModel.RequestEmailChange(int(first.ID), second.Email, "test_token", "test_salt", "cancel_token", "cancel_salt")
+		if err != nil {
+			t.Errorf("Expected no error, got %s", err)
+		}
+		err = userModel.ConfirmEmailChange(int(first.ID))
+		if !errors.Is(err, ErrDuplicateEmail) {
+			t.Errorf("Expected duplicate email, got %v", err)
+		}
+		err = userModel.CancelEmailChange(int(first.ID))
+		if err != nil {
+			t.Errorf("Expected no error, got %s", err)
+		}
+		_ = userModel.DeleteUser(first.Email)
+		_ = userModel.DeleteUser(second.Email)
+	})
+}
+
+func TestUserModel_SoftDeleteUser(t *testing.T) {
+	cfg := data.TestPostgresConfig()
+	db, err := data.Open(cfg)
+	if err != nil {
+		t.Errorf("Expected no error, got %s", err)
+	}
+
+	defer func() {
+		if err := db.Close(); err != nil {
+			t.Errorf("Error closing server: %s", err)
+		}
+	}()
+
+	userModel := &UserModel{DB: db}
+	userToDelete := User{
+		Email:    "softdelete@localhost",
+		Password: "veryinsecurepassword",
+	}
+	err = userModel.Insert(&userToDelete)
+	if err != nil {
+		t.Errorf("Expected no error, got %s", err)
+	}
+
+	t.Run("Delete blocks login", func(t *testing.T) {
+		err := userModel.SoftDeleteUser(int(userToDelete.ID), "test_token", "test_salt", time.Now().Add(time.Hour))
+		if err != nil {
+			t.Errorf("Expected no error, got %s", err)
+		}
+		user, err := userModel.GetByEmail(userToDelete.Email)
+		if err != nil {
+			t.Errorf("Expected no error, got %s", err)
+		}
+		if user.DeletedAt == nil || user.RestoreHashToken != "test_token" {
+			t.Errorf("Expected user to be soft deleted, got %+v", user)
+		}
+		_, err = userModel.Authenticate(userToDelete.Email, "veryinsecurepassword")
+		if err == nil {
+			t.Errorf("Expected deleted user not to authenticate")
+		}
+	})
+	t.Run("Restore", func(t *testing.T) {
+		err := userModel.RestoreUser(int(userToDelete.ID))
+		if err != nil {
+			t.Errorf("Expected no error, got %s", err)
+		}
+		_, err = userModel.Authenticate(userToDelete.Email, "veryinsecurepassword")
+		if err != nil {
+			t.Errorf("Expected restored user to authenticate, got %s", err)
+		}
+	})
+	t.Run("Purge", func(t *testing.T) {
+		err := userModel.SoftDeleteUser(int(userToDelete.ID), "test_token", "test_salt", time.Now().Add(-time.Hour))
+		if err != nil {
+			t.Errorf("Expected no error, got %s", err)
+		}
+		purged, err := userModel.PurgeDeletedUsers(time.Now())
+		if err != nil {
+			t.Errorf("Expected no error, got %s", err)
+		}
+		if purged < 1 {
+			t.Errorf("Expected at least one purged user, got %d", purged)
+		}
+		_, err = userModel.GetByEmail(userToDelete.Email)
+		if !errors.Is(err, ErrRecordNotFound) {
+			t.Errorf("Expected record not found, got %v", err)
+		}
+	})
+}
+
+func TestUserModel_ListUsers(t *testing.T) {
+	cfg := data.TestPostgresConfig()
+	db, err := data.Open(cfg)
+	if err != nil {
+		t.Errorf("Expected no error, got %s", err)
+	}
+
+	defer func() {
+		if err := db.Close(); err != nil {
+			t.Errorf("Error closing server: %s", err)
+		}
+	}()
+
+	userModel := &UserModel{DB: db}
+	emails := []string{"listing_b@localhost", "listing_a@localhost", "listing_c@localhost"}
+	for _, email := range emails {
+		err := userModel.Insert(&User{Email: email, Password: "veryinsecurepassword", CreatedAt: time.Now()})
+		if err != nil {
+			t.Errorf("Expected no error, got %s", err)
+		}
+	}
+	defer func() {
+		for _, email := range emails {
+			_ = userModel.DeleteUser(email)
+		}
+	}()
+
+	t.Run("Filter, sort and page", func(t *testing.T) {
+		users, metadata, err := userModel.ListUsers(UserFilters{
+			Filters: Filters{Page: 1, PageSize: 2, Sort: "-email", SortSafelist: UserSortSafelist},
+			Email:   "listing_",
+		})
+		if err != nil {
+			t.Errorf("Expected no error, got %s", err)
+		}
+		if metadata.TotalRecords != 3 || metadata.LastPage != 2 {
+			t.Errorf("Expected 3 records over 2 pages, got %+v", metadata)
+		}
+		if len(users) != 2 || users[0].Email != "listing_c@localhost" {
+			t.Errorf("Expected listing_c first, got %v", users)
+		}
+	})
+	t.Run("Wildcards are literal", func(t *testing.T) {
+		_, metadata, err := userModel.ListUsers(UserFilters{
+			Filters: Filters{Page: 1, PageSize: 20, Sort: "id", SortSafelist: UserSortSafelist},
+			Email:   "%",
+		})
+		if err != nil {
+			t.Errorf("Expected no error, got %s", err)
+		}
+		if metadata.TotalRecords != 0 {
+			t.Errorf("Expected %% to match literally, got %d records", metadata.TotalRecords)
+		}
+	})
+}
+
+func TestUserModel_SearchUsers(t *testing.T) {
+	cfg := data.TestPostgresConfig()
+	db, err := data.Open(cfg)
+	if err != nil {
+		t.Errorf("Expected no error, got %s", err)
+	}
+
+	defer func() {
+		if err := db.Close(); err != nil {
+			t.Errorf("Error closing server: %s", err)
+		}
+	}()
+
+	userModel := &UserModel{DB: db}
+	named := &User{Email: "search_zephyrine@localhost", Password: "veryinsecurepassword", CreatedAt: time.Now()}
+	other := &User{Email: "search_quill@localhost", Password: "veryinsecurepassword", CreatedAt: time.Now()}
+	for _, user := range []*User{named, other} {
+		err := userModel.Insert(user)
+		if err != nil {
+			t.Errorf("Expected no error, got %s", err)
+		}
+	}
+	defer func() {
+		_ = userModel.DeleteUser(named.Email)
+		_ = userModel.DeleteUser(other.Email)
+	}()
+	named.DisplayName = "Zephyrine Quillfeather"
+	err = userModel.UpdateProfile(named)
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+
+	filters := SearchFilters{Filters: Filters{Page: 1, PageSize: 20, Sort: "rank", SortSafelist: SearchSortSafelist}}
+	t.Run("A name word prefix ranks above a substring", func(t *testing.T) {
+		filters.Query = "Quill"
+		results, metadata, err := userModel.SearchUsers(filters)
+		if err != nil {
+			t.Errorf("Expected no error, got %s", err)
+		}
+		if metadata.TotalRecords != 2 || len(results) != 2 {
+			t.Fatalf("Expected 2 results, got %d and %+v", len(results), metadata)
+		}
+		if results[0].User.Email != named.Email || results[0].Rank <= results[1].Rank {
+			t.Errorf("Expected %s first, got %s", named.Email, results[0].User.Email)
+		}
+		if results[1].Highlights["email"] != "search_<mark>quill</mark>@localhost" {
+			t.Errorf("Expected the email match to be highlighted, got %v", results[1].Highlights)
+		}
+	})
+	t.Run("Typo", func(t *testing.T) {
+		filters.Query = "quilfeather"
+		results, _, err := userModel.SearchUsers(filters)
+		if err != nil {
+			t.Errorf("Expected no error, got %s", err)
+		}
+		if len(results) != 1 || results[0].User.Email != named.Email {
+			t.Fatalf("Expected only %s, got %d results", named.Email, len(results))
+		}
+		if results[0].Highlights["display_name"] != "Zephyrine <mark>Quillfeather</mark>" {
+			t.Errorf("Expected the fuzzy word to be highlighted, got %v", results[0].Highlights)
+		}
+	})
+	t.Run("Wildcards are literal", func(t *testing.T) {
+		filters.Query = "%_%"
+		_, metadata, err := userModel.SearchUsers(filters)
+		if err != nil {
+			t.Errorf("Expected no error, got %s", err)
+		}
+		if metadata.TotalRecords != 0 {
+			t.Errorf("Expected %%_%% to match literally, got %d records", metadata.TotalRecords)
+		}
+	})
+}
+
+func TestUserModel_Roles(t *testing.T) {
+	cfg := data.TestPostgresConfig()
+	db, err := data.Open(cfg)
+	if err != nil {
+		t.Errorf("Expected no error, got %s", err)
+	}
+
+	defer func() {
+		if err := db.Close(); err != nil {
+			t.Errorf("Error closing server: %s", err)
+		}
+	}()
+
+	userModel := &UserModel{DB: db}
+	user := &User{Email: "roles@localhost", Password: "veryinsecurepassword", CreatedAt: time.Now()}
+	err = userModel.Insert(user)
+	if err != nil {
+		t.Errorf("Expected no error, got %s", err)
+	}
+	defer func() {
+		_ = userModel.DeleteUser(user.Email)
+	}()
+
+	t.Run("Assign", func(t *testing.T) {
+		err := userModel.AssignRole(int(user.ID), RoleSupport)
+		if err != nil {
+			t.Errorf("Expected no error, got %s", err)
+		}
+		err = userModel.AssignRole(int(user.ID), RoleSupport)
+		if err != nil {
+			t.Errorf("Expected assigning twice to be a no-op, got %s", err)
+		}
+		got, err := userModel.GetByID(int(user.ID))
+		if err != nil {
+			t.Fatalf("Expected no error, got %s", err)
+		}
+		if len(got.Roles) != 1 || got.Roles[0] != RoleSupport {
+			t.Errorf("Expected support role, got %v", got.Roles)
+		}
+		if len(got.Permissions) != 1 || got.Permissions[0] != PermissionUsersRead {
+			t.Errorf("Expected users:read permission, got %v", got.Permissions)
+		}
+	})
+	t.Run("Unknown role", func(t *testing.T) {
+		err := userModel.AssignRole(int(user.ID), "owner")
+		if !errors.Is(err, ErrUnknownRole) {
+			t.Errorf("Expected ErrUnknownRole, got %v", err)
+		}
+	})
+	t.Run("Revoke", func(t *testing.T) {
+		err := userModel.RevokeRole(int(user.ID), RoleSupport)
+		if err != nil {
+			t.Errorf("Expected no error, got %s", err)
+		}
+		err = userModel.RevokeRole(int(user.ID), RoleSupport)
+		if err == nil {
+			t.Errorf("Expected error revoking twice, got nil")
+		}
+	})
+}
+
+func TestUserModel_Lockout(t *testing.T) {
+	cfg := data.TestPostgresConfig()
+	db, err := data.Open(cfg)
+	if err != nil {
+		t.Errorf("Expected no error, got %s", err)
+	}
+
+	defer func() {
+		if err := db.Close(); err != nil {
+			t.Errorf("Error closing server: %s", err)
+		}
+	}()
+
+	// no back-off so the test doesn't have to wait between attempts
+	userModel := &UserModel{DB: db, Lockout: LockoutPolicy{Threshold: 2, LockDuration: time.Hour}}
+	user := &User{Email: "lockout@localhost", Password: "veryinsecurepassword", CreatedAt: time.Now()}
+	err = userModel.Insert(user)
+	if err != nil {
+		t.Errorf("Expected no error, got %s", err)
+	}
+	defer func() {
+		_ = userModel.DeleteUser(user.Email)
+	}()
+
+	_, err = userModel.Authenticate(user.Email, "wrong")
+	if err == nil || errors.Is(err, ErrTooManyAttempts) {
+		t.Errorf("Expected a plain failure, got %v", err)
+	}
+	_, err = userModel.Authenticate(user.Email, "wrong")
+	if !errors.Is(err, ErrTooManyAttempts) {
+		t.Errorf("Expected ErrTooManyAttempts, got %v", err)
+	}
+	_, err = userModel.Authenticate(user.Email, "veryinsecurepassword")
+	if !errors.Is(err, ErrAccountLocked) {
+		t.Errorf("Expected ErrAccountLocked, got %v", err)
+	}
+
+	err = userModel.UnlockUser(int(user.ID))
+	if err != nil {
+		t.Errorf("Expected no error, got %s", err)
+	}
+	got, err := userModel.Authenticate(user.Email, "veryinsecurepassword")
+	if err != nil {
+		t.Fatalf("Expected login after unlock, got %s", err)
+	}
+	if got.LockedUntil != nil || got.FailedLogins != 0 {
+		t.Errorf("Expected lock and counter to be cleared, got %v and %d", got.LockedUntil, got.FailedLogins)
+	}
+}
+
+func TestUserModel_PasswordHistory(t *testing.T) {
+	cfg := data.TestPostgresConfig()
+	db, err := data.Open(cfg)
+	if err != nil {
+		t.Errorf("Expected no error, got %s", err)
+	}
+
+	defer func() {
+		if err := db.Close(); err != nil {
+			t.Errorf("Error closing server: %s", err)
+		}
+	}()
+
+	userModel := &UserModel{DB: db, PasswordHistory: 1}
+	user := &User{Email: "history@localhost", Password: "password-0", CreatedAt: time.Now()}
+	err = userModel.Insert(user)
+	if err != nil {
+		t.Errorf("Expected no error, got %s", err)
+	}
+	defer func() {
+		_ = userModel.DeleteUser(user.Email)
+	}()
+
+	err = userModel.UpdatePassword(int(user.ID), "password-0", user.Version)
+	if !errors.Is(err, ErrPasswordReused) {
+		t.Errorf("Expected ErrPasswordReused for the current password, got %v", err)
+	}
+	for _, password := range []string{"password-1", "password-2"} {
+		err = userModel.UpdatePassword(int(user.ID), password, user.Version)
+		if err != nil {
+			t.Errorf("Expected no error, got %s", err)
+		}
+		user.Version++
+	}
+	err = userModel.UpdatePassword(int(user.ID), "password-1", user.Version)
+	if !errors.Is(err, ErrPasswordReused) {
+		t.Errorf("Expected ErrPasswordReused for the previous password, got %v", err)
+	}
+	err = userModel.UpdatePassword(int(user.ID), "password-0", user.Version)
+	if err != nil {
+		t.Errorf("Expected a password older than the history to be allowed, got %s", err)
+	}
+}
+
+func TestUserModel_RehashOnLogin(t *testing.T) {
+	cfg := data.TestPostgresConfig()
+	db, err := data.Open(cfg)
+	if err != nil {
+		t.Errorf("Expected no error, got %s", err)
+	}
+
+	defer func() {
+		if err := db.Close(); err != nil {
+			t.Errorf("Error closing server: %s", err)
+		}
+	}()
+
+	userModel := &UserModel{DB: db, Hasher: Hasher{Current: DefaultBcrypt}}
+	user := &User{Email: "rehash@localhost", Password: "veryinsecurepassword", CreatedAt: time.Now()}
+	err = userModel.Insert(user)
+	if err != nil {
+		t.Errorf("Expected no error, got %s", err)
+	}
+	defer func() {
+		_ = userModel.DeleteUser(user.Email)
+	}()
+
+	userModel.Hasher = Hasher{Current: DefaultArgon2id}
+	_, err = userModel.Authenticate(user.Email, "veryinsecurepassword")
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	stored, err := userModel.GetByEmail(user.Email)
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	if !strings.HasPrefix(stored.Password, "$argon2id$") {
+		t.Errorf("Expected the stored hash to be upgraded, got %s", stored.Password)
+	}
+}
+
+func TestUserModel_CanonicalEmail(t *testing.T) {
+	cfg := data.TestPostgresConfig()
+	db, err := data.Open(cfg)
+	if err != nil {
+		t.Errorf("Expected no error, got %s", err)
+	}
+
+	defer func() {
+		if err := db.Close(); err != nil {
+			t.Errorf("Error closing server: %s", err)
+		}
+	}()
+
+	userModel := &UserModel{DB: db}
+	user := &User{Email: "Canonical@Localhost", Password: "veryinsecurepassword", CreatedAt: time.Now()}
+	err = userModel.Insert(user)
+	if err != nil {
+		t.Errorf("Expected no error, got %s", err)
+	}
+	defer func() {
+		_ = userModel.DeleteUser("canonical@localhost")
+	}()
+
+	err = userModel.Insert(&User{Email: "canonical@LOCALHOST", Password: "veryinsecurepassword", CreatedAt: time.Now()})
+	if !errors.Is(err, ErrDuplicateEmail) {
+		t.Errorf("Expected ErrDuplicateEmail for a case-only duplicate, got %v", err)
+	}
+	got, err := userModel.GetByEmail("CANONICAL@localhost")
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	if got.Email != "Canonical@Localhost" {
+		t.Errorf("Expected the address to be kept as typed, got %s", got.Email)
+	}
+	_, err = userModel.Authenticate("canonical@localhost", "veryinsecurepassword")
+	if err != nil {
+		t.Errorf("Expected to sign in with a differently cased address, got %s", err)
+	}
+}
+
+func TestUserModel_GetByPublicID(t *testing.T) {
+	cfg := data.TestPostgresConfig()
+	db, err := data.Open(cfg)
+	if err != nil {
+		t.Errorf("Expected no error, got %s", err)
+	}
+
+	defer func() {
+		if err := db.Close(); err != nil {
+			t.Errorf("Error closing server: %s", err)
+		}
+	}()
+
+	userModel := &UserModel{DB: db}
+	user := &User{Email: "publicid@localhost", Password: "veryinsecurepassword", CreatedAt: time.Now()}
+	err = userModel.Insert(user)
+	if err != nil {
+		t.Errorf("Expected no error, got %s", err)
+	}
+	defer func() {
+		_ = userModel.DeleteUser("publicid@localhost")
+	}()
+
+	got, err := userModel.GetByPublicID(user.PublicID)
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	if got.ID != user.ID || got.PublicID != user.PublicID {
+		t.Errorf("Expected user %d (%s), got %d (%s)", user.ID, user.PublicID, got.ID, got.PublicID)
+	}
+
+	for _, publicID := range []string{"not-a-uuid", "0190a6e2-5c3b-7c1e-9f3a-2b4c6d8e0f12"} {
+		_, err = userModel.GetByPublicID(publicID)
+		if !errors.Is(err, ErrRecordNotFound) {
+			t.Errorf("Expected ErrRecordNotFound for %q, got %v", publicID, err)
+		}
+	}
+}
+
+func TestUserModel_Organizations(t *testing.T) {
+	cfg := data.TestPostgresConfig()
+	db, err := data.Open(cfg)
+	if err != nil {
+		t.Errorf("Expected no error, got %s", err)
+	}
+
+	defer func() {
+		if err := db.Close(); err != nil {
+			t.Errorf("Error closing server: %s", err)
+		}
+	}()
+
+	userModel := &UserModel{DB: db}
+	owner := &User{Email: "orgowner@localhost", Password: "veryinsecurepassword", CreatedAt: time.Now()}
+	member := &User{Email: "orgmember@localhost", Password: "veryinsecurepassword", CreatedAt: time.Now()}
+	for _, user := range []*User{owner, member} {
+		err = userModel.Insert(user)
+		if err != nil {
+			t.Fatalf("Expected no error, got %s", err)
+		}
+	}
+	defer func() {
+		_, _ = db.Exec(`DELETE FROM organizations WHERE slug = 'integration-org'`)
+		_ = userModel.DeleteUser("orgowner@localhost")
+		_ = userModel.DeleteUser("orgmember@localhost")
+	}()
+
+	_, err = userModel.GetMembership(DefaultOrgSlug, int(member.ID))
+	if err != nil {
+		t.Errorf("Expected new users to join the default organization, got %s", err)
+	}
+
+	org := &Organization{Slug: "integration-org", Name: "Integration", CreatedAt: time.Now()}
+	err = userModel.CreateOrganization(org, int(owner.ID))
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	err = userModel.CreateOrganization(&Organization{Slug: "integration-org", Name: "Again", CreatedAt: time.Now()}, int(member.ID))
+	if !errors.Is(err, ErrDuplicateSlug) {
+		t.Errorf("Expected ErrDuplicateSlug, got %v", err)
+	}
+
+	members, err := userModel.ListMembers(int(org.ID))
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	if len(members) != 1 || members[0].UserPublicID != owner.PublicID || members[0].Role != OrgRoleOwner {
+		t.Errorf("Expected the creator as the only owner, got %+v", members)
+	}
+
+	err = userModel.RemoveMember(int(org.ID), int(owner.ID))
+	if !errors.Is(err, ErrLastOwner) {
+		t.Errorf("Expected ErrLastOwner, got %v", err)
+	}
+	err = userModel.RemoveMember(int(org.ID), int(member.ID))
+	if !errors.Is(err, ErrNotMember) {
+		t.Errorf("Expected ErrNotMember, got %v", err)
+	}
+}
+
+func TestUserModel_Invitations(t *testing.T) {
+	cfg := data.TestPostgresConfig()
+	db, err := data.Open(cfg)
+	if err != nil {
+		t.Errorf("Expected no error, got %s", err)
+	}
+
+	defer func() {
+		if err := db.Close(); err != nil {
+			t.Errorf("Error closing server: %s", err)
+		}
+	}()
+
+	userModel := &UserModel{DB: db}
+	owner := &User{Email: "inviteowner@localhost", Password: "veryinsecurepassword", CreatedAt: time.Now()}
+	err = userModel.Insert(owner)
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	defer func() {
+		_, _ = db.Exec(`DELETE FROM organizations WHERE slug = 'invite-org'`)
+		_ = userModel.DeleteUser("inviteowner@localhost")
+		_ = userModel.DeleteUser("invitee@localhost")
+	}()
+	org := &Organization{Slug: "invite-org", Name: "Invites", CreatedAt: time.Now()}
+	err = userModel.CreateOrganization(org, int(owner.ID))
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+
+	now := time.Now()
+	first := &Invitation{OrgID: org.ID, Email: "invitee@localhost", Role: OrgRoleMember, InvitedBy: owner.ID,
+		TokenHash: "hash", TokenSalt: "salt", CreatedAt: now, ExpiresAt: now.Add(time.Hour)}
+	second := *first
+	second.PublicID = ""
+	for _, inv := range []*Invitation{first, &second} {
+		err = userModel.CreateInvitation(inv)
+		if err != nil {
+			t.Fatalf("Expected no error, got %s", err)
+		}
+	}
+
+	pending, err := userModel.ListPendingInvitations(int(org.ID))
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	if len(pending) != 1 || pending[0].PublicID != second.PublicID {
+		t.Errorf("Expected only the newest invitation to be pending, got %+v", pending)
+	}
+	got, err := userModel.GetInvitation(first.PublicID)
+	if err != nil || got.RevokedAt == nil {
+		t.Errorf("Expected the first invitation to be revoked, got %+v, %v", got, err)
+	}
+
+	invitee := &User{Email: "invitee@localhost", Password: "veryinsecurepassword", CreatedAt: time.Now(), Verified: true}
+	err = userModel.Insert(invitee)
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	err = userModel.AcceptInvitation(int(second.ID), int(invitee.ID))
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	err = userModel.AcceptInvitation(int(second.ID), int(invitee.ID))
+	if !errors.Is(err, ErrInvitationClosed) {
+		t.Errorf("Expected ErrInvitationClosed accepting twice, got %v", err)
+	}
+	_, err = userModel.GetMembership("invite-org", int(invitee.ID))
+	if err != nil {
+		t.Errorf("Expected the invitee to be a member, got %s", err)
+	}
+	stored, err := userModel.GetByID(int(invitee.ID))
+	if err != nil || !stored.Verified {
+		t.Errorf("Expected the invitee to be stored verified, got %+v, %v", stored, err)
+	}
+}
+
+func TestUserModel_Metadata(t *testing.T) {
+	cfg := data.TestPostgresConfig()
+	db, err := data.Open(cfg)
+	if err != nil {
+		t.Errorf("Expected no error, got %s", err)
+	}
+
+	defer func() {
+		if err := db.Close(); err != nil {
+			t.Errorf("Error closing server: %s", err)
+		}
+	}()
+
+	userModel := &UserModel{DB: db}
+	user := &User{Email: "metadata@localhost", Password: "veryinsecurepassword", CreatedAt: time.Now()}
+	err = userModel.Insert(user)
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	defer func() {
+		_ = userModel.DeleteUser("metadata@localhost")
+	}()
+
+	err = userModel.UpdateAppMetadata(user, json.RawMessage(`{"plan":"pro","seats":3}`))
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	err = userModel.UpdateAppMetadata(user, json.RawMessage(`{"seats":null}`))
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	err = userModel.UpdateUserMetadata(user, json.RawMessage(`{"theme":"dark"}`))
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+
+	stored, err := userModel.GetByID(int(user.ID))
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	var appMetadata map[string]any
+	if err := json.Unmarshal(stored.AppMetadata, &appMetadata); err != nil || len(appMetadata) != 1 || appMetadata["plan"] != "pro" {
+		t.Errorf("Expected app_metadata to hold only the plan, got %s", stored.AppMetadata)
+	}
+	if !strings.Contains(string(stored.UserMetadata), "dark") {
+		t.Errorf("Expected user_metadata to hold the theme, got %s", stored.UserMetadata)
+	}
+
+	err = userModel.UpdateUserMetadata(user, json.RawMessage(`["not", "an", "object"]`))
+	if !errors.Is(err, ErrMetadataNotObject) {
+		t.Errorf("Expected ErrMetadataNotObject, got %v", err)
+	}
+}
+
+func TestUserModel_AuditEvents(t *testing.T) {
+	cfg := data.TestPostgresConfig()
+	db, err := data.Open(cfg)
+	if err != nil {
+		t.Errorf("Expected no error, got %s", err)
+	}
+
+	defer func() {
+		if err := db.Close(); err != nil {
+			t.Errorf("Error closing server: %s", err)
+		}
+	}()
+
+	userModel := &UserModel{DB: db}
+	subject, err := NewPublicID()
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	now := time.Now().Truncate(time.Second)
+	for _, event := range []*AuditEvent{
+		{Type: AuditLoginFailed, SubjectID: subject, Email: "audit@localhost", IP: "192.0.2.1", CreatedAt: now},
+		{Type: AuditLoginSucceeded, ActorID: subject, SubjectID: subject, IP: "192.0.2.1", RequestID: "req-1", CreatedAt: now.Add(time.Second)},
+		{Type: AuditLoginFailed, Email: "nobody@localhost", CreatedAt: now},
+	} {
+		err = userModel.RecordAuditEvent(event)
+		if err != nil {
+			t.Fatalf("Expected no error, got %s", err)
+		}
+		if event.ID == 0 {
+			t.Errorf("Expected the event to get an id")
+		}
+	}
+
+	events, metadata, err := userModel.ListAuditEvents(AuditFilters{
+		Filters: Filters{Page: 1, PageSize: 20, Sort: "-created_at", SortSafelist: AuditSortSafelist},
+		User:    subject,
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	if metadata.TotalRecords != 2 || events[0].Type != AuditLoginSucceeded || events[0].RequestID != "req-1" || events[1].ActorID != "" {
+		t.Errorf("Expected the success then the failure for the subject, got %+v", events)
+	}
+
+	// the log is append-only
+	_, err = db.Exec(`UPDATE audit_events SET event_type = 'login.succeeded' WHERE id = $1`, events[1].ID)
+	if err == nil {
+		t.Errorf("Expected updating an audit event to fail")
+	}
+	_, err = db.Exec(`DELETE FROM audit_events WHERE id = $1`, events[1].ID)
+	if err == nil {
+		t.Errorf("Expected deleting an audit event to fail")
+	}
+}
+
+func TestUserModel_LoginHistory(t *testing.T) {
+	cfg := data.TestPostgresConfig()
+	db, err := data.Open(cfg)
+	if err != nil {
+		t.Errorf("Expected no error, got %s", err)
+	}
+
+	defer func() {
+		if err := db.Close(); err != nil {
+			t.Errorf("Error closing server: %s", err)
+		}
+	}()
+
+	userModel := &UserModel{DB: db}
+	subject, err := NewPublicID()
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	now := time.Now().Truncate(time.Second)
+	for _, event := range []*AuditEvent{
+		{Type: AuditLoginSucceeded, SubjectID: subject, Method: LoginMethodPassword, CreatedAt: now.Add(-48 * time.Hour)},
+		{Type: AuditUserCreated, ActorID: subject, SubjectID: subject, CreatedAt: now.Add(-48 * time.Hour)},
+		{Type: AuditLoginFailed, SubjectID: subject, Method: LoginMethodPassword, UserAgent: "curl/8.4.0", CreatedAt: now},
+	} {
+		err = userModel.RecordAuditEvent(event)
+		if err != nil {
+			t.Fatalf("Expected no error, got %s", err)
+		}
+	}
+
+	history, metadata, err := userModel.ListLoginHistory(subject, now.Add(-24*time.Hour), Filters{Page: 1, PageSize: 20})
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	if metadata.TotalRecords != 1 || history[0].Succeeded || history[0].Browser != "curl" {
+		t.Errorf("Expected the one recent failed curl sign in, got %+v", history)
+	}
+}
+
+func TestUserModel_ImportUsers(t *testing.T) {
+	cfg := data.TestPostgresConfig()
+	db, err := data.Open(cfg)
+	if err != nil {
+		t.Errorf("Expected no error, got %s", err)
+	}
+
+	defer func() {
+		if err := db.Close(); err != nil {
+			t.Errorf("Error closing server: %s", err)
+		}
+	}()
+
+	userModel := &UserModel{DB: db}
+	existing := &User{Email: "importexisting@localhost", Password: "veryinsecurepassword", CreatedAt: time.Now()}
+	err = userModel.Insert(existing)
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	hash, err := DefaultBcrypt.Hash("veryinsecurepassword")
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	newUsers := func() []*User {
+		return []*User{
+			{Email: "imported@localhost", Password: hash, CreatedAt: time.Now(), Verified: true},
+			{Email: "ImportExisting@localhost", Password: hash, CreatedAt: time.Now()},
+		}
+	}
+	defer func() {
+		_ = userModel.DeleteUser(existing.Email)
+		_ = userModel.DeleteUser("imported@localhost")
+	}()
+
+	t.Run("Dry run", func(t *testing.T) {
+		errs, err := userModel.ImportUsers(newUsers(), true)
+		if err != nil {
+			t.Fatalf("Expected no error, got %s", err)
+		}
+		if errs[0] != nil || !errors.Is(errs[1], ErrUserExists) {
+			t.Errorf("Expected only the existing email to fail, got %v", errs)
+		}
+		if _, err := userModel.GetByEmail("imported@localhost"); !errors.Is(err, ErrRecordNotFound) {
+			t.Errorf("Expected a dry run to store nothing, got %v", err)
+		}
+	})
+	t.Run("Import", func(t *testing.T) {
+		errs, err := userModel.ImportUsers(newUsers(), false)
+		if err != nil {
+			t.Fatalf("Expected no error, got %s", err)
+		}
+		if errs[0] != nil || !errors.Is(errs[1], ErrUserExists) {
+			t.Errorf("Expected only the existing email to fail, got %v", errs)
+		}
+		user, err := userModel.Authenticate("imported@localhost", "veryinsecurepassword")
+		if err != nil || !user.Verified {
+			t.Errorf("Expected the imported user to sign in with their bcrypt hash, got %+v, %v", user, err)
+		}
+
+		exported := map[string]bool{}
+		err = userModel.ExportUsers(func(user *User) error {
+			exported[user.Email] = true
+			return nil
+		})
+		if err != nil || !exported["imported@localhost"] || !exported[existing.Email] {
+			t.Errorf("Expected both users in the export, got %v, %v", exported, err)
+		}
+	})
+}
+
+func TestUserModel_DataExports(t *testing.T) {
+	cfg := data.TestPostgresConfig()
+	db, err := data.Open(cfg)
+	if err != nil {
+		t.Errorf("Expected no error, got %s", err)
+	}
+
+	defer func() {
+		if err := db.Close(); err != nil {
+			t.Errorf("Error closing server: %s", err)
+		}
+	}()
+
+	userModel := &UserModel{DB: db}
+	user := &User{Email: "dataexport@localhost", Password: "veryinsecurepassword", CreatedAt: time.Now()}
+	err = userModel.Insert(user)
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	defer func() {
+		_ = userModel.DeleteUser(user.Email)
+	}()
+
+	memberships, err := userModel.ListMemberships(int(user.ID))
+	if err != nil || len(memberships) != 1 || memberships[0].OrgSlug != DefaultOrgSlug {
+		t.Errorf("Expected the default organization, got %+v, %v", memberships, err)
+	}
+
+	now := time.Now().Truncate(time.Second)
+	current := &DataExport{UserID: user.ID, TokenHash: "hash", TokenSalt: "salt", Content: []byte(`{"profile":{}}`),
+		CreatedAt: now, ExpiresAt: now.Add(time.Hour)}
+	expired := &DataExport{UserID: user.ID, TokenHash: "hash", TokenSalt: "salt", Content: []byte(`{}`),
+		CreatedAt: now.Add(-2 * time.Hour), ExpiresAt: now.Add(-time.Hour)}
+	for _, export := range []*DataExport{current, expired} {
+		err = userModel.CreateDataExport(export)
+		if err != nil {
+			t.Fatalf("Expected no error, got %s", err)
+		}
+	}
+
+	got, err := userModel.GetDataExport(current.PublicID)
+	if err != nil || got.UserID != user.ID || string(got.Content) != string(current.Content) {
+		t.Errorf("Expected the current export, got %+v, %v", got, err)
+	}
+	_, err = userModel.GetDataExport(expired.PublicID)
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("Expected an expired export not to be found, got %v", err)
+	}
+
+	purged, err := userModel.PurgeDataExports(now)
+	if err != nil || purged < 1 {
+		t.Errorf("Expected the expired export to be purged, got %d, %v", purged, err)
+	}
+	_, err = userModel.GetDataExport(current.PublicID)
+	if err != nil {
+		t.Errorf("Expected the current export to be kept, got %s", err)
+	}
+}
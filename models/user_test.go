@@ -1,7 +1,9 @@
 package models
 
 import (
+	"errors"
 	"reflect"
+	"strings"
 	"testing"
 	"the_lonely_road/token"
 	"the_lonely_road/validator"
@@ -71,7 +73,7 @@ func TestUserModelMock_UpdatePassword(t *testing.T) {
 	userModel := UserModelMock{}
 	userModel.DB = append(userModel.DB, &mockUser)
 	t.Run("Happy path", func(t *testing.T) {
-		err := userModel.UpdatePassword(int(mockUser.ID), "newpassword")
+		err := userModel.UpdatePassword(int(mockUser.ID), "newpassword", mockUser.Version)
 		if err != nil {
 			t.Errorf("Expected no error, got %s", err)
 		}
@@ -83,8 +85,14 @@ func TestUserModelMock_UpdatePassword(t *testing.T) {
 			t.Errorf("Expected password to be updated")
 		}
 	})
+	t.Run("Stale version", func(t *testing.T) {
+		err := userModel.UpdatePassword(int(mockUser.ID), "anotherpassword", mockUser.Version-1)
+		if !errors.Is(err, ErrEditConflict) {
+			t.Errorf("Expected ErrEditConflict, got %v", err)
+		}
+	})
 	t.Run("User not found", func(t *testing.T) {
-		err := userModel.UpdatePassword(999, "newpassword")
+		err := userModel.UpdatePassword(999, "newpassword", 1)
 		if err == nil && err.Error() != "user not found" {
 			t.Errorf("Expected error, got %s", err)
 		}
@@ -188,7 +196,7 @@ func TestUserModelMock_EnterPasswordHash(t *testing.T) {
 			t.Fatal(err)
 		}
 		token.HashToken(passwordHash, salt)
-		err = userModel.EnterPasswordHash(mockUser.Email, passwordHash, salt)
+		err = userModel.EnterPasswordHash(mockUser.Email, passwordHash, salt, mockUser.Version)
 		if err != nil {
 			t.Errorf("Expected no error, got %s", err)
 		}
@@ -201,7 +209,7 @@ func TestUserModelMock_EnterPasswordHash(t *testing.T) {
 	})
 
 	t.Run("User not found", func(t *testing.T) {
-		err = userModel.EnterPasswordHash("notfound", "notfound", "notfound")
+		err = userModel.EnterPasswordHash("notfound", "notfound", "notfound", 1)
 		if err == nil && err.Error() != "user not found" {
 			t.Errorf("Expected error, got %s", err)
 		}
@@ -225,7 +233,7 @@ func TestUserModelMock_ConsumePasswordReset(t *testing.T) {
 			t.Fatal(err)
 		}
 		token.HashToken(passwordHash, salt)
-		err = userModel.EnterPasswordHash(mockUser.Email, passwordHash, salt)
+		err = userModel.EnterPasswordHash(mockUser.Email, passwordHash, salt, mockUser.Version)
 		if err != nil {
 			t.Errorf("Expected no error, got %s", err)
 		}
@@ -235,7 +243,7 @@ func TestUserModelMock_ConsumePasswordReset(t *testing.T) {
 		if mockUser.PasswordResetHashToken == "" || mockUser.PasswordResetSalt == "" {
 			t.Errorf("Expected PasswordResetToken and PasswordResetSalt to be set, got %s and %s", mockUser.PasswordResetHashToken, mockUser.PasswordResetSalt)
 		}
-		err = userModel.ConsumePasswordReset(mockUser.Email)
+		err = userModel.ConsumePasswordReset(mockUser.Email, mockUser.Version)
 		if err != nil {
 			t.Errorf("Expected no error, got %s", err)
 		}
@@ -247,13 +255,287 @@ func TestUserModelMock_ConsumePasswordReset(t *testing.T) {
 		}
 	})
 	t.Run("User not found", func(t *testing.T) {
-		err = userModel.ConsumePasswordReset("notfound")
+		err = userModel.ConsumePasswordReset("notfound", 1)
 		if err == nil && err.Error() != "user not found" {
 			t.Errorf("Expected error, got %s", err)
 		}
 	})
 }
 
+func TestUserModelMock_GetByID(t *testing.T) {
+	mockUser := User{
+		ID:        3,
+		Email:     "mock@userx.com",
+		Password:  "mockpassword",
+		CreatedAt: time.Now(),
+	}
+
+	userModel := UserModelMock{}
+	userModel.DB = append(userModel.DB, &mockUser)
+
+	t.Run("User Found", func(t *testing.T) {
+		user, err := userModel.GetByID(int(mockUser.ID))
+		if err != nil {
+			t.Errorf("Expected no error, got %s", err)
+		}
+		if !reflect.DeepEqual(user, &mockUser) {
+			t.Errorf("Expected user to be returned")
+		}
+	})
+	t.Run("User Not Found", func(t *testing.T) {
+		_, err := userModel.GetByID(999)
+		if err == nil || err.Error() != "record not found" {
+			t.Errorf("Expected record not found, got %v", err)
+		}
+	})
+}
+
+func TestUserModelMock_UpdateProfile(t *testing.T) {
+	mockUser := User{
+		ID:        3,
+		Email:     "mock@userx.com",
+		Password:  "mockpassword",
+		CreatedAt: time.Now(),
+	}
+
+	userModel := UserModelMock{}
+	userModel.DB = append(userModel.DB, &mockUser)
+
+	t.Run("Happy path", func(t *testing.T) {
+		update := User{
+			ID:          mockUser.ID,
+			DisplayName: "Mock",
+			Locale:      "en-GB",
+			TimeZone:    "Europe/London",
+		}
+		err := userModel.UpdateProfile(&update)
+		if err != nil {
+			t.Errorf("Expected no error, got %s", err)
+		}
+		if mockUser.DisplayName != "Mock" || mockUser.Locale != "en-GB" || mockUser.TimeZone != "Europe/London" {
+			t.Errorf("Expected profile to be updated, got %+v", mockUser)
+		}
+		if update.UpdatedAt.IsZero() || !update.UpdatedAt.Equal(mockUser.UpdatedAt) {
+			t.Errorf("Expected UpdatedAt to be refreshed")
+		}
+		if update.Version != 1 || mockUser.Version != 1 {
+			t.Errorf("Expected the version to go up to 1, got %d and %d", update.Version, mockUser.Version)
+		}
+	})
+	t.Run("Stale version", func(t *testing.T) {
+		stale := User{ID: mockUser.ID, DisplayName: "Stale", Version: 0}
+		err := userModel.UpdateProfile(&stale)
+		if !errors.Is(err, ErrEditConflict) {
+			t.Errorf("Expected ErrEditConflict, got %v", err)
+		}
+		if mockUser.DisplayName != "Mock" {
+			t.Errorf("Expected a stale update to be refused, got %q", mockUser.DisplayName)
+		}
+	})
+	t.Run("User not found", func(t *testing.T) {
+		err := userModel.UpdateProfile(&User{ID: 999})
+		if err == nil {
+			t.Errorf("Expected error, got nil")
+		}
+	})
+}
+
+func TestUserModelMock_EmailChange(t *testing.T) {
+	mockUser := User{
+		ID:        3,
+		Email:     "old@userx.com",
+		Password:  "mockpassword",
+		CreatedAt: time.Now(),
+	}
+	otherUser := User{
+		ID:        4,
+		Email:     "other@userx.com",
+		Password:  "mockpassword",
+		CreatedAt: time.Now(),
+	}
+	userModel := UserModelMock{DB: []*User{&mockUser, &otherUser}}
+
+	t.Run("Confirm happy path", func(t *testing.T) {
+		err := userModel.RequestEmailChange(int(mockUser.ID), "new@userx.com", "hash", "salt", "cancelhash", "cancelsalt")
+		if err != nil {
+			t.Errorf("Expected no error, got %s", err)
+		}
+		if mockUser.Email != "old@userx.com" || mockUser.PendingEmail != "new@userx.com" {
+			t.Errorf("Expected change to be pending, got email %s pending %s", mockUser.Email, mockUser.PendingEmail)
+		}
+		if mockUser.EmailChangeExpiry.Before(time.Now()) {
+			t.Errorf("Expected expiry in the future, got %s", mockUser.EmailChangeExpiry)
+		}
+		err = userModel.ConfirmEmailChange(int(mockUser.ID))
+		if err != nil {
+			t.Errorf("Expected no error, got %s", err)
+		}
+		if mockUser.Email != "new@userx.com" || mockUser.PendingEmail != "" || mockUser.EmailChangeHashToken != "" {
+			t.Errorf("Expected change to be applied and consumed, got %+v", mockUser)
+		}
+	})
+	t.Run("Confirm without pending change", func(t *testing.T) {
+		err := userModel.ConfirmEmailChange(int(mockUser.ID))
+		if err == nil {
+			t.Errorf("Expected error, got nil")
+		}
+	})
+	t.Run("Confirm duplicate email", func(t *testing.T) {
+		err := userModel.RequestEmailChange(int(mockUser.ID), otherUser.Email, "hash", "salt", "cancelhash", "cancelsalt")
+		if err != nil {
+			t.Errorf("Expected no error, got %s", err)
+		}
+		err = userModel.ConfirmEmailChange(int(mockUser.ID))
+		if !errors.Is(err, ErrDuplicateEmail) {
+			t.Errorf("Expected duplicate email, got %v", err)
+		}
+	})
+	t.Run("Cancel", func(t *testing.T) {
+		err := userModel.CancelEmailChange(int(mockUser.ID))
+		if err != nil {
+			t.Errorf("Expected no error, got %s", err)
+		}
+		if mockUser.PendingEmail != "" || mockUser.EmailChangeSalt != "" || !mockUser.EmailChangeExpiry.IsZero() {
+			t.Errorf("Expected pending change to be cleared, got %+v", mockUser)
+		}
+	})
+	t.Run("User not found", func(t *testing.T) {
+		err := userModel.RequestEmailChange(999, "new@userx.com", "hash", "salt", "cancelhash", "cancelsalt")
+		if err == nil {
+			t.Errorf("Expected error, got nil")
+		}
+	})
+}
+
+func TestUserModelMock_SoftDeleteUser(t *testing.T) {
+	mockUser := User{
+		ID:        3,
+		Email:     "softdelete@userx.com",
+		Password:  "mockpassword",
+		CreatedAt: time.Now(),
+	}
+	userModel := UserModelMock{}
+	err := userModel.Insert(&mockUser)
+	if err != nil {
+		t.Errorf("Expected no error, got %s", err)
+	}
+
+	t.Run("Delete blocks login", func(t *testing.T) {
+		err := userModel.SoftDeleteUser(int(mockUser.ID), "hash", "salt", time.Now().Add(time.Hour))
+		if err != nil {
+			t.Errorf("Expected no error, got %s", err)
+		}
+		if mockUser.DeletedAt == nil {
+			t.Errorf("Expected DeletedAt to be set")
+		}
+		_, err = userModel.Authenticate(mockUser.Email, "mockpassword")
+		if err == nil {
+			t.Errorf("Expected deleted user not to authenticate")
+		}
+		err = userModel.SoftDeleteUser(int(mockUser.ID), "hash", "salt", time.Now().Add(time.Hour))
+		if err == nil {
+			t.Errorf("Expected error deleting an already deleted user")
+		}
+	})
+	t.Run("Purge keeps users inside the window", func(t *testing.T) {
+		purged, err := userModel.PurgeDeletedUsers(time.Now())
+		if err != nil {
+			t.Errorf("Expected no error, got %s", err)
+		}
+		if purged != 0 || len(userModel.DB) != 1 {
+			t.Errorf("Expected nothing to be purged, purged %d", purged)
+		}
+	})
+	t.Run("Restore allows login", func(t *testing.T) {
+		err := userModel.RestoreUser(int(mockUser.ID))
+		if err != nil {
+			t.Errorf("Expected no error, got %s", err)
+		}
+		if mockUser.DeletedAt != nil || mockUser.RestoreHashToken != "" {
+			t.Errorf("Expected user to be restored, got %+v", mockUser)
+		}
+		_, err = userModel.Authenticate(mockUser.Email, "mockpassword")
+		if err != nil {
+			t.Errorf("Expected restored user to authenticate, got %s", err)
+		}
+		err = userModel.RestoreUser(int(mockUser.ID))
+		if err == nil {
+			t.Errorf("Expected error restoring an active user")
+		}
+	})
+	t.Run("Purge removes expired users", func(t *testing.T) {
+		err := userModel.SoftDeleteUser(int(mockUser.ID), "hash", "salt", time.Now().Add(-time.Hour))
+		if err != nil {
+			t.Errorf("Expected no error, got %s", err)
+		}
+		purged, err := userModel.PurgeDeletedUsers(time.Now())
+		if err != nil {
+			t.Errorf("Expected no error, got %s", err)
+		}
+		if purged != 1 || len(userModel.DB) != 0 {
+			t.Errorf("Expected user to be purged, purged %d", purged)
+		}
+	})
+}
+
+func TestUserModelMock_ListUsers(t *testing.T) {
+	verified := true
+	userModel := UserModelMock{DB: []*User{
+		{ID: 1, Email: "b@userx.com", Verified: true},
+		{ID: 2, Email: "a@userx.com"},
+		{ID: 3, Email: "c@other.com", Verified: true},
+	}}
+	filters := UserFilters{
+		Filters:  Filters{Page: 1, PageSize: 1, Sort: "email", SortSafelist: UserSortSafelist},
+		Email:    "userx",
+		Verified: &verified,
+	}
+
+	users, metadata, err := userModel.ListUsers(filters)
+	if err != nil {
+		t.Errorf("Expected no error, got %s", err)
+	}
+	if len(users) != 1 || users[0].ID != 1 {
+		t.Errorf("Expected only user 1, got %v", users)
+	}
+	if metadata.TotalRecords != 1 || metadata.LastPage != 1 {
+		t.Errorf("Expected one matching record, got %+v", metadata)
+	}
+
+	filters.Verified = nil
+	filters.Page = 5
+	users, metadata, err = userModel.ListUsers(filters)
+	if err != nil {
+		t.Errorf("Expected no error, got %s", err)
+	}
+	if len(users) != 0 || metadata.TotalRecords != 2 {
+		t.Errorf("Expected an empty page past the end with 2 total, got %d users and %+v", len(users), metadata)
+	}
+}
+
+func TestValidateProfile(t *testing.T) {
+	tests := []struct {
+		name  string
+		user  User
+		valid bool
+	}{
+		{name: "Empty profile", user: User{}, valid: true},
+		{name: "Full profile", user: User{DisplayName: "Zoë", GivenName: "Zoë", FamilyName: "Smith", Locale: "fr-CA", TimeZone: "America/Toronto"}, valid: true},
+		{name: "Display name too long", user: User{DisplayName: strings.Repeat("a", 101)}, valid: false},
+		{name: "Bad locale", user: User{Locale: "en_US"}, valid: false},
+		{name: "Bad time zone", user: User{TimeZone: "Nowhere/Special"}, valid: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			v := validator.New()
+			ValidateProfile(v, &test.user)
+			if v.Valid() != test.valid {
+				t.Errorf("Expected valid to be %v, got errors %v", test.valid, v.Errors)
+			}
+		})
+	}
+}
+
 func TestValidateEmail(t *testing.T) {
 	t.Run("Happy path", func(t *testing.T) {
 		v := validator.New()
@@ -269,19 +551,77 @@ func TestValidateEmail(t *testing.T) {
 			t.Errorf("Expected validator to be invalid, got valid")
 		}
 	})
+	for _, email := range []string{"nobodyhome", "@example.com", "alice@", "alice@bob@example.com", "enc:v1:a:b:c", "ENC:alice@example.com"} {
+		t.Run("Not an address "+email, func(t *testing.T) {
+			v := validator.New()
+			ValidateEmail(v, email)
+			if v.Valid() {
+				t.Errorf("Expected %q to be invalid, got valid", email)
+			}
+		})
+	}
+}
+
+func TestInvalidEmails(t *testing.T) {
+	deleted := time.Now()
+	m := &UserModelMock{DB: []*User{
+		{ID: 1, PublicID: "alice", Email: "alice@example.com"},
+		{ID: 2, PublicID: "bob", Email: "bobsmith", Username: "bob"},
+		{ID: 3, PublicID: "carol", Email: "carolsmith", DeletedAt: &deleted},
+	}}
+	ids, err := InvalidEmails(m)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(ids) != 1 || ids[0] != "bob" {
+		t.Errorf("Expected only bob to be reported, got %v", ids)
+	}
 }
 
 func TestValidatePasswordPlaintext(t *testing.T) {
 	t.Run("Happy path", func(t *testing.T) {
 		v := validator.New()
-		ValidatePasswordPlaintext(v, "averygoodpassword")
+		ValidatePasswordPlaintext(v, "averygoodpassword", nil)
 		if !v.Valid() {
 			t.Errorf("Expected validator to be valid, got invalid")
 		}
 	})
 	t.Run("Password too short", func(t *testing.T) {
 		v := validator.New()
-		ValidatePasswordPlaintext(v, "abc")
+		ValidatePasswordPlaintext(v, "abc", nil)
+		if v.Valid() {
+			t.Errorf("Expected validator to be invalid, got valid")
+		}
+	})
+	t.Run("Longer than bcrypt allows", func(t *testing.T) {
+		v := validator.New()
+		ValidatePasswordPlaintext(v, strings.Repeat("a", 100), nil)
+		if !v.Valid() {
+			t.Errorf("Expected validator to be valid, got invalid")
+		}
+	})
+	t.Run("Longer than bcrypt allows with bcrypt", func(t *testing.T) {
+		v := validator.New()
+		ValidatePasswordPlaintext(v, strings.Repeat("a", 73), Hasher{Current: testBcrypt})
+		if v.Valid() {
+			t.Errorf("Expected validator to be invalid, got valid")
+		}
+		v = validator.New()
+		ValidatePasswordPlaintext(v, strings.Repeat("a", 72), Hasher{Current: testBcrypt})
+		if !v.Valid() {
+			t.Errorf("Expected 72 bytes to be valid, got %v", v.Errors)
+		}
+	})
+	t.Run("Longer than bcrypt allows with a pepper", func(t *testing.T) {
+		v := validator.New()
+		ValidatePasswordPlaintext(v, strings.Repeat("a", 100), Hasher{Current: testBcrypt, Pepper: []byte("pepper")})
+		if !v.Valid() {
+			t.Errorf("Expected validator to be valid, got invalid")
+		}
+	})
+	t.Run("Password too long", func(t *testing.T) {
+		v := validator.New()
+		ValidatePasswordPlaintext(v, strings.Repeat("a", 257), nil)
 		if v.Valid() {
 			t.Errorf("Expected validator to be invalid, got valid")
 		}
@@ -292,10 +632,10 @@ func TestValidateUser(t *testing.T) {
 	t.Run("Happy path", func(t *testing.T) {
 		v := validator.New()
 		user := User{
-			Email:    "AverygoodEmail",
+			Email:    "AverygoodEmail@great.com",
 			Password: "averygoodpassword",
 		}
-		ValidateUser(v, &user)
+		ValidateUser(v, &user, nil)
 		if !v.Valid() {
 			t.Errorf("Expected validator to be valid, got invalid")
 		}
@@ -306,7 +646,7 @@ func TestValidateUser(t *testing.T) {
 			Email:    "bad",
 			Password: "averygoodpassword",
 		}
-		ValidateUser(v, &user)
+		ValidateUser(v, &user, nil)
 		if v.Valid() {
 			t.Errorf("Expected validator to not be valid")
 		}
@@ -317,7 +657,7 @@ func TestValidateUser(t *testing.T) {
 			Email:    "averygoodemail",
 			Password: "",
 		}
-		ValidateUser(v, &user)
+		ValidateUser(v, &user, nil)
 		if v.Valid() {
 			t.Errorf("Expected validator to not be valid")
 		}
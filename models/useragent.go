@@ -0,0 +1,46 @@
+package models
+
+import "strings"
+
+// browserTokens and osTokens are checked in order, the first match wins. Order matters because most browsers
+// claim to be several others, Edge's user agent mentions Chrome and Safari, and Android's mentions Linux.
+var browserTokens = []struct{ token, name string }{
+	{"Edg/", "Edge"},
+	{"OPR/", "Opera"},
+	{"SamsungBrowser/", "Samsung Internet"},
+	{"Firefox/", "Firefox"},
+	{"FxiOS/", "Firefox"},
+	{"CriOS/", "Chrome"},
+	{"Chrome/", "Chrome"},
+	{"Safari/", "Safari"},
+	{"curl/", "curl"},
+}
+
+var osTokens = []struct{ token, name string }{
+	{"Windows", "Windows"},
+	{"iPhone", "iOS"},
+	{"iPad", "iOS"},
+	{"Android", "Android"},
+	{"CrOS", "ChromeOS"},
+	{"Macintosh", "macOS"},
+	{"Linux", "Linux"},
+}
+
+// ParseUserAgent summarises a User-Agent header as a browser and operating system name, "Unknown" when it can't tell.
+// It is only meant to help people recognise their own devices, not to detect anything reliably.
+func ParseUserAgent(ua string) (browser, os string) {
+	browser, os = "Unknown", "Unknown"
+	for _, b := range browserTokens {
+		if strings.Contains(ua, b.token) {
+			browser = b.name
+			break
+		}
+	}
+	for _, o := range osTokens {
+		if strings.Contains(ua, o.token) {
+			os = o.name
+			break
+		}
+	}
+	return browser, os
+}
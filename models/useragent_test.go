@@ -0,0 +1,35 @@
+package models
+
+import "testing"
+
+func TestParseUserAgent(t *testing.T) {
+	tests := []struct {
+		name    string
+		ua      string
+		browser string
+		os      string
+	}{
+		{name: "Chrome on Windows", ua: "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36",
+			browser: "Chrome", os: "Windows"},
+		{name: "Edge on Windows", ua: "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36 Edg/120.0.2210.91",
+			browser: "Edge", os: "Windows"},
+		{name: "Safari on macOS", ua: "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.1 Safari/605.1.15",
+			browser: "Safari", os: "macOS"},
+		{name: "Safari on iPhone", ua: "Mozilla/5.0 (iPhone; CPU iPhone OS 17_1 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.1 Mobile/15E148 Safari/604.1",
+			browser: "Safari", os: "iOS"},
+		{name: "Chrome on Android", ua: "Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Mobile Safari/537.36",
+			browser: "Chrome", os: "Android"},
+		{name: "Firefox on Linux", ua: "Mozilla/5.0 (X11; Linux x86_64; rv:121.0) Gecko/20100101 Firefox/121.0", browser: "Firefox", os: "Linux"},
+		{name: "curl", ua: "curl/8.4.0", browser: "curl", os: "Unknown"},
+		{name: "Empty", ua: "", browser: "Unknown", os: "Unknown"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			browser, os := ParseUserAgent(test.ua)
+			if browser != test.browser || os != test.os {
+				t.Errorf("Expected %s on %s, got %s on %s", test.browser, test.os, browser, os)
+			}
+		})
+	}
+}
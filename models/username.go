@@ -0,0 +1,75 @@
+package models
+
+import (
+	"errors"
+	"strings"
+	"the_lonely_road/validator"
+)
+
+var ErrDuplicateUsername = errors.New("duplicate username")
+
+// ValidateUsername checks a handle someone wants to take, the rules themselves live in the validator package
+func ValidateUsername(v *validator.Validator, username string) {
+	v.Check(len(username) >= 3, "Username", "must be at least 3 characters long")
+	v.Check(len(username) <= 30, "Username", "must not be more than 30 characters long")
+	v.Check(validator.Matches(username, validator.UsernameRX), "Username",
+		"must only be letters, digits, dots, dashes and underscores, starting and ending with a letter or digit")
+	v.Check(!validator.ReservedUsername(username), "Username", "is reserved")
+}
+
+// IsEmailLogin reports whether login names an account by email rather than username, usernames can't contain @
+func IsEmailLogin(login string) bool {
+	return strings.Contains(login, "@")
+}
+
+// InvalidEmails lists the public ids of accounts whose stored email isn't one ValidateEmail accepts, most likely
+// written before it asked for an @. IsEmailLogin sends such a login to the username lookup, so these accounts can only
+// sign in by username until their address is changed.
+func InvalidEmails(m IUserModel) ([]string, error) {
+	var ids []string
+	err := m.ExportUsers(func(user *User) error {
+		v := validator.New()
+		if ValidateEmail(v, user.Email); !v.Valid() {
+			ids = append(ids, user.PublicID)
+		}
+		return nil
+	})
+	return ids, err
+}
+
+// loginLookup is the WHERE clause and argument that find the account login names, c is the model's Cipher
+func loginLookup(login string, c *FieldCipher) (string, any) {
+	if IsEmailLogin(login) {
+		return "email_canonical = $1", c.EmailIndex(login)
+	}
+	return "lower(username) = $1", usernameKey(login)
+}
+
+// usernameKey is the form usernames are compared in, they are ASCII so lower() in either database agrees with it
+func usernameKey(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
+
+func sameUsername(a, b *User) bool {
+	return a.Username != "" && usernameKey(a.Username) == usernameKey(b.Username)
+}
+
+func (user *User) matchesLogin(login string) bool {
+	if IsEmailLogin(login) {
+		return CanonicalEmail(user.Email) == CanonicalEmail(login)
+	}
+	return user.Username != "" && usernameKey(user.Username) == usernameKey(login)
+}
+
+func (m *UserModel) GetByUsername(username string) (*User, error) {
+	return m.getUser("lower(username) = $1 AND deleted_at IS NULL", usernameKey(username))
+}
+
+func (mockUM *UserModelMock) GetByUsername(username string) (*User, error) {
+	for _, user := range mockUM.DB {
+		if user.Username != "" && usernameKey(user.Username) == usernameKey(username) && user.DeletedAt == nil {
+			return user, nil
+		}
+	}
+	return nil, ErrRecordNotFound
+}
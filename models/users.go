@@ -3,212 +3,795 @@ package models
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"golang.org/x/crypto/bcrypt"
+	"sort"
 	"strings"
 	"the_lonely_road/validator"
 	"time"
 )
 
+var (
+	ErrDuplicateEmail = errors.New("duplicate email")
+	ErrRecordNotFound = errors.New("record not found")
+	// ErrEditConflict means the user was written since the caller read the version it passed in
+	ErrEditConflict = errors.New("edit conflict")
+)
+
 type IUserModel interface {
 	Insert(user *User) error
+	// GetByEmail, GetByUsername and Authenticate skip soft deleted accounts, GetDeletedByEmail only finds those
 	GetByEmail(email string) (*User, error)
-	UpdatePassword(userID int, password string) error
+	GetDeletedByEmail(email string) (*User, error)
+	UpdatePassword(userID int, password string, version int) error
+	// ResetPassword is UpdatePassword that also consumes the reset token in the same write
+	ResetPassword(userID int, password string, version int) error
 	DeleteUser(userEmail string) error
-	Authenticate(email, password string) (*User, error)
-	EnterPasswordHash(email, passwordHash, salt string) error
-	ConsumePasswordReset(email string) error
+	// Authenticate takes an email address or a username as login
+	Authenticate(login, password string) (*User, error)
+	EnterPasswordHash(email, passwordHash, salt string, version int) error
+	ConsumePasswordReset(email string, version int) error
+	GetByID(id int) (*User, error)
+	GetByUsername(username string) (*User, error)
+	GetByPublicID(publicID string) (*User, error)
+	UpdateProfile(user *User) error
+	RequestEmailChange(userID int, newEmail, tokenHash, salt, cancelTokenHash, cancelSalt string) error
+	ConfirmEmailChange(userID int) error
+	CancelEmailChange(userID int) error
+	SetPhone(userID int, phone string) error
+	VerifyPhone(userID int, phone string) error
+	CreateSMSCode(code *SMSCode) error
+	GetSMSCode(userID int, purpose string) (*SMSCode, error)
+	RecordSMSCodeAttempt(codeID int) error
+	DeleteSMSCode(codeID int) error
+	SoftDeleteUser(userID int, tokenHash, salt string, restoreExpiry time.Time) error
+	RestoreUser(userID int) error
+	PurgeDeletedUsers(now time.Time) (int64, error)
+	ListUsers(filters UserFilters) ([]*User, Metadata, error)
+	SearchUsers(filters SearchFilters) ([]*UserSearchResult, Metadata, error)
+	AssignRole(userID int, role string) error
+	RevokeRole(userID int, role string) error
+	UnlockUser(userID int) error
+	CreateOrganization(org *Organization, ownerID int) error
+	GetOrganization(slug string) (*Organization, error)
+	GetMembership(slug string, userID int) (*Membership, error)
+	ListMembers(orgID int) ([]*Membership, error)
+	ListMemberships(userID int) ([]*Membership, error)
+	RemoveMember(orgID, userID int) error
+	CreateInvitation(inv *Invitation) error
+	GetInvitation(publicID string) (*Invitation, error)
+	ListPendingInvitations(orgID int) ([]*Invitation, error)
+	RevokeInvitation(orgID int, publicID string) error
+	AcceptInvitation(invitationID, userID int) error
+	UpdateAppMetadata(user *User, patch json.RawMessage) error
+	UpdateUserMetadata(user *User, patch json.RawMessage) error
+	RecordAuditEvent(event *AuditEvent) error
+	ListAuditEvents(filters AuditFilters) ([]*AuditEvent, Metadata, error)
+	ListLoginHistory(publicID string, since time.Time, filters Filters) ([]*LoginHistoryEntry, Metadata, error)
+	ImportUsers(users []*User, dryRun bool) ([]error, error)
+	ExportUsers(fn func(user *User) error) error
+	CreateDataExport(export *DataExport) error
+	GetDataExport(publicID string) (*DataExport, error)
+	PurgeDataExports(now time.Time) (int64, error)
+	ReencryptUsers(batchSize int) (int64, error)
 }
 
 type User struct {
-	ID                     int64     `json:"id"`
-	Password               string    `json:"password"`
+	ID                     int64     `json:"-"`
+	PublicID               string    `json:"id"`
+	Password               string    `json:"-"`
 	Email                  string    `json:"email"`
 	CreatedAt              time.Time `json:"created_at"`
+	UpdatedAt              time.Time `json:"updated_at"`
+	DisplayName            string    `json:"display_name"`
+	GivenName              string    `json:"given_name"`
+	FamilyName             string    `json:"family_name"`
+	Locale                 string    `json:"locale"`
+	TimeZone               string    `json:"time_zone"`
+	Username               string    `json:"username,omitempty"`
+	Phone                  string    `json:"phone,omitempty"`
+	PhoneVerified          bool      `json:"phone_verified"`
 	PasswordResetHashToken string    `json:"-"`
 	PasswordResetExpiry    time.Time `json:"-"`
 	PasswordResetSalt      string    `json:"-"`
+	PendingEmail           string    `json:"pending_email,omitempty"`
+	EmailChangeHashToken   string    `json:"-"`
+	EmailChangeExpiry      time.Time `json:"-"`
+	EmailChangeSalt        string    `json:"-"`
+	// EmailChangeCancelHashToken and EmailChangeCancelSalt check the token sent to the old address
+	EmailChangeCancelHashToken string     `json:"-"`
+	EmailChangeCancelSalt      string     `json:"-"`
+	DeletedAt                  *time.Time `json:"deleted_at,omitempty"`
+	RestoreHashToken           string     `json:"-"`
+	RestoreExpiry              time.Time  `json:"-"`
+	RestoreSalt                string     `json:"-"`
+	Verified                   bool       `json:"verified"`
+	LockedUntil                *time.Time `json:"locked_until,omitempty"`
+	FailedLogins               int        `json:"-"`
+	LastFailedLogin            *time.Time `json:"-"`
+	// PasswordHistory is only filled in by the mock, newest first, UserModel keeps it in the password_history table
+	PasswordHistory []string `json:"-"`
+	Roles           []string `json:"roles"`
+	Permissions     []string `json:"permissions"`
+	// AppMetadata is written by admins and can be projected into tokens, UserMetadata is the user's own
+	AppMetadata  json.RawMessage `json:"app_metadata"`
+	UserMetadata json.RawMessage `json:"user_metadata"`
+	// Version goes up by one with every write to the row, updates that take a version fail with ErrEditConflict
+	// when it has moved on. Clients see it as the ETag.
+	Version int `json:"-"`
 }
 
 type UserModel struct {
-	DB *sql.DB
+	DB      *sql.DB
+	Lockout LockoutPolicy
+	// PasswordHistory is how many previous passwords UpdatePassword refuses on top of the current one
+	PasswordHistory int
+	// Hasher defaults to DefaultHasher when nil
+	Hasher PasswordHasher
+	// Cipher encrypts the email columns, they are stored in plaintext when it is nil
+	Cipher *FieldCipher
+	// Dialect is the SQL DB speaks, Postgres unless it is set
+	Dialect Dialect
 }
 
 type UserModelMock struct {
-	DB []*User
+	DB              []*User
+	Lockout         LockoutPolicy
+	PasswordHistory int
+	Hasher          PasswordHasher
+	Orgs            []*Organization
+	Memberships     []*Membership
+	Invitations     []*Invitation
+	AuditEvents     []*AuditEvent
+	DataExports     []*DataExport
+	SMSCodes        []*SMSCode
 }
 
+// EncryptPassword hashes with DefaultHasher, models use their own Hasher
 func EncryptPassword(plaintext string) (string, error) {
-	hashedBytes, err := bcrypt.GenerateFromPassword([]byte(plaintext), bcrypt.DefaultCost)
-	if err != nil {
-		return "", err
+	return DefaultHasher.Hash(plaintext)
+}
 
+func hasherOrDefault(h PasswordHasher) PasswordHasher {
+	if h == nil {
+		return DefaultHasher
 	}
-	return string(hashedBytes), nil
+	return h
 }
 
 func (m *UserModel) Insert(user *User) error {
-	hashedPassword, err := EncryptPassword(user.Password)
+	hashedPassword, err := hasherOrDefault(m.Hasher).Hash(user.Password)
 	if err != nil {
 		return err
 	}
 	user.Password = hashedPassword
-	query := `
-	INSERT INTO users (email, password_hash, created_at, password_reset_expires, password_reset_token, password_reset_salt)
-	VALUES ($1, $2, $3, $4, $5, $6)
-	RETURNING id`
+	user.UpdatedAt = user.CreatedAt
+	if len(user.AppMetadata) == 0 {
+		user.AppMetadata = emptyMetadata
+	}
+	if len(user.UserMetadata) == 0 {
+		user.UserMetadata = emptyMetadata
+	}
+	if user.PublicID == "" {
+		user.PublicID, err = NewPublicID()
+		if err != nil {
+			return err
+		}
+	}
 
-	args := []interface{}{user.Email, user.Password, user.CreatedAt, user.PasswordResetExpiry, user.PasswordResetHashToken, user.PasswordResetSalt}
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	err = m.DB.QueryRowContext(ctx, query, args...).Scan(&user.ID)
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `INSERT INTO users (email, password_hash, created_at, updated_at, password_reset_expires, password_reset_token, password_reset_salt,
+		display_name, given_name, family_name, locale, time_zone, email_canonical, public_id, verified,
+		app_metadata, user_metadata, username, phone, phone_verified)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16::jsonb, $17::jsonb, NULLIF($18, ''), $19, $20)
+	RETURNING id, version`
+
+	email, err := m.Cipher.Encrypt(user.Email, user.PublicID)
+	if err != nil {
+		return err
+	}
+	args := []interface{}{email, user.Password, user.CreatedAt.UTC(), user.UpdatedAt.UTC(), user.PasswordResetExpiry.UTC(),
+		user.PasswordResetHashToken, user.PasswordResetSalt,
+		user.DisplayName, user.GivenName, user.FamilyName, user.Locale, user.TimeZone, m.Cipher.EmailIndex(user.Email), user.PublicID, user.Verified,
+		string(user.AppMetadata), string(user.UserMetadata), user.Username, user.Phone, user.PhoneVerified}
+	err = tx.QueryRowContext(ctx, m.rebind(query), args...).Scan(&user.ID, &user.Version)
 	if err != nil {
 		switch {
-		case strings.Contains(err.Error(), "users_email_key"):
-			return errors.New("duplicate email")
+		case uniqueViolation(err, "users_email_key"), uniqueViolation(err, "users_email_canonical_key"):
+			return ErrDuplicateEmail
+		case uniqueViolation(err, "users_username_key"):
+			return ErrDuplicateUsername
 		default:
 			return err
 		}
 	}
 
-	return nil
+	// new users join the default organization, if it still exists
+	err = m.joinDefaultOrganization(ctx, tx, user)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (m *UserModel) joinDefaultOrganization(ctx context.Context, tx *sql.Tx, user *User) error {
+	_, err := tx.ExecContext(ctx, `INSERT INTO memberships (organization_id, user_id, role, created_at)
+	SELECT id, $1, 'member', $2 FROM organizations WHERE slug = 'default'`, user.ID, user.CreatedAt.UTC())
+	return err
 }
 
 func (m *UserModel) GetByEmail(email string) (*User, error) {
-	query := `
-	SELECT id, password_hash, email, created_at, password_reset_expires, password_reset_token, password_reset_salt
-	FROM users
-	WHERE email = $1`
+	return m.getUser("email_canonical = $1 AND deleted_at IS NULL", m.Cipher.EmailIndex(email))
+}
 
-	var user User
+// GetDeletedByEmail finds a soft deleted account that can still be restored or purged
+func (m *UserModel) GetDeletedByEmail(email string) (*User, error) {
+	return m.getUser("email_canonical = $1 AND deleted_at IS NOT NULL", m.Cipher.EmailIndex(email))
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
+func (m *UserModel) GetByID(id int) (*User, error) {
+	return m.getUser("id = $1", id)
+}
 
-	err := m.DB.QueryRowContext(ctx, query, email).Scan(
+func (m *UserModel) GetByPublicID(publicID string) (*User, error) {
+	// anything that isn't a UUID would make Postgres error rather than just not match
+	if !validator.Matches(publicID, validator.UUIDRX) {
+		return nil, ErrRecordNotFound
+	}
+	return m.getUser("public_id = $1", publicID)
+}
+
+// userColumns must stay in the same order as the pointers returned by scanDestinations
+const userColumns = `id, public_id, password_hash, email, created_at, updated_at, password_reset_expires, password_reset_token, password_reset_salt,
+	display_name, given_name, family_name, locale, time_zone, COALESCE(username, ''), phone, phone_verified,
+	pending_email, email_change_token, email_change_expires, email_change_salt, email_change_cancel_token, email_change_cancel_salt,
+	deleted_at, restore_token, restore_expires, restore_salt,
+	verified, locked_until, failed_logins, last_failed_login, app_metadata::text, user_metadata::text, version,
+	COALESCE((SELECT string_agg(r.name, ',' ORDER BY r.name)
+		FROM user_roles ur JOIN roles r ON r.id = ur.role_id
+		WHERE ur.user_id = users.id), ''),
+	COALESCE((SELECT string_agg(DISTINCT p.code, ',' ORDER BY p.code)
+		FROM user_roles ur JOIN role_permissions rp ON rp.role_id = ur.role_id JOIN permissions p ON p.id = rp.permission_id
+		WHERE ur.user_id = users.id), '')`
+
+func (user *User) scanDestinations() []any {
+	return []any{
 		&user.ID,
+		&user.PublicID,
 		&user.Password,
 		&user.Email,
 		&user.CreatedAt,
+		&user.UpdatedAt,
 		&user.PasswordResetExpiry,
 		&user.PasswordResetHashToken,
 		&user.PasswordResetSalt,
-	)
+		&user.DisplayName,
+		&user.GivenName,
+		&user.FamilyName,
+		&user.Locale,
+		&user.TimeZone,
+		&user.Username,
+		&user.Phone,
+		&user.PhoneVerified,
+		&user.PendingEmail,
+		&user.EmailChangeHashToken,
+		&user.EmailChangeExpiry,
+		&user.EmailChangeSalt,
+		&user.EmailChangeCancelHashToken,
+		&user.EmailChangeCancelSalt,
+		&user.DeletedAt,
+		&user.RestoreHashToken,
+		&user.RestoreExpiry,
+		&user.RestoreSalt,
+		&user.Verified,
+		&user.LockedUntil,
+		&user.FailedLogins,
+		&user.LastFailedLogin,
+		(*rawJSON)(&user.AppMetadata),
+		(*rawJSON)(&user.UserMetadata),
+		&user.Version,
+		(*stringList)(&user.Roles),
+		(*stringList)(&user.Permissions),
+	}
+}
+
+// getUser keeps the column list in one place so every lookup returns the same shape of user
+func (m *UserModel) getUser(where string, arg any) (*User, error) {
+	query := `SELECT ` + m.columns() + ` FROM users WHERE ` + where
+
+	var user User
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
 
+	err := m.DB.QueryRowContext(ctx, query, arg).Scan(user.scanDestinations()...)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
-			return nil, errors.New("record not found")
+			return nil, ErrRecordNotFound
 		default:
 			return nil, err
 		}
 	}
+	err = m.Cipher.decryptUser(&user)
+	if err != nil {
+		return nil, err
+	}
 
 	return &user, nil
 }
 
-func (m *UserModel) UpdatePassword(userID int, password string) error {
-	hashedBytes, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+// ListUsers returns one page of users matching filters along with the paging metadata
+func (m *UserModel) ListUsers(filters UserFilters) ([]*User, Metadata, error) {
+	query := fmt.Sprintf(`
+	SELECT count(*) OVER(), %s
+	FROM users
+	WHERE ($1 = '' OR email ILIKE '%%' || $1 || '%%' ESCAPE '\')
+	AND ($9 = '' OR email_canonical = $9)
+	AND ($2::timestamp IS NULL OR created_at >= $2)
+	AND ($3::timestamp IS NULL OR created_at < $3)
+	AND ($4::boolean IS NULL OR verified = $4)
+	AND ($5::boolean IS NULL OR (locked_until IS NOT NULL AND locked_until > $10) = $5)
+	AND ($6 = '' OR EXISTS (SELECT 1 FROM user_roles ur JOIN roles r ON r.id = ur.role_id WHERE ur.user_id = users.id AND r.name = $6))
+	ORDER BY %s %s, id ASC
+	LIMIT $7 OFFSET $8`, m.columns(), filters.sortColumn(), filters.sortDirection())
+
+	emailLike, emailIndex := m.Cipher.emailFilter(filters.Email)
+	args := []any{emailLike, utcOrNil(filters.CreatedAfter), utcOrNil(filters.CreatedBefore), filters.Verified, filters.Locked,
+		filters.Role, filters.limit(), filters.offset(), emailIndex, time.Now().UTC()}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, m.rebind(query), args...)
 	if err != nil {
-		return fmt.Errorf("update password: %w", err)
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	users := []*User{}
+	for rows.Next() {
+		var user User
+		err := rows.Scan(append([]any{&totalRecords}, user.scanDestinations()...)...)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		err = m.Cipher.decryptUser(&user)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		users = append(users, &user)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
 	}
-	passwordHash := string(hashedBytes)
+
+	return users, calculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
+
+// escapeLike stops user input from being treated as LIKE wildcards
+func escapeLike(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(value)
+}
+
+// UpdateProfile writes the profile fields of user back to the database if user.Version is still current,
+// and refreshes user.UpdatedAt and user.Version
+func (m *UserModel) UpdateProfile(user *User) error {
 	query := `UPDATE users
-	SET password_hash = $2
-	WHERE id = $1`
+	SET display_name = $2,
+		given_name = $3,
+		family_name = $4,
+		locale = $5,
+		time_zone = $6,
+		username = NULLIF($8, ''),
+		updated_at = $9,
+		version = version + 1
+	WHERE id = $1 AND version = $7
+	RETURNING version`
+
+	now := time.Now().UTC()
+	args := []interface{}{user.ID, user.DisplayName, user.GivenName, user.FamilyName, user.Locale, user.TimeZone, user.Version, user.Username, now}
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	// we actually only need to check for error, we're going to see the rows affected and return the no data then
-	result, err := m.DB.ExecContext(ctx, query, userID, passwordHash)
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return m.conflictOrNotFound(ctx, "id = $1", user.ID, ErrRecordNotFound)
+		case uniqueViolation(err, "users_username_key"):
+			return ErrDuplicateUsername
+		default:
+			return err
+		}
+	}
+	user.UpdatedAt = now
+	return nil
+}
+
+// conflictOrNotFound explains why a versioned update matched no row: the user exists, so the version was stale,
+// or it doesn't and notFound is returned
+func (m *UserModel) conflictOrNotFound(ctx context.Context, where string, arg any, notFound error) error {
+	var exists bool
+	err := m.DB.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM users WHERE `+where+`)`, arg).Scan(&exists)
 	if err != nil {
 		return err
 	}
-	rowsAffected, _ := result.RowsAffected()
-	if rowsAffected == 0 {
-		return errors.New("no data")
+	if exists {
+		return ErrEditConflict
 	}
+	return notFound
+}
 
-	return nil
+// UpdatePassword refuses the current password and the last PasswordHistory ones with ErrPasswordReused,
+// otherwise the current hash moves into password_history before it is replaced. It returns ErrEditConflict
+// when the user isn't at version any more.
+func (m *UserModel) UpdatePassword(userID int, password string, version int) error {
+	return m.updatePassword(userID, password, version, false)
+}
+
+// ResetPassword sets a password the user forgot, clearing the reset token in the same transaction so a token that was
+// used can't be used again whatever fails after
+func (m *UserModel) ResetPassword(userID int, password string, version int) error {
+	return m.updatePassword(userID, password, version, true)
+}
+
+func (m *UserModel) updatePassword(userID int, password string, version int, consumeReset bool) error {
+	hasher := hasherOrDefault(m.Hasher)
+	passwordHash, err := hasher.Hash(password)
+	if err != nil {
+		return fmt.Errorf("update password: %w", err)
+	}
+	// a few hash compares on top of the hash above, so this gets a little longer than the usual 3 seconds
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
 
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var currentHash string
+	var currentVersion int
+	err = tx.QueryRowContext(ctx, m.rebind(`SELECT password_hash, version FROM users WHERE id = $1 FOR UPDATE`), userID).Scan(&currentHash, &currentVersion)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return errors.New("no data")
+		default:
+			return err
+		}
+	}
+	if currentVersion != version {
+		return ErrEditConflict
+	}
+
+	previous, err := m.passwordHistory(ctx, tx, userID)
+	if err != nil {
+		return err
+	}
+	if matchesAny(hasher, password, append([]string{currentHash}, previous...)) {
+		return ErrPasswordReused
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE users SET password_hash = $2, version = version + 1 WHERE id = $1`, userID, passwordHash)
+	if err != nil {
+		return err
+	}
+	if consumeReset {
+		_, err = tx.ExecContext(ctx, `UPDATE users SET password_reset_expires = $2, password_reset_token = '', password_reset_salt = ''
+		WHERE id = $1`, userID, time.Time{})
+		if err != nil {
+			return err
+		}
+	}
+	err = m.rememberPassword(ctx, tx, userID, currentHash)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
-func (m *UserModel) EnterPasswordHash(email, passwordHash, salt string) error {
+// EnterPasswordHash stores a hashed reset token, two reset requests racing each other get ErrEditConflict
+// rather than the later one silently replacing the earlier token
+func (m *UserModel) EnterPasswordHash(email, passwordHash, salt string, version int) error {
 	expiry := time.Now().Add(30 * time.Minute).UTC()
 	query := `UPDATE users
 	SET password_reset_expires = $1,
 		password_reset_token = $2,
-		password_reset_salt = $3
-	WHERE email = $4
-	RETURNING password_reset_expires, password_reset_token, password_reset_salt;`
+		password_reset_salt = $3,
+		version = version + 1
+	WHERE email_canonical = $4 AND version = $5 AND deleted_at IS NULL`
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
-	result, err := m.DB.ExecContext(ctx, query, expiry, passwordHash, salt, email)
+	result, err := m.DB.ExecContext(ctx, query, expiry, passwordHash, salt, m.Cipher.EmailIndex(email), version)
 	if err != nil {
 		return err
 	}
 	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
 	if rowsAffected == 0 {
-		return errors.New("user not found")
+		return m.conflictOrNotFound(ctx, "email_canonical = $1 AND deleted_at IS NULL", m.Cipher.EmailIndex(email), errors.New("user not found"))
 	}
 	return nil
 }
 
 // ConsumePasswordReset after resetting user password we should consume the token for security reasons
-func (m *UserModel) ConsumePasswordReset(email string) error {
+func (m *UserModel) ConsumePasswordReset(email string, version int) error {
 	query := `UPDATE users
 	SET password_reset_expires = $1,
 		password_reset_token = $2,
-		password_reset_salt = $3
-	WHERE email = $4
-	RETURNING password_reset_expires, password_reset_token, password_reset_salt;`
+		password_reset_salt = $3,
+		version = version + 1
+	WHERE email_canonical = $4 AND version = $5 AND deleted_at IS NULL`
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
-	result, err := m.DB.ExecContext(ctx, query, time.Time{}, "", "", email)
+	result, err := m.DB.ExecContext(ctx, query, time.Time{}, "", "", m.Cipher.EmailIndex(email), version)
 	if err != nil {
 		return err
 	}
 	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return m.conflictOrNotFound(ctx, "email_canonical = $1 AND deleted_at IS NULL", m.Cipher.EmailIndex(email), errors.New("user not found"))
+	}
+	return nil
+}
+
+// RequestEmailChange stores the new address alongside the hashed confirmation token and the hashed token that cancels
+// the change from the old address, the users email doesn't change yet
+func (m *UserModel) RequestEmailChange(userID int, newEmail, tokenHash, salt, cancelTokenHash, cancelSalt string) error {
+	expiry := time.Now().Add(24 * time.Hour).UTC()
+	query := `UPDATE users
+	SET pending_email = $1,
+		email_change_token = $2,
+		email_change_salt = $3,
+		email_change_expires = $4,
+		email_change_cancel_token = $6,
+		email_change_cancel_salt = $7,
+		version = version + 1
+	WHERE id = $5`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	// the address is sealed for the user's row, so look up its public id first
+	var publicID string
+	err := m.DB.QueryRowContext(ctx, `SELECT public_id FROM users WHERE id = $1`, userID).Scan(&publicID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return errors.New("user not found")
+		}
+		return err
+	}
+	pendingEmail, err := m.Cipher.Encrypt(newEmail, publicID)
+	if err != nil {
+		return err
+	}
+	result, err := m.DB.ExecContext(ctx, query, pendingEmail, tokenHash, salt, expiry, userID, cancelTokenHash, cancelSalt)
+	if err != nil {
+		return err
+	}
+	rowsAffected, _ := result.RowsAffected()
 	if rowsAffected == 0 {
 		return errors.New("user not found")
 	}
 	return nil
 }
 
-func (m *UserModel) Authenticate(email, password string) (*User, error) {
-	email = strings.ToLower(email)
-	user := User{
-		Email: email,
+// ConfirmEmailChange swaps the pending address in, someone may have signed up with it since the change was requested
+func (m *UserModel) ConfirmEmailChange(userID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	// the canonical form is worked out here, so read the pending address first and only swap it in if it hasn't changed
+	var publicID, pendingEmail string
+	err := m.DB.QueryRowContext(ctx, `SELECT public_id, pending_email FROM users WHERE id = $1`, userID).Scan(&publicID, &pendingEmail)
+	if err != nil || pendingEmail == "" {
+		return errors.New("no pending email change")
+	}
+	newEmail, err := m.Cipher.Decrypt(pendingEmail, publicID)
+	if err != nil {
+		return err
 	}
 
-	row := m.DB.QueryRow(
-		`SELECT id, password_hash, created_at
-		FROM users WHERE email=$1`, email,
-	)
+	query := `UPDATE users
+	SET email = pending_email,
+		email_canonical = $3,
+		pending_email = '',
+		email_change_token = '',
+		email_change_salt = '',
+		email_change_cancel_token = '',
+		email_change_cancel_salt = '',
+		email_change_expires = $1,
+		updated_at = $5,
+		version = version + 1
+	WHERE id = $2 AND pending_email = $4`
 
-	err := row.Scan(&user.ID, &user.Password, &user.CreatedAt)
+	result, err := m.DB.ExecContext(ctx, query, time.Time{}, userID, m.Cipher.EmailIndex(newEmail), pendingEmail, time.Now().UTC())
+	if err != nil {
+		switch {
+		case uniqueViolation(err, "users_email_key"), uniqueViolation(err, "users_email_canonical_key"):
+			return ErrDuplicateEmail
+		default:
+			return err
+		}
+	}
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		return errors.New("no pending email change")
+	}
+	return nil
+}
+
+// CancelEmailChange throws away a pending email change so its token can no longer be used
+func (m *UserModel) CancelEmailChange(userID int) error {
+	query := `UPDATE users
+	SET pending_email = '',
+		email_change_token = '',
+		email_change_salt = '',
+		email_change_cancel_token = '',
+		email_change_cancel_salt = '',
+		email_change_expires = $1,
+		version = version + 1
+	WHERE id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, time.Time{}, userID)
+	if err != nil {
+		return err
+	}
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		return errors.New("user not found")
+	}
+	return nil
+}
+
+// SoftDeleteUser marks the account deleted and stores the hashed restore token, the row stays until PurgeDeletedUsers runs
+func (m *UserModel) SoftDeleteUser(userID int, tokenHash, salt string, restoreExpiry time.Time) error {
+	query := `UPDATE users
+	SET deleted_at = $5,
+		restore_token = $1,
+		restore_salt = $2,
+		restore_expires = $3,
+		version = version + 1
+	WHERE id = $4 AND deleted_at IS NULL`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, tokenHash, salt, restoreExpiry.UTC(), userID, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		return errors.New("no data")
+	}
+	return nil
+}
+
+// RestoreUser undoes SoftDeleteUser and consumes the restore token
+func (m *UserModel) RestoreUser(userID int) error {
+	query := `UPDATE users
+	SET deleted_at = NULL,
+		restore_token = '',
+		restore_salt = '',
+		restore_expires = $1,
+		version = version + 1
+	WHERE id = $2 AND deleted_at IS NOT NULL`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, time.Time{}, userID)
+	if err != nil {
+		return err
+	}
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		return errors.New("no data")
+	}
+	return nil
+}
+
+// PurgeDeletedUsers hard deletes soft deleted accounts whose restore window closed before now
+func (m *UserModel) PurgeDeletedUsers(now time.Time) (int64, error) {
+	query := `DELETE FROM users
+	WHERE deleted_at IS NOT NULL AND restore_expires < $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, now.UTC())
+	if err != nil {
+		return 0, fmt.Errorf("purge deleted users: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+func (m *UserModel) Authenticate(login, password string) (*User, error) {
+	where, arg := loginLookup(login, m.Cipher)
+	user, err := m.getUser(where+" AND deleted_at IS NULL", arg)
 	if err != nil {
 		return nil, fmt.Errorf("authenticate: %w", err)
 	}
 
-	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password))
+	// refuse before hashing so a locked or throttled account costs the attacker nothing but also gains them nothing
+	now := time.Now()
+	err = m.Lockout.check(user, now)
+	if err != nil {
+		return nil, err
+	}
+
+	hasher := hasherOrDefault(m.Hasher)
+	needsRehash, err := hasher.Verify(password, user.Password)
 
 	if err != nil {
-		return nil, fmt.Errorf("compare() error: %v", err)
+		lockErr := m.recordFailedLogin(user.ID, now)
+		if lockErr != nil {
+			return nil, lockErr
+		}
+		return nil, fmt.Errorf("compare() error: %w", err)
 	}
 
-	return &user, nil
+	if needsRehash {
+		// the login already succeeded, if the upgrade fails the next login tries again
+		_ = m.rehashPassword(hasher, user, password)
+	}
+
+	if user.FailedLogins > 0 {
+		err = m.resetFailedLogins(user.ID)
+		if err != nil {
+			return nil, err
+		}
+		user.FailedLogins, user.LastFailedLogin = 0, nil
+	}
+
+	return user, nil
+}
+
+// rehashPassword stores a fresh hash of a password that was just verified, unless it changed in the meantime. The
+// password is the same so the version isn't bumped, an edit the user has open still applies.
+func (m *UserModel) rehashPassword(hasher PasswordHasher, user *User, password string) error {
+	passwordHash, err := hasher.Hash(password)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err = m.DB.ExecContext(ctx, `UPDATE users SET password_hash = $2 WHERE id = $1 AND password_hash = $3`,
+		user.ID, passwordHash, user.Password)
+	if err != nil {
+		return err
+	}
+	user.Password = passwordHash
+	return nil
 }
 
 func (m *UserModel) DeleteUser(userEmail string) error {
-	query := `delete from users where email = $1`
+	query := `delete from users where email_canonical = $1`
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 	// same as above, we need to check result
-	result, err := m.DB.ExecContext(ctx, query, userEmail)
+	result, err := m.DB.ExecContext(ctx, query, m.Cipher.EmailIndex(userEmail))
 	if err != nil {
 		return err
 	}
@@ -220,39 +803,156 @@ func (m *UserModel) DeleteUser(userEmail string) error {
 }
 
 func (mockUM *UserModelMock) Insert(user *User) error {
-	hashedPassword, err := EncryptPassword(user.Password)
+	hashedPassword, err := hasherOrDefault(mockUM.Hasher).Hash(user.Password)
 	if err != nil {
 		return err
 	}
 	user.Password = hashedPassword
+	return mockUM.insertHashed(user)
+}
+
+// insertHashed stores user, whose password is already hashed, and gives them the next id when they have none
+func (mockUM *UserModelMock) insertHashed(user *User) error {
+	var err error
+	user.UpdatedAt = user.CreatedAt
+	user.Version = 1
+	user.Roles, user.Permissions = []string{}, []string{}
+	if len(user.AppMetadata) == 0 {
+		user.AppMetadata = emptyMetadata
+	}
+	if len(user.UserMetadata) == 0 {
+		user.UserMetadata = emptyMetadata
+	}
+	if user.PublicID == "" {
+		user.PublicID, err = NewPublicID()
+		if err != nil {
+			return err
+		}
+	}
 	targetUser := user
 	for _, userToCheck := range mockUM.DB {
-		if userToCheck.Email == targetUser.Email {
-			return errors.New("duplicate email")
+		if CanonicalEmail(userToCheck.Email) == CanonicalEmail(targetUser.Email) {
+			return ErrDuplicateEmail
+		}
+		if sameUsername(userToCheck, targetUser) {
+			return ErrDuplicateUsername
 		}
 	}
+	if user.ID == 0 {
+		user.ID = mockUM.nextUserID()
+	}
 	mockUM.DB = append(mockUM.DB, user)
+	mockUM.addMembership(mockUM.defaultOrg(), user, OrgRoleMember)
 	return nil
 }
 
+// nextUserID is one past the highest id in use
+func (mockUM *UserModelMock) nextUserID() int64 {
+	next := int64(1)
+	for _, user := range mockUM.DB {
+		if user.ID >= next {
+			next = user.ID + 1
+		}
+	}
+	return next
+}
+
 func (mockUM *UserModelMock) GetByEmail(email string) (*User, error) {
+	return mockUM.byEmail(email, false)
+}
+
+func (mockUM *UserModelMock) GetDeletedByEmail(email string) (*User, error) {
+	return mockUM.byEmail(email, true)
+}
+
+func (mockUM *UserModelMock) byEmail(email string, deleted bool) (*User, error) {
+	email = CanonicalEmail(email)
+	for _, user := range mockUM.DB {
+		if CanonicalEmail(user.Email) == email && (user.DeletedAt != nil) == deleted {
+			return user, nil
+		}
+	}
+	return nil, ErrRecordNotFound
+}
+
+func (mockUM *UserModelMock) GetByPublicID(publicID string) (*User, error) {
 	for _, user := range mockUM.DB {
-		if user.Email == email {
+		if publicID != "" && user.PublicID == publicID {
 			return user, nil
 		}
 	}
-	return nil, errors.New("record not found")
+	return nil, ErrRecordNotFound
 }
 
-func (mockUM *UserModelMock) UpdatePassword(userID int, password string) error {
-	hashedPassword, err := EncryptPassword(password)
+func (mockUM *UserModelMock) GetByID(id int) (*User, error) {
+	for _, user := range mockUM.DB {
+		if user.ID == int64(id) {
+			return user, nil
+		}
+	}
+	return nil, ErrRecordNotFound
+}
+
+func (mockUM *UserModelMock) UpdateProfile(user *User) error {
+	storedUser, err := mockUM.GetByID(int(user.ID))
+	if err != nil {
+		return err
+	}
+	if storedUser.Version != user.Version {
+		return ErrEditConflict
+	}
+	for _, other := range mockUM.DB {
+		if other.ID != storedUser.ID && sameUsername(other, user) {
+			return ErrDuplicateUsername
+		}
+	}
+	user.UpdatedAt = time.Now()
+	user.Version++
+	storedUser.Username = user.Username
+	storedUser.DisplayName = user.DisplayName
+	storedUser.GivenName = user.GivenName
+	storedUser.FamilyName = user.FamilyName
+	storedUser.Locale = user.Locale
+	storedUser.TimeZone = user.TimeZone
+	storedUser.UpdatedAt = user.UpdatedAt
+	storedUser.Version = user.Version
+	return nil
+}
+
+func (mockUM *UserModelMock) UpdatePassword(userID int, password string, version int) error {
+	return mockUM.updatePassword(userID, password, version, false)
+}
+
+func (mockUM *UserModelMock) ResetPassword(userID int, password string, version int) error {
+	return mockUM.updatePassword(userID, password, version, true)
+}
+
+func (mockUM *UserModelMock) updatePassword(userID int, password string, version int, consumeReset bool) error {
+	hasher := hasherOrDefault(mockUM.Hasher)
+	hashedPassword, err := hasher.Hash(password)
 	if err != nil {
 		return err
 	}
 	newpassword := hashedPassword
 	for _, user := range mockUM.DB {
 		if user.ID == int64(userID) {
+			if user.Version != version {
+				return ErrEditConflict
+			}
+			if matchesAny(hasher, password, append([]string{user.Password}, user.PasswordHistory...)) {
+				return ErrPasswordReused
+			}
+			user.PasswordHistory = append([]string{user.Password}, user.PasswordHistory...)
+			if len(user.PasswordHistory) > mockUM.PasswordHistory {
+				user.PasswordHistory = user.PasswordHistory[:mockUM.PasswordHistory]
+			}
 			user.Password = newpassword
+			user.Version++
+			if consumeReset {
+				user.PasswordResetExpiry = time.Time{}
+				user.PasswordResetHashToken = ""
+				user.PasswordResetSalt = ""
+			}
 			return nil
 		}
 	}
@@ -260,45 +960,73 @@ func (mockUM *UserModelMock) UpdatePassword(userID int, password string) error {
 }
 
 func (mockUM *UserModelMock) DeleteUser(userEmail string) error {
+	userEmail = CanonicalEmail(userEmail)
 	for i, user := range mockUM.DB {
-		if user.Email == userEmail {
+		if CanonicalEmail(user.Email) == userEmail {
 			mockUM.DB = append(mockUM.DB[:i], mockUM.DB[i+1:]...)
+			mockUM.dropMemberships(user.ID)
+			mockUM.dropSMSCodes(func(code *SMSCode) bool { return code.UserID == user.ID })
 			return nil
 		}
 	}
 	return errors.New("no data")
 }
 
-func (mockUM *UserModelMock) Authenticate(email, password string) (*User, error) {
-	email = strings.ToLower(email)
+func (mockUM *UserModelMock) Authenticate(login, password string) (*User, error) {
 	for _, user := range mockUM.DB {
-		if user.Email == email {
-			err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password))
+		if user.matchesLogin(login) && user.DeletedAt == nil {
+			now := time.Now()
+			err := mockUM.Lockout.check(user, now)
+			if err != nil {
+				return nil, err
+			}
+			hasher := hasherOrDefault(mockUM.Hasher)
+			needsRehash, err := hasher.Verify(password, user.Password)
 			if err != nil {
-				return nil, fmt.Errorf("compare() error: %v", err)
+				lockErr := mockUM.Lockout.recordFailure(user, now)
+				if lockErr != nil {
+					return nil, lockErr
+				}
+				return nil, fmt.Errorf("compare() error: %w", err)
+			}
+			if needsRehash {
+				if rehashed, err := hasher.Hash(password); err == nil {
+					user.Password = rehashed
+				}
+			}
+			if user.FailedLogins > 0 {
+				user.FailedLogins, user.LastFailedLogin = 0, nil
 			}
 			return user, nil
 		}
 	}
-	return nil, errors.New("no data")
+	return nil, fmt.Errorf("authenticate: %w", ErrRecordNotFound)
 }
 
-func (mockUM *UserModelMock) EnterPasswordHash(email, passwordHash, salt string) error {
+func (mockUM *UserModelMock) EnterPasswordHash(email, passwordHash, salt string, version int) error {
 	user, err := mockUM.GetByEmail(email)
 	if err != nil {
 		return err
 	}
+	if user.Version != version {
+		return ErrEditConflict
+	}
+	user.Version++
 	user.PasswordResetExpiry = time.Now().Add(30 * time.Minute)
 	user.PasswordResetHashToken = passwordHash
 	user.PasswordResetSalt = salt
 	return nil
 }
 
-func (mockUM *UserModelMock) ConsumePasswordReset(email string) error {
+func (mockUM *UserModelMock) ConsumePasswordReset(email string, version int) error {
 	user, err := mockUM.GetByEmail(email)
 	if err != nil {
 		return err
 	}
+	if user.Version != version {
+		return ErrEditConflict
+	}
+	user.Version++
 	// reset the fields to default values
 	user.PasswordResetExpiry = time.Time{}
 	user.PasswordResetHashToken = ""
@@ -306,26 +1034,205 @@ func (mockUM *UserModelMock) ConsumePasswordReset(email string) error {
 	return nil
 }
 
+func (mockUM *UserModelMock) RequestEmailChange(userID int, newEmail, tokenHash, salt, cancelTokenHash, cancelSalt string) error {
+	user, err := mockUM.GetByID(userID)
+	if err != nil {
+		return errors.New("user not found")
+	}
+	user.Version++
+	user.PendingEmail = newEmail
+	user.EmailChangeHashToken = tokenHash
+	user.EmailChangeSalt = salt
+	user.EmailChangeCancelHashToken = cancelTokenHash
+	user.EmailChangeCancelSalt = cancelSalt
+	user.EmailChangeExpiry = time.Now().Add(24 * time.Hour)
+	return nil
+}
+
+func (mockUM *UserModelMock) ConfirmEmailChange(userID int) error {
+	user, err := mockUM.GetByID(userID)
+	if err != nil || user.PendingEmail == "" {
+		return errors.New("no pending email change")
+	}
+	// a deleted account keeps its address until it is purged, the user's own address is theirs to re-case
+	for _, other := range mockUM.DB {
+		if other.ID != user.ID && CanonicalEmail(other.Email) == CanonicalEmail(user.PendingEmail) {
+			return ErrDuplicateEmail
+		}
+	}
+	user.Email = user.PendingEmail
+	user.UpdatedAt = time.Now()
+	return mockUM.CancelEmailChange(userID)
+}
+
+func (mockUM *UserModelMock) CancelEmailChange(userID int) error {
+	user, err := mockUM.GetByID(userID)
+	if err != nil {
+		return errors.New("user not found")
+	}
+	user.Version++
+	user.PendingEmail = ""
+	user.EmailChangeHashToken = ""
+	user.EmailChangeSalt = ""
+	user.EmailChangeCancelHashToken = ""
+	user.EmailChangeCancelSalt = ""
+	user.EmailChangeExpiry = time.Time{}
+	return nil
+}
+
+func (mockUM *UserModelMock) SoftDeleteUser(userID int, tokenHash, salt string, restoreExpiry time.Time) error {
+	user, err := mockUM.GetByID(userID)
+	if err != nil || user.DeletedAt != nil {
+		return errors.New("no data")
+	}
+	deletedAt := time.Now()
+	user.Version++
+	user.DeletedAt = &deletedAt
+	user.RestoreHashToken = tokenHash
+	user.RestoreSalt = salt
+	user.RestoreExpiry = restoreExpiry
+	return nil
+}
+
+func (mockUM *UserModelMock) RestoreUser(userID int) error {
+	user, err := mockUM.GetByID(userID)
+	if err != nil || user.DeletedAt == nil {
+		return errors.New("no data")
+	}
+	user.Version++
+	user.DeletedAt = nil
+	user.RestoreHashToken = ""
+	user.RestoreSalt = ""
+	user.RestoreExpiry = time.Time{}
+	return nil
+}
+
+func (mockUM *UserModelMock) PurgeDeletedUsers(now time.Time) (int64, error) {
+	var purged int64
+	kept := mockUM.DB[:0]
+	for _, user := range mockUM.DB {
+		if user.DeletedAt != nil && user.RestoreExpiry.Before(now) {
+			purged++
+			mockUM.dropMemberships(user.ID)
+			mockUM.dropSMSCodes(func(code *SMSCode) bool { return code.UserID == user.ID })
+			continue
+		}
+		kept = append(kept, user)
+	}
+	mockUM.DB = kept
+	return purged, nil
+}
+
+func (mockUM *UserModelMock) ListUsers(filters UserFilters) ([]*User, Metadata, error) {
+	matched := []*User{}
+	for _, user := range mockUM.DB {
+		locked := user.LockedUntil != nil && user.LockedUntil.After(time.Now())
+		switch {
+		case filters.Email != "" && !strings.Contains(strings.ToLower(user.Email), strings.ToLower(filters.Email)):
+		case filters.CreatedAfter != nil && user.CreatedAt.Before(*filters.CreatedAfter):
+		case filters.CreatedBefore != nil && !user.CreatedAt.Before(*filters.CreatedBefore):
+		case filters.Verified != nil && user.Verified != *filters.Verified:
+		case filters.Locked != nil && locked != *filters.Locked:
+		case filters.Role != "" && !hasRole(user, filters.Role):
+		default:
+			matched = append(matched, user)
+		}
+	}
+
+	column, descending := filters.sortColumn(), filters.sortDirection() == "DESC"
+	sort.SliceStable(matched, func(i, j int) bool {
+		a, b := matched[i], matched[j]
+		var less, equal bool
+		switch column {
+		case "email":
+			less, equal = a.Email < b.Email, a.Email == b.Email
+		case "created_at":
+			less, equal = a.CreatedAt.Before(b.CreatedAt), a.CreatedAt.Equal(b.CreatedAt)
+		case "updated_at":
+			less, equal = a.UpdatedAt.Before(b.UpdatedAt), a.UpdatedAt.Equal(b.UpdatedAt)
+		default:
+			less, equal = a.ID < b.ID, a.ID == b.ID
+		}
+		if equal {
+			return a.ID < b.ID
+		}
+		return less != descending
+	})
+
+	metadata := calculateMetadata(len(matched), filters.Page, filters.PageSize)
+	start, end := filters.offset(), filters.offset()+filters.limit()
+	if start > len(matched) {
+		start = len(matched)
+	}
+	if end > len(matched) {
+		end = len(matched)
+	}
+	return matched[start:end], metadata, nil
+}
+
+func hasRole(user *User, role string) bool {
+	for _, r := range user.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateEmail checks an address someone typed, it needs exactly one @ with something on both sides of it. Nothing
+// starting with enc: is accepted either, so a stored email is never mistaken for a value FieldCipher encrypted.
 func ValidateEmail(v *validator.Validator, email string) {
-	v.Check(email != "", email, "must be provided")
+	v.Check(email != "", "Email", "must be provided")
 	v.Check(len(email) >= 5, "Email", "must be at least 5 bytes long")
+	local, domain, _ := strings.Cut(email, "@")
+	v.Check(strings.Count(email, "@") == 1 && local != "" && domain != "", "Email", "must be a valid email address")
+	v.Check(!strings.HasPrefix(strings.ToLower(email), "enc:"), "Email", "must be a valid email address")
 }
 
-func ValidatePasswordPlaintext(v *validator.Validator, password string) {
+// ValidatePasswordPlaintext checks a password that is about to be hashed with hasher, nil meaning DefaultHasher
+func ValidatePasswordPlaintext(v *validator.Validator, password string, hasher PasswordHasher) {
 	v.Check(password != "", "Password", "must be provided")
 	v.Check(len(password) >= 4, "Password", "must at least be 4 characters long")
-	v.Check(len(password) <= 72, "Password", "must not be more than 72 bytes long")
+	maxBytes := maxPasswordBytes(hasher)
+	v.Check(len(password) <= maxBytes, "Password", fmt.Sprintf("must not be more than %d bytes long", maxBytes))
+}
+
+// maxPasswordBytes is 72 for unpeppered bcrypt, which refuses anything longer. A pepper hashes the password down to
+// 44 bytes first and the other hashers take any length, so they only need a sane upper bound.
+func maxPasswordBytes(hasher PasswordHasher) int {
+	hasher = hasherOrDefault(hasher)
+	if h, ok := hasher.(Hasher); ok && len(h.Pepper) > 0 {
+		return 256
+	}
+	if hasher.Algorithm() == DefaultBcrypt.Algorithm() {
+		return 72
+	}
+	return 256
 }
 
-func ValidateUser(v *validator.Validator, user *User) {
+func ValidateUser(v *validator.Validator, user *User, hasher PasswordHasher) {
 	v.Check(user.Email != "", "Email", "must be provided")
 	v.Check(len(user.Email) >= 3, "Email", "must be at least 3 bytes long")
 	v.Check(len(user.Email) <= 500, "Email", "must be less than 500 bytes long")
 
 	ValidateEmail(v, user.Email)
+	ValidateProfile(v, user)
+	ValidatePasswordPlaintext(v, user.Password, hasher)
+}
 
-	if user.Password == "" {
-		ValidatePasswordPlaintext(v, user.Password)
-	}
+// ValidateProfile checks the optional profile fields, empty values are allowed so users can clear them
+func ValidateProfile(v *validator.Validator, user *User) {
+	v.Check(validator.MaxChars(user.DisplayName, 100), "DisplayName", "must not be more than 100 characters long")
+	v.Check(validator.MaxChars(user.GivenName, 100), "GivenName", "must not be more than 100 characters long")
+	v.Check(validator.MaxChars(user.FamilyName, 100), "FamilyName", "must not be more than 100 characters long")
 
+	if user.Locale != "" {
+		v.Check(validator.Matches(user.Locale, validator.LocaleRX), "Locale", "must be a valid language tag such as en-US")
+	}
+	if user.TimeZone != "" {
+		v.Check(validator.ValidTimeZone(user.TimeZone), "TimeZone", "must be a valid IANA time zone such as Europe/London")
+	}
+	if user.Username != "" {
+		ValidateUsername(v, user.Username)
+	}
 }
@@ -3,7 +3,10 @@ package token
 import (
 	"crypto/rand"
 	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
+	"fmt"
+	"math/big"
 )
 
 func GenerateTokenAndSalt(tokenLength, saltLength int) (token, salt string, err error) {
@@ -72,3 +75,41 @@ func IsValidToken(userProvidedToken, storedHashedToken, salt string) bool {
 	// Compare the hashed user-provided token with the stored hashed token
 	return hashedUserToken == storedHashedToken
 }
+
+// GenerateCode returns a random code of digits digits for people to type in, such as one sent by SMS, and a salt
+// for HashCode. Codes are short, so whatever checks them has to limit the guesses.
+func GenerateCode(digits int) (code, salt string, err error) {
+	n, err := rand.Int(rand.Reader, new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(digits)), nil))
+	if err != nil {
+		return "", "", err
+	}
+	code = fmt.Sprintf("%0*d", digits, n)
+
+	saltBytes := make([]byte, 16)
+	_, err = rand.Read(saltBytes)
+	if err != nil {
+		return "", "", err
+	}
+	salt = base64.URLEncoding.EncodeToString(saltBytes)
+
+	return code, salt, nil
+}
+
+// HashCode hashes a code from GenerateCode with its salt. Unlike a token the code is hashed as typed, it isn't base64.
+func HashCode(code, salt string) string {
+	saltBytes, err := base64.URLEncoding.DecodeString(salt)
+	if err != nil {
+		return ""
+	}
+
+	hasher := sha256.New()
+	hasher.Write([]byte(code))
+	hasher.Write(saltBytes)
+
+	return base64.URLEncoding.EncodeToString(hasher.Sum(nil))
+}
+
+func IsValidCode(userProvidedCode, storedHashedCode, salt string) bool {
+	hashedUserCode := HashCode(userProvidedCode, salt)
+	return hashedUserCode != "" && subtle.ConstantTimeCompare([]byte(hashedUserCode), []byte(storedHashedCode)) == 1
+}
@@ -1,6 +1,9 @@
 package token
 
-import "testing"
+import (
+	"strings"
+	"testing"
+)
 
 func TestGenerateTokenAndSalt(t *testing.T) {
 	token, salt, err := GenerateTokenAndSalt(32, 16)
@@ -39,3 +42,37 @@ func TestIsValidToken(t *testing.T) {
 		t.Errorf("want %v; got %v", true, ok)
 	}
 }
+
+func TestGenerateCode(t *testing.T) {
+	code, salt, err := GenerateCode(6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(code) != 6 || strings.Trim(code, "0123456789") != "" {
+		t.Errorf("want 6 digits; got %q", code)
+	}
+	if len(salt) != 24 {
+		t.Errorf("want %d; got %d", 16, len(salt))
+	}
+}
+
+func TestIsValidCode(t *testing.T) {
+	code, salt, err := GenerateCode(6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashedCode := HashCode(code, salt)
+	if !IsValidCode(code, hashedCode, salt) {
+		t.Errorf("want %v; got %v", true, false)
+	}
+	wrong := "000000"
+	if code == wrong {
+		wrong = "000001"
+	}
+	if IsValidCode(wrong, hashedCode, salt) {
+		t.Errorf("want %v for a wrong code; got %v", false, true)
+	}
+	if IsValidCode(code, hashedCode, "not base64!") {
+		t.Errorf("want %v for a bad salt; got %v", false, true)
+	}
+}
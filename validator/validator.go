@@ -1,6 +1,38 @@
 package validator
 
-import "regexp"
+import (
+	"regexp"
+	"strings"
+	"time"
+	_ "time/tzdata"
+	"unicode/utf8"
+)
+
+// LocaleRX loosely matches BCP 47 language tags such as "en", "en-US" or "zh-Hant-TW"
+var LocaleRX = regexp.MustCompile(`^[a-zA-Z]{2,3}(-[a-zA-Z0-9]{2,8})*$`)
+
+// UUIDRX matches a UUID in the lowercase hyphenated form Postgres prints
+var UUIDRX = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+// SlugRX matches lowercase URL slugs such as "acme" or "acme-eu", up to 40 characters with no leading or trailing hyphen
+var SlugRX = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,38}[a-z0-9])?$`)
+
+// RequestIDRX matches request ids we accept from upstream proxies, up to 64 letters, digits, dots, dashes and underscores
+var RequestIDRX = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// UsernameRX matches handles of 3 to 30 ASCII letters, digits, dots, dashes and underscores that start and end with a
+// letter or digit. There is no @, so a username can't be mistaken for an email address at the login form.
+var UsernameRX = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{1,28}[A-Za-z0-9]$`)
+
+// PhoneRX matches E.164 phone numbers: a plus, a country code that doesn't start with 0 and at most 15 digits in all
+var PhoneRX = regexp.MustCompile(`^\+[1-9][0-9]{6,14}$`)
+
+// ReservedUsernames can't be taken by anyone, they could pass for staff or the service itself
+var ReservedUsernames = []string{
+	"abuse", "admin", "administrator", "anonymous", "api", "billing", "help", "info", "mail", "me", "moderator",
+	"noreply", "null", "official", "owner", "postmaster", "root", "security", "staff", "support", "system",
+	"undefined", "webmaster", "www",
+}
 
 type Validator struct {
 	Errors map[string]string
@@ -46,3 +78,25 @@ func Unique[T comparable](values []T) bool {
 	}
 	return len(values) == len(uniqueValues)
 }
+
+// MaxChars counts characters rather than bytes so multibyte names aren't penalised
+func MaxChars(value string, n int) bool {
+	return utf8.RuneCountInString(value) <= n
+}
+
+// ReservedUsername reports whether name is on the ReservedUsernames list, ignoring case and the dots, dashes and
+// underscores a username may contain, so "Ad_Min" is as reserved as "admin"
+func ReservedUsername(name string) bool {
+	name = strings.ToLower(strings.NewReplacer(".", "", "-", "", "_", "").Replace(name))
+	return PermittedValue(name, ReservedUsernames...)
+}
+
+// ValidTimeZone reports whether name is an IANA time zone such as "Europe/London".
+// The tzdata import means this doesn't depend on the host having zoneinfo installed.
+func ValidTimeZone(name string) bool {
+	if name == "" || name == "Local" {
+		return false
+	}
+	_, err := time.LoadLocation(name)
+	return err == nil
+}
@@ -2,6 +2,7 @@ package validator
 
 import (
 	"regexp"
+	"strings"
 	"testing"
 )
 
@@ -141,3 +142,122 @@ func TestValidator_Check(t *testing.T) {
 		t.Errorf("Unexpected error message. Expected: %s, Got: %s", "Invalid condition", v.Errors["field"])
 	}
 }
+
+func TestMaxChars(t *testing.T) {
+	if !MaxChars("Zoë", 3) {
+		t.Error("Expected multibyte characters to count once, but got false")
+	}
+	if MaxChars("four", 3) {
+		t.Error("Expected value over the limit to fail, but got true")
+	}
+}
+
+func TestLocaleRX(t *testing.T) {
+	for _, locale := range []string{"en", "en-US", "zh-Hant-TW"} {
+		if !Matches(locale, LocaleRX) {
+			t.Errorf("Expected %s to match", locale)
+		}
+	}
+	for _, locale := range []string{"", "e", "en_US", "english-language-tag-"} {
+		if Matches(locale, LocaleRX) {
+			t.Errorf("Expected %s not to match", locale)
+		}
+	}
+}
+
+func TestUUIDRX(t *testing.T) {
+	if !Matches("0190a6e2-5c3b-7c1e-9f3a-2b4c6d8e0f12", UUIDRX) {
+		t.Error("Expected a UUID to match")
+	}
+	for _, id := range []string{"", "42", "0190A6E2-5C3B-7C1E-9F3A-2B4C6D8E0F12", "0190a6e25c3b7c1e9f3a2b4c6d8e0f12"} {
+		if Matches(id, UUIDRX) {
+			t.Errorf("Expected %s not to match", id)
+		}
+	}
+}
+
+func TestSlugRX(t *testing.T) {
+	for _, slug := range []string{"a", "acme", "acme-eu", "2024-launch"} {
+		if !Matches(slug, SlugRX) {
+			t.Errorf("Expected %s to match", slug)
+		}
+	}
+	for _, slug := range []string{"", "Acme", "-acme", "acme-", "acme eu", "a-very-long-organization-slug-over-forty-chars"} {
+		if Matches(slug, SlugRX) {
+			t.Errorf("Expected %s not to match", slug)
+		}
+	}
+}
+
+func TestValidTimeZone(t *testing.T) {
+	tests := []struct {
+		name     string
+		timeZone string
+		want     bool
+	}{
+		{name: "IANA zone", timeZone: "Europe/London", want: true},
+		{name: "UTC", timeZone: "UTC", want: true},
+		{name: "Empty", timeZone: "", want: false},
+		{name: "Local", timeZone: "Local", want: false},
+		{name: "Made up", timeZone: "Mars/Olympus_Mons", want: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := ValidTimeZone(test.timeZone); got != test.want {
+				t.Errorf("Expected %v, got %v", test.want, got)
+			}
+		})
+	}
+}
+
+func TestRequestIDRX(t *testing.T) {
+	for _, id := range []string{"0190a6e2-5c3b-7c1e-9f3a-2b4c6d8e0f12", "abc123", "req_1.2-3"} {
+		if !Matches(id, RequestIDRX) {
+			t.Errorf("Expected %s to match", id)
+		}
+	}
+	for _, id := range []string{"", "has space", "new\nline", strings.Repeat("a", 65)} {
+		if Matches(id, RequestIDRX) {
+			t.Errorf("Expected %q not to match", id)
+		}
+	}
+}
+
+func TestUsernameRX(t *testing.T) {
+	for _, username := range []string{"bob", "Bob_Smith", "b.o-b", "user42", strings.Repeat("a", 30)} {
+		if !Matches(username, UsernameRX) {
+			t.Errorf("Expected %s to match", username)
+		}
+	}
+	for _, username := range []string{"", "bo", "_bob", "bob.", "bob smith", "bob@example.com", "zoë", strings.Repeat("a", 31)} {
+		if Matches(username, UsernameRX) {
+			t.Errorf("Expected %s not to match", username)
+		}
+	}
+}
+
+func TestPhoneRX(t *testing.T) {
+	for _, phone := range []string{"+14155552671", "+442079460958", "+6421234567", "+123456789012345"} {
+		if !Matches(phone, PhoneRX) {
+			t.Errorf("Expected %s to match", phone)
+		}
+	}
+	for _, phone := range []string{"", "14155552671", "+04155552671", "+1 415 555 2671", "+1234567890123456", "+12345"} {
+		if Matches(phone, PhoneRX) {
+			t.Errorf("Expected %s not to match", phone)
+		}
+	}
+}
+
+func TestReservedUsername(t *testing.T) {
+	for _, username := range []string{"admin", "ADMIN", "Ad_Min", "sup.port", "root"} {
+		if !ReservedUsername(username) {
+			t.Errorf("Expected %s to be reserved", username)
+		}
+	}
+	for _, username := range []string{"bob", "admins", "rooty"} {
+		if ReservedUsername(username) {
+			t.Errorf("Expected %s not to be reserved", username)
+		}
+	}
+}